@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+)
+
+// artifactPath returns the path of the artifact with the given SHA-256 hash.
+// Artifacts are spread over subdirectories named after the first two characters of their hash.
+func (cfg *config) artifactPath(hash string) string {
+	directory := cfg.Artifacts.Directory
+	if directory == "" {
+		directory = filepath.Join(cfg.WorkDir, "artifacts")
+	}
+	return filepath.Join(directory, hash[:2], hash)
+}
+
+// storeArtifact stores data in the content-addressed artifact directory and returns its SHA-256 hash.
+// Data already stored, too large or received while artifacts are disabled is only hashed.
+func (cfg *config) storeArtifact(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if !cfg.Artifacts.Enabled || (cfg.Artifacts.MaxSize > 0 && int64(len(data)) > cfg.Artifacts.MaxSize) {
+		return hash, nil
+	}
+	artifactPath := cfg.artifactPath(hash)
+	if _, err := os.Stat(artifactPath); err == nil {
+		return hash, nil
+	} else if !os.IsNotExist(err) {
+		return hash, err
+	}
+	if err := os.MkdirAll(filepath.Dir(artifactPath), 0755); err != nil {
+		return hash, err
+	}
+	// Write to a temporary file first so that concurrent sessions never see a partial artifact.
+	file, err := os.CreateTemp(filepath.Dir(artifactPath), ".tmp-")
+	if err != nil {
+		return hash, err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return hash, err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return hash, err
+	}
+	if err := os.Rename(file.Name(), artifactPath); err != nil {
+		os.Remove(file.Name())
+		return hash, err
+	}
+	return hash, nil
+}
+
+// captureFile stores the contents of a file of the virtual filesystem as an artifact and logs its upload.
+func (context *sessionContext) captureFile(name string) {
+	info, err := context.filesystem.Stat(name)
+	if err != nil || !info.mode.IsRegular() {
+		return
+	}
+	data, err := context.filesystem.ReadFile(name)
+	if err != nil {
+		return
+	}
+	hash, err := context.cfg.storeArtifact(data)
+	if err != nil {
+		warningLogger.Printf("Failed to store artifact %v: %v", hash, err)
+	}
+	context.logEvent(fileUploadLog{
+		channelLog: channelLog{
+			ChannelID: context.channelID,
+		},
+		Path:   name,
+		Size:   len(data),
+		SHA256: hash,
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileUploadArtifacts(t *testing.T) {
+	for _, test := range []struct {
+		source, path string
+		content      []byte
+	}{
+		{`echo hello > /tmp/redirect`, "/tmp/redirect", []byte("hello\n")},
+		{"cat > /tmp/heredoc <<EOF\nline 1\nline 2\nEOF", "/tmp/heredoc", []byte("line 1\nline 2\n")},
+		{`echo f0VMRgI= | base64 -d > /tmp/binary`, "/tmp/binary", []byte("\x7fELF\x02")},
+		{`printf '\x7fELF\001' > /tmp/printf`, "/tmp/printf", []byte("\x7fELF\x01")},
+		{`echo payload | dd of=/tmp/dd`, "/tmp/dd", []byte("payload\n")},
+	} {
+		cfg := &config{Artifacts: artifactsConfig{Enabled: true, Directory: t.TempDir()}}
+		logBuffer := setupLogBuffer(t, cfg)
+		stdout := &bytes.Buffer{}
+		if _, err := executeProgram(commandContext{
+			args:   []string{"sh", "-c", test.source},
+			stdin:  newBufferReadLiner(nil),
+			stdout: stdout,
+			stderr: stdout,
+			user:   "root",
+		}, newTestSessionContext(cfg)); err != nil {
+			t.Fatalf("%q: failed to execute: %v", test.source, err)
+		}
+
+		sum := sha256.Sum256(test.content)
+		hash := hex.EncodeToString(sum[:])
+		data, err := os.ReadFile(cfg.artifactPath(hash))
+		if err != nil {
+			t.Errorf("%q: failed to read artifact: %v", test.source, err)
+		} else if !bytes.Equal(data, test.content) {
+			t.Errorf("%q: artifact=%q, want %q", test.source, data, test.content)
+		}
+		expectedLogs := fmt.Sprintf("[127.0.0.1:1234] [channel 0] file %q with size %v and SHA-256 %v uploaded\n", test.path, len(test.content), hash)
+		if logs := logBuffer.String(); logs != expectedLogs {
+			t.Errorf("%q: logs=%q, want %q", test.source, logs, expectedLogs)
+		}
+	}
+}
+
+func TestStoreArtifactLimits(t *testing.T) {
+	cfg := &config{Artifacts: artifactsConfig{Enabled: true, Directory: t.TempDir(), MaxSize: 4}}
+	for _, test := range []struct {
+		data   string
+		stored bool
+	}{
+		{"tiny", true},
+		{"too large", false},
+	} {
+		hash, err := cfg.storeArtifact([]byte(test.data))
+		if err != nil {
+			t.Fatalf("Failed to store artifact: %v", err)
+		}
+		if _, err := os.Stat(cfg.artifactPath(hash)); (err == nil) != test.stored {
+			t.Errorf("%q: stored=%v, want %v", test.data, err == nil, test.stored)
+		}
+	}
+	temporaryFiles, err := filepath.Glob(filepath.Join(cfg.Artifacts.Directory, "*", ".tmp-*"))
+	if err != nil {
+		t.Fatalf("Failed to list artifacts: %v", err)
+	}
+	if len(temporaryFiles) != 0 {
+		t.Errorf("temporaryFiles=%v, want none", temporaryFiles)
+	}
+}
@@ -13,19 +13,20 @@ import (
 var authAttemptsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "sshesame_auth_attempts_total",
 	Help: "Total number of authentication attempts",
-}, []string{"method", "accepted"})
+}, []string{"listener", "method", "accepted"})
 
 func (cfg *config) getAuthLogCallback() func(conn ssh.ConnMetadata, method string, err error) {
 	return func(conn ssh.ConnMetadata, method string, err error) {
+		startAuthTimeout(conn)
 		var acceptedLabel string
 		if err == nil {
 			acceptedLabel = "true"
 		} else {
 			acceptedLabel = "false"
 		}
-		authAttemptsMetric.WithLabelValues(method, acceptedLabel).Inc()
+		authAttemptsMetric.WithLabelValues(cfg.listenerName, method, acceptedLabel).Inc()
 		if method == "none" {
-			connContext{ConnMetadata: conn, cfg: cfg}.logEvent(noAuthLog{authLog: authLog{
+			cfg.handshakeContext(conn).logEvent(noAuthLog{authLog: authLog{
 				User:     conn.User(),
 				Accepted: err == nil,
 			}})
@@ -38,17 +39,16 @@ func (cfg *config) getPasswordCallback() func(conn ssh.ConnMetadata, password []
 		return nil
 	}
 	return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-		connContext{ConnMetadata: conn, cfg: cfg}.logEvent(passwordAuthLog{
+		passwordString := string(password)
+		permissions, err := cfg.authenticate(authAttempt{conn: conn, password: &passwordString}, cfg.Auth.PasswordAuth.Accepted)
+		cfg.handshakeContext(conn).logEvent(passwordAuthLog{
 			authLog: authLog{
 				User:     conn.User(),
-				Accepted: authAccepted(cfg.Auth.PasswordAuth.Accepted),
+				Accepted: authAccepted(err == nil),
 			},
-			Password: string(password),
+			Password: passwordString,
 		})
-		if !cfg.Auth.PasswordAuth.Accepted {
-			return nil, errors.New("")
-		}
-		return nil, nil
+		return permissions, err
 	}
 }
 
@@ -57,17 +57,19 @@ func (cfg *config) getPublicKeyCallback() func(conn ssh.ConnMetadata, key ssh.Pu
 		return nil
 	}
 	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-		connContext{ConnMetadata: conn, cfg: cfg}.logEvent(publicKeyAuthLog{
-			authLog: authLog{
-				User:     conn.User(),
-				Accepted: authAccepted(cfg.Auth.PublicKeyAuth.Accepted),
-			},
-			PublicKeyFingerprint: ssh.FingerprintSHA256(key),
-		})
-		if !cfg.Auth.PublicKeyAuth.Accepted {
-			return nil, errors.New("")
+		permissions, err := cfg.authenticate(authAttempt{conn: conn, key: key}, cfg.Auth.PublicKeyAuth.Accepted)
+		cfg.handshakeContext(conn).logEvent(newPublicKeyAuthLog(conn.User(), key, err == nil, false))
+		if err != nil {
+			return nil, err
 		}
-		return nil, nil
+		if permissions == nil {
+			permissions = &ssh.Permissions{}
+		}
+		if permissions.Extensions == nil {
+			permissions.Extensions = map[string]string{}
+		}
+		permissions.Extensions[publicKeyExtension] = string(ssh.MarshalAuthorizedKey(key))
+		return permissions, nil
 	}
 }
 
@@ -75,29 +77,58 @@ func (cfg *config) getKeyboardInteractiveCallback() func(conn ssh.ConnMetadata,
 	if !cfg.Auth.KeyboardInteractiveAuth.Enabled {
 		return nil
 	}
-	var keyboardInteractiveQuestions []string
-	var keyboardInteractiveEchos []bool
-	for _, question := range cfg.Auth.KeyboardInteractiveAuth.Questions {
-		keyboardInteractiveQuestions = append(keyboardInteractiveQuestions, question.Text)
-		keyboardInteractiveEchos = append(keyboardInteractiveEchos, question.Echo)
+	rounds := cfg.Auth.KeyboardInteractiveAuth.Rounds
+	if len(rounds) == 0 {
+		rounds = []keyboardInteractiveAuthRound{{
+			Instruction: cfg.Auth.KeyboardInteractiveAuth.Instruction,
+			Questions:   cfg.Auth.KeyboardInteractiveAuth.Questions,
+		}}
 	}
 	return func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
-		answers, err := client(conn.User(), cfg.Auth.KeyboardInteractiveAuth.Instruction, keyboardInteractiveQuestions, keyboardInteractiveEchos)
-		if err != nil {
-			warningLogger.Printf("Failed to process keyboard interactive authentication: %v", err)
-			return nil, errors.New("")
+		var answers []string
+		var labels []labeledAnswer
+		for i, round := range rounds {
+			var questions []string
+			var echos []bool
+			for _, question := range round.Questions {
+				questions = append(questions, question.Text)
+				echos = append(echos, question.Echo)
+			}
+			roundAnswers, err := client(conn.User(), round.Instruction, questions, echos)
+			if err != nil {
+				cfg.handshakeContext(conn).logEvent(keyboardInteractiveAuthAbortLog{
+					authLog: authLog{
+						User:     conn.User(),
+						Accepted: false,
+					},
+					Round:   i + 1,
+					Answers: answers,
+					Labels:  labels,
+					Error:   err.Error(),
+				})
+				return nil, errors.New("")
+			}
+			for j, answer := range roundAnswers {
+				if j < len(round.Questions) && round.Questions[j].Label != "" {
+					labels = append(labels, labeledAnswer{Round: i + 1, Label: round.Questions[j].Label, Answer: answer})
+				}
+			}
+			answers = append(answers, roundAnswers...)
 		}
-		connContext{ConnMetadata: conn, cfg: cfg}.logEvent(keyboardInteractiveAuthLog{
+		attempt := authAttempt{conn: conn}
+		if len(answers) > 0 {
+			attempt.password = &answers[0]
+		}
+		permissions, err := cfg.authenticate(attempt, cfg.Auth.KeyboardInteractiveAuth.Accepted)
+		cfg.handshakeContext(conn).logEvent(keyboardInteractiveAuthLog{
 			authLog: authLog{
 				User:     conn.User(),
-				Accepted: authAccepted(cfg.Auth.KeyboardInteractiveAuth.Accepted),
+				Accepted: authAccepted(err == nil),
 			},
 			Answers: answers,
+			Labels:  labels,
 		})
-		if !cfg.Auth.KeyboardInteractiveAuth.Accepted {
-			return nil, errors.New("")
-		}
-		return nil, nil
+		return permissions, err
 	}
 }
 
@@ -109,5 +140,8 @@ func (cfg *config) getBannerCallback() func(conn ssh.ConnMetadata) string {
 	if !strings.HasSuffix(banner, "\r\n") {
 		banner = fmt.Sprintf("%v\r\n", banner)
 	}
-	return func(conn ssh.ConnMetadata) string { return banner }
+	return func(conn ssh.ConnMetadata) string {
+		cfg.tarpit("banner", cfg.Tarpit.BannerDelay)
+		return banner
+	}
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"reflect"
 	"testing"
@@ -228,8 +230,8 @@ func TestPublicKeySuccess(t *testing.T) {
 	if err != nil {
 		t.Errorf("err=%v, want nil", err)
 	}
-	if permissions != nil {
-		t.Errorf("permissions=%v, want nil", permissions)
+	if permissions == nil || permissions.Extensions[publicKeyExtension] != "rsa cnNh\n" {
+		t.Errorf("permissions=%v, want the public key extension", permissions)
 	}
 	expectedLogs := `[127.0.0.1:1234] authentication for user "root" with public key "SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q" accepted
 `
@@ -256,7 +258,7 @@ func TestPublicKeyFailJSON(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"public_key_auth","event":{"user":"root","accepted":false,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q"}}
+	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"public_key_auth","event":{"user":"root","accepted":false,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q","public_key_md5":"MD5:ef:31:07:0d:66:44:06:87:a7:3b:eb:62:42:f2:98:bc","public_key_type":"rsa","authorized_key":"rsa cnNh","signed":false}}
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -278,10 +280,10 @@ func TestPublicKeySuccessJSON(t *testing.T) {
 	if err != nil {
 		t.Errorf("err=%v, want nil", err)
 	}
-	if permissions != nil {
-		t.Errorf("permissions=%v, want nil", permissions)
+	if permissions == nil || permissions.Extensions[publicKeyExtension] != "rsa cnNh\n" {
+		t.Errorf("permissions=%v, want the public key extension", permissions)
 	}
-	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"public_key_auth","event":{"user":"root","accepted":true,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q"}}
+	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"public_key_auth","event":{"user":"root","accepted":true,"public_key":"SHA256:9faRaLujz6HiqA3/g5tI2zbfNvqHbBzZ19UI86swh0Q","public_key_md5":"MD5:ef:31:07:0d:66:44:06:87:a7:3b:eb:62:42:f2:98:bc","public_key_type":"rsa","authorized_key":"rsa cnNh","signed":false}}
 `
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
@@ -293,8 +295,8 @@ func TestKeyboardInteractiveDisabled(t *testing.T) {
 	cfg.Auth.KeyboardInteractiveAuth.Enabled = false
 	cfg.Auth.KeyboardInteractiveAuth.Instruction = "inst"
 	cfg.Auth.KeyboardInteractiveAuth.Questions = []keyboardInteractiveAuthQuestion{
-		{"q1", true},
-		{"q2", false},
+		{Text: "q1", Echo: true},
+		{Text: "q2", Echo: false},
 	}
 	callback := cfg.getKeyboardInteractiveCallback()
 	if callback != nil {
@@ -308,8 +310,8 @@ func TestKeyboardInteractiveError(t *testing.T) {
 	cfg.Auth.KeyboardInteractiveAuth.Accepted = false
 	cfg.Auth.KeyboardInteractiveAuth.Instruction = "inst"
 	cfg.Auth.KeyboardInteractiveAuth.Questions = []keyboardInteractiveAuthQuestion{
-		{"q1", true},
-		{"q2", false},
+		{Text: "q1", Echo: true},
+		{Text: "q2", Echo: false},
 	}
 	callback := cfg.getKeyboardInteractiveCallback()
 	if callback == nil {
@@ -329,7 +331,7 @@ func TestKeyboardInteractiveError(t *testing.T) {
 		if !reflect.DeepEqual(echos, []bool{true, false}) {
 			t.Errorf("echos=%v, want [true, false]", echos)
 		}
-		return nil, errors.New("")
+		return nil, errors.New("client disconnected")
 	})
 	logs := logBuffer.String()
 	if err == nil {
@@ -338,7 +340,8 @@ func TestKeyboardInteractiveError(t *testing.T) {
 	if permissions != nil {
 		t.Errorf("permissions=%v, want nil", permissions)
 	}
-	expectedLogs := ``
+	expectedLogs := `[127.0.0.1:1234] authentication for user "root" with keyboard interactive answers [] aborted in round 1: client disconnected
+`
 	if logs != expectedLogs {
 		t.Errorf("logs=%v, want %v", string(logs), expectedLogs)
 	}
@@ -350,8 +353,8 @@ func TestKeyboardInteractiveFail(t *testing.T) {
 	cfg.Auth.KeyboardInteractiveAuth.Accepted = false
 	cfg.Auth.KeyboardInteractiveAuth.Instruction = "inst"
 	cfg.Auth.KeyboardInteractiveAuth.Questions = []keyboardInteractiveAuthQuestion{
-		{"q1", true},
-		{"q2", false},
+		{Text: "q1", Echo: true},
+		{Text: "q2", Echo: false},
 	}
 	callback := cfg.getKeyboardInteractiveCallback()
 	if callback == nil {
@@ -381,8 +384,8 @@ func TestKeyboardInteractiveSuccess(t *testing.T) {
 	cfg.Auth.KeyboardInteractiveAuth.Accepted = true
 	cfg.Auth.KeyboardInteractiveAuth.Instruction = "inst"
 	cfg.Auth.KeyboardInteractiveAuth.Questions = []keyboardInteractiveAuthQuestion{
-		{"q1", true},
-		{"q2", false},
+		{Text: "q1", Echo: true},
+		{Text: "q2", Echo: false},
 	}
 	callback := cfg.getKeyboardInteractiveCallback()
 	if callback == nil {
@@ -413,8 +416,8 @@ func TestKeyboardInteractiveFailJSON(t *testing.T) {
 	cfg.Auth.KeyboardInteractiveAuth.Accepted = false
 	cfg.Auth.KeyboardInteractiveAuth.Instruction = "inst"
 	cfg.Auth.KeyboardInteractiveAuth.Questions = []keyboardInteractiveAuthQuestion{
-		{"q1", true},
-		{"q2", false},
+		{Text: "q1", Echo: true},
+		{Text: "q2", Echo: false},
 	}
 	callback := cfg.getKeyboardInteractiveCallback()
 	if callback == nil {
@@ -445,8 +448,8 @@ func TestKeyboardInteractiveSuccessJSON(t *testing.T) {
 	cfg.Auth.KeyboardInteractiveAuth.Accepted = true
 	cfg.Auth.KeyboardInteractiveAuth.Instruction = "inst"
 	cfg.Auth.KeyboardInteractiveAuth.Questions = []keyboardInteractiveAuthQuestion{
-		{"q1", true},
-		{"q2", false},
+		{Text: "q1", Echo: true},
+		{Text: "q2", Echo: false},
 	}
 	callback := cfg.getKeyboardInteractiveCallback()
 	if callback == nil {
@@ -492,3 +495,121 @@ func TestBanner(t *testing.T) {
 		t.Errorf("banner=%v, want %v", banner, expectedBanner)
 	}
 }
+
+func TestKeyboardInteractiveRounds(t *testing.T) {
+	cfg := &config{}
+	cfg.Logging.JSON = true
+	cfg.Auth.KeyboardInteractiveAuth.Enabled = true
+	cfg.Auth.KeyboardInteractiveAuth.Accepted = true
+	cfg.Auth.KeyboardInteractiveAuth.Rounds = []keyboardInteractiveAuthRound{
+		{Questions: []keyboardInteractiveAuthQuestion{{Text: "Password: ", Label: "password"}}},
+		{Instruction: "inst", Questions: []keyboardInteractiveAuthQuestion{{Text: "Code: ", Echo: true, Label: "otp"}, {Text: "q2"}}},
+	}
+	callback := cfg.getKeyboardInteractiveCallback()
+	if callback == nil {
+		t.Fatalf("callback=nil, want a function")
+	}
+	tests := []struct {
+		name              string
+		abortRound        int
+		expectedEventType string
+		expectedEvent     map[string]interface{}
+	}{
+		{
+			name:              "answered",
+			expectedEventType: "keyboard_interactive_auth",
+			expectedEvent: map[string]interface{}{
+				"user":     "root",
+				"accepted": true,
+				"answers":  []interface{}{"hunter2", "123456", "a2"},
+				"labels": []interface{}{
+					map[string]interface{}{"round": float64(1), "label": "password", "answer": "hunter2"},
+					map[string]interface{}{"round": float64(2), "label": "otp", "answer": "123456"},
+				},
+			},
+		},
+		{
+			name:              "aborted",
+			abortRound:        2,
+			expectedEventType: "keyboard_interactive_auth_abort",
+			expectedEvent: map[string]interface{}{
+				"user":     "root",
+				"accepted": false,
+				"round":    float64(2),
+				"answers":  []interface{}{"hunter2"},
+				"labels": []interface{}{
+					map[string]interface{}{"round": float64(1), "label": "password", "answer": "hunter2"},
+				},
+				"error": "ssh: disconnect",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logBuffer := setupLogBuffer(t, cfg)
+			round := 0
+			_, err := callback(mockConnContext{}, func(user, instruction string, questions []string, echos []bool) (answers []string, err error) {
+				round++
+				if round == test.abortRound {
+					return nil, errors.New("ssh: disconnect")
+				}
+				switch round {
+				case 1:
+					if instruction != "" || !reflect.DeepEqual(questions, []string{"Password: "}) || !reflect.DeepEqual(echos, []bool{false}) {
+						t.Errorf("instruction=%v, questions=%v, echos=%v, want the password round", instruction, questions, echos)
+					}
+					return []string{"hunter2"}, nil
+				default:
+					if instruction != "inst" || !reflect.DeepEqual(questions, []string{"Code: ", "q2"}) || !reflect.DeepEqual(echos, []bool{true, false}) {
+						t.Errorf("instruction=%v, questions=%v, echos=%v, want the code round", instruction, questions, echos)
+					}
+					return []string{"123456", "a2"}, nil
+				}
+			})
+			if accepted := err == nil; accepted != (test.abortRound == 0) {
+				t.Errorf("accepted=%v, want %v", accepted, test.abortRound == 0)
+			}
+			var logEntry struct {
+				EventType string                 `json:"event_type"`
+				Event     map[string]interface{} `json:"event"`
+			}
+			if err := json.Unmarshal(logBuffer.Bytes(), &logEntry); err != nil {
+				t.Fatalf("Failed to parse log: %v", err)
+			}
+			if logEntry.EventType != test.expectedEventType {
+				t.Errorf("eventType=%v, want %v", logEntry.EventType, test.expectedEventType)
+			}
+			if !reflect.DeepEqual(logEntry.Event, test.expectedEvent) {
+				t.Errorf("event=%v, want %v", logEntry.Event, test.expectedEvent)
+			}
+		})
+	}
+}
+
+func TestKeyboardInteractiveRepeatedLabel(t *testing.T) {
+	cfg := &config{}
+	cfg.Logging.JSON = true
+	cfg.Auth.KeyboardInteractiveAuth.Enabled = true
+	cfg.Auth.KeyboardInteractiveAuth.Accepted = true
+	cfg.Auth.KeyboardInteractiveAuth.Rounds = []keyboardInteractiveAuthRound{
+		{Questions: []keyboardInteractiveAuthQuestion{{Text: "Password: ", Label: "password"}}},
+		{Instruction: "Wrong password, try again.", Questions: []keyboardInteractiveAuthQuestion{{Text: "Password: ", Label: "password"}}},
+	}
+	callback := cfg.getKeyboardInteractiveCallback()
+	if callback == nil {
+		t.Fatalf("callback=nil, want a function")
+	}
+	logBuffer := setupLogBuffer(t, cfg)
+	round := 0
+	if _, err := callback(mockConnContext{}, func(user, instruction string, questions []string, echos []bool) (answers []string, err error) {
+		round++
+		return []string{fmt.Sprintf("hunter%v", round)}, nil
+	}); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+	expectedLogs := `{"source":"127.0.0.1:1234","event_type":"keyboard_interactive_auth","event":{"user":"root","accepted":true,"answers":["hunter1","hunter2"],"labels":[{"round":1,"label":"password","answer":"hunter1"},{"round":2,"label":"password","answer":"hunter2"}]}}
+`
+	if logs := logBuffer.String(); logs != expectedLogs {
+		t.Errorf("logs=%v, want %v", logs, expectedLogs)
+	}
+}
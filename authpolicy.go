@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeUserExtension is the permission extension carrying the user a session logs in as, if an auth rule picked one.
+const fakeUserExtension = "fake-user"
+
+// authStateTTL is how long the attempts of a connection are remembered after its last one.
+const authStateTTL = 10 * time.Minute
+
+type authRule struct {
+	User                   string   `yaml:"user"`
+	Password               string   `yaml:"password"`
+	PasswordFile           string   `yaml:"password_file"`
+	PublicKeyFingerprints  []string `yaml:"public_key_fingerprints"`
+	Sources                []string `yaml:"sources"`
+	Attempt                int      `yaml:"attempt"`
+	AfterDifferentPassword bool     `yaml:"after_different_password"`
+	Accepted               bool     `yaml:"accepted"`
+	FakeUser               string   `yaml:"fake_user"`
+
+	passwords map[string]bool
+	networks  []*net.IPNet
+}
+
+func loadPasswordFile(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	passwords := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		passwords[strings.TrimSuffix(scanner.Text(), "\r")] = true
+	}
+	return passwords, scanner.Err()
+}
+
+func parseNetwork(source string) (*net.IPNet, error) {
+	if !strings.Contains(source, "/") {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source %q", source)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(source)
+	return network, err
+}
+
+// setup validates the patterns of a rule, and loads its password list and networks.
+func (rule *authRule) setup() error {
+	for _, pattern := range []string{rule.User, rule.Password} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	if rule.PasswordFile != "" {
+		passwords, err := loadPasswordFile(rule.PasswordFile)
+		if err != nil {
+			return err
+		}
+		rule.passwords = passwords
+	}
+	for _, source := range rule.Sources {
+		network, err := parseNetwork(source)
+		if err != nil {
+			return err
+		}
+		rule.networks = append(rule.networks, network)
+	}
+	return nil
+}
+
+// authAttempt is an authentication attempt, with the password (or first keyboard interactive answer) or public key
+// the client offered.
+type authAttempt struct {
+	conn     ssh.ConnMetadata
+	password *string
+	key      ssh.PublicKey
+
+	// number counts the attempts of the connection, starting at 1.
+	number            int
+	previousPasswords []string
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (rule *authRule) matches(attempt authAttempt) bool {
+	if rule.User != "" {
+		if matched, _ := path.Match(rule.User, attempt.conn.User()); !matched {
+			return false
+		}
+	}
+	if rule.Password != "" || rule.passwords != nil {
+		if attempt.password == nil {
+			return false
+		}
+		if matched, _ := path.Match(rule.Password, *attempt.password); rule.Password != "" && !matched {
+			return false
+		}
+		if rule.passwords != nil && !rule.passwords[*attempt.password] {
+			return false
+		}
+	}
+	if len(rule.PublicKeyFingerprints) > 0 {
+		if attempt.key == nil {
+			return false
+		}
+		sha256Fingerprint, md5Fingerprint := ssh.FingerprintSHA256(attempt.key), ssh.FingerprintLegacyMD5(attempt.key)
+		found := false
+		for _, fingerprint := range rule.PublicKeyFingerprints {
+			if fingerprint == sha256Fingerprint || strings.TrimPrefix(fingerprint, "MD5:") == md5Fingerprint {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.networks) > 0 {
+		ip := remoteIP(attempt.conn.RemoteAddr())
+		found := false
+		for _, network := range rule.networks {
+			if ip != nil && network.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if attempt.number < rule.Attempt {
+		return false
+	}
+	if rule.AfterDifferentPassword {
+		if attempt.password == nil {
+			return false
+		}
+		different := false
+		for _, password := range attempt.previousPasswords {
+			if password != *attempt.password {
+				different = true
+				break
+			}
+		}
+		if !different {
+			return false
+		}
+	}
+	return true
+}
+
+type connAuthState struct {
+	attempts  int
+	passwords []string
+	lastSeen  time.Time
+}
+
+// authTracker remembers the authentication attempts of connections, which some rules depend on.
+type authTracker struct {
+	lock      sync.Mutex
+	conns     map[string]*connAuthState
+	lastPrune time.Time
+}
+
+func newAuthTracker() *authTracker {
+	return &authTracker{conns: map[string]*connAuthState{}, lastPrune: time.Now()}
+}
+
+// record counts an attempt of a connection, filling in its number and the passwords tried before it.
+func (tracker *authTracker) record(attempt *authAttempt) {
+	if tracker == nil {
+		attempt.number = 1
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	now := time.Now()
+	if now.Sub(tracker.lastPrune) > time.Minute {
+		for id, state := range tracker.conns {
+			if now.Sub(state.lastSeen) > authStateTTL {
+				delete(tracker.conns, id)
+			}
+		}
+		tracker.lastPrune = now
+	}
+	id := string(attempt.conn.SessionID())
+	state, ok := tracker.conns[id]
+	if !ok {
+		state = &connAuthState{}
+		tracker.conns[id] = state
+	}
+	state.attempts++
+	state.lastSeen = now
+	attempt.number = state.attempts
+	attempt.previousPasswords = append([]string(nil), state.passwords...)
+	if attempt.password != nil {
+		state.passwords = append(state.passwords, *attempt.password)
+	}
+}
+
+// authenticate decides whether to accept an attempt. A password remembered for the user and source decides first,
+// then the first matching rule, then the default of the method. It returns the permissions to accept the attempt with,
+// or an error to reject it.
+func (cfg *config) authenticate(attempt authAttempt, accepted bool) (*ssh.Permissions, error) {
+	cfg.tarpitAuth()
+	cfg.authTracker.record(&attempt)
+	var fakeUser string
+	var remembered *rememberedCredential
+	source := remoteIP(attempt.conn.RemoteAddr()).String()
+	if cfg.credentialMemory != nil && attempt.password != nil {
+		remembered = cfg.credentialMemory.recall(source, attempt.conn.User())
+	}
+	if remembered != nil {
+		accepted, fakeUser = *attempt.password == remembered.Password, remembered.FakeUser
+	} else {
+		for i := range cfg.Auth.Rules {
+			rule := &cfg.Auth.Rules[i]
+			if rule.matches(attempt) {
+				accepted, fakeUser = rule.Accepted, rule.FakeUser
+				break
+			}
+		}
+	}
+	if !accepted {
+		return nil, errors.New("")
+	}
+	if cfg.credentialMemory != nil && attempt.password != nil {
+		cfg.credentialMemory.remember(source, attempt.conn.User(), *attempt.password, fakeUser)
+	}
+	if fakeUser == "" {
+		return nil, nil
+	}
+	return &ssh.Permissions{Extensions: map[string]string{fakeUserExtension: fakeUser}}, nil
+}
+
+// fakeUserConnMetadata makes a session log in as the user an auth rule picked.
+type fakeUserConnMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (metadata fakeUserConnMetadata) User() string {
+	return metadata.user
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type sessionConnContext struct {
+	mockConnContext
+	sessionID string
+}
+
+func (context sessionConnContext) SessionID() []byte {
+	return []byte(context.sessionID)
+}
+
+func TestAuthRules(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	key := signer.PublicKey()
+	passwordFile := path.Join(t.TempDir(), "passwords")
+	if err := os.WriteFile(passwordFile, []byte("123456\r\nqwerty\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write password file: %v", err)
+	}
+
+	password := func(password string) *string {
+		return &password
+	}
+	type attempt struct {
+		password *string
+		key      ssh.PublicKey
+		accepted bool
+	}
+	tests := []struct {
+		name     string
+		rule     authRule
+		attempts []attempt
+	}{
+		{
+			name: "user and password patterns",
+			rule: authRule{User: "ro*", Password: "hunter?", Accepted: true},
+			attempts: []attempt{
+				{password: password("hunter2"), accepted: true},
+				{password: password("hunter22")},
+				{key: key},
+			},
+		},
+		{
+			name: "password file",
+			rule: authRule{PasswordFile: passwordFile, Accepted: true},
+			attempts: []attempt{
+				{password: password("123456"), accepted: true},
+				{password: password("qwerty"), accepted: true},
+				{password: password("hunter2")},
+			},
+		},
+		{
+			name: "SHA256 fingerprint",
+			rule: authRule{PublicKeyFingerprints: []string{ssh.FingerprintSHA256(key)}, Accepted: true},
+			attempts: []attempt{
+				{key: key, accepted: true},
+				{key: mockPublicKey{}},
+				{password: password("hunter2")},
+			},
+		},
+		{
+			name: "MD5 fingerprint",
+			rule: authRule{PublicKeyFingerprints: []string{"MD5:" + ssh.FingerprintLegacyMD5(key)}, Accepted: true},
+			attempts: []attempt{
+				{key: key, accepted: true},
+			},
+		},
+		{
+			name: "matching source",
+			rule: authRule{Sources: []string{"10.0.0.0/8", "127.0.0.0/8"}, Accepted: true},
+			attempts: []attempt{
+				{password: password("hunter2"), accepted: true},
+			},
+		},
+		{
+			name: "other source",
+			rule: authRule{Sources: []string{"10.0.0.1", "::1"}, Accepted: true},
+			attempts: []attempt{
+				{password: password("hunter2")},
+			},
+		},
+		{
+			name: "nth attempt",
+			rule: authRule{Attempt: 3, Accepted: true},
+			attempts: []attempt{
+				{password: password("hunter2")},
+				{key: key},
+				{password: password("hunter2"), accepted: true},
+				{password: password("hunter2"), accepted: true},
+			},
+		},
+		{
+			name: "after different password",
+			rule: authRule{AfterDifferentPassword: true, Accepted: true},
+			attempts: []attempt{
+				{password: password("hunter2")},
+				{password: password("hunter2")},
+				{key: key},
+				{password: password("123456"), accepted: true},
+			},
+		},
+		{
+			name: "rejecting rule",
+			rule: authRule{User: "root", Accepted: false},
+			attempts: []attempt{
+				{password: password("hunter2")},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &config{}
+			cfg.Auth.Rules = []authRule{test.rule}
+			if err := cfg.Auth.Rules[0].setup(); err != nil {
+				t.Fatalf("Failed to set up rule: %v", err)
+			}
+			cfg.authTracker = newAuthTracker()
+			conn := sessionConnContext{sessionID: test.name}
+			for i, attempt := range test.attempts {
+				_, err := cfg.authenticate(authAttempt{conn: conn, password: attempt.password, key: attempt.key}, false)
+				if accepted := err == nil; accepted != attempt.accepted {
+					t.Errorf("attempt %v: accepted=%v, want %v", i+1, accepted, attempt.accepted)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthRuleErrors(t *testing.T) {
+	for _, rule := range []authRule{
+		{User: "[root"},
+		{Password: "hunter["},
+		{PasswordFile: path.Join(t.TempDir(), "nonexistent")},
+		{Sources: []string{"localhost"}},
+		{Sources: []string{"10.0.0.0/33"}},
+	} {
+		if err := rule.setup(); err == nil {
+			t.Errorf("rule=%+v: err=nil, want an error", rule)
+		}
+	}
+}
+
+func TestAuthRuleDefaults(t *testing.T) {
+	cfg := &config{}
+	cfg.Auth.Rules = []authRule{{User: "admin", Accepted: true}}
+	cfg.authTracker = newAuthTracker()
+	hunter2 := "hunter2"
+	// No rule matches root, so the accepted setting of the method decides.
+	if _, err := cfg.authenticate(authAttempt{conn: mockConnContext{}, password: &hunter2}, true); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+	if _, err := cfg.authenticate(authAttempt{conn: mockConnContext{}, password: &hunter2}, false); err == nil {
+		t.Errorf("err=nil, want an error")
+	}
+}
+
+func TestAuthRuleFakeUser(t *testing.T) {
+	cfg := &config{}
+	cfg.Auth.PasswordAuth.Enabled = true
+	cfg.Auth.Rules = []authRule{{Password: "hunter2", Accepted: true, FakeUser: "admin"}}
+	cfg.authTracker = newAuthTracker()
+	callback := cfg.getPasswordCallback()
+	logBuffer := setupLogBuffer(t, cfg)
+	permissions, err := callback(mockConnContext{}, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("err=%v, want nil", err)
+	}
+	if user := permissions.Extensions[fakeUserExtension]; user != "admin" {
+		t.Errorf("fakeUser=%v, want admin", user)
+	}
+	expectedLogs := `[127.0.0.1:1234] authentication for user "root" with password "hunter2" accepted
+`
+	if logs := logBuffer.String(); logs != expectedLogs {
+		t.Errorf("logs=%v, want %v", logs, expectedLogs)
+	}
+	if user := (fakeUserConnMetadata{mockConnContext{}, "admin"}).User(); user != "admin" {
+		t.Errorf("user=%v, want admin", user)
+	}
+}
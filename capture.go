@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func (cfg *config) capturePath(connectionID string, channelID int, stream string) string {
+	directory := cfg.Capture.Directory
+	if directory == "" {
+		directory = filepath.Join(cfg.WorkDir, "captures")
+	}
+	return filepath.Join(directory, fmt.Sprintf("%v-%v.%v", connectionID, channelID, stream))
+}
+
+// captureStream hashes and counts all bytes of a stream, and saves up to maxSize of them to a file created on the first write.
+// Bytes written after the stream is closed, such as late stderr data, are dropped.
+type captureStream struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	hash    hash.Hash
+	size    int64
+	failed  bool
+	closed  bool
+}
+
+func newCaptureStream(path string, maxSize int64) *captureStream {
+	return &captureStream{path: path, maxSize: maxSize, hash: sha256.New()}
+}
+
+func (stream *captureStream) Write(data []byte) (int, error) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if stream.closed {
+		return len(data), nil
+	}
+	stream.hash.Write(data)
+	saved := data
+	if stream.maxSize > 0 {
+		if remaining := stream.maxSize - stream.size; remaining <= 0 {
+			saved = nil
+		} else if int64(len(saved)) > remaining {
+			saved = saved[:remaining]
+		}
+	}
+	stream.size += int64(len(data))
+	if len(saved) == 0 || stream.failed {
+		return len(data), nil
+	}
+	if stream.file == nil {
+		if err := os.MkdirAll(filepath.Dir(stream.path), 0755); err != nil {
+			warningLogger.Printf("Failed to capture %v: %v", stream.path, err)
+			stream.failed = true
+			return len(data), nil
+		}
+		file, err := os.OpenFile(stream.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			warningLogger.Printf("Failed to capture %v: %v", stream.path, err)
+			stream.failed = true
+			return len(data), nil
+		}
+		stream.file = file
+	}
+	if _, err := stream.file.Write(saved); err != nil {
+		warningLogger.Printf("Failed to capture %v: %v", stream.path, err)
+		stream.failed = true
+	}
+	return len(data), nil
+}
+
+// Close closes the capture file and returns the number of bytes and the SHA-256 hash of the whole stream.
+func (stream *captureStream) Close() (int64, string) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.closed = true
+	if stream.file != nil {
+		if err := stream.file.Close(); err != nil {
+			warningLogger.Printf("Failed to capture %v: %v", stream.path, err)
+		}
+		stream.file = nil
+	}
+	return stream.size, hex.EncodeToString(stream.hash.Sum(nil))
+}
+
+type rawCapture struct {
+	stdin, stdout, stderr *captureStream
+}
+
+// capturingWriter tees the stderr extended data of a channel into a capture stream.
+type capturingWriter struct {
+	io.ReadWriter
+	stream *captureStream
+}
+
+func (writer capturingWriter) Write(data []byte) (int, error) {
+	n, err := writer.ReadWriter.Write(data)
+	writer.stream.Write(data[:n])
+	return n, err
+}
+
+// capturingChannel tees all data going through a session channel into capture streams.
+type capturingChannel struct {
+	ssh.Channel
+	capture *rawCapture
+}
+
+func (channel capturingChannel) Read(data []byte) (int, error) {
+	n, err := channel.Channel.Read(data)
+	channel.capture.stdin.Write(data[:n])
+	return n, err
+}
+
+func (channel capturingChannel) Write(data []byte) (int, error) {
+	n, err := channel.Channel.Write(data)
+	channel.capture.stdout.Write(data[:n])
+	return n, err
+}
+
+func (channel capturingChannel) Stderr() io.ReadWriter {
+	return capturingWriter{channel.Channel.Stderr(), channel.capture.stderr}
+}
+
+// startCapture captures the raw input and output of a session without a pty.
+func (context *sessionContext) startCapture() {
+	if !context.cfg.Capture.Enabled || context.capture != nil {
+		return
+	}
+	newStream := func(stream string) *captureStream {
+		return newCaptureStream(context.cfg.capturePath(context.connectionID, context.channelID, stream), context.cfg.Capture.MaxSize)
+	}
+	context.capture = &rawCapture{
+		stdin:  newStream("stdin"),
+		stdout: newStream("stdout"),
+		stderr: newStream("stderr"),
+	}
+	context.Channel = capturingChannel{context.Channel, context.capture}
+}
+
+// stopCapture finishes the raw capture of the session, if any, and logs a summary of it.
+func (context *sessionContext) stopCapture() {
+	if context.capture == nil {
+		return
+	}
+	stdinSize, stdinHash := context.capture.stdin.Close()
+	stdoutSize, stdoutHash := context.capture.stdout.Close()
+	stderrSize, stderrHash := context.capture.stderr.Close()
+	context.logEvent(rawCaptureLog{
+		channelLog: channelLog{
+			ChannelID: context.channelID,
+		},
+		StdinSize:    stdinSize,
+		StdinSHA256:  stdinHash,
+		StdoutSize:   stdoutSize,
+		StdoutSHA256: stdoutHash,
+		StderrSize:   stderrSize,
+		StderrSHA256: stderrHash,
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRawCapture(t *testing.T) {
+	for _, test := range []struct {
+		maxSize               int64
+		stdin, stdout, stderr string
+	}{
+		{0, "\x7fELF\x02\x01\x01\x00partial", "output\n", "error\n"},
+		{4, "\x7fELF", "outp", "erro"},
+	} {
+		cfg := &config{Capture: captureConfig{Enabled: true, Directory: t.TempDir(), MaxSize: test.maxSize}}
+		logBuffer := setupLogBuffer(t, cfg)
+		ctx := newTestSessionContext(cfg)
+		ctx.connectionID = "42"
+		ctx.channelID = 3
+		input := "\x7fELF\x02\x01\x01\x00partial"
+		ctx.Channel = mockChannel{input: bytes.NewBufferString(input), output: &bytes.Buffer{}, stderr: &bytes.Buffer{}}
+
+		ctx.startCapture()
+		data, err := io.ReadAll(ctx)
+		if err != nil || string(data) != input {
+			t.Errorf("data=%q, err=%v, want %q", data, err, input)
+		}
+		fmt.Fprint(ctx, "output\n")
+		fmt.Fprint(ctx.Stderr(), "error\n")
+		ctx.stopCapture()
+		fmt.Fprint(ctx.Stderr(), "late\n")
+
+		for stream, expected := range map[string]string{"stdin": test.stdin, "stdout": test.stdout, "stderr": test.stderr} {
+			data, err := os.ReadFile(filepath.Join(cfg.Capture.Directory, "42-3."+stream))
+			if err != nil || string(data) != expected {
+				t.Errorf("maxSize=%v: %v=%q, err=%v, want %q", test.maxSize, stream, data, err, expected)
+			}
+		}
+
+		hash := func(data string) string {
+			sum := sha256.Sum256([]byte(data))
+			return hex.EncodeToString(sum[:])
+		}
+		expectedLog := fmt.Sprintf("[127.0.0.1:1234] [channel 3] raw I/O captured: 15 bytes of stdin with SHA-256 %v, 7 bytes of stdout with SHA-256 %v, 6 bytes of stderr with SHA-256 %v\n",
+			hash(input), hash("output\n"), hash("error\n"))
+		if logs := logBuffer.String(); logs != expectedLog {
+			t.Errorf("maxSize=%v: logs=%q, want %q", test.maxSize, logs, expectedLog)
+		}
+	}
+}
+
+func TestRawCaptureDisabled(t *testing.T) {
+	cfg := &config{Capture: captureConfig{Directory: t.TempDir()}}
+	logBuffer := setupLogBuffer(t, cfg)
+	ctx := newTestSessionContext(cfg)
+	ctx.startCapture()
+	ctx.stopCapture()
+	if logs := logBuffer.String(); logs != "" {
+		t.Errorf("logs=%q, want none", logs)
+	}
+	if entries, err := os.ReadDir(cfg.Capture.Directory); err != nil || len(entries) != 0 {
+		t.Errorf("entries=%v, err=%v, want none", entries, err)
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"math"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type readLiner interface {
@@ -27,30 +32,96 @@ type command interface {
 }
 
 var commands = map[string]command{
-	"sh":     cmdShell{},
-	"true":   cmdTrue{},
-	"false":  cmdFalse{},
-	"echo":   cmdEcho{},
-	"cat":    cmdCat{},
-	"su":     cmdSu{},
-	"whoami": cmdWhoami{},
-	"pwd":    cmdPwd{},
-	"huahuo": cmdHuahuo{},
-	"never":  cmdNeverGonnaGiveYouUp{},
-	"uname":  cmdUname{},
-	"cd":     cmdCd{},
-	"ls":     cmdLs{},
-	"ll":     cmdLs{},
+	"sh":      cmdShell{},
+	"bash":    cmdShell{},
+	"true":    cmdTrue{},
+	"false":   cmdFalse{},
+	"echo":    cmdEcho{},
+	"cat":     cmdCat{},
+	"su":      cmdSu{},
+	"whoami":  cmdWhoami{},
+	"pwd":     cmdPwd{},
+	"huahuo":  cmdHuahuo{},
+	"never":   cmdNeverGonnaGiveYouUp{},
+	"uname":   cmdUname{},
+	"cd":      cmdCd{},
+	"ls":      cmdLs{},
+	"ll":      cmdLs{},
+	"export":  cmdExport{},
+	"unset":   cmdUnset{},
+	"env":     cmdEnv{},
+	"set":     cmdSet{},
+	"mkdir":   cmdMkdir{},
+	"rmdir":   cmdRmdir{},
+	"rm":      cmdRm{},
+	"touch":   cmdTouch{},
+	"mv":      cmdMv{},
+	"cp":      cmdCp{},
+	"chmod":   cmdChmod{},
+	"printf":  cmdPrintf{},
+	"base64":  cmdBase64{},
+	"dd":      cmdDd{},
+	"wget":    cmdWget{},
+	"curl":    cmdCurl{},
+	"tftp":    cmdTftp{},
+	"ftpget":  cmdFtpget{},
+	"busybox": cmdBusybox{},
+	"scp":     cmdScp{},
+}
+
+// shellBuiltins are commands that don't have an executable in the filesystem.
+var shellBuiltins = map[string]bool{
+	"cd":     true,
+	"ll":     true,
+	"export": true,
+	"unset":  true,
+	"set":    true,
 }
 
 var shellProgram = []string{"sh"}
 
+// setupCommands picks the commands clients can run: the enabled ones, or all of them if none are, minus the disabled
+// ones.
+func (cfg *config) setupCommands() error {
+	cfg.commands = map[string]command{}
+	if cfg.Commands.Enabled == nil {
+		for name, command := range commands {
+			cfg.commands[name] = command
+		}
+	}
+	for _, name := range cfg.Commands.Enabled {
+		command, ok := commands[name]
+		if !ok {
+			return fmt.Errorf("unknown command %q", name)
+		}
+		cfg.commands[name] = command
+	}
+	for _, name := range cfg.Commands.Disabled {
+		if _, ok := commands[name]; !ok {
+			return fmt.Errorf("unknown command %q", name)
+		}
+		delete(cfg.commands, name)
+	}
+	return nil
+}
+
+// command returns the command with the given name, or nil if there's no such command or it isn't enabled.
+func (cfg *config) command(name string) command {
+	if cfg.commands == nil {
+		return commands[name]
+	}
+	return cfg.commands[name]
+}
+
 func executeProgram(context commandContext, ctx *sessionContext) (uint32, error) {
 	if len(context.args) == 0 {
 		return 0, nil
 	}
-	cmd := strings.TrimRight(context.args[0], ";")
-	command := commands[cmd]
+	ctx.cfg.tarpitCommand(context.args[0])
+	if strings.Contains(context.args[0], "/") {
+		return executeFile(context, ctx)
+	}
+	command := ctx.cfg.command(context.args[0])
 	if command == nil {
 		_, err := fmt.Fprintf(context.stderr, "%v: command not found\n", context.args[0])
 		return 127, err
@@ -58,10 +129,75 @@ func executeProgram(context commandContext, ctx *sessionContext) (uint32, error)
 	return command.execute(context, ctx)
 }
 
+// executeFile executes a program specified by its path.
+// Known commands run as usual, scripts are run by the shell and anything else fails to execute.
+func executeFile(context commandContext, ctx *sessionContext) (uint32, error) {
+	name := ctx.resolvePath(context.args[0])
+	info, err := ctx.filesystem.Stat(name)
+	if err == nil && info.mode.IsDir() {
+		err = errIsDir
+	}
+	if err == nil && info.mode&0111 == 0 {
+		err = errors.New("Permission denied")
+	}
+	if err != nil {
+		status := uint32(126)
+		if err == errNoSuchFile {
+			status = 127
+		}
+		_, err := fmt.Fprintf(context.stderr, "sh: %v: %v\n", context.args[0], err)
+		return status, err
+	}
+	data, err := ctx.filesystem.ReadFile(name)
+	if err != nil {
+		return 126, err
+	}
+	if command := ctx.cfg.command(path.Base(name)); command != nil && bytes.Equal(data, fakeBinary(path.Base(name))) {
+		return command.execute(context, ctx)
+	}
+	if bytes.HasPrefix(data, []byte("\x7fELF")) || bytes.IndexByte(data, 0) != -1 {
+		_, err := fmt.Fprintf(context.stderr, "sh: %v: cannot execute binary file: Exec format error\n", context.args[0])
+		return 126, err
+	}
+	sh := &shell{ctx: ctx, args: context.args}
+	status, err := sh.runSource(string(data), context)
+	var exitErr shellExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.status, nil
+	}
+	return status, err
+}
+
 type cmdShell struct{}
 
 func (cmdShell) execute(context commandContext, ctx *sessionContext) (uint32, error) {
-	var prompt string
+	sh := &shell{ctx: ctx, args: context.args[:1]}
+	if len(context.args) > 2 && context.args[1] == "-c" {
+		if len(context.args) > 3 {
+			sh.args = context.args[3:]
+		}
+		status, err := sh.runSource(context.args[2], context)
+		var exitErr shellExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.status, nil
+		}
+		return status, err
+	}
+	if len(context.args) > 1 && !strings.HasPrefix(context.args[1], "-") {
+		script, err := ctx.filesystem.ReadFile(ctx.resolvePath(context.args[1]))
+		if err != nil {
+			_, err := fmt.Fprintf(context.stderr, "%v: %v: %v\n", context.args[0], context.args[1], err)
+			return 127, err
+		}
+		sh.args = context.args[1:]
+		status, err := sh.runSource(string(script), context)
+		var exitErr shellExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.status, nil
+		}
+		return status, err
+	}
+	var prompt, continuationPrompt string
 	if context.pty {
 		switch context.user {
 		case "root":
@@ -69,38 +205,54 @@ func (cmdShell) execute(context commandContext, ctx *sessionContext) (uint32, er
 		default:
 			prompt = "$ "
 		}
+		continuationPrompt = "> "
 	}
-	var lastStatus uint32
-	var line string
-	var err error
+	lineNumber := 0
 	for {
-		_, err = fmt.Fprint(context.stdout, prompt)
-		if err != nil {
-			return lastStatus, err
+		if _, err := fmt.Fprint(context.stdout, prompt); err != nil {
+			return sh.lastStatus, err
 		}
-		line, err = context.stdin.ReadLine()
+		source, err := context.stdin.ReadLine()
 		if err != nil {
-			return lastStatus, err
-		}
-		args := strings.Fields(line)
-		if len(args) == 0 {
-			continue
+			return sh.lastStatus, err
 		}
-		if args[0] == "exit" || args[0] == "exit;" {
-			var err error
-			var status uint64 = uint64(lastStatus)
-			if len(args) > 1 {
-				status, err = strconv.ParseUint(args[1], 10, 32)
-				if err != nil {
-					status = 255
+		lineNumber++
+		list, err := parseShell(source)
+		for {
+			if _, incomplete := err.(shellIncompleteError); !incomplete {
+				break
+			}
+			if _, err := fmt.Fprint(context.stdout, continuationPrompt); err != nil {
+				return sh.lastStatus, err
+			}
+			line, readErr := context.stdin.ReadLine()
+			if readErr != nil {
+				if _, err := fmt.Fprintf(context.stderr, "%v: %v: Syntax error: %v\n", context.args[0], lineNumber, err); err != nil {
+					return 2, err
 				}
+				return 2, readErr
 			}
-			return uint32(status), nil
+			lineNumber++
+			source = fmt.Sprintf("%v\n%v", source, line)
+			if len(source) > maxShellCommandSize {
+				return 2, bufio.ErrTooLong
+			}
+			list, err = parseShell(source)
 		}
-		newContext := context
-		newContext.args = args
-		if lastStatus, err = executeProgram(newContext, ctx); err != nil {
-			return lastStatus, err
+		if err != nil {
+			if _, err := fmt.Fprintf(context.stderr, "%v: %v: Syntax error: %v\n", context.args[0], lineNumber, err); err != nil {
+				return 2, err
+			}
+			sh.lastStatus = 2
+			continue
+		}
+		status, err := sh.runList(list, context)
+		var exitErr shellExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.status, nil
+		}
+		if err != nil {
+			return status, err
 		}
 	}
 }
@@ -120,10 +272,103 @@ func (cmdFalse) execute(context commandContext, ctx *sessionContext) (uint32, er
 type cmdEcho struct{}
 
 func (cmdEcho) execute(context commandContext, ctx *sessionContext) (uint32, error) {
-	_, err := fmt.Fprintln(context.stdout, strings.Join(context.args[1:], " "))
+	args := context.args[1:]
+	newline, escapes := true, false
+	for len(args) > 0 && len(args[0]) > 1 && strings.Trim(args[0], "-neE") == "" && strings.HasPrefix(args[0], "-") {
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 'n':
+				newline = false
+			case 'e':
+				escapes = true
+			case 'E':
+				escapes = false
+			}
+		}
+		args = args[1:]
+	}
+	output := strings.Join(args, " ")
+	if escapes {
+		var stop bool
+		output, stop = expandEscapes(output, false)
+		newline = newline && !stop
+	}
+	if newline {
+		output += "\n"
+	}
+	_, err := io.WriteString(context.stdout, output)
 	return 0, err
 }
 
+// expandEscapes expands backslash escape sequences as echo -e and printf do.
+// Octal escapes are written as \0nnn for echo and as \nnn for printf.
+// It also reports if a \c sequence requested to stop producing output.
+func expandEscapes(text string, printf bool) (string, bool) {
+	output := strings.Builder{}
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i == len(text)-1 {
+			output.WriteByte(text[i])
+			continue
+		}
+		i++
+		switch text[i] {
+		case 'a':
+			output.WriteByte('\a')
+		case 'b':
+			output.WriteByte('\b')
+		case 'c':
+			return output.String(), true
+		case 'e':
+			output.WriteByte(0x1b)
+		case 'f':
+			output.WriteByte('\f')
+		case 'n':
+			output.WriteByte('\n')
+		case 'r':
+			output.WriteByte('\r')
+		case 't':
+			output.WriteByte('\t')
+		case 'v':
+			output.WriteByte('\v')
+		case '\\':
+			output.WriteByte('\\')
+		case 'x':
+			digits := 0
+			for digits < 2 && i+1+digits < len(text) && strings.IndexByte("0123456789abcdefABCDEF", text[i+1+digits]) != -1 {
+				digits++
+			}
+			if digits == 0 {
+				output.WriteString("\\x")
+				continue
+			}
+			value, _ := strconv.ParseUint(text[i+1:i+1+digits], 16, 8)
+			output.WriteByte(byte(value))
+			i += digits
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			start := i
+			if !printf {
+				if text[i] != '0' {
+					output.WriteByte('\\')
+					output.WriteByte(text[i])
+					continue
+				}
+				start++
+			}
+			end := start
+			for end < start+3 && end < len(text) && text[end] >= '0' && text[end] <= '7' {
+				end++
+			}
+			value, _ := strconv.ParseUint("0"+text[start:end], 8, 16)
+			output.WriteByte(byte(value))
+			i = end - 1
+		default:
+			output.WriteByte('\\')
+			output.WriteByte(text[i])
+		}
+	}
+	return output.String(), false
+}
+
 type cmdHuahuo struct{}
 
 func (cmdHuahuo) execute(context commandContext, ctx *sessionContext) (uint32, error) {
@@ -148,11 +393,30 @@ func (cmdUname) execute(context commandContext, ctx *sessionContext) (uint32, er
 type cmdCd struct{}
 
 func (cmdCd) execute(context commandContext, ctx *sessionContext) (uint32, error) {
-	if len(context.args[1]) > 1024 {
-		ctx.virtualPath = context.args[1][:1024]
-	} else {
-		ctx.virtualPath = context.args[1]
+	var target string
+	switch {
+	case len(context.args) < 2:
+		target, _ = ctx.lookupVariable("HOME")
+	case context.args[1] == "-":
+		target, _ = ctx.lookupVariable("OLDPWD")
+		if _, err := fmt.Fprintln(context.stdout, target); err != nil {
+			return 0, err
+		}
+	default:
+		target = context.args[1]
+	}
+	name := ctx.resolvePath(target)
+	info, err := ctx.filesystem.Stat(name)
+	if err == nil && !info.mode.IsDir() {
+		err = errNotDir
+	}
+	if err != nil {
+		_, err := fmt.Fprintf(context.stderr, "sh: %v: %v: %v\n", context.args[0], target, err)
+		return 1, err
 	}
+	ctx.setVariable("OLDPWD", ctx.virtualPath)
+	ctx.virtualPath = name
+	ctx.setVariable("PWD", name)
 	return 0, nil
 }
 
@@ -163,58 +427,181 @@ func (cmdPwd) execute(context commandContext, ctx *sessionContext) (uint32, erro
 	return 0, err
 }
 
+// parseFlags splits command line arguments into single letter flags and operands.
+func parseFlags(args []string) (map[rune]bool, []string) {
+	flags := map[rune]bool{}
+	var operands []string
+	for i, arg := range args {
+		if arg == "--" {
+			operands = append(operands, args[i+1:]...)
+			break
+		}
+		if strings.HasPrefix(arg, "--") {
+			flags[rune(arg[2])] = true
+			continue
+		}
+		if len(arg) > 1 && strings.HasPrefix(arg, "-") {
+			for _, flag := range arg[1:] {
+				flags[flag] = true
+			}
+			continue
+		}
+		operands = append(operands, arg)
+	}
+	return flags, operands
+}
+
 type cmdLs struct{}
 
 func (cmdLs) execute(context commandContext, ctx *sessionContext) (uint32, error) {
-	param := ""
-	if len(context.args) > 1 {
-		param = context.args[1]
-	}
+	flags, operands := parseFlags(context.args[1:])
 	if context.args[0] == "ll" {
-		param += "l"
+		flags['l'], flags['a'], flags['F'] = true, true, true
 	}
-	files := fakeFileList(rand.Intn(100))
-	if strings.Index(param, "l") > -1 {
-		showHidden := strings.Index(param, "a") > -1
-		for _, file := range files {
-			if file.isHidden && !showHidden {
-				continue
-			}
-			dText := "-"
-			if file.IsDir {
-				dText = "d"
-			}
-			_, err := fmt.Fprintf(
-				context.stdout,
-				"%s%s %1d %8s %8s %8d %s %s\n",
-				dText,
-				file.Perm,
-				1,
-				file.Owner,
-				file.OwnerGroup,
-				file.FileSize,
-				file.ModTime.Format("Jan 02 15:04"),
-				file.FileName,
-			)
-			if err != nil {
+	if len(operands) == 0 {
+		operands = []string{"."}
+	}
+	var status uint32
+	var files []fsInfo
+	var dirs []string
+	for _, operand := range operands {
+		info, err := ctx.filesystem.Stat(ctx.resolvePath(operand))
+		if err != nil {
+			if _, err := fmt.Fprintf(context.stderr, "%v: cannot access '%v': %v\n", context.args[0], operand, err); err != nil {
 				return 0, err
 			}
+			status = 2
+			continue
 		}
-		_, err := fmt.Fprintf(context.stdout, "total %d\n", len(files))
-		return 0, err
-	}
-	showHidden := strings.Index(param, "a") > -1
-	for _, file := range files {
-		if file.isHidden && !showHidden {
+		if info.mode.IsDir() && !flags['d'] {
+			dirs = append(dirs, operand)
 			continue
 		}
-		_, err := fmt.Fprintf(context.stdout, "%s\t", file.FileName)
+		if lstat, err := ctx.filesystem.Lstat(ctx.resolvePath(operand)); err == nil && flags['l'] {
+			info = lstat
+		}
+		info.name = operand
+		files = append(files, info)
+	}
+	if len(files) > 0 {
+		if err := writeListing(context, files, flags, false); err != nil {
+			return 0, err
+		}
+	}
+	for i, dir := range dirs {
+		if len(files) > 0 || i > 0 {
+			if _, err := fmt.Fprintln(context.stdout); err != nil {
+				return 0, err
+			}
+		}
+		if len(operands) > 1 {
+			if _, err := fmt.Fprintf(context.stdout, "%v:\n", dir); err != nil {
+				return 0, err
+			}
+		}
+		name := ctx.resolvePath(dir)
+		entries, err := ctx.filesystem.ReadDir(name)
 		if err != nil {
+			if _, err := fmt.Fprintf(context.stderr, "%v: cannot open directory '%v': %v\n", context.args[0], dir, err); err != nil {
+				return 0, err
+			}
+			status = 2
+			continue
+		}
+		var listed []fsInfo
+		if flags['a'] {
+			for _, special := range []struct{ name, path string }{{".", name}, {"..", path.Dir(name)}} {
+				info, err := ctx.filesystem.Stat(special.path)
+				if err == nil {
+					info.name = special.name
+					listed = append(listed, info)
+				}
+			}
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.name, ".") && !flags['a'] && !flags['A'] {
+				continue
+			}
+			listed = append(listed, entry)
+		}
+		if err := writeListing(context, listed, flags, true); err != nil {
 			return 0, err
 		}
 	}
-	_, err := fmt.Fprintln(context.stdout, "")
-	return 0, err
+	return status, nil
+}
+
+func fileTypeIndicator(info fsInfo) string {
+	switch {
+	case info.mode.IsDir():
+		return "/"
+	case info.mode&os.ModeSymlink != 0:
+		return "@"
+	case info.mode&0111 != 0:
+		return "*"
+	}
+	return ""
+}
+
+func writeListing(context commandContext, entries []fsInfo, flags map[rune]bool, total bool) error {
+	if !flags['l'] {
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.name
+			if flags['F'] {
+				names[i] += fileTypeIndicator(entry)
+			}
+		}
+		if len(names) == 0 {
+			return nil
+		}
+		separator := "\n"
+		if context.pty && !flags['1'] {
+			separator = "  "
+		}
+		_, err := fmt.Fprintln(context.stdout, strings.Join(names, separator))
+		return err
+	}
+	var blocks int64
+	var linksWidth, ownerWidth, groupWidth, sizeWidth int
+	for _, entry := range entries {
+		blocks += (entry.size + 4095) / 4096 * 4
+		linksWidth = max(linksWidth, len(fmt.Sprint(entry.nlink)))
+		ownerWidth = max(ownerWidth, len(entry.owner))
+		groupWidth = max(groupWidth, len(entry.group))
+		sizeWidth = max(sizeWidth, len(fmt.Sprint(entry.size)))
+	}
+	if total {
+		if _, err := fmt.Fprintf(context.stdout, "total %d\n", blocks); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		modTime := entry.modTime.Format("Jan _2 15:04")
+		if time.Since(entry.modTime) > 180*24*time.Hour {
+			modTime = entry.modTime.Format("Jan _2  2006")
+		}
+		name := entry.name
+		if entry.mode&os.ModeSymlink != 0 {
+			name = fmt.Sprintf("%v -> %v", name, entry.target)
+		} else if flags['F'] {
+			name += fileTypeIndicator(entry)
+		}
+		if _, err := fmt.Fprintf(
+			context.stdout,
+			"%v %*d %-*v %-*v %*d %v %v\n",
+			fileModeString(entry.mode),
+			linksWidth, entry.nlink,
+			ownerWidth, entry.owner,
+			groupWidth, entry.group,
+			sizeWidth, entry.size,
+			modTime,
+			name,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type cmdNeverGonnaGiveYouUp struct{}
@@ -227,32 +614,54 @@ func (cmdNeverGonnaGiveYouUp) execute(context commandContext, ctx *sessionContex
 type cmdCat struct{}
 
 func (cmdCat) execute(context commandContext, ctx *sessionContext) (uint32, error) {
-	if len(context.args) > 1 {
-		for _, file := range context.args[1:] {
-			funnyFileName := strings.Replace(file, "/", "_", -1)
-			fp, err := os.OpenFile(path.Join(ctx.cfg.WorkDir, "./funny_files/cat/", funnyFileName), os.O_RDONLY, 0644)
-			if err == nil {
-				fileData, err := io.ReadAll(fp)
-				if err == nil {
-					_, err := fmt.Fprintln(context.stdout, string(fileData))
-					return 0, err
-				}
+	_, operands := parseFlags(context.args[1:])
+	if len(operands) == 0 {
+		operands = []string{"-"}
+	}
+	var status uint32
+	for _, file := range operands {
+		if file == "-" {
+			// Copy the input as is when it can be read raw, so that binary payloads keep their bytes.
+			var err error
+			if reader, ok := context.stdin.(io.Reader); ok {
+				_, err = io.Copy(context.stdout, reader)
+			} else {
+				err = copyLines(context.stdout, context.stdin)
 			}
-			if _, err := fmt.Fprintf(context.stderr, "%v: %v: No such file or directory\n", context.args[0], file); err != nil {
+			if err != nil {
 				return 0, err
 			}
+			continue
+		}
+		data, err := ctx.filesystem.ReadFile(ctx.resolvePath(file))
+		if err != nil {
+			if _, err := fmt.Fprintf(context.stderr, "%v: %v: %v\n", context.args[0], file, err); err != nil {
+				return 0, err
+			}
+			status = 1
+			continue
+		}
+		if _, err := context.stdout.Write(data); err != nil {
+			return 0, err
 		}
-		return 1, nil
 	}
+	return status, nil
+}
+
+// copyLines copies lines from stdin to an output until the end of the input.
+func copyLines(output io.Writer, stdin readLiner) error {
 	var line string
 	var err error
 	for err == nil {
-		line, err = context.stdin.ReadLine()
+		line, err = stdin.ReadLine()
 		if err == nil {
-			_, err = fmt.Fprintln(context.stdout, line)
+			_, err = fmt.Fprintln(output, line)
 		}
 	}
-	return 0, err
+	if err == io.EOF {
+		return nil
+	}
+	return err
 }
 
 type cmdSu struct{}
@@ -266,3 +675,671 @@ func (cmdSu) execute(context commandContext, ctx *sessionContext) (uint32, error
 	newContext.args = shellProgram
 	return executeProgram(newContext, ctx)
 }
+
+type cmdExport struct{}
+
+func (cmdExport) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	args := context.args[1:]
+	if len(args) > 0 && args[0] == "-p" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		for _, name := range sortedVariableNames(ctx.env) {
+			if _, err := fmt.Fprintf(context.stdout, "export %v=%v\n", name, shellQuote(ctx.env[name])); err != nil {
+				return 0, err
+			}
+		}
+		return 0, nil
+	}
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !shellVariableNameRegexp.MatchString(name) {
+			_, err := fmt.Fprintf(context.stderr, "sh: %v: %v: bad variable name\n", context.args[0], name)
+			return 2, err
+		}
+		if !hasValue {
+			value, _ = ctx.lookupVariable(name)
+		}
+		ctx.exportVariable(name, value)
+	}
+	return 0, nil
+}
+
+type cmdUnset struct{}
+
+func (cmdUnset) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	for _, name := range context.args[1:] {
+		if name == "-v" || name == "-f" {
+			continue
+		}
+		ctx.unsetVariable(name)
+	}
+	return 0, nil
+}
+
+type cmdEnv struct{}
+
+func (cmdEnv) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	args := context.args[1:]
+	restore := ctx.saveShellState()
+	defer restore()
+	for len(args) > 0 {
+		name, value, found := strings.Cut(args[0], "=")
+		if !found || !shellVariableNameRegexp.MatchString(name) {
+			break
+		}
+		ctx.exportVariable(name, value)
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		newContext := context
+		newContext.args = args
+		return executeProgram(newContext, ctx)
+	}
+	for _, name := range sortedVariableNames(ctx.env) {
+		if _, err := fmt.Fprintf(context.stdout, "%v=%v\n", name, ctx.env[name]); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+type cmdSet struct{}
+
+func (cmdSet) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	// Options like "set +o history" are accepted and ignored.
+	if len(context.args) > 1 {
+		return 0, nil
+	}
+	for _, name := range sortedVariableNames(ctx.env, ctx.vars) {
+		value, _ := ctx.lookupVariable(name)
+		if _, err := fmt.Fprintf(context.stdout, "%v=%v\n", name, shellQuote(value)); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+type cmdMkdir struct{}
+
+func (cmdMkdir) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	flags, operands := parseFlags(context.args[1:])
+	if len(operands) == 0 {
+		_, err := fmt.Fprintf(context.stderr, "%v: missing operand\n", context.args[0])
+		return 1, err
+	}
+	var status uint32
+	for _, operand := range operands {
+		if err := ctx.filesystem.Mkdir(ctx.resolvePath(operand), flags['p']); err != nil {
+			if _, err := fmt.Fprintf(context.stderr, "%v: cannot create directory '%v': %v\n", context.args[0], operand, err); err != nil {
+				return 0, err
+			}
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+type cmdRmdir struct{}
+
+func (cmdRmdir) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	_, operands := parseFlags(context.args[1:])
+	if len(operands) == 0 {
+		_, err := fmt.Fprintf(context.stderr, "%v: missing operand\n", context.args[0])
+		return 1, err
+	}
+	var status uint32
+	for _, operand := range operands {
+		if err := ctx.filesystem.Remove(ctx.resolvePath(operand), false, true); err != nil {
+			if _, err := fmt.Fprintf(context.stderr, "%v: failed to remove '%v': %v\n", context.args[0], operand, err); err != nil {
+				return 0, err
+			}
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+type cmdRm struct{}
+
+func (cmdRm) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	flags, operands := parseFlags(context.args[1:])
+	if len(operands) == 0 && !flags['f'] {
+		_, err := fmt.Fprintf(context.stderr, "%v: missing operand\n", context.args[0])
+		return 1, err
+	}
+	var status uint32
+	for _, operand := range operands {
+		err := ctx.filesystem.Remove(ctx.resolvePath(operand), flags['r'] || flags['R'], flags['d'])
+		if err == nil || (err == errNoSuchFile && flags['f']) {
+			continue
+		}
+		if _, err := fmt.Fprintf(context.stderr, "%v: cannot remove '%v': %v\n", context.args[0], operand, err); err != nil {
+			return 0, err
+		}
+		status = 1
+	}
+	return status, nil
+}
+
+type cmdTouch struct{}
+
+func (cmdTouch) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	_, operands := parseFlags(context.args[1:])
+	if len(operands) == 0 {
+		_, err := fmt.Fprintf(context.stderr, "%v: missing file operand\n", context.args[0])
+		return 1, err
+	}
+	var status uint32
+	for _, operand := range operands {
+		if err := ctx.filesystem.Touch(ctx.resolvePath(operand)); err != nil {
+			if _, err := fmt.Fprintf(context.stderr, "%v: cannot touch '%v': %v\n", context.args[0], operand, err); err != nil {
+				return 0, err
+			}
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+// copyOrMove implements mv and cp, which move or copy the sources into the destination if it is a directory.
+func copyOrMove(context commandContext, ctx *sessionContext, verb string, operation func(source, destination string) error) (uint32, error) {
+	_, operands := parseFlags(context.args[1:])
+	if len(operands) < 2 {
+		_, err := fmt.Fprintf(context.stderr, "%v: missing file operand\n", context.args[0])
+		return 1, err
+	}
+	sources, destination := operands[:len(operands)-1], ctx.resolvePath(operands[len(operands)-1])
+	info, err := ctx.filesystem.Stat(destination)
+	destinationIsDir := err == nil && info.mode.IsDir()
+	if len(sources) > 1 && !destinationIsDir {
+		_, err := fmt.Fprintf(context.stderr, "%v: target '%v' is not a directory\n", context.args[0], operands[len(operands)-1])
+		return 1, err
+	}
+	var status uint32
+	for _, source := range sources {
+		target := destination
+		if destinationIsDir {
+			target = path.Join(destination, path.Base(ctx.resolvePath(source)))
+		}
+		err := operation(ctx.resolvePath(source), target)
+		if err == nil {
+			continue
+		}
+		var message string
+		switch err {
+		case errNoSuchFile:
+			message = fmt.Sprintf("cannot stat '%v': %v", source, err)
+		case errOmittingDirectory:
+			message = fmt.Sprintf("-r not specified; omitting directory '%v'", source)
+		default:
+			message = fmt.Sprintf("cannot %v '%v' to '%v': %v", verb, source, operands[len(operands)-1], err)
+		}
+		if _, err := fmt.Fprintf(context.stderr, "%v: %v\n", context.args[0], message); err != nil {
+			return 0, err
+		}
+		status = 1
+	}
+	return status, nil
+}
+
+type cmdMv struct{}
+
+func (cmdMv) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	return copyOrMove(context, ctx, "move", ctx.filesystem.Rename)
+}
+
+type cmdCp struct{}
+
+var errOmittingDirectory = errors.New("omitting directory")
+
+func (cmdCp) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	flags, _ := parseFlags(context.args[1:])
+	recursive := flags['r'] || flags['R'] || flags['a']
+	return copyOrMove(context, ctx, "copy", func(source, destination string) error {
+		if info, err := ctx.filesystem.Stat(source); err == nil && info.mode.IsDir() && !recursive {
+			return errOmittingDirectory
+		}
+		return ctx.filesystem.Copy(source, destination, recursive)
+	})
+}
+
+type cmdChmod struct{}
+
+func (cmdChmod) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	args := context.args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && !strings.ContainsAny(args[0][1:], "rwxXst") {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		_, err := fmt.Fprintf(context.stderr, "%v: missing operand\n", context.args[0])
+		return 1, err
+	}
+	var status uint32
+	for _, operand := range args[1:] {
+		name := ctx.resolvePath(operand)
+		info, err := ctx.filesystem.Stat(name)
+		if err != nil {
+			if _, err := fmt.Fprintf(context.stderr, "%v: cannot access '%v': %v\n", context.args[0], operand, err); err != nil {
+				return 0, err
+			}
+			status = 1
+			continue
+		}
+		mode, ok := parseFileMode(args[0], info.mode)
+		if !ok {
+			_, err := fmt.Fprintf(context.stderr, "%v: invalid mode: '%v'\n", context.args[0], args[0])
+			return 1, err
+		}
+		if err := ctx.filesystem.Chmod(name, mode); err != nil {
+			return 1, err
+		}
+	}
+	return status, nil
+}
+
+// parseFileMode applies an octal or symbolic mode, like "755" or "u+x,go-w", to a file mode.
+func parseFileMode(spec string, mode os.FileMode) (os.FileMode, bool) {
+	if octal, err := strconv.ParseUint(spec, 8, 32); err == nil {
+		result := mode&^(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) | os.FileMode(octal)&os.ModePerm
+		if octal&04000 != 0 {
+			result |= os.ModeSetuid
+		}
+		if octal&02000 != 0 {
+			result |= os.ModeSetgid
+		}
+		if octal&01000 != 0 {
+			result |= os.ModeSticky
+		}
+		return result, true
+	}
+	for _, clause := range strings.Split(spec, ",") {
+		who := strings.TrimLeft(clause, "ugoa")
+		var mask os.FileMode
+		for _, w := range clause[:len(clause)-len(who)] {
+			switch w {
+			case 'u':
+				mask |= 0700
+			case 'g':
+				mask |= 0070
+			case 'o':
+				mask |= 0007
+			case 'a':
+				mask |= 0777
+			}
+		}
+		if mask == 0 {
+			mask = 0777
+		}
+		if who == "" || !strings.ContainsRune("+-=", rune(who[0])) {
+			return mode, false
+		}
+		var bits, special os.FileMode
+		for _, permission := range who[1:] {
+			switch permission {
+			case 'r':
+				bits |= 0444
+			case 'w':
+				bits |= 0222
+			case 'x', 'X':
+				bits |= 0111
+			case 's':
+				special |= os.ModeSetuid | os.ModeSetgid
+			case 't':
+				special |= os.ModeSticky
+			default:
+				return mode, false
+			}
+		}
+		switch who[0] {
+		case '+':
+			mode |= bits&mask | special
+		case '-':
+			mode &^= bits&mask | special
+		case '=':
+			mode = mode&^mask | bits&mask | special
+		}
+	}
+	return mode, true
+}
+
+// maxInputSize limits the input commands reading all of their input at once read into memory.
+const maxInputSize = 16 * 1024 * 1024
+
+// maxShellCommandSize limits commands spanning multiple lines, which are parsed again with every line.
+const maxShellCommandSize = 1024 * 1024
+
+var errInputTooLarge = errors.New("File too large")
+
+// readInput reads all of the input of a command.
+// Pipes and redirected files are read as is, interactive input is read line by line until its end.
+func readInput(stdin readLiner) ([]byte, error) {
+	if reader, ok := stdin.(io.Reader); ok {
+		data, err := io.ReadAll(io.LimitReader(reader, maxInputSize+1))
+		if err == nil && len(data) > maxInputSize {
+			return nil, errInputTooLarge
+		}
+		return data, err
+	}
+	var data []byte
+	for {
+		line, err := stdin.ReadLine()
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return data, err
+		}
+		data = append(append(data, line...), '\n')
+		if len(data) > maxInputSize {
+			return nil, errInputTooLarge
+		}
+	}
+}
+
+// readInputFile reads a file named on the command line, or the input of the command if it is "-".
+func readInputFile(context commandContext, ctx *sessionContext, name string) ([]byte, error) {
+	if name == "-" {
+		return readInput(context.stdin)
+	}
+	return ctx.filesystem.ReadFile(ctx.resolvePath(name))
+}
+
+type cmdPrintf struct{}
+
+func (cmdPrintf) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	args := context.args[1:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		_, err := fmt.Fprintf(context.stderr, "%v: usage: printf format [arguments]\n", context.args[0])
+		return 2, err
+	}
+	format, args := args[0], args[1:]
+	var status uint32
+	output := strings.Builder{}
+	for {
+		consumed, stop := formatPrintf(&output, format, args, func(arg string) {
+			fmt.Fprintf(context.stderr, "%v: %v: invalid number\n", context.args[0], arg)
+			status = 1
+		})
+		args = args[min(consumed, len(args)):]
+		if stop || consumed == 0 || len(args) == 0 {
+			break
+		}
+	}
+	_, err := io.WriteString(context.stdout, output.String())
+	return status, err
+}
+
+// formatPrintf formats the arguments according to a printf format string once.
+// It returns the number of arguments consumed and whether a \c sequence stopped the output.
+func formatPrintf(output *strings.Builder, format string, args []string, invalidNumber func(string)) (int, bool) {
+	consumed := 0
+	nextArg := func() string {
+		consumed++
+		if consumed > len(args) {
+			return ""
+		}
+		return args[consumed-1]
+	}
+	parseNumber := func(arg string) int64 {
+		if arg == "" {
+			return 0
+		}
+		if len(arg) > 1 && (arg[0] == '\'' || arg[0] == '"') {
+			return int64([]rune(arg[1:])[0])
+		}
+		value, err := strconv.ParseInt(arg, 0, 64)
+		if err != nil {
+			invalidNumber(arg)
+		}
+		return value
+	}
+	for i := 0; i < len(format); i++ {
+		switch format[i] {
+		case '\\':
+			length := escapeLength(format[i:])
+			expanded, stop := expandEscapes(format[i:i+length], true)
+			if stop {
+				return consumed, true
+			}
+			output.WriteString(expanded)
+			i += length - 1
+		case '%':
+			end := i + 1
+			for end < len(format) && strings.IndexByte("-+ #0123456789.", format[end]) != -1 {
+				end++
+			}
+			if end == len(format) {
+				output.WriteString(format[i:])
+				return consumed, false
+			}
+			spec := format[i:end]
+			switch verb := format[end]; verb {
+			case '%':
+				output.WriteByte('%')
+			case 's':
+				fmt.Fprintf(output, spec+"s", nextArg())
+			case 'b':
+				expanded, stop := expandEscapes(nextArg(), false)
+				fmt.Fprintf(output, spec+"s", expanded)
+				if stop {
+					return consumed, true
+				}
+			case 'c':
+				if arg := nextArg(); arg != "" {
+					output.WriteByte(arg[0])
+				}
+			case 'd', 'i':
+				fmt.Fprintf(output, spec+"d", parseNumber(nextArg()))
+			case 'u':
+				fmt.Fprintf(output, spec+"d", uint64(parseNumber(nextArg())))
+			case 'o', 'x', 'X':
+				fmt.Fprintf(output, spec+string(verb), uint64(parseNumber(nextArg())))
+			case 'e', 'E', 'f', 'F', 'g', 'G':
+				value, err := strconv.ParseFloat(nextArg(), 64)
+				if err != nil && consumed > 0 && consumed <= len(args) && args[consumed-1] != "" {
+					invalidNumber(args[consumed-1])
+				}
+				fmt.Fprintf(output, spec+string(verb), value)
+			default:
+				output.WriteString(format[i : end+1])
+			}
+			i = end
+		default:
+			output.WriteByte(format[i])
+		}
+	}
+	return consumed, false
+}
+
+// escapeLength returns the length of the backslash escape sequence at the start of text, as printf reads it.
+func escapeLength(text string) int {
+	if len(text) < 2 {
+		return len(text)
+	}
+	switch {
+	case text[1] == 'x':
+		length := 2
+		for length < 4 && length < len(text) && strings.IndexByte("0123456789abcdefABCDEF", text[length]) != -1 {
+			length++
+		}
+		return length
+	case text[1] >= '0' && text[1] <= '7':
+		length := 2
+		for length < 4 && length < len(text) && text[length] >= '0' && text[length] <= '7' {
+			length++
+		}
+		return length
+	}
+	return 2
+}
+
+type cmdBase64 struct{}
+
+func (cmdBase64) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	decode := false
+	wrap := 76
+	var files []string
+	for i := 1; i < len(context.args); i++ {
+		switch arg := context.args[i]; {
+		case arg == "-d" || arg == "--decode" || arg == "-di" || arg == "-id":
+			decode = true
+		case arg == "-i" || arg == "--ignore-garbage":
+		case arg == "-w" && i+1 < len(context.args):
+			i++
+			wrap, _ = strconv.Atoi(context.args[i])
+		case strings.HasPrefix(arg, "-w"):
+			wrap, _ = strconv.Atoi(strings.TrimPrefix(arg, "-w"))
+		case strings.HasPrefix(arg, "--wrap="):
+			wrap, _ = strconv.Atoi(strings.TrimPrefix(arg, "--wrap="))
+		default:
+			files = append(files, arg)
+		}
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	input, err := readInputFile(context, ctx, files[0])
+	if err != nil {
+		if _, err := fmt.Fprintf(context.stderr, "%v: %v: %v\n", context.args[0], files[0], err); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	if decode {
+		encoded := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(" \t\r\n", r) {
+				return -1
+			}
+			return r
+		}, string(input))
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		}
+		if _, err := context.stdout.Write(decoded); err != nil {
+			return 0, err
+		}
+		if err != nil {
+			_, err := fmt.Fprintf(context.stderr, "%v: invalid input\n", context.args[0])
+			return 1, err
+		}
+		return 0, nil
+	}
+	encoded := base64.StdEncoding.EncodeToString(input)
+	output := strings.Builder{}
+	for wrap > 0 && len(encoded) > wrap {
+		output.WriteString(encoded[:wrap])
+		output.WriteByte('\n')
+		encoded = encoded[wrap:]
+	}
+	output.WriteString(encoded)
+	if encoded != "" {
+		output.WriteByte('\n')
+	}
+	_, err = io.WriteString(context.stdout, output.String())
+	return 0, err
+}
+
+// multiplySize multiplies two sizes, reporting whether the product fits in an int.
+func multiplySize(a, b int) (int, bool) {
+	if a != 0 && b > math.MaxInt/a {
+		return 0, false
+	}
+	return a * b, true
+}
+
+// parseSize parses a size given to dd, such as 512, 4K or 1M.
+func parseSize(size string) (int, bool) {
+	multiplier := 1
+	for suffix, value := range map[string]int{"c": 1, "w": 2, "b": 512, "K": 1024, "k": 1024, "M": 1024 * 1024, "G": 1024 * 1024 * 1024} {
+		if strings.HasSuffix(size, suffix) {
+			size, multiplier = strings.TrimSuffix(size, suffix), value
+			break
+		}
+	}
+	value, err := strconv.Atoi(size)
+	if err != nil || value < 0 {
+		return 0, false
+	}
+	return multiplySize(value, multiplier)
+}
+
+type cmdDd struct{}
+
+func (cmdDd) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	operands := map[string]string{}
+	for _, arg := range context.args[1:] {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			_, err := fmt.Fprintf(context.stderr, "%v: unrecognized operand '%v'\n", context.args[0], arg)
+			return 1, err
+		}
+		operands[key] = value
+	}
+	sizes := map[string]int{"bs": 512, "count": -1, "skip": 0}
+	for key := range sizes {
+		if value, ok := operands[key]; ok {
+			size, ok := parseSize(value)
+			if !ok {
+				_, err := fmt.Fprintf(context.stderr, "%v: invalid number: '%v'\n", context.args[0], value)
+				return 1, err
+			}
+			sizes[key] = size
+		}
+	}
+	if sizes["bs"] == 0 {
+		_, err := fmt.Fprintf(context.stderr, "%v: invalid number: '0'\n", context.args[0])
+		return 1, err
+	}
+	inputName := operands["if"]
+	if inputName == "" {
+		inputName = "-"
+	}
+	input, err := readInputFile(context, ctx, inputName)
+	if err != nil {
+		_, err := fmt.Fprintf(context.stderr, "%v: failed to open '%v': %v\n", context.args[0], operands["if"], err)
+		return 1, err
+	}
+	start := time.Now()
+	// Offsets past the end of the input, even ones too large for an int, leave nothing.
+	if skip, ok := multiplySize(sizes["skip"], sizes["bs"]); ok && skip < len(input) {
+		input = input[skip:]
+	} else {
+		input = nil
+	}
+	if sizes["count"] >= 0 {
+		if count, ok := multiplySize(sizes["count"], sizes["bs"]); ok && count < len(input) {
+			input = input[:count]
+		}
+	}
+	if output := operands["of"]; output != "" {
+		name := ctx.resolvePath(output)
+		if err := ctx.filesystem.WriteFile(name, input, false); err != nil {
+			_, err := fmt.Fprintf(context.stderr, "%v: failed to open '%v': %v\n", context.args[0], output, err)
+			return 1, err
+		}
+		if len(input) > 0 {
+			ctx.captureFile(name)
+		}
+	} else if _, err := context.stdout.Write(input); err != nil {
+		return 0, err
+	}
+	if operands["status"] == "none" {
+		return 0, nil
+	}
+	fullRecords, partialRecords := len(input)/sizes["bs"], 0
+	if len(input)%sizes["bs"] != 0 {
+		partialRecords = 1
+	}
+	elapsed := time.Since(start).Seconds() + 0.0001
+	_, err = fmt.Fprintf(
+		context.stderr,
+		"%[1]v+%[2]v records in\n%[1]v+%[2]v records out\n%[3]v bytes copied, %.6[4]f s, %.1[5]f kB/s\n",
+		fullRecords, partialRecords, len(input), elapsed, float64(len(input))/elapsed/1000,
+	)
+	return 0, err
+}
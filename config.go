@@ -4,16 +4,21 @@ import (
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/elliptic"
+	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v2"
@@ -26,12 +31,14 @@ type serverConfig struct {
 }
 
 type loggingConfig struct {
-	File           string `yaml:"file"`
-	JSON           bool   `yaml:"json"`
-	Timestamps     bool   `yaml:"timestamps"`
-	MetricsAddress string `yaml:"metrics_address"`
-	Debug          bool   `yaml:"debug"`
-	SplitHostPort  bool   `yaml:"split_host_port"`
+	File           string         `yaml:"file"`
+	JSON           bool           `yaml:"json"`
+	Timestamps     bool           `yaml:"timestamps"`
+	MetricsAddress string         `yaml:"metrics_address"`
+	Debug          bool           `yaml:"debug"`
+	SplitHostPort  bool           `yaml:"split_host_port"`
+	QueueSize      int            `yaml:"queue_size"`
+	Rotation       rotationConfig `yaml:"rotation"`
 }
 
 type commonAuthConfig struct {
@@ -40,14 +47,21 @@ type commonAuthConfig struct {
 }
 
 type keyboardInteractiveAuthQuestion struct {
-	Text string `yaml:"text"`
-	Echo bool   `yaml:"echo"`
+	Text  string `yaml:"text"`
+	Echo  bool   `yaml:"echo"`
+	Label string `yaml:"label"`
+}
+
+type keyboardInteractiveAuthRound struct {
+	Instruction string                            `yaml:"instruction"`
+	Questions   []keyboardInteractiveAuthQuestion `yaml:"questions"`
 }
 
 type keyboardInteractiveAuthConfig struct {
 	commonAuthConfig `yaml:",inline"`
 	Instruction      string                            `yaml:"instruction"`
 	Questions        []keyboardInteractiveAuthQuestion `yaml:"questions"`
+	Rounds           []keyboardInteractiveAuthRound    `yaml:"rounds"`
 }
 
 type authConfig struct {
@@ -56,9 +70,20 @@ type authConfig struct {
 	PasswordAuth            commonAuthConfig              `yaml:"password_auth"`
 	PublicKeyAuth           commonAuthConfig              `yaml:"public_key_auth"`
 	KeyboardInteractiveAuth keyboardInteractiveAuthConfig `yaml:"keyboard_interactive_auth"`
+	Rules                   []authRule                    `yaml:"rules"`
+	CredentialMemory        credentialMemoryConfig        `yaml:"credential_memory"`
+}
+
+type credentialMemoryConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	TTL        time.Duration `yaml:"ttl"`
+	Store      string        `yaml:"store"`
+	File       string        `yaml:"file"`
+	MaxEntries int           `yaml:"max_entries"`
 }
 
 type sshProtoConfig struct {
+	Persona        string   `yaml:"persona"`
 	Version        string   `yaml:"version"`
 	Banner         string   `yaml:"banner"`
 	RekeyThreshold uint64   `yaml:"rekey_threshold"`
@@ -68,40 +93,175 @@ type sshProtoConfig struct {
 }
 
 type mongoDBConfig struct {
-	Enable          bool   `yaml:"enable"`
-	Host            string `yaml:"host"`
-	Port            int    `yaml:"port"`
-	User            string `yaml:"user"`
-	Password        string `yaml:"password"`
-	Auth            string `yaml:"auth"`
-	DB              string `yaml:"db"`
-	SSHLogCollect   string `yaml:"ssh_log_collect"`
-	AuthLogCollect  string `yaml:"auth_log_collect"`
-	ShellLogCollect string `yaml:"shell_log_collect"`
+	Enable            bool   `yaml:"enable"`
+	Host              string `yaml:"host"`
+	Port              int    `yaml:"port"`
+	User              string `yaml:"user"`
+	Password          string `yaml:"password"`
+	Auth              string `yaml:"auth"`
+	DB                string `yaml:"db"`
+	SSHLogCollect     string `yaml:"ssh_log_collect"`
+	AuthLogCollect    string `yaml:"auth_log_collect"`
+	ShellLogCollect   string `yaml:"shell_log_collect"`
+	CredentialCollect string `yaml:"credential_collect"`
+}
+
+type artifactsConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Directory string `yaml:"directory"`
+	MaxSize   int64  `yaml:"max_size"`
+}
+
+type downloadsConfig struct {
+	Fetch   bool          `yaml:"fetch"`
+	Timeout time.Duration `yaml:"timeout"`
+	MaxSize int64         `yaml:"max_size"`
+}
+
+type recordingsConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Directory string `yaml:"directory"`
+	MaxSize   int64  `yaml:"max_size"`
+}
+
+type captureConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Directory string `yaml:"directory"`
+	MaxSize   int64  `yaml:"max_size"`
+}
+
+type tarpitConfig struct {
+	AuthDelay     time.Duration            `yaml:"auth_delay"`
+	AuthJitter    time.Duration            `yaml:"auth_jitter"`
+	DripLines     int                      `yaml:"drip_lines"`
+	DripInterval  time.Duration            `yaml:"drip_interval"`
+	BannerDelay   time.Duration            `yaml:"banner_delay"`
+	CommandDelay  time.Duration            `yaml:"command_delay"`
+	CommandJitter time.Duration            `yaml:"command_jitter"`
+	CommandDelays map[string]time.Duration `yaml:"command_delays"`
+}
+
+type connectionLimitConfig struct {
+	Max    int    `yaml:"max"`
+	Action string `yaml:"action"`
+}
+
+type limitsConfig struct {
+	Global         connectionLimitConfig `yaml:"global"`
+	PerIP          connectionLimitConfig `yaml:"per_ip"`
+	PerNetwork     connectionLimitConfig `yaml:"per_network"`
+	PerIPPerMinute connectionLimitConfig `yaml:"per_ip_per_minute"`
+	MaxTarpitted   int                   `yaml:"max_tarpitted"`
+	TarpitDuration time.Duration         `yaml:"tarpit_duration"`
+}
+
+type timeoutsConfig struct {
+	Handshake         time.Duration `yaml:"handshake"`
+	Auth              time.Duration `yaml:"auth"`
+	Idle              time.Duration `yaml:"idle"`
+	AutoLogoutMessage bool          `yaml:"auto_logout_message"`
+	MaxLifetime       time.Duration `yaml:"max_lifetime"`
+}
+
+type sensorConfig struct {
+	Name     string `yaml:"name"`
+	IDFormat string `yaml:"id_format"`
+	NodeID   int64  `yaml:"node_id"`
+}
+
+type proxyProtocolConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	TrustedSources []string      `yaml:"trusted_sources"`
+	HeaderTimeout  time.Duration `yaml:"header_timeout"`
+}
+
+type commandsConfig struct {
+	Enabled  []string `yaml:"enabled"`
+	Disabled []string `yaml:"disabled"`
+}
+
+type filesystemConfig struct {
+	Template string `yaml:"template"`
+	MaxSize  int64  `yaml:"max_size"`
+	MaxFiles int64  `yaml:"max_files"`
 }
 
 type config struct {
-	Server        serverConfig   `yaml:"server"`
-	Logging       loggingConfig  `yaml:"logging"`
-	Auth          authConfig     `yaml:"auth"`
-	SSHProto      sshProtoConfig `yaml:"ssh_proto"`
-	MongoDBConfig mongoDBConfig  `yaml:"mongodb"`
-	WorkDir       string         `yaml:"work_dir"`
+	Server        serverConfig        `yaml:"server"`
+	Sensor        sensorConfig        `yaml:"sensor"`
+	Listeners     []listenerConfig    `yaml:"listeners"`
+	ProxyProtocol proxyProtocolConfig `yaml:"proxy_protocol"`
+	Logging       loggingConfig       `yaml:"logging"`
+	Sinks         []sinkConfig        `yaml:"sinks"`
+	Auth          authConfig          `yaml:"auth"`
+	SSHProto      sshProtoConfig      `yaml:"ssh_proto"`
+	MongoDBConfig mongoDBConfig       `yaml:"mongodb"`
+	Commands      commandsConfig      `yaml:"commands"`
+	Filesystem    filesystemConfig    `yaml:"filesystem"`
+	Artifacts     artifactsConfig     `yaml:"artifacts"`
+	Downloads     downloadsConfig     `yaml:"downloads"`
+	Recordings    recordingsConfig    `yaml:"recordings"`
+	Capture       captureConfig       `yaml:"capture"`
+	Tarpit        tarpitConfig        `yaml:"tarpit"`
+	Limits        limitsConfig        `yaml:"limits"`
+	Timeouts      timeoutsConfig      `yaml:"timeouts"`
+	WorkDir       string              `yaml:"work_dir"`
 
-	parsedHostKeys []ssh.Signer
-	sshConfig      *ssh.ServerConfig
-	logFileHandle  io.WriteCloser
-	mongoRecorder  *MongoRecorder
+	listenerName       string
+	listeners          []*config
+	current            *atomic.Pointer[config]
+	trustedProxies     []*net.IPNet
+	parsedHostKeys     []ssh.Signer
+	sshConfig          *ssh.ServerConfig
+	serverHASSH        string
+	authTracker        *authTracker
+	credentialMemory   *credentialMemory
+	logFileHandle      io.WriteCloser
+	sinks              []*eventSink
+	mongoRecorder      *MongoRecorder
+	filesystemTemplate *fsNode
+	commands           map[string]command
+	idGenerator        idGenerator
+	fetcher            fetcher
 }
 
+const (
+	defaultServerVersion = "SSH-2.0-sshesame"
+	defaultBanner        = "This is an SSH honeypot. Everything is logged and monitored."
+)
+
 func (cfg *config) setDefaults() {
 	cfg.Server.ListenAddress = "127.0.0.1:2022"
+	cfg.Sensor.IDFormat = "snowflake"
 	cfg.Logging.Timestamps = true
+	cfg.Logging.QueueSize = 1000
 	cfg.Auth.PasswordAuth.Enabled = true
 	cfg.Auth.PasswordAuth.Accepted = true
 	cfg.Auth.PublicKeyAuth.Enabled = true
-	cfg.SSHProto.Version = "SSH-2.0-sshesame"
-	cfg.SSHProto.Banner = "This is an SSH honeypot. Everything is logged and monitored."
+	cfg.Auth.CredentialMemory.TTL = 7 * 24 * time.Hour
+	cfg.Auth.CredentialMemory.Store = "file"
+	cfg.Auth.CredentialMemory.MaxEntries = 10000
+	cfg.SSHProto.Version = defaultServerVersion
+	cfg.SSHProto.Banner = defaultBanner
+	cfg.Filesystem.MaxSize = 64 * 1024 * 1024
+	cfg.Filesystem.MaxFiles = 10000
+	cfg.Artifacts.MaxSize = 10 * 1024 * 1024
+	cfg.Downloads.Timeout = 30 * time.Second
+	cfg.Downloads.MaxSize = 10 * 1024 * 1024
+	cfg.Recordings.Enabled = true
+	cfg.Recordings.MaxSize = 10 * 1024 * 1024
+	cfg.Capture.MaxSize = 10 * 1024 * 1024
+	cfg.Tarpit.DripInterval = 10 * time.Second
+	cfg.Limits.Global.Action = "drop"
+	cfg.Limits.PerIP.Action = "drop"
+	cfg.Limits.PerNetwork.Action = "drop"
+	cfg.Limits.PerIPPerMinute.Action = "drop"
+	cfg.Limits.MaxTarpitted = 100
+	cfg.Limits.TarpitDuration = 10 * time.Minute
+	cfg.ProxyProtocol.HeaderTimeout = 5 * time.Second
+	cfg.Timeouts.Handshake = 30 * time.Second
+	cfg.Timeouts.Auth = 2 * time.Minute
+	cfg.Timeouts.AutoLogoutMessage = true
 }
 
 var defaultTCPIPServices = map[uint32]string{
@@ -219,10 +379,22 @@ func (cfg *config) setupSSHConfig() error {
 	if err := cfg.parseHostKeys(); err != nil {
 		return err
 	}
+	hostKeys, err := cfg.personaHostKeys(cfg.parsedHostKeys)
+	if err != nil {
+		return err
+	}
+	cfg.parsedHostKeys = hostKeys
 	for _, key := range cfg.parsedHostKeys {
 		sshConfig.AddHostKey(key)
 	}
 	cfg.sshConfig = sshConfig
+	hasshSum := md5.Sum([]byte(cfg.serverHASSHAlgorithms()))
+	cfg.serverHASSH = hex.EncodeToString(hasshSum[:])
+	if cfg.listenerName != "" {
+		infoLogger.Printf("Listener %q presenting server version %q and HASSH %v", cfg.listenerName, cfg.SSHProto.Version, cfg.serverHASSH)
+	} else {
+		infoLogger.Printf("Presenting server version %q and HASSH %v", cfg.SSHProto.Version, cfg.serverHASSH)
+	}
 	return nil
 }
 
@@ -230,7 +402,7 @@ func (cfg *config) setupLogging() error {
 	var logFile io.WriteCloser
 	if cfg.Logging.File != "" {
 		var err error
-		logFile, err = os.OpenFile(cfg.Logging.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		logFile, err = newRotatingFile(cfg.Logging.File, cfg.Logging.Rotation)
 		if err != nil {
 			return err
 		}
@@ -249,11 +421,20 @@ func (cfg *config) setupLogging() error {
 	} else {
 		log.SetFlags(0)
 	}
-	return nil
+	return cfg.setupSinks()
 }
 
 func (cfg *config) load(configString string, dataDir string) error {
+	previousListeners := map[string]loadedListener{}
+	for _, listenerCfg := range cfg.listeners {
+		previousListeners[listenerCfg.listenerName] = loadedListener{listenerCfg.Server.ListenAddress, listenerCfg.current}
+	}
+	previousSinks := cfg.sinks
+	previousLogFile := cfg.logFileHandle
+	previousCredentialMemory := cfg.credentialMemory
+	previousMongoRecorder := cfg.mongoRecorder
 	*cfg = config{}
+	cfg.logFileHandle = previousLogFile
 
 	cfg.setDefaults()
 
@@ -271,19 +452,88 @@ func (cfg *config) load(configString string, dataDir string) error {
 		}
 	}
 
+	if err := cfg.setupSensor(); err != nil {
+		return err
+	}
+
+	// The MongoDB connection is made once at startup, and kept across reloads.
+	if cfg.MongoDBConfig.Enable {
+		cfg.mongoRecorder = previousMongoRecorder
+	}
+
+	cfg.authTracker = newAuthTracker()
+	// Let the previous store finish writing before the new one reads what it stored.
+	if previousCredentialMemory != nil {
+		previousCredentialMemory.close()
+	}
+	if err := cfg.setupCredentialMemory(dataDir); err != nil {
+		return err
+	}
+
+	if err := cfg.setupListener(dataDir); err != nil {
+		return err
+	}
+	if err := cfg.setupLogging(); err != nil {
+		return err
+	}
+	for _, sink := range previousSinks {
+		sink.close()
+	}
+
+	if cfg.Downloads.Fetch {
+		cfg.fetcher = newHTTPFetcher(cfg.Downloads.Timeout, cfg.Downloads.MaxSize, publicAddress)
+	}
+
+	if err := cfg.setupListeners(configString, dataDir, previousListeners); err != nil {
+		return err
+	}
+	for _, listenerCfg := range cfg.listeners {
+		if err := listenerCfg.setupLimits(); err != nil {
+			return err
+		}
+	}
+	for _, listenerCfg := range cfg.listeners {
+		listenerCfg.current.Store(listenerCfg)
+	}
+
+	return nil
+}
+
+// setupListener sets up what can differ between listeners.
+func (cfg *config) setupListener(dataDir string) error {
+	if err := cfg.applyPersona(); err != nil {
+		return err
+	}
+
 	if len(cfg.Server.HostKeys) == 0 {
 		infoLogger.Printf("No host keys configured, using keys at %q", dataDir)
-		if err := cfg.setDefaultHostKeys(dataDir, []keySignature{rsa_key, ecdsa_key, ed25519_key}); err != nil {
+		if err := cfg.setDefaultHostKeys(dataDir, cfg.hostKeySignatures()); err != nil {
 			return err
 		}
 	}
 
+	for i := range cfg.Auth.Rules {
+		if err := cfg.Auth.Rules[i].setup(); err != nil {
+			return fmt.Errorf("invalid auth rule %v: %w", i+1, err)
+		}
+	}
+
+	if err := cfg.setupProxyProtocol(); err != nil {
+		return err
+	}
+
 	if err := cfg.setupSSHConfig(); err != nil {
 		return err
 	}
-	if err := cfg.setupLogging(); err != nil {
+
+	if err := cfg.setupCommands(); err != nil {
+		return err
+	}
+	template, err := loadFilesystemTemplate(cfg.WorkDir, cfg.Filesystem.Template, cfg.commands)
+	if err != nil {
 		return err
 	}
+	cfg.filesystemTemplate = template
 
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"path"
 	"reflect"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v2"
@@ -58,6 +59,40 @@ func verifyConfig(t *testing.T, cfg *config, expected *config) {
 	if !reflect.DeepEqual(cfg.SSHProto, expected.SSHProto) {
 		t.Errorf("SSHProto=%v, want %v", cfg.SSHProto, expected.SSHProto)
 	}
+	// The sensor name defaults to the hostname, so only the ID settings are compared.
+	if cfg.Sensor.IDFormat != expected.Sensor.IDFormat {
+		t.Errorf("Sensor.IDFormat=%v, want %v", cfg.Sensor.IDFormat, expected.Sensor.IDFormat)
+	}
+	if cfg.Sensor.NodeID != expected.Sensor.NodeID {
+		t.Errorf("Sensor.NodeID=%v, want %v", cfg.Sensor.NodeID, expected.Sensor.NodeID)
+	}
+	if !reflect.DeepEqual(cfg.ProxyProtocol, expected.ProxyProtocol) {
+		t.Errorf("ProxyProtocol=%v, want %v", cfg.ProxyProtocol, expected.ProxyProtocol)
+	}
+	if !reflect.DeepEqual(cfg.Filesystem, expected.Filesystem) {
+		t.Errorf("Filesystem=%v, want %v", cfg.Filesystem, expected.Filesystem)
+	}
+	if !reflect.DeepEqual(cfg.Artifacts, expected.Artifacts) {
+		t.Errorf("Artifacts=%v, want %v", cfg.Artifacts, expected.Artifacts)
+	}
+	if !reflect.DeepEqual(cfg.Downloads, expected.Downloads) {
+		t.Errorf("Downloads=%v, want %v", cfg.Downloads, expected.Downloads)
+	}
+	if !reflect.DeepEqual(cfg.Recordings, expected.Recordings) {
+		t.Errorf("Recordings=%v, want %v", cfg.Recordings, expected.Recordings)
+	}
+	if !reflect.DeepEqual(cfg.Capture, expected.Capture) {
+		t.Errorf("Capture=%v, want %v", cfg.Capture, expected.Capture)
+	}
+	if !reflect.DeepEqual(cfg.Tarpit, expected.Tarpit) {
+		t.Errorf("Tarpit=%v, want %v", cfg.Tarpit, expected.Tarpit)
+	}
+	if !reflect.DeepEqual(cfg.Limits, expected.Limits) {
+		t.Errorf("Limits=%v, want %v", cfg.Limits, expected.Limits)
+	}
+	if !reflect.DeepEqual(cfg.Timeouts, expected.Timeouts) {
+		t.Errorf("Timeouts=%v, want %v", cfg.Timeouts, expected.Timeouts)
+	}
 
 	if cfg.sshConfig.RekeyThreshold != expected.SSHProto.RekeyThreshold {
 		t.Errorf("sshConfig.RekeyThreshold=%v, want %v", cfg.sshConfig.RekeyThreshold, expected.SSHProto.RekeyThreshold)
@@ -162,11 +197,35 @@ func TestDefaultConfig(t *testing.T) {
 		8080: "HTTP",
 	}
 	expectedConfig.Logging.Timestamps = true
+	expectedConfig.Logging.QueueSize = 1000
 	expectedConfig.Auth.PasswordAuth.Enabled = true
 	expectedConfig.Auth.PasswordAuth.Accepted = true
 	expectedConfig.Auth.PublicKeyAuth.Enabled = true
+	expectedConfig.Auth.CredentialMemory.TTL = 7 * 24 * time.Hour
+	expectedConfig.Auth.CredentialMemory.Store = "file"
+	expectedConfig.Auth.CredentialMemory.MaxEntries = 10000
 	expectedConfig.SSHProto.Version = "SSH-2.0-sshesame"
 	expectedConfig.SSHProto.Banner = "This is an SSH honeypot. Everything is logged and monitored."
+	expectedConfig.Sensor.IDFormat = "snowflake"
+	expectedConfig.ProxyProtocol.HeaderTimeout = 5 * time.Second
+	expectedConfig.Filesystem.MaxSize = 64 * 1024 * 1024
+	expectedConfig.Filesystem.MaxFiles = 10000
+	expectedConfig.Artifacts.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Downloads.Timeout = 30 * time.Second
+	expectedConfig.Downloads.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Recordings.Enabled = true
+	expectedConfig.Recordings.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Capture.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Tarpit.DripInterval = 10 * time.Second
+	expectedConfig.Limits.Global.Action = "drop"
+	expectedConfig.Limits.PerIP.Action = "drop"
+	expectedConfig.Limits.PerNetwork.Action = "drop"
+	expectedConfig.Limits.PerIPPerMinute.Action = "drop"
+	expectedConfig.Limits.MaxTarpitted = 100
+	expectedConfig.Limits.TarpitDuration = 10 * time.Minute
+	expectedConfig.Timeouts.Handshake = 30 * time.Second
+	expectedConfig.Timeouts.Auth = 2 * time.Minute
+	expectedConfig.Timeouts.AutoLogoutMessage = true
 	verifyConfig(t, cfg, expectedConfig)
 	verifyDefaultKeys(t, dataDir)
 }
@@ -232,6 +291,7 @@ ssh_proto:
 	expectedConfig.Logging.Timestamps = false
 	expectedConfig.Logging.MetricsAddress = "0.0.0.0:2112"
 	expectedConfig.Logging.SplitHostPort = true
+	expectedConfig.Logging.QueueSize = 1000
 	expectedConfig.Auth.MaxTries = 234
 	expectedConfig.Auth.NoAuth = true
 	expectedConfig.Auth.PublicKeyAuth.Accepted = true
@@ -239,14 +299,37 @@ ssh_proto:
 	expectedConfig.Auth.KeyboardInteractiveAuth.Accepted = true
 	expectedConfig.Auth.KeyboardInteractiveAuth.Instruction = "instruction"
 	expectedConfig.Auth.KeyboardInteractiveAuth.Questions = []keyboardInteractiveAuthQuestion{
-		{"q1", true},
-		{"q2", false},
+		{Text: "q1", Echo: true},
+		{Text: "q2", Echo: false},
 	}
+	expectedConfig.Auth.CredentialMemory.TTL = 7 * 24 * time.Hour
+	expectedConfig.Auth.CredentialMemory.Store = "file"
+	expectedConfig.Auth.CredentialMemory.MaxEntries = 10000
 	expectedConfig.SSHProto.Version = "SSH-2.0-test"
 	expectedConfig.SSHProto.RekeyThreshold = 123
 	expectedConfig.SSHProto.KeyExchanges = []string{"kex"}
 	expectedConfig.SSHProto.Ciphers = []string{"cipher"}
 	expectedConfig.SSHProto.MACs = []string{"mac"}
+	expectedConfig.Sensor.IDFormat = "snowflake"
+	expectedConfig.ProxyProtocol.HeaderTimeout = 5 * time.Second
+	expectedConfig.Filesystem.MaxSize = 64 * 1024 * 1024
+	expectedConfig.Filesystem.MaxFiles = 10000
+	expectedConfig.Artifacts.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Downloads.Timeout = 30 * time.Second
+	expectedConfig.Downloads.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Recordings.Enabled = true
+	expectedConfig.Recordings.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Capture.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Tarpit.DripInterval = 10 * time.Second
+	expectedConfig.Limits.Global.Action = "drop"
+	expectedConfig.Limits.PerIP.Action = "drop"
+	expectedConfig.Limits.PerNetwork.Action = "drop"
+	expectedConfig.Limits.PerIPPerMinute.Action = "drop"
+	expectedConfig.Limits.MaxTarpitted = 100
+	expectedConfig.Limits.TarpitDuration = 10 * time.Minute
+	expectedConfig.Timeouts.Handshake = 30 * time.Second
+	expectedConfig.Timeouts.Auth = 2 * time.Minute
+	expectedConfig.Timeouts.AutoLogoutMessage = true
 	verifyConfig(t, cfg, expectedConfig)
 	verifyDefaultKeys(t, dataDir)
 }
@@ -275,11 +358,35 @@ server:
 		8080: "HTTP",
 	}
 	expectedConfig.Logging.Timestamps = true
+	expectedConfig.Logging.QueueSize = 1000
 	expectedConfig.Auth.PasswordAuth.Enabled = true
 	expectedConfig.Auth.PasswordAuth.Accepted = true
 	expectedConfig.Auth.PublicKeyAuth.Enabled = true
+	expectedConfig.Auth.CredentialMemory.TTL = 7 * 24 * time.Hour
+	expectedConfig.Auth.CredentialMemory.Store = "file"
+	expectedConfig.Auth.CredentialMemory.MaxEntries = 10000
 	expectedConfig.SSHProto.Version = "SSH-2.0-sshesame"
 	expectedConfig.SSHProto.Banner = "This is an SSH honeypot. Everything is logged and monitored."
+	expectedConfig.Sensor.IDFormat = "snowflake"
+	expectedConfig.ProxyProtocol.HeaderTimeout = 5 * time.Second
+	expectedConfig.Filesystem.MaxSize = 64 * 1024 * 1024
+	expectedConfig.Filesystem.MaxFiles = 10000
+	expectedConfig.Artifacts.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Downloads.Timeout = 30 * time.Second
+	expectedConfig.Downloads.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Recordings.Enabled = true
+	expectedConfig.Recordings.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Capture.MaxSize = 10 * 1024 * 1024
+	expectedConfig.Tarpit.DripInterval = 10 * time.Second
+	expectedConfig.Limits.Global.Action = "drop"
+	expectedConfig.Limits.PerIP.Action = "drop"
+	expectedConfig.Limits.PerNetwork.Action = "drop"
+	expectedConfig.Limits.PerIPPerMinute.Action = "drop"
+	expectedConfig.Limits.MaxTarpitted = 100
+	expectedConfig.Limits.TarpitDuration = 10 * time.Minute
+	expectedConfig.Timeouts.Handshake = 30 * time.Second
+	expectedConfig.Timeouts.Auth = 2 * time.Minute
+	expectedConfig.Timeouts.AutoLogoutMessage = true
 	verifyConfig(t, cfg, expectedConfig)
 	files, err := os.ReadDir(dataDir)
 	if err != nil {
@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
-	"github.com/bwmarrin/snowflake"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jaksi/sshutils"
 	"github.com/prometheus/client_golang/prometheus"
@@ -15,7 +16,9 @@ type connContext struct {
 	ssh.ConnMetadata
 	cfg            *config
 	noMoreSessions bool
-	sessionId      int64
+	connectionID   string
+	channelUID     string
+	filesystem     *virtualFS
 }
 
 type channelContext struct {
@@ -23,49 +26,94 @@ type channelContext struct {
 	channelID int
 }
 
+// newChannelContext returns the context of a channel, identified across connections by the ID of the connection and
+// its own.
+func (context connContext) newChannelContext(channelID int) channelContext {
+	context.channelUID = fmt.Sprintf("%v-%v", context.connectionID, channelID)
+	return channelContext{context, channelID}
+}
+
 var channelHandlers = map[string]func(newChannel ssh.NewChannel, context channelContext) error{
 	"session":      handleSessionChannel,
 	"direct-tcpip": handleDirectTCPIPChannel,
 }
 
 var (
-	sshConnectionsMetric = promauto.NewCounter(prometheus.CounterOpts{
+	sshConnectionsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "sshesame_ssh_connections_total",
 		Help: "Total number of SSH connections",
-	})
-	activeSSHConnectionsMetric = promauto.NewGauge(prometheus.GaugeOpts{
+	}, []string{"listener"})
+	activeSSHConnectionsMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "sshesame_active_ssh_connections",
 		Help: "Number of active SSH connections",
-	})
-	unknownChannelsMetric = promauto.NewCounter(prometheus.CounterOpts{
+	}, []string{"listener"})
+	unknownChannelsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "sshesame_unknown_channels_total",
 		Help: "Total number of unknown channels",
-	})
+	}, []string{"listener"})
 )
 
 func handleConnection(conn *sshutils.Conn, cfg *config) {
-	sshConnectionsMetric.Inc()
-	activeSSHConnectionsMetric.Inc()
-	defer activeSSHConnectionsMetric.Dec()
-	var channels sync.WaitGroup
-
-	// Create a new Node with a Node number of 1
-	idGenerator, err := snowflake.NewNode(1)
-	if err != nil {
-		fmt.Println(err)
+	connectionID, ok := finishHandshake(conn.RemoteAddr())
+	if !ok {
+		// Timed out right as the handshake finished, the timeout closed and logged the connection.
 		return
 	}
+	sshConnectionsMetric.WithLabelValues(cfg.listenerName).Inc()
+	activeSSHConnectionsMetric.WithLabelValues(cfg.listenerName).Inc()
+	defer activeSSHConnectionsMetric.WithLabelValues(cfg.listenerName).Dec()
+	var channels sync.WaitGroup
 
-	context := connContext{ConnMetadata: conn, cfg: cfg, sessionId: idGenerator.Generate().Int64()}
+	var metadata ssh.ConnMetadata = conn
+	if serverConn, ok := conn.Conn.(*ssh.ServerConn); ok && serverConn.Permissions != nil {
+		if fakeUser := serverConn.Permissions.Extensions[fakeUserExtension]; fakeUser != "" {
+			metadata = fakeUserConnMetadata{conn, fakeUser}
+		}
+	}
+	if connectionID == "" {
+		connectionID = cfg.newID()
+	}
+	filesystem := newVirtualFS(cfg.filesystemTemplate, metadata.User())
+	filesystem.maxSize, filesystem.maxFiles = cfg.Filesystem.MaxSize, cfg.Filesystem.MaxFiles
+	context := connContext{
+		ConnMetadata: metadata,
+		cfg:          cfg,
+		connectionID: connectionID,
+		filesystem:   filesystem,
+	}
+	var closeReason atomic.Value
 	defer func() {
 		conn.Close()
 		channels.Wait()
-		context.logEvent(connectionCloseLog{})
+		reason, _ := closeReason.Load().(string)
+		context.logEvent(connectionCloseLog{Reason: reason})
 	}()
+	if cfg.Timeouts.MaxLifetime > 0 {
+		lifetime := time.AfterFunc(cfg.Timeouts.MaxLifetime, func() {
+			closeReason.Store("max lifetime")
+			conn.Close()
+		})
+		defer lifetime.Stop()
+	}
 
-	context.logEvent(connectionLog{
+	if serverConn, ok := conn.Conn.(*ssh.ServerConn); ok {
+		context.logSignedPublicKey(conn.User(), serverConn.Permissions)
+	}
+
+	connection := connectionLog{
 		ClientVersion: string(conn.ClientVersion()),
-	})
+		ServerHASSH:   cfg.serverHASSH,
+	}
+	if kexInit := clientKexInit(conn.RemoteAddr()); kexInit != nil {
+		connection.KexAlgorithms = kexInit.KexAlgos
+		connection.HostKeyAlgorithms = kexInit.ServerHostKeyAlgos
+		connection.Ciphers = kexInit.CiphersClientServer
+		connection.MACs = kexInit.MACsClientServer
+		connection.Compression = kexInit.CompressionClientServer
+		connection.HASSH = kexInit.hassh()
+		connection.HASSHAlgorithms = kexInit.hasshAlgorithms()
+	}
+	context.logEvent(connection)
 
 	hostKeysPayload := make([][]byte, len(cfg.parsedHostKeys))
 	for i, key := range cfg.parsedHostKeys {
@@ -107,7 +155,7 @@ func handleConnection(conn *sshutils.Conn, cfg *config) {
 			channelType := newChannel.ChannelType()
 			handler := channelHandlers[channelType]
 			if handler == nil {
-				unknownChannelsMetric.Inc()
+				unknownChannelsMetric.WithLabelValues(cfg.listenerName).Inc()
 				warningLogger.Printf("Unsupported channel type %v", channelType)
 				if err := newChannel.Reject(ssh.ConnectionFailed, "open failed"); err != nil {
 					warningLogger.Printf("Failed to reject channel: %v", err)
@@ -123,7 +171,7 @@ func handleConnection(conn *sshutils.Conn, cfg *config) {
 					warningLogger.Printf("Failed to handle new channel: %v", err)
 					conn.Close()
 				}
-			}(channelContext{context, channelID})
+			}(context.newChannelContext(channelID))
 			channelID++
 		}
 	}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// rememberedCredential is a password accepted for a user from a source IP. Until it expires, the user is only let in
+// from that IP with the same password, like a real server would.
+type rememberedCredential struct {
+	Source   string    `json:"source" bson:"source"`
+	User     string    `json:"user" bson:"user"`
+	Password string    `json:"password" bson:"password"`
+	FakeUser string    `json:"fake_user,omitempty" bson:"fake_user,omitempty"`
+	Expires  time.Time `json:"expires" bson:"expires"`
+}
+
+type credentialStore interface {
+	// find returns the credential remembered for a user from a source, or nil if there is none.
+	find(source, user string) (*rememberedCredential, error)
+	remember(credential rememberedCredential) error
+	// close waits for pending changes to be stored and releases the store.
+	close()
+}
+
+type credentialKey struct {
+	source, user string
+}
+
+// memoryCredentialStore keeps at most maxEntries credentials in memory, and in a JSON file if one is set. The file is
+// written in the background so that authentication doesn't wait for it, and changes made while it's being written are
+// saved together afterwards.
+type memoryCredentialStore struct {
+	lock        sync.Mutex
+	file        string
+	maxEntries  int
+	credentials map[credentialKey]rememberedCredential
+	closed      bool
+	changed     chan struct{}
+	saved       chan struct{}
+}
+
+func newMemoryCredentialStore(file string, maxEntries int) (*memoryCredentialStore, error) {
+	store := &memoryCredentialStore{file: file, maxEntries: maxEntries, credentials: map[credentialKey]rememberedCredential{}}
+	if file == "" {
+		return store, nil
+	}
+	credentialsBytes, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var credentials []rememberedCredential
+		if err := json.Unmarshal(credentialsBytes, &credentials); err != nil {
+			return nil, fmt.Errorf("failed to parse %q: %w", file, err)
+		}
+		for _, credential := range credentials {
+			store.credentials[credentialKey{credential.Source, credential.User}] = credential
+		}
+	}
+	store.changed = make(chan struct{}, 1)
+	store.saved = make(chan struct{})
+	go store.saveChanges()
+	return store, nil
+}
+
+func (store *memoryCredentialStore) saveChanges() {
+	defer close(store.saved)
+	for range store.changed {
+		store.lock.Lock()
+		credentials := make([]rememberedCredential, 0, len(store.credentials))
+		for _, credential := range store.credentials {
+			credentials = append(credentials, credential)
+		}
+		store.lock.Unlock()
+		if err := store.save(credentials); err != nil {
+			warningLogger.Printf("Failed to save remembered credentials: %v", err)
+		}
+	}
+}
+
+func (store *memoryCredentialStore) save(credentials []rememberedCredential) error {
+	credentialsBytes, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a crash doesn't leave a truncated file behind.
+	tempFile := store.file + ".tmp"
+	if err := os.WriteFile(tempFile, credentialsBytes, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, store.file)
+}
+
+func (store *memoryCredentialStore) find(source, user string) (*rememberedCredential, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	credential, ok := store.credentials[credentialKey{source, user}]
+	if !ok {
+		return nil, nil
+	}
+	return &credential, nil
+}
+
+func (store *memoryCredentialStore) remember(credential rememberedCredential) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.closed {
+		return errors.New("credential store closed")
+	}
+	store.credentials[credentialKey{credential.Source, credential.User}] = credential
+	now := time.Now()
+	var soonestKey credentialKey
+	var soonest time.Time
+	for key, credential := range store.credentials {
+		if now.After(credential.Expires) {
+			delete(store.credentials, key)
+			continue
+		}
+		if soonest.IsZero() || credential.Expires.Before(soonest) {
+			soonestKey, soonest = key, credential.Expires
+		}
+	}
+	// Only one credential is added at a time, so forgetting the one expiring soonest is enough to stay within the limit.
+	if store.maxEntries > 0 && len(store.credentials) > store.maxEntries {
+		delete(store.credentials, soonestKey)
+	}
+	if store.changed != nil {
+		select {
+		case store.changed <- struct{}{}:
+		default:
+			// A save is already pending, and it will include this change.
+		}
+	}
+	return nil
+}
+
+func (store *memoryCredentialStore) close() {
+	store.lock.Lock()
+	wasClosed := store.closed
+	store.closed = true
+	store.lock.Unlock()
+	if wasClosed || store.changed == nil {
+		return
+	}
+	close(store.changed)
+	<-store.saved
+}
+
+// mongoCredentialStore keeps the credentials in a MongoDB collection, which sensors can share.
+type mongoCredentialStore struct {
+	cfg *config
+}
+
+func (store mongoCredentialStore) collection() (*mongo.Collection, error) {
+	mongoRecorder := store.cfg.mongoRecorder
+	if mongoRecorder == nil || !mongoRecorder.isConnected {
+		return nil, errors.New("not connected to MongoDB")
+	}
+	return mongoRecorder.client.Database(store.cfg.MongoDBConfig.DB).Collection(store.cfg.MongoDBConfig.CredentialCollect), nil
+}
+
+func (store mongoCredentialStore) find(source, user string) (*rememberedCredential, error) {
+	collection, err := store.collection()
+	if err != nil {
+		return nil, err
+	}
+	credential := &rememberedCredential{}
+	err = collection.FindOne(context.Background(), bson.M{"source": source, "user": user}).Decode(credential)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+func (store mongoCredentialStore) remember(credential rememberedCredential) error {
+	collection, err := store.collection()
+	if err != nil {
+		return err
+	}
+	_, err = collection.ReplaceOne(
+		context.Background(),
+		bson.M{"source": credential.Source, "user": credential.User},
+		credential,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (store mongoCredentialStore) close() {}
+
+// credentialMemory remembers the passwords accepted from source IPs, so that repeat visitors get consistent results.
+type credentialMemory struct {
+	ttl   time.Duration
+	store credentialStore
+}
+
+func (cfg *config) setupCredentialMemory(dataDir string) error {
+	if !cfg.Auth.CredentialMemory.Enabled {
+		return nil
+	}
+	memory := &credentialMemory{ttl: cfg.Auth.CredentialMemory.TTL}
+	switch cfg.Auth.CredentialMemory.Store {
+	case "memory":
+		memory.store, _ = newMemoryCredentialStore("", cfg.Auth.CredentialMemory.MaxEntries)
+	case "file":
+		file := cfg.Auth.CredentialMemory.File
+		if file == "" {
+			file = path.Join(dataDir, "credentials.json")
+		}
+		store, err := newMemoryCredentialStore(file, cfg.Auth.CredentialMemory.MaxEntries)
+		if err != nil {
+			return err
+		}
+		memory.store = store
+	case "mongodb":
+		if !cfg.MongoDBConfig.Enable || cfg.MongoDBConfig.CredentialCollect == "" {
+			return errors.New("storing credentials in MongoDB requires mongodb to be enabled and credential_collect to be set")
+		}
+		memory.store = mongoCredentialStore{cfg}
+	default:
+		return fmt.Errorf("unknown credential store %q", cfg.Auth.CredentialMemory.Store)
+	}
+	cfg.credentialMemory = memory
+	return nil
+}
+
+// recall returns the unexpired credential remembered for a user from a source, or nil if there is none.
+func (memory *credentialMemory) recall(source, user string) *rememberedCredential {
+	credential, err := memory.store.find(source, user)
+	if err != nil {
+		warningLogger.Printf("Failed to look up remembered credential: %v", err)
+		return nil
+	}
+	if credential == nil || time.Now().After(credential.Expires) {
+		return nil
+	}
+	return credential
+}
+
+// close waits for the remembered credentials to be stored.
+func (memory *credentialMemory) close() {
+	memory.store.close()
+}
+
+// remember stores an accepted credential, or extends the time it's remembered for.
+func (memory *credentialMemory) remember(source, user, password, fakeUser string) {
+	if err := memory.store.remember(rememberedCredential{
+		Source:   source,
+		User:     user,
+		Password: password,
+		FakeUser: fakeUser,
+		Expires:  time.Now().Add(memory.ttl),
+	}); err != nil {
+		warningLogger.Printf("Failed to remember credential: %v", err)
+	}
+}
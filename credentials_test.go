@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net"
+	"path"
+	"testing"
+	"time"
+)
+
+type remoteConnContext struct {
+	mockConnContext
+	ip net.IP
+}
+
+func (context remoteConnContext) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: context.ip, Port: 1234}
+}
+
+func TestCredentialMemory(t *testing.T) {
+	credentialsFile := path.Join(t.TempDir(), "credentials.json")
+	newConfig := func() *config {
+		cfg := &config{}
+		cfg.Auth.CredentialMemory = credentialMemoryConfig{Enabled: true, TTL: time.Hour, Store: "file", File: credentialsFile}
+		cfg.Auth.Rules = []authRule{{Password: "123456", Accepted: true, FakeUser: "admin"}, {Password: "hunter?", Accepted: true}}
+		for i := range cfg.Auth.Rules {
+			if err := cfg.Auth.Rules[i].setup(); err != nil {
+				t.Fatalf("Failed to set up rule: %v", err)
+			}
+		}
+		if err := cfg.setupCredentialMemory(""); err != nil {
+			t.Fatalf("Failed to set up credential memory: %v", err)
+		}
+		t.Cleanup(cfg.credentialMemory.close)
+		return cfg
+	}
+	cfg := newConfig()
+	attempt := func(cfg *config, conn remoteConnContext, password string) (bool, string) {
+		permissions, err := cfg.authenticate(authAttempt{conn: conn, password: &password}, false)
+		if err != nil {
+			return false, ""
+		}
+		if permissions == nil {
+			return true, ""
+		}
+		return true, permissions.Extensions[fakeUserExtension]
+	}
+	first := remoteConnContext{ip: net.IPv4(192, 0, 2, 1)}
+	second := remoteConnContext{ip: net.IPv4(192, 0, 2, 2)}
+
+	if accepted, fakeUser := attempt(cfg, first, "qwerty"); accepted {
+		t.Errorf("accepted=%v, want false", accepted)
+	} else if fakeUser != "" {
+		t.Errorf("fakeUser=%v, want none", fakeUser)
+	}
+	if accepted, fakeUser := attempt(cfg, first, "123456"); !accepted || fakeUser != "admin" {
+		t.Errorf("accepted=%v, fakeUser=%v, want true and admin", accepted, fakeUser)
+	}
+	// Once a password is accepted, the rules no longer apply to the user from that IP.
+	if accepted, _ := attempt(cfg, first, "hunter2"); accepted {
+		t.Errorf("accepted=%v, want false", accepted)
+	}
+	if accepted, _ := attempt(cfg, second, "hunter2"); !accepted {
+		t.Errorf("accepted=%v, want true", accepted)
+	}
+
+	// The credentials survive a restart.
+	cfg.credentialMemory.close()
+	cfg = newConfig()
+	if accepted, fakeUser := attempt(cfg, first, "123456"); !accepted || fakeUser != "admin" {
+		t.Errorf("accepted=%v, fakeUser=%v, want true and admin", accepted, fakeUser)
+	}
+	if accepted, _ := attempt(cfg, second, "123456"); accepted {
+		t.Errorf("accepted=%v, want false", accepted)
+	}
+
+	// Expired credentials are forgotten.
+	cfg.credentialMemory.ttl = -time.Second
+	attempt(cfg, first, "123456")
+	if accepted, _ := attempt(cfg, first, "hunter2"); !accepted {
+		t.Errorf("accepted=%v, want true", accepted)
+	}
+}
+
+func TestCredentialMemoryMaxEntries(t *testing.T) {
+	credentialsFile := path.Join(t.TempDir(), "credentials.json")
+	store, err := newMemoryCredentialStore(credentialsFile, 2)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	now := time.Now()
+	for i, user := range []string{"first", "second", "third"} {
+		credential := rememberedCredential{Source: "192.0.2.1", User: user, Password: "123456", Expires: now.Add(time.Duration(i+1) * time.Hour)}
+		if err := store.remember(credential); err != nil {
+			t.Fatalf("Failed to remember credential: %v", err)
+		}
+	}
+	store.close()
+	if err := store.remember(rememberedCredential{Source: "192.0.2.1", User: "fourth", Expires: now.Add(time.Hour)}); err == nil {
+		t.Errorf("err=nil, want an error after closing")
+	}
+
+	store, err = newMemoryCredentialStore(credentialsFile, 2)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.close()
+	for _, user := range []string{"first", "second", "third", "fourth"} {
+		credential, err := store.find("192.0.2.1", user)
+		if err != nil {
+			t.Fatalf("Failed to find credential: %v", err)
+		}
+		if remembered, expected := credential != nil, user == "second" || user == "third"; remembered != expected {
+			t.Errorf("user=%v: remembered=%v, want %v", user, remembered, expected)
+		}
+	}
+}
+
+func TestCredentialMemoryErrors(t *testing.T) {
+	for _, memoryConfig := range []credentialMemoryConfig{
+		{Enabled: true, Store: "redis"},
+		{Enabled: true, Store: "mongodb"},
+	} {
+		cfg := &config{}
+		cfg.Auth.CredentialMemory = memoryConfig
+		if err := cfg.setupCredentialMemory(t.TempDir()); err == nil {
+			t.Errorf("store=%v: err=nil, want an error", memoryConfig.Store)
+		}
+	}
+}
+
+func TestCredentialMemoryMongoDBReload(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	cfgString := "mongodb:\n  enable: true\n  credential_collect: credentials\nauth:\n  credential_memory:\n    enabled: true\n    store: mongodb\nlisteners:\n  - listen_address: 0.0.0.0:22\n"
+	cfg := &config{}
+	if err := cfg.load(cfgString, dataDir); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	mongoRecorder := &MongoRecorder{cfg: cfg}
+	cfg.mongoRecorder = mongoRecorder
+	for _, listenerCfg := range cfg.listeners {
+		listenerCfg.mongoRecorder = mongoRecorder
+	}
+	if err := cfg.load(cfgString, dataDir); err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if cfg.mongoRecorder != mongoRecorder || cfg.listeners[0].mongoRecorder != mongoRecorder {
+		t.Errorf("mongoRecorder=%p and %p, want %p", cfg.mongoRecorder, cfg.listeners[0].mongoRecorder, mongoRecorder)
+	}
+	if store := cfg.credentialMemory.store.(mongoCredentialStore); store.cfg.mongoRecorder != mongoRecorder {
+		t.Errorf("store mongoRecorder=%p, want %p", store.cfg.mongoRecorder, mongoRecorder)
+	}
+}
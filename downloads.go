@@ -0,0 +1,604 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// fetcher retrieves the contents of URLs clients try to download.
+type fetcher interface {
+	fetch(url, userAgent string) ([]byte, error)
+}
+
+// errDownloadTooLarge is returned by fetchers when a response is larger than the maximum download size.
+var errDownloadTooLarge = errors.New("download too large")
+
+// httpStatusError is returned by fetchers when a server responds with an unsuccessful status.
+type httpStatusError struct {
+	code   int
+	status string
+	body   []byte
+}
+
+func (err httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %v", err.status)
+}
+
+// httpFetcher fetches HTTP and HTTPS URLs, other schemes are rejected.
+type httpFetcher struct {
+	client  *http.Client
+	maxSize int64
+}
+
+// newHTTPFetcher creates a fetcher that only connects to addresses allowAddress accepts. They are checked once resolved,
+// for every connection including those of redirects, so that clients can't use host names or redirects to reach
+// internal services.
+func newHTTPFetcher(timeout time.Duration, maxSize int64, allowAddress func(net.IP) bool) httpFetcher {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !allowAddress(ip) {
+				return fmt.Errorf("connecting to %v is not allowed", host)
+			}
+			return nil
+		},
+	}
+	return httpFetcher{&http.Client{
+		Timeout: timeout,
+		// Proxies from the environment aren't used, as they would connect to the checked addresses instead.
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+	}, maxSize}
+}
+
+// internalNetworks are special-purpose networks not covered by the methods of net.IP.
+var internalNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"),
+	mustParseCIDR("240.0.0.0/4"),
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// publicAddress reports whether an address is on the internet, rather than a loopback, private, link-local (such as
+// cloud metadata services) or other internal address.
+func publicAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (fetcher httpFetcher) fetch(rawURL, userAgent string) ([]byte, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", parsedURL.Scheme)
+	}
+	request, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
+	}
+	response, err := fetcher.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var body io.Reader = response.Body
+	if fetcher.maxSize > 0 {
+		// One more byte is read to tell a body of exactly the maximum size from a larger one.
+		body = io.LimitReader(body, fetcher.maxSize+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if fetcher.maxSize > 0 && int64(len(data)) > fetcher.maxSize {
+		return nil, errDownloadTooLarge
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, httpStatusError{response.StatusCode, response.Status, data}
+	}
+	return data, nil
+}
+
+// download logs an attempt to download a URL and fetches it if a fetcher is configured.
+func (context *sessionContext) download(tool, rawURL, output, userAgent string) ([]byte, error) {
+	context.logEvent(downloadAttemptLog{
+		channelLog: channelLog{
+			ChannelID: context.channelID,
+		},
+		Tool:      tool,
+		URL:       rawURL,
+		Output:    output,
+		UserAgent: userAgent,
+	})
+	if context.cfg.fetcher == nil {
+		return nil, errors.New("no fetcher configured")
+	}
+	return context.cfg.fetcher.fetch(rawURL, userAgent)
+}
+
+// saveDownload writes downloaded data to a file of the virtual filesystem and captures it as an artifact.
+func (context *sessionContext) saveDownload(name string, data []byte) error {
+	name = context.resolvePath(name)
+	if err := context.filesystem.WriteFile(name, data, false); err != nil {
+		return err
+	}
+	context.captureFile(name)
+	return nil
+}
+
+// downloadURL parses a URL given to a download tool, defaulting to HTTP like the tools do.
+func downloadURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsedURL.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+	return parsedURL, nil
+}
+
+func urlPort(parsedURL *url.URL) string {
+	if port := parsedURL.Port(); port != "" {
+		return port
+	}
+	switch parsedURL.Scheme {
+	case "https":
+		return "443"
+	case "ftp":
+		return "21"
+	case "tftp":
+		return "69"
+	}
+	return "80"
+}
+
+// remoteFileName returns the name a download tool saves a URL as by default.
+func remoteFileName(parsedURL *url.URL) string {
+	name := path.Base(parsedURL.Path)
+	if name == "/" || name == "." || name == "" {
+		return "index.html"
+	}
+	return name
+}
+
+type cmdWget struct {
+	busybox bool
+}
+
+func (command cmdWget) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	userAgent := "Wget/1.20.3 (linux-gnu)"
+	if command.busybox {
+		userAgent = "Wget"
+	}
+	var urls []string
+	var output, directory string
+	quiet := false
+	args := context.args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		value := func() string {
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		switch {
+		case arg == "-O" || arg == "--output-document":
+			output = value()
+		case strings.HasPrefix(arg, "--output-document="):
+			output = strings.TrimPrefix(arg, "--output-document=")
+		case strings.HasPrefix(arg, "-O"):
+			output = strings.TrimPrefix(arg, "-O")
+		case arg == "-U" || arg == "--user-agent":
+			userAgent = value()
+		case strings.HasPrefix(arg, "--user-agent="):
+			userAgent = strings.TrimPrefix(arg, "--user-agent=")
+		case arg == "-P" || arg == "--directory-prefix":
+			directory = value()
+		case strings.HasPrefix(arg, "--directory-prefix="):
+			directory = strings.TrimPrefix(arg, "--directory-prefix=")
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		case arg == "-T" || arg == "-t" || arg == "--header" || arg == "-Y" || arg == "-o" || arg == "-a":
+			value()
+		case strings.HasPrefix(arg, "-"):
+			if strings.Contains(arg[1:], "q") && !strings.HasPrefix(arg, "--") {
+				quiet = true
+			}
+		default:
+			urls = append(urls, arg)
+		}
+	}
+	if len(urls) == 0 {
+		if command.busybox {
+			_, err := fmt.Fprintf(context.stderr, "BusyBox v1.30.1 (Ubuntu 1:1.30.1-4ubuntu6.4) multi-call binary.\n\nUsage: wget [-c|--continue] [--spider] [-q|--quiet] [-O|--output-document FILE]\n\t[-o|--output-file FILE] [--header 'header: value'] [-Y|--proxy on/off]\n\t[-P DIR] [-S|--server-response] [-U|--user-agent AGENT] [-T SEC] URL...\n\nRetrieve files via HTTP or FTP\n")
+			return 1, err
+		}
+		_, err := fmt.Fprintf(context.stderr, "wget: missing URL\nUsage: wget [OPTION]... [URL]...\n\nTry `wget --help' for more options.\n")
+		return 1, err
+	}
+	progress := context.stderr
+	if quiet {
+		progress = io.Discard
+	}
+	var status uint32
+	for _, rawURL := range urls {
+		parsedURL, err := downloadURL(rawURL)
+		if err != nil {
+			if _, err := fmt.Fprintf(progress, "%v: %v: Invalid host name.\n", context.args[0], rawURL); err != nil {
+				return 0, err
+			}
+			status = 1
+			continue
+		}
+		file := output
+		if file == "" {
+			file = path.Join(directory, remoteFileName(parsedURL))
+		}
+		host, port := parsedURL.Hostname(), urlPort(parsedURL)
+		if !command.busybox {
+			if _, err := fmt.Fprintf(progress, "--%v--  %v\n", time.Now().Format("2006-01-02 15:04:05"), parsedURL); err != nil {
+				return 0, err
+			}
+		}
+		data, err := ctx.download(context.args[0], parsedURL.String(), file, userAgent)
+		if err != nil {
+			var statusErr httpStatusError
+			switch {
+			case errors.As(err, &statusErr):
+				if command.busybox {
+					_, err = fmt.Fprintf(progress, "Connecting to %v (%v)\nwget: server returned error: HTTP/1.1 %v\n", parsedURL.Host, net.JoinHostPort(host, port), statusErr.status)
+				} else {
+					_, err = fmt.Fprintf(progress, "Connecting to %v|%v|:%v... connected.\nHTTP request sent, awaiting response... %v\n%v ERROR %v.\n\n", host, host, port, statusErr.status, time.Now().Format("2006-01-02 15:04:05"), statusErr.status)
+				}
+				status = 8
+			case net.ParseIP(host) != nil:
+				if command.busybox {
+					_, err = fmt.Fprintf(progress, "Connecting to %v (%v)\nwget: can't connect to remote host (%v): Connection refused\n", parsedURL.Host, net.JoinHostPort(host, port), host)
+					status = 1
+				} else {
+					_, err = fmt.Fprintf(progress, "Connecting to %v:%v... failed: Connection refused.\n", host, port)
+					status = 4
+				}
+			default:
+				if command.busybox {
+					_, err = fmt.Fprintf(progress, "wget: bad address '%v'\n", parsedURL.Host)
+					status = 1
+				} else {
+					_, err = fmt.Fprintf(progress, "Resolving %v (%v)... failed: Temporary failure in name resolution.\nwget: unable to resolve host address ‘%v’\n", host, host, host)
+					status = 4
+				}
+			}
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if command.busybox {
+			if _, err := fmt.Fprintf(progress, "Connecting to %v (%v)\nsaving to '%v'\n%-20v 100%% |********************************| %7v  0:00:00 ETA\n'%v' saved\n", parsedURL.Host, net.JoinHostPort(host, port), file, path.Base(file), len(data), file); err != nil {
+				return 0, err
+			}
+		} else if _, err := fmt.Fprintf(progress, "Connecting to %v|%v|:%v... connected.\nHTTP request sent, awaiting response... 200 OK\nLength: %v [application/octet-stream]\nSaving to: ‘%v’\n\n%-20v 100%%[===================>] %7v  --.-KB/s    in 0s\n\n%v (%.1f MB/s) - ‘%v’ saved [%v/%v]\n\n", host, host, port, len(data), file, path.Base(file), len(data), time.Now().Format("2006-01-02 15:04:05"), float64(len(data))/1e6*100, file, len(data), len(data)); err != nil {
+			return 0, err
+		}
+		if file == "-" {
+			if _, err := context.stdout.Write(data); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := ctx.saveDownload(file, data); err != nil {
+			if _, err := fmt.Fprintf(context.stderr, "%v: %v: %v\n", context.args[0], file, err); err != nil {
+				return 0, err
+			}
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+type cmdCurl struct{}
+
+func (cmdCurl) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	userAgent := "curl/7.68.0"
+	var urls []string
+	var output string
+	remoteName, silent, showError, fail := false, false, false, false
+	args := context.args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		value := func() string {
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		switch {
+		case arg == "-o" || arg == "--output":
+			output = value()
+		case arg == "-A" || arg == "--user-agent":
+			userAgent = value()
+		case arg == "-O" || arg == "--remote-name":
+			remoteName = true
+		case arg == "-s" || arg == "--silent":
+			silent = true
+		case arg == "-S" || arg == "--show-error":
+			showError = true
+		case arg == "-f" || arg == "--fail":
+			fail = true
+		case arg == "-H" || arg == "--header" || arg == "-d" || arg == "--data" || arg == "-X" || arg == "--request" || arg == "-m" || arg == "--max-time" || arg == "--connect-timeout" || arg == "-e" || arg == "-u" || arg == "-x":
+			value()
+		case strings.HasPrefix(arg, "--"):
+		case strings.HasPrefix(arg, "-"):
+			// Combined short options, like -fsSLo file.
+			for j, flag := range arg[1:] {
+				switch flag {
+				case 's':
+					silent = true
+				case 'S':
+					showError = true
+				case 'f':
+					fail = true
+				case 'O':
+					remoteName = true
+				case 'o', 'A':
+					optionValue := arg[2+j:]
+					if optionValue == "" {
+						optionValue = value()
+					}
+					if flag == 'o' {
+						output = optionValue
+					} else {
+						userAgent = optionValue
+					}
+				}
+				if flag == 'o' || flag == 'A' {
+					break
+				}
+			}
+		default:
+			urls = append(urls, arg)
+		}
+	}
+	if len(urls) == 0 {
+		_, err := fmt.Fprintf(context.stderr, "curl: try 'curl --help' or 'curl --manual' for more information\n")
+		return 2, err
+	}
+	errorOutput := context.stderr
+	if silent && !showError {
+		errorOutput = io.Discard
+	}
+	var status uint32
+	for _, rawURL := range urls {
+		parsedURL, err := downloadURL(rawURL)
+		if err != nil {
+			if _, err := fmt.Fprintf(errorOutput, "curl: (3) URL using bad/illegal format or missing URL\n"); err != nil {
+				return 0, err
+			}
+			status = 3
+			continue
+		}
+		file := output
+		if remoteName {
+			file = remoteFileName(parsedURL)
+		}
+		if file == "" {
+			file = "-"
+		}
+		data, err := ctx.download(context.args[0], parsedURL.String(), file, userAgent)
+		var statusErr httpStatusError
+		if errors.As(err, &statusErr) && !fail {
+			data, err = statusErr.body, nil
+		}
+		if err != nil {
+			host, port := parsedURL.Hostname(), urlPort(parsedURL)
+			switch {
+			case errors.As(err, &statusErr):
+				_, err = fmt.Fprintf(errorOutput, "curl: (22) The requested URL returned error: %v\n", statusErr.code)
+				status = 22
+			case net.ParseIP(host) != nil:
+				_, err = fmt.Fprintf(errorOutput, "curl: (7) Failed to connect to %v port %v: Connection refused\n", host, port)
+				status = 7
+			default:
+				_, err = fmt.Fprintf(errorOutput, "curl: (6) Could not resolve host: %v\n", host)
+				status = 6
+			}
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if file == "-" {
+			if _, err := context.stdout.Write(data); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if !silent {
+			if _, err := fmt.Fprintf(context.stderr, "  %% Total    %% Received %% Xferd  Average Speed   Time    Time     Time  Current\n                                 Dload  Upload   Total   Spent    Left  Speed\n100 %5v  100 %5v    0     0   %5v      0 --:--:-- --:--:-- --:--:-- %5v\n", len(data), len(data), len(data), len(data)); err != nil {
+				return 0, err
+			}
+		}
+		if err := ctx.saveDownload(file, data); err != nil {
+			if _, err := fmt.Fprintf(errorOutput, "curl: (23) Failure writing output to destination\n"); err != nil {
+				return 0, err
+			}
+			status = 23
+		}
+	}
+	return status, nil
+}
+
+type cmdTftp struct{}
+
+func (cmdTftp) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	var remoteFile, localFile, host, port string
+	get := false
+	args := context.args[1:]
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-g":
+			get = true
+		case arg == "-p":
+			get = false
+		case (arg == "-r" || arg == "-l" || arg == "-b") && i+1 < len(args):
+			i++
+			if arg == "-r" {
+				remoteFile = args[i]
+			} else if arg == "-l" {
+				localFile = args[i]
+			}
+		case host == "":
+			host = arg
+		default:
+			port = arg
+		}
+	}
+	if host == "" || (remoteFile == "" && localFile == "") {
+		_, err := fmt.Fprintf(context.stderr, "BusyBox v1.30.1 (Ubuntu 1:1.30.1-4ubuntu6.4) multi-call binary.\n\nUsage: tftp [OPTIONS] HOST [PORT]\n\nTransfer a file from/to tftp server\n\n\t-l FILE\tLocal FILE\n\t-r FILE\tRemote FILE\n\t-g\tGet file\n\t-p\tPut file\n\t-b SIZE\tTransfer blocks of SIZE octets\n")
+		return 1, err
+	}
+	if remoteFile == "" {
+		remoteFile = path.Base(localFile)
+	}
+	if localFile == "" {
+		localFile = path.Base(remoteFile)
+	}
+	if port == "" {
+		port = "69"
+	}
+	if !get {
+		_, err := fmt.Fprintf(context.stderr, "tftp: timeout\n")
+		return 1, err
+	}
+	return fetchRemoteFile(context, ctx, fmt.Sprintf("tftp://%v/%v", net.JoinHostPort(host, port), strings.TrimPrefix(remoteFile, "/")), host, localFile, "tftp: timeout")
+}
+
+type cmdFtpget struct{}
+
+func (cmdFtpget) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	var operands []string
+	user, password, port := "anonymous", "", "21"
+	args := context.args[1:]
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case (arg == "-u" || arg == "-p" || arg == "-P") && i+1 < len(args):
+			i++
+			switch arg {
+			case "-u":
+				user = args[i]
+			case "-p":
+				password = args[i]
+			case "-P":
+				port = args[i]
+			}
+		case arg == "-v" || arg == "-c":
+		default:
+			operands = append(operands, arg)
+		}
+	}
+	if len(operands) < 2 {
+		_, err := fmt.Fprintf(context.stderr, "BusyBox v1.30.1 (Ubuntu 1:1.30.1-4ubuntu6.4) multi-call binary.\n\nUsage: ftpget [OPTIONS] HOST [LOCAL_FILE] REMOTE_FILE\n\nDownload a file via FTP\n\n\t-c\tContinue previous transfer\n\t-v\tVerbose\n\t-u USER\tUsername\n\t-p PASS\tPassword\n\t-P PORT\n")
+		return 1, err
+	}
+	host, localFile, remoteFile := operands[0], operands[1], operands[len(operands)-1]
+	if len(operands) == 2 {
+		localFile = path.Base(remoteFile)
+	}
+	credentials := url.User(user)
+	if password != "" {
+		credentials = url.UserPassword(user, password)
+	}
+	ftpURL := url.URL{Scheme: "ftp", User: credentials, Host: net.JoinHostPort(host, port), Path: "/" + strings.TrimPrefix(remoteFile, "/")}
+	return fetchRemoteFile(context, ctx, ftpURL.String(), host, localFile, fmt.Sprintf("ftpget: can't connect to remote host (%v): Connection refused", host))
+}
+
+// fetchRemoteFile implements the BusyBox tftp and ftpget commands, which don't print any progress.
+func fetchRemoteFile(context commandContext, ctx *sessionContext, rawURL, host, localFile, connectionError string) (uint32, error) {
+	data, err := ctx.download(context.args[0], rawURL, localFile, "")
+	if err != nil {
+		message := connectionError
+		if net.ParseIP(host) == nil {
+			message = fmt.Sprintf("%v: bad address '%v'", context.args[0], host)
+		}
+		_, err := fmt.Fprintln(context.stderr, message)
+		return 1, err
+	}
+	if localFile == "-" {
+		_, err := context.stdout.Write(data)
+		return 0, err
+	}
+	if err := ctx.saveDownload(localFile, data); err != nil {
+		_, err := fmt.Fprintf(context.stderr, "%v: can't open '%v': %v\n", context.args[0], localFile, err)
+		return 1, err
+	}
+	return 0, nil
+}
+
+// busyboxApplets are the commands available through busybox, with their own flavor of output where it differs.
+var busyboxApplets = map[string]command{
+	"wget":   cmdWget{busybox: true},
+	"tftp":   cmdTftp{},
+	"ftpget": cmdFtpget{},
+}
+
+type cmdBusybox struct{}
+
+func (cmdBusybox) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	if len(context.args) < 2 {
+		_, err := fmt.Fprintf(context.stdout, "BusyBox v1.30.1 (Ubuntu 1:1.30.1-4ubuntu6.4) multi-call binary.\nBusyBox is copyrighted by many authors between 1998-2015.\nLicensed under GPLv2. See source distribution for detailed\ncopyright notices.\n\nUsage: busybox [function [arguments]...]\n   or: busybox --list[-full]\n   or: busybox --show SCRIPT\n   or: busybox --install [-s] [DIR]\n   or: function [arguments]...\n")
+		return 0, err
+	}
+	applet, ok := busyboxApplets[context.args[1]]
+	if !ok {
+		applet = ctx.cfg.command(context.args[1])
+	}
+	if applet == nil || shellBuiltins[context.args[1]] {
+		_, err := fmt.Fprintf(context.stderr, "%v: applet not found\n", context.args[1])
+		return 127, err
+	}
+	context.args = context.args[1:]
+	return applet.execute(context, ctx)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math/rand"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+var shellVariableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func homeDirectory(user string) string {
+	if user == "root" {
+		return "/root"
+	}
+	return fmt.Sprintf("/home/%v", user)
+}
+
+// defaultEnvironment returns the environment a login shell of the user starts with,
+// before the variables sent by the client are applied.
+func defaultEnvironment(user string) map[string]string {
+	return map[string]string{
+		"HOME":    homeDirectory(user),
+		"LOGNAME": user,
+		"USER":    user,
+		"PATH":    defaultPath,
+		"SHELL":   "/bin/bash",
+		"PWD":     homeDirectory(user),
+	}
+}
+
+// fakePID returns a plausible process ID for a shell.
+func fakePID() int {
+	return 1000 + rand.Intn(30000)
+}
+
+// lookupVariable returns the value of a shell or environment variable.
+func (context *sessionContext) lookupVariable(name string) (string, bool) {
+	if value, ok := context.vars[name]; ok {
+		return value, true
+	}
+	value, ok := context.env[name]
+	return value, ok
+}
+
+// setVariable sets a variable, keeping it in the environment if it is already exported.
+func (context *sessionContext) setVariable(name, value string) {
+	if _, exported := context.env[name]; exported {
+		context.env[name] = value
+		return
+	}
+	context.vars[name] = value
+}
+
+func (context *sessionContext) exportVariable(name, value string) {
+	delete(context.vars, name)
+	context.env[name] = value
+}
+
+func (context *sessionContext) unsetVariable(name string) {
+	delete(context.vars, name)
+	delete(context.env, name)
+}
+
+// saveShellState returns a function restoring the variables and the working directory to their current state,
+// so that changes made in subshells don't leak to the parent shell.
+func (context *sessionContext) saveShellState() func() {
+	env := maps.Clone(context.env)
+	vars := maps.Clone(context.vars)
+	virtualPath := context.virtualPath
+	return func() {
+		context.env = env
+		context.vars = vars
+		context.virtualPath = virtualPath
+	}
+}
+
+// shellQuote quotes a value the way set and export print it.
+func shellQuote(value string) string {
+	return fmt.Sprintf("'%v'", strings.ReplaceAll(value, "'", `'\''`))
+}
+
+func sortedVariableNames(variables ...map[string]string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, vars := range variables {
+		for name := range vars {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolvePath turns a path relative to the working directory into a clean absolute path.
+func (context *sessionContext) resolvePath(name string) string {
+	if !path.IsAbs(name) {
+		name = path.Join(context.virtualPath, name)
+	}
+	return path.Clean(name)
+}
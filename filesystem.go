@@ -0,0 +1,872 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errNoSuchFile   = errors.New("No such file or directory")
+	errNotDir       = errors.New("Not a directory")
+	errIsDir        = errors.New("Is a directory")
+	errExists       = errors.New("File exists")
+	errNotEmpty     = errors.New("Directory not empty")
+	errTooManyLinks = errors.New("Too many levels of symbolic links")
+	errInvalidMove  = errors.New("Invalid argument")
+	errNoSpace      = errors.New("No space left on device")
+)
+
+const maxSymlinkDepth = 40
+
+// maxUploadSize limits the size of files uploaded with SFTP and SCP even if the size of the filesystem isn't limited.
+const maxUploadSize = 1 << 30
+
+// fsNode is a file, directory, symbolic link or device in a virtual filesystem.
+// Nodes are shared between filesystems until they are modified, see virtualFS.mutable.
+type fsNode struct {
+	mode     os.FileMode
+	data     []byte
+	target   string
+	children map[string]*fsNode
+	modTime  time.Time
+	owner    string
+	group    string
+	// generation is the generation of the filesystem owning the node, 0 for nodes of a template.
+	generation uint64
+}
+
+func (node *fsNode) isDir() bool {
+	return node.mode.IsDir()
+}
+
+func (node *fsNode) isSymlink() bool {
+	return node.mode&os.ModeSymlink != 0
+}
+
+func (node *fsNode) isDevice() bool {
+	return node.mode&os.ModeDevice != 0
+}
+
+// fsInfo describes a node of a virtual filesystem.
+type fsInfo struct {
+	name    string
+	mode    os.FileMode
+	size    int64
+	nlink   int
+	modTime time.Time
+	owner   string
+	group   string
+	target  string
+}
+
+func (node *fsNode) info(name string) fsInfo {
+	info := fsInfo{
+		name:    name,
+		mode:    node.mode,
+		size:    int64(len(node.data)),
+		nlink:   1,
+		modTime: node.modTime,
+		owner:   node.owner,
+		group:   node.group,
+		target:  node.target,
+	}
+	switch {
+	case node.isDir():
+		info.size = 4096
+		info.nlink = 2
+		for _, child := range node.children {
+			if child.isDir() {
+				info.nlink++
+			}
+		}
+	case node.isSymlink():
+		info.size = int64(len(node.target))
+	}
+	return info
+}
+
+var fsGenerations atomic.Uint64
+
+// virtualFS is a copy-on-write overlay of a filesystem template.
+// Every connection gets its own, so changes made by the client stay visible to it, and only to it.
+type virtualFS struct {
+	lock       sync.Mutex
+	root       *fsNode
+	generation uint64
+	user       string
+	// maxSize and maxFiles limit the bytes and files clients can add on top of the template, 0 meaning no limit.
+	maxSize  int64
+	maxFiles int64
+	size     int64
+	files    int64
+}
+
+func newVirtualFS(template *fsNode, user string) *virtualFS {
+	if template == nil {
+		template = defaultFilesystemTemplate()
+	}
+	filesystem := &virtualFS{
+		root:       template,
+		generation: fsGenerations.Add(1),
+		user:       user,
+	}
+	home := homeDirectory(user)
+	if _, node, err := filesystem.walk(home, true); err == nil && node == nil {
+		if err := filesystem.mkdirAll(home, 0755); err != nil {
+			warningLogger.Printf("Failed to create home directory: %v", err)
+		}
+	}
+	return filesystem
+}
+
+// treeUsage returns the bytes of data and the number of nodes in a tree.
+func treeUsage(node *fsNode) (int64, int64) {
+	size, files := int64(len(node.data)), int64(1)
+	for _, child := range node.children {
+		childSize, childFiles := treeUsage(child)
+		size += childSize
+		files += childFiles
+	}
+	return size, files
+}
+
+// reserve accounts for bytes and files being added, or removed if negative, failing if that exceeds a limit.
+func (filesystem *virtualFS) reserve(size, files int64) error {
+	if (size > 0 && filesystem.maxSize > 0 && filesystem.size+size > filesystem.maxSize) ||
+		(files > 0 && filesystem.maxFiles > 0 && filesystem.files+files > filesystem.maxFiles) {
+		return errNoSpace
+	}
+	filesystem.size += size
+	filesystem.files += files
+	return nil
+}
+
+// Allocate accounts for data kept outside of the filesystem until it's written, such as files being uploaded, or
+// releases it if size is negative.
+func (filesystem *virtualFS) Allocate(size int64) error {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	return filesystem.reserve(size, 0)
+}
+
+// FreeSpace returns how many more bytes clients can write, or -1 if there is no limit.
+func (filesystem *virtualFS) FreeSpace() int64 {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	if filesystem.maxSize <= 0 {
+		return -1
+	}
+	return max(filesystem.maxSize-filesystem.size, 0)
+}
+
+func pathComponents(name string) []string {
+	var components []string
+	for _, component := range strings.Split(name, "/") {
+		if component != "" {
+			components = append(components, component)
+		}
+	}
+	return components
+}
+
+// walk resolves an absolute path to its canonical form and its node.
+// Symbolic links are followed in every component, and in the last one only if follow is set.
+// If only the last component is missing, the node is nil and no error is returned.
+func (filesystem *virtualFS) walk(name string, follow bool) (string, *fsNode, error) {
+	return filesystem.walkDepth(path.Clean(name), follow, 0)
+}
+
+func (filesystem *virtualFS) walkDepth(name string, follow bool, depth int) (string, *fsNode, error) {
+	current := "/"
+	node := filesystem.root
+	components := pathComponents(name)
+	for i, component := range components {
+		last := i == len(components)-1
+		if !node.isDir() {
+			return "", nil, errNotDir
+		}
+		child := node.children[component]
+		if child == nil {
+			if last {
+				return path.Join(current, component), nil, nil
+			}
+			return "", nil, errNoSuchFile
+		}
+		if child.isSymlink() && (!last || follow) {
+			if depth >= maxSymlinkDepth {
+				return "", nil, errTooManyLinks
+			}
+			target := child.target
+			if !path.IsAbs(target) {
+				target = path.Join(current, target)
+			}
+			resolved, resolvedNode, err := filesystem.walkDepth(target, true, depth+1)
+			if err != nil {
+				return "", nil, err
+			}
+			if resolvedNode == nil {
+				if last {
+					return resolved, nil, nil
+				}
+				return "", nil, errNoSuchFile
+			}
+			current, node = resolved, resolvedNode
+			continue
+		}
+		current, node = path.Join(current, component), child
+	}
+	return current, node, nil
+}
+
+func (filesystem *virtualFS) lookup(name string, follow bool) (string, *fsNode, error) {
+	canonical, node, err := filesystem.walk(name, follow)
+	if err != nil {
+		return "", nil, err
+	}
+	if node == nil {
+		return "", nil, errNoSuchFile
+	}
+	return canonical, node, nil
+}
+
+// mutable returns a copy of a node owned by the filesystem, which can be modified in place.
+func (filesystem *virtualFS) mutable(node *fsNode) *fsNode {
+	if node.generation == filesystem.generation {
+		return node
+	}
+	clone := *node
+	clone.generation = filesystem.generation
+	clone.data = clone.data[:len(clone.data):len(clone.data)]
+	if clone.children != nil {
+		clone.children = maps.Clone(clone.children)
+	}
+	return &clone
+}
+
+// mutableDir copies every directory on a canonical path, making the last one modifiable.
+func (filesystem *virtualFS) mutableDir(name string) *fsNode {
+	filesystem.root = filesystem.mutable(filesystem.root)
+	node := filesystem.root
+	for _, component := range pathComponents(name) {
+		child := filesystem.mutable(node.children[component])
+		node.children[component] = child
+		node = child
+	}
+	return node
+}
+
+func (filesystem *virtualFS) newNode(mode os.FileMode) *fsNode {
+	node := &fsNode{
+		mode:       mode,
+		modTime:    time.Now(),
+		owner:      filesystem.user,
+		group:      filesystem.user,
+		generation: filesystem.generation,
+	}
+	if mode.IsDir() {
+		node.children = map[string]*fsNode{}
+	}
+	return node
+}
+
+// parentDir resolves the directory a new entry would be created in.
+func (filesystem *virtualFS) parentDir(canonical string) (string, error) {
+	dir := path.Dir(canonical)
+	_, node, err := filesystem.lookup(dir, true)
+	if err != nil {
+		return "", err
+	}
+	if !node.isDir() {
+		return "", errNotDir
+	}
+	return dir, nil
+}
+
+func (filesystem *virtualFS) Stat(name string) (fsInfo, error) {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	canonical, node, err := filesystem.lookup(name, true)
+	if err != nil {
+		return fsInfo{}, err
+	}
+	return node.info(path.Base(canonical)), nil
+}
+
+func (filesystem *virtualFS) Lstat(name string) (fsInfo, error) {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	_, node, err := filesystem.lookup(name, false)
+	if err != nil {
+		return fsInfo{}, err
+	}
+	return node.info(path.Base(name)), nil
+}
+
+func (filesystem *virtualFS) ReadFile(name string) ([]byte, error) {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	_, node, err := filesystem.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.isDir() {
+		return nil, errIsDir
+	}
+	return node.data[:len(node.data):len(node.data)], nil
+}
+
+func (filesystem *virtualFS) ReadDir(name string) ([]fsInfo, error) {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	_, node, err := filesystem.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.isDir() {
+		return nil, errNotDir
+	}
+	entries := make([]fsInfo, 0, len(node.children))
+	for childName, child := range node.children {
+		entries = append(entries, child.info(childName))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortableFileName(entries[i].name) < sortableFileName(entries[j].name)
+	})
+	return entries, nil
+}
+
+// sortableFileName approximates the collation ls uses, which ignores case and leading dots.
+func sortableFileName(name string) string {
+	return strings.ToLower(strings.TrimLeft(name, "."))
+}
+
+// WriteFile creates or truncates a file, or appends to it.
+func (filesystem *virtualFS) WriteFile(name string, data []byte, appendMode bool) error {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	canonical, node, err := filesystem.walk(name, true)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		if node.isDir() {
+			return errIsDir
+		}
+		if node.isDevice() {
+			return nil
+		}
+	}
+	dir, err := filesystem.parentDir(canonical)
+	if err != nil {
+		return err
+	}
+	size, files := int64(len(data)), int64(0)
+	if node == nil {
+		files = 1
+	} else if !appendMode {
+		size -= int64(len(node.data))
+	}
+	if err := filesystem.reserve(size, files); err != nil {
+		return err
+	}
+	parent := filesystem.mutableDir(dir)
+	if node == nil {
+		node = filesystem.newNode(0644)
+	} else {
+		node = filesystem.mutable(node)
+		node.modTime = time.Now()
+	}
+	if appendMode {
+		node.data = append(node.data, data...)
+	} else {
+		node.data = append([]byte(nil), data...)
+	}
+	parent.children[path.Base(canonical)] = node
+	return nil
+}
+
+func (filesystem *virtualFS) Touch(name string) error {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	canonical, node, err := filesystem.walk(name, true)
+	if err != nil {
+		return err
+	}
+	dir, err := filesystem.parentDir(canonical)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		if err := filesystem.reserve(0, 1); err != nil {
+			return err
+		}
+	}
+	parent := filesystem.mutableDir(dir)
+	if node == nil {
+		node = filesystem.newNode(0644)
+	} else {
+		node = filesystem.mutable(node)
+		node.modTime = time.Now()
+	}
+	parent.children[path.Base(canonical)] = node
+	return nil
+}
+
+func (filesystem *virtualFS) Mkdir(name string, parents bool) error {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	if parents {
+		return filesystem.mkdirAll(name, 0755)
+	}
+	canonical, node, err := filesystem.walk(name, false)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		return errExists
+	}
+	dir, err := filesystem.parentDir(canonical)
+	if err != nil {
+		return err
+	}
+	if err := filesystem.reserve(0, 1); err != nil {
+		return err
+	}
+	filesystem.mutableDir(dir).children[path.Base(canonical)] = filesystem.newNode(os.ModeDir | 0755)
+	return nil
+}
+
+func (filesystem *virtualFS) mkdirAll(name string, mode os.FileMode) error {
+	current := "/"
+	for _, component := range pathComponents(path.Clean(name)) {
+		canonical, node, err := filesystem.walk(path.Join(current, component), true)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			if err := filesystem.reserve(0, 1); err != nil {
+				return err
+			}
+			filesystem.mutableDir(path.Dir(canonical)).children[path.Base(canonical)] = filesystem.newNode(os.ModeDir | mode)
+		} else if !node.isDir() {
+			return errNotDir
+		}
+		current = canonical
+	}
+	return nil
+}
+
+// Remove removes a file, or a directory if recursive is set or if dir is set and the directory is empty.
+func (filesystem *virtualFS) Remove(name string, recursive, dir bool) error {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	canonical, node, err := filesystem.lookup(name, false)
+	if err != nil {
+		return err
+	}
+	if canonical == "/" {
+		return errIsDir
+	}
+	if node.isDir() && !recursive {
+		if !dir {
+			return errIsDir
+		}
+		if len(node.children) > 0 {
+			return errNotEmpty
+		}
+	}
+	if !node.isDir() && dir && !recursive {
+		return errNotDir
+	}
+	size, files := treeUsage(node)
+	filesystem.reserve(-size, -files)
+	delete(filesystem.mutableDir(path.Dir(canonical)).children, path.Base(canonical))
+	return nil
+}
+
+// Rename moves a node, replacing the destination if it is not a directory.
+func (filesystem *virtualFS) Rename(oldName, newName string) error {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	oldCanonical, node, err := filesystem.lookup(oldName, false)
+	if err != nil {
+		return err
+	}
+	newCanonical, existing, err := filesystem.walk(newName, false)
+	if err != nil {
+		return err
+	}
+	if oldCanonical == "/" || newCanonical == oldCanonical || strings.HasPrefix(newCanonical, oldCanonical+"/") {
+		return errInvalidMove
+	}
+	if existing != nil && existing.isDir() {
+		if !node.isDir() {
+			return errIsDir
+		}
+		if len(existing.children) > 0 {
+			return errNotEmpty
+		}
+	}
+	newDir, err := filesystem.parentDir(newCanonical)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		size, files := treeUsage(existing)
+		filesystem.reserve(-size, -files)
+	}
+	delete(filesystem.mutableDir(path.Dir(oldCanonical)).children, path.Base(oldCanonical))
+	filesystem.mutableDir(newDir).children[path.Base(newCanonical)] = node
+	return nil
+}
+
+// Copy copies a file, or a directory tree if recursive is set.
+func (filesystem *virtualFS) Copy(oldName, newName string, recursive bool) error {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	_, node, err := filesystem.lookup(oldName, true)
+	if err != nil {
+		return err
+	}
+	if node.isDir() && !recursive {
+		return errIsDir
+	}
+	newCanonical, existing, err := filesystem.walk(newName, true)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.isDir() {
+		return errIsDir
+	}
+	newDir, err := filesystem.parentDir(newCanonical)
+	if err != nil {
+		return err
+	}
+	size, files := treeUsage(node)
+	if existing != nil {
+		size -= int64(len(existing.data))
+		files--
+	}
+	if err := filesystem.reserve(size, files); err != nil {
+		return err
+	}
+	filesystem.mutableDir(newDir).children[path.Base(newCanonical)] = filesystem.copyTree(node)
+	return nil
+}
+
+// copyTree copies the nodes of a tree, which share their data with the original until either is written to.
+func (filesystem *virtualFS) copyTree(node *fsNode) *fsNode {
+	clone := filesystem.newNode(node.mode)
+	clone.data = node.data[:len(node.data):len(node.data)]
+	clone.target = node.target
+	for name, child := range node.children {
+		clone.children[name] = filesystem.copyTree(child)
+	}
+	return clone
+}
+
+func (filesystem *virtualFS) Chmod(name string, mode os.FileMode) error {
+	filesystem.lock.Lock()
+	defer filesystem.lock.Unlock()
+	canonical, node, err := filesystem.lookup(name, true)
+	if err != nil {
+		return err
+	}
+	if canonical == "/" {
+		filesystem.root = filesystem.mutable(filesystem.root)
+		filesystem.root.mode = filesystem.root.mode&^os.ModePerm | mode&os.ModePerm
+		return nil
+	}
+	node = filesystem.mutable(node)
+	node.mode = node.mode&^(os.ModePerm|os.ModeSticky|os.ModeSetuid|os.ModeSetgid) | mode&(os.ModePerm|os.ModeSticky|os.ModeSetuid|os.ModeSetgid)
+	filesystem.mutableDir(path.Dir(canonical)).children[path.Base(canonical)] = node
+	return nil
+}
+
+// fileModeString formats a file mode the way ls -l does.
+func fileModeString(mode os.FileMode) string {
+	result := []byte("----------")
+	switch {
+	case mode.IsDir():
+		result[0] = 'd'
+	case mode&os.ModeSymlink != 0:
+		result[0] = 'l'
+	case mode&os.ModeCharDevice != 0:
+		result[0] = 'c'
+	case mode&os.ModeDevice != 0:
+		result[0] = 'b'
+	}
+	for i, c := range "rwxrwxrwx" {
+		if mode&(1<<uint(8-i)) != 0 {
+			result[i+1] = byte(c)
+		}
+	}
+	special := func(index int, set bool, executable, notExecutable byte) {
+		if !set {
+			return
+		}
+		if result[index] == 'x' {
+			result[index] = executable
+		} else {
+			result[index] = notExecutable
+		}
+	}
+	special(3, mode&os.ModeSetuid != 0, 's', 'S')
+	special(6, mode&os.ModeSetgid != 0, 's', 'S')
+	special(9, mode&os.ModeSticky != 0, 't', 'T')
+	return string(result)
+}
+
+// templateBuilder builds a filesystem template, which is never modified afterwards.
+type templateBuilder struct {
+	root *fsNode
+}
+
+func newTemplateBuilder() *templateBuilder {
+	return &templateBuilder{&fsNode{mode: os.ModeDir | 0755, children: map[string]*fsNode{}, owner: "root", group: "root", modTime: time.Now()}}
+}
+
+func (builder *templateBuilder) add(name string, node *fsNode) {
+	components := pathComponents(path.Clean("/" + name))
+	if len(components) == 0 {
+		if node.isDir() {
+			builder.root.mode, builder.root.modTime = node.mode, node.modTime
+		}
+		return
+	}
+	dir := builder.root
+	for _, component := range components[:len(components)-1] {
+		child := dir.children[component]
+		if child == nil || !child.isDir() {
+			child = &fsNode{mode: os.ModeDir | 0755, children: map[string]*fsNode{}, owner: "root", group: "root", modTime: node.modTime}
+			dir.children[component] = child
+		}
+		dir = child
+	}
+	if existing := dir.children[components[len(components)-1]]; existing != nil && existing.isDir() && node.isDir() {
+		existing.mode, existing.modTime, existing.owner, existing.group = node.mode, node.modTime, node.owner, node.group
+		return
+	}
+	if node.isDir() && node.children == nil {
+		node.children = map[string]*fsNode{}
+	}
+	dir.children[components[len(components)-1]] = node
+}
+
+func (builder *templateBuilder) addDir(name string, mode os.FileMode) {
+	builder.add(name, &fsNode{mode: os.ModeDir | mode, owner: "root", group: "root", modTime: bootTime})
+}
+
+func (builder *templateBuilder) addFile(name string, mode os.FileMode, data []byte) {
+	builder.add(name, &fsNode{mode: mode, data: data, owner: "root", group: "root", modTime: bootTime})
+}
+
+func (builder *templateBuilder) addSymlink(name, target string) {
+	builder.add(name, &fsNode{mode: os.ModeSymlink | 0777, target: target, owner: "root", group: "root", modTime: bootTime})
+}
+
+// addDirectory adds the contents of a directory on the host.
+func (builder *templateBuilder) addDirectory(root string) error {
+	return filepath.WalkDir(root, func(hostPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(root, hostPath)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		node := &fsNode{mode: info.Mode(), modTime: info.ModTime(), owner: "root", group: "root"}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if node.target, err = os.Readlink(hostPath); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if node.data, err = os.ReadFile(hostPath); err != nil {
+				return err
+			}
+		case !info.IsDir():
+			return nil
+		}
+		builder.add(filepath.ToSlash(relative), node)
+		return nil
+	})
+}
+
+// addTarball adds the contents of a tar archive, which may be gzip-compressed.
+func (builder *templateBuilder) addTarball(file string) error {
+	archive, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	var reader io.Reader = archive
+	if strings.HasSuffix(file, ".gz") || strings.HasSuffix(file, ".tgz") {
+		gzipReader, err := gzip.NewReader(archive)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		node := &fsNode{mode: header.FileInfo().Mode(), modTime: header.ModTime, owner: header.Uname, group: header.Gname}
+		if node.owner == "" {
+			node.owner = fmt.Sprint(header.Uid)
+		}
+		if node.group == "" {
+			node.group = fmt.Sprint(header.Gid)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+		case tar.TypeSymlink:
+			node.target = header.Linkname
+		case tar.TypeReg:
+			if node.data, err = io.ReadAll(tarReader); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		builder.add(header.Name, node)
+	}
+}
+
+// addFunnyFiles adds the files served by cat in older versions, stored with slashes replaced by underscores.
+func (builder *templateBuilder) addFunnyFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		builder.addFile(strings.ReplaceAll(entry.Name(), "_", "/"), 0644, data)
+	}
+	return nil
+}
+
+var bootTime = time.Now().Add(-37 * 24 * time.Hour).Truncate(time.Hour)
+
+func fakeBinary(name string) []byte {
+	size := 18000 + len(name)*7919%90000
+	data := make([]byte, size)
+	copy(data, "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x03\x00\x3e\x00")
+	return data
+}
+
+// addSkeleton adds a minimal Linux filesystem layout, with binaries for the given commands.
+func (builder *templateBuilder) addSkeleton(commands map[string]command) {
+	for _, dir := range []string{"/boot", "/dev", "/etc", "/home", "/media", "/mnt", "/opt", "/proc", "/run", "/srv", "/sys",
+		"/usr/bin", "/usr/sbin", "/usr/lib", "/usr/local/bin", "/usr/local/sbin", "/usr/share", "/var/cache", "/var/lib", "/var/log", "/var/mail"} {
+		builder.addDir(dir, 0755)
+	}
+	builder.addDir("/root", 0700)
+	builder.addDir("/tmp", os.ModeSticky|0777)
+	builder.addDir("/var/tmp", os.ModeSticky|0777)
+	for _, link := range []string{"bin", "sbin", "lib", "lib64"} {
+		builder.addSymlink(link, "usr/"+link)
+	}
+	builder.addDir("/usr/lib64", 0755)
+	builder.add("/dev/null", &fsNode{mode: os.ModeDevice | os.ModeCharDevice | 0666, owner: "root", group: "root", modTime: bootTime})
+	for name := range commands {
+		if shellBuiltins[name] {
+			continue
+		}
+		builder.addFile("/usr/bin/"+name, 0755, fakeBinary(name))
+	}
+	builder.addFile("/etc/hostname", 0644, []byte("never-gonna-give-you-up-server\n"))
+	builder.addFile("/etc/hosts", 0644, []byte("127.0.0.1 localhost\n127.0.1.1 never-gonna-give-you-up-server\n\n::1     ip6-localhost ip6-loopback\n"))
+	builder.addFile("/etc/issue", 0644, []byte("Ubuntu 20.04.6 LTS \\n \\l\n\n"))
+	builder.addFile("/etc/os-release", 0644, []byte(`NAME="Ubuntu"
+VERSION="20.04.6 LTS (Focal Fossa)"
+ID=ubuntu
+ID_LIKE=debian
+PRETTY_NAME="Ubuntu 20.04.6 LTS"
+VERSION_ID="20.04"
+HOME_URL="https://www.ubuntu.com/"
+SUPPORT_URL="https://help.ubuntu.com/"
+BUG_REPORT_URL="https://bugs.launchpad.net/ubuntu/"
+PRIVACY_POLICY_URL="https://www.ubuntu.com/legal/terms-and-policies/privacy-policy"
+VERSION_CODENAME=focal
+UBUNTU_CODENAME=focal
+`))
+	builder.addFile("/etc/shells", 0644, []byte("# /etc/shells: valid login shells\n/bin/sh\n/bin/bash\n/usr/bin/bash\n/bin/dash\n/usr/bin/dash\n"))
+	builder.addFile("/etc/passwd", 0644, []byte("root:x:0:0:root:/root:/bin/bash\ndaemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin\nbin:x:2:2:bin:/bin:/usr/sbin/nologin\nsys:x:3:3:sys:/dev:/usr/sbin/nologin\n"))
+	builder.addFile("/etc/group", 0644, []byte("root:x:0:\ndaemon:x:1:\nbin:x:2:\nsys:x:3:\nadm:x:4:syslog\n"))
+	builder.addFile("/proc/version", 0444, []byte("Linux version 5.4.0-187-generic (buildd@lcy02-amd64-079) (gcc version 9.4.0 (Ubuntu 9.4.0-1ubuntu1~20.04.2)) #207-Ubuntu SMP Mon Jun 10 08:16:10 UTC 2024\n"))
+}
+
+var (
+	defaultTemplate     *fsNode
+	defaultTemplateOnce sync.Once
+)
+
+// defaultFilesystemTemplate returns the built-in filesystem used when no template is configured.
+func defaultFilesystemTemplate() *fsNode {
+	defaultTemplateOnce.Do(func() {
+		builder := newTemplateBuilder()
+		builder.addSkeleton(commands)
+		defaultTemplate = builder.root
+	})
+	return defaultTemplate
+}
+
+// loadFilesystemTemplate builds the filesystem template from the built-in skeleton,
+// the legacy funny files and the configured template directory or tarball.
+func loadFilesystemTemplate(workDir, template string, commands map[string]command) (*fsNode, error) {
+	builder := newTemplateBuilder()
+	builder.addSkeleton(commands)
+	if err := builder.addFunnyFiles(filepath.Join(workDir, "funny_files", "cat")); err != nil {
+		return nil, err
+	}
+	if template == "" {
+		return builder.root, nil
+	}
+	info, err := os.Stat(template)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		err = builder.addDirectory(template)
+	} else {
+		err = builder.addTarball(template)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return builder.root, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVirtualFSCopyOnWrite(t *testing.T) {
+	builder := newTemplateBuilder()
+	builder.addFile("/etc/motd", 0644, []byte("hello\n"))
+	first := newVirtualFS(builder.root, "root")
+	second := newVirtualFS(builder.root, "root")
+
+	if err := first.WriteFile("/etc/motd", []byte("changed\n"), true); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := first.Mkdir("/tmp/a/b", true); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	data, err := first.ReadFile("/etc/motd")
+	if err != nil || string(data) != "hello\nchanged\n" {
+		t.Errorf("first: data=%q, err=%v, want %q", data, err, "hello\nchanged\n")
+	}
+	data, err = second.ReadFile("/etc/motd")
+	if err != nil || string(data) != "hello\n" {
+		t.Errorf("second: data=%q, err=%v, want %q", data, err, "hello\n")
+	}
+	if _, err := second.Stat("/tmp/a"); err != errNoSuchFile {
+		t.Errorf("second: err=%v, want %v", err, errNoSuchFile)
+	}
+	if string(builder.root.children["etc"].children["motd"].data) != "hello\n" {
+		t.Errorf("template modified")
+	}
+}
+
+func TestVirtualFSQuota(t *testing.T) {
+	filesystem := newVirtualFS(nil, "root")
+	filesystem.maxSize, filesystem.maxFiles = 100, 5
+	if err := filesystem.WriteFile("/tmp/a", make([]byte, 60), false); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := filesystem.WriteFile("/tmp/a", make([]byte, 50), true); err != errNoSpace {
+		t.Errorf("append: err=%v, want %v", err, errNoSpace)
+	}
+	// Copies count towards the quota even though they share their data.
+	if err := filesystem.Copy("/tmp/a", "/tmp/b", false); err != errNoSpace {
+		t.Errorf("copy: err=%v, want %v", err, errNoSpace)
+	}
+	if err := filesystem.Remove("/tmp/a", false, false); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if free := filesystem.FreeSpace(); free != 100 {
+		t.Errorf("free=%v, want 100", free)
+	}
+	if err := filesystem.Mkdir("/tmp/d/e/f/g/h/i", true); err != errNoSpace {
+		t.Errorf("mkdir: err=%v, want %v", err, errNoSpace)
+	}
+
+	// Copying a tree into itself over and over stops once the quota is used up.
+	ctx := newTestSessionContext(&config{})
+	ctx.filesystem.maxFiles = 100
+	stderr := &strings.Builder{}
+	status, err := executeProgram(commandContext{
+		args:   []string{"sh", "-c", `cp -r /etc /tmp/a; cp -r /tmp /tmp/b; cp -r /tmp /tmp/c; cp -r /tmp /tmp/d; cp -r /tmp /tmp/e`},
+		stdout: io.Discard,
+		stderr: stderr,
+	}, ctx)
+	if err != nil {
+		t.Fatalf("Failed to execute: %v", err)
+	}
+	if expected := "cp: cannot copy '/tmp' to '/tmp/e': No space left on device\n"; status != 1 || stderr.String() != expected {
+		t.Errorf("status=%v, stderr=%q, want 1 and %q", status, stderr.String(), expected)
+	}
+}
+
+func TestFilesystemCommands(t *testing.T) {
+	for _, test := range []struct {
+		source, stdout, stderr string
+		status                 uint32
+	}{
+		{`echo a > /tmp/f; echo b >> /tmp/f; cat /tmp/f`, "a\nb\n", "", 0},
+		{`printf abc | cat > /tmp/f; cat /tmp/f | base64`, "YWJj\n", "", 0},
+		{`echo /wAKAQ== | base64 -d | cat > /tmp/f; cat - < /tmp/f | base64`, "/wAKAQ==\n", "", 0},
+		{`cd /tmp; echo x > f; cat /tmp/f ../tmp/./f`, "x\nx\n", "", 0},
+		{`cd /usr/bin/..; pwd; cd ..; pwd; cd; pwd; cd -`, "/usr\n/\n/root\n/\n", "", 0},
+		{`cd /nonexistent`, "", "sh: cd: /nonexistent: No such file or directory\n", 1},
+		{`cd /etc/hostname`, "", "sh: cd: /etc/hostname: Not a directory\n", 1},
+		{`mkdir -p /tmp/a/b; touch /tmp/a/b/c; ls /tmp/a/b`, "c\n", "", 0},
+		{`mkdir /tmp/a/b`, "", "mkdir: cannot create directory '/tmp/a/b': No such file or directory\n", 1},
+		{`touch /tmp/x; mv /tmp/x /tmp/y; ls /tmp`, "y\n", "", 0},
+		{`mkdir /tmp/d; touch /tmp/x; mv /tmp/x /tmp/d; ls /tmp /tmp/d`, "/tmp:\nd\n\n/tmp/d:\nx\n", "", 0},
+		{`echo a > /tmp/x; cp /tmp/x /tmp/y; echo b >> /tmp/y; cat /tmp/x /tmp/y`, "a\na\nb\n", "", 0},
+		{`cp /etc /tmp`, "", "cp: -r not specified; omitting directory '/etc'\n", 1},
+		{`cp -r /etc /tmp; cat /tmp/etc/hostname`, "never-gonna-give-you-up-server\n", "", 0},
+		{`mv /nonexistent /tmp`, "", "mv: cannot stat '/nonexistent': No such file or directory\n", 1},
+		{`mkdir /tmp/d; rm /tmp/d`, "", "rm: cannot remove '/tmp/d': Is a directory\n", 1},
+		{`mkdir -p /tmp/d/e; rm -r /tmp/d; ls /tmp`, "", "", 0},
+		{`rm -f /nonexistent`, "", "", 0},
+		{`ls /nonexistent`, "", "ls: cannot access '/nonexistent': No such file or directory\n", 2},
+		{`ls -d /etc /tmp`, "/etc\n/tmp\n", "", 0},
+		{`echo 'echo script $1' > /tmp/s; sh /tmp/s arg`, "script arg\n", "", 0},
+		{`echo 'echo script' > /tmp/s; /tmp/s`, "", "sh: /tmp/s: Permission denied\n", 126},
+		{`echo 'echo script' > /tmp/s; chmod +x /tmp/s; /tmp/s`, "script\n", "", 0},
+		{`/bin/echo a`, "a\n", "", 0},
+		{`/tmp/nonexistent`, "", "sh: /tmp/nonexistent: No such file or directory\n", 127},
+		{`cp /bin/true /tmp/x; /tmp/x`, "", "sh: /tmp/x: cannot execute binary file: Exec format error\n", 126},
+		{`echo 'sh /tmp/x' > /tmp/x; sh /tmp/x`, "", "sh: maximum nested function level reached\n", 2},
+	} {
+		stdout, stderr, status := runTestShell(t, []string{"sh", "-c", test.source}, "")
+		if stdout != test.stdout {
+			t.Errorf("%q: stdout=%q, want %q", test.source, stdout, test.stdout)
+		}
+		if stderr != test.stderr {
+			t.Errorf("%q: stderr=%q, want %q", test.source, stderr, test.stderr)
+		}
+		if status != test.status {
+			t.Errorf("%q: status=%v, want %v", test.source, status, test.status)
+		}
+	}
+}
+
+func TestListingIsStable(t *testing.T) {
+	ctx := newTestSessionContext(&config{})
+	var listings []string
+	for i := 0; i < 2; i++ {
+		stdout := &strings.Builder{}
+		if _, err := executeProgram(commandContext{args: []string{"ls", "-la", "/etc"}, stdout: stdout, stderr: stdout}, ctx); err != nil {
+			t.Fatalf("Failed to list: %v", err)
+		}
+		listings = append(listings, stdout.String())
+	}
+	if listings[0] != listings[1] {
+		t.Errorf("listings differ: %q, %q", listings[0], listings[1])
+	}
+}
+
+func TestLoadFilesystemTemplate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "template", "home"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "template", "home", "notes.txt"), []byte("from directory\n"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	tarball, err := os.Create(filepath.Join(dir, "template.tar.gz"))
+	if err != nil {
+		t.Fatalf("Failed to create tarball: %v", err)
+	}
+	gzipWriter := gzip.NewWriter(tarball)
+	tarWriter := tar.NewWriter(gzipWriter)
+	content := []byte("from tarball\n")
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "./opt/app/config", Mode: 0640, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+	if _, err := tarWriter.Write(content); err != nil {
+		t.Fatalf("Failed to write content: %v", err)
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatalf("Failed to close gzip writer: %v", err)
+	}
+	if err := tarball.Close(); err != nil {
+		t.Fatalf("Failed to close tarball: %v", err)
+	}
+
+	for _, test := range []struct {
+		template, file, content string
+		mode                    os.FileMode
+	}{
+		{filepath.Join(dir, "template"), "/home/notes.txt", "from directory\n", 0600},
+		{filepath.Join(dir, "template.tar.gz"), "/opt/app/config", "from tarball\n", 0640},
+	} {
+		template, err := loadFilesystemTemplate(dir, test.template, commands)
+		if err != nil {
+			t.Fatalf("Failed to load template %v: %v", test.template, err)
+		}
+		filesystem := newVirtualFS(template, "root")
+		data, err := filesystem.ReadFile(test.file)
+		if err != nil || string(data) != test.content {
+			t.Errorf("%v: data=%q, err=%v, want %q", test.template, data, err, test.content)
+		}
+		info, err := filesystem.Stat(test.file)
+		if err != nil || info.mode != test.mode {
+			t.Errorf("%v: mode=%v, err=%v, want %v", test.template, info.mode, err, test.mode)
+		}
+		if _, err := filesystem.Stat("/etc/passwd"); err != nil {
+			t.Errorf("%v: skeleton missing: %v", test.template, err)
+		}
+	}
+}
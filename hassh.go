@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxKexInitSize is the most bytes read while looking for the KEXINIT of a client, larger than any sane packet.
+const maxKexInitSize = 64 * 1024
+
+const msgKexInit = 20
+
+type kexInitMsg struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// hasshAlgorithms returns the algorithms HASSH fingerprints, as defined at https://github.com/salesforce/hassh.
+func (msg *kexInitMsg) hasshAlgorithms() string {
+	return strings.Join([]string{
+		strings.Join(msg.KexAlgos, ","),
+		strings.Join(msg.CiphersClientServer, ","),
+		strings.Join(msg.MACsClientServer, ","),
+		strings.Join(msg.CompressionClientServer, ","),
+	}, ";")
+}
+
+func (msg *kexInitMsg) hassh() string {
+	sum := md5.Sum([]byte(msg.hasshAlgorithms()))
+	return hex.EncodeToString(sum[:])
+}
+
+// kexInitConns holds the accepted connections by connKey, so that the KEXINIT of a client can be found once its SSH
+// connection is established.
+var kexInitConns sync.Map
+
+// connKey identifies an accepted connection by its remote address value rather than the address string, which can be
+// shared by several connections, e.g. with PROXY headers that don't carry the client address. The value stays the same
+// through the wrappers of the connection and the SSH library, which hands it to the callbacks as is.
+func connKey(addr net.Addr) any {
+	return addr
+}
+
+// kexInitConn sniffs the KEXINIT the client sends in the clear at the start of a connection.
+type kexInitConn struct {
+	net.Conn
+	lock    sync.Mutex
+	buffer  []byte
+	done    bool
+	kexInit *kexInitMsg
+}
+
+func (conn *kexInitConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if !conn.done && n > 0 {
+		conn.buffer = append(conn.buffer, p[:n]...)
+		conn.parse()
+	}
+	return n, err
+}
+
+// parse looks for the KEXINIT after the version line in what the client sent so far.
+func (conn *kexInitConn) parse() {
+	if len(conn.buffer) > maxKexInitSize {
+		conn.done, conn.buffer = true, nil
+		return
+	}
+	versionEnd := bytes.IndexByte(conn.buffer, '\n')
+	if versionEnd == -1 {
+		return
+	}
+	packet := conn.buffer[versionEnd+1:]
+	if len(packet) < 5 {
+		return
+	}
+	length := binary.BigEndian.Uint32(packet)
+	if length > maxKexInitSize {
+		conn.done, conn.buffer = true, nil
+		return
+	}
+	if uint32(len(packet)-4) < length {
+		return
+	}
+	conn.done = true
+	padding := uint32(packet[4])
+	if padding+1 > length {
+		conn.buffer = nil
+		return
+	}
+	payload := packet[5 : 4+length-padding]
+	conn.buffer = nil
+	if len(payload) == 0 || payload[0] != msgKexInit {
+		return
+	}
+	kexInit := &kexInitMsg{}
+	if err := ssh.Unmarshal(payload, kexInit); err != nil {
+		warningLogger.Printf("Failed to parse client KEXINIT: %v", err)
+		return
+	}
+	conn.kexInit = kexInit
+}
+
+func (conn *kexInitConn) Close() error {
+	kexInitConns.CompareAndDelete(connKey(conn.RemoteAddr()), conn)
+	return conn.Conn.Close()
+}
+
+// clientKexInit returns the KEXINIT sent by the client of the connection with the remote address addr, if it was seen.
+func clientKexInit(addr net.Addr) *kexInitMsg {
+	value, ok := kexInitConns.Load(connKey(addr))
+	if !ok {
+		return nil
+	}
+	conn := value.(*kexInitConn)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.kexInit
+}
+
+type kexInitListener struct {
+	net.Listener
+}
+
+func (listener kexInitListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	kexInitConn := &kexInitConn{Conn: conn}
+	kexInitConns.Store(connKey(conn.RemoteAddr()), kexInitConn)
+	return kexInitConn, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestClientKexInit(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := kexInitListener{tcpListener}
+	defer listener.Close()
+
+	clientConfig := &ssh.ClientConfig{
+		Config: ssh.Config{
+			KeyExchanges: []string{"curve25519-sha256", "diffie-hellman-group14-sha256"},
+			Ciphers:      []string{"aes128-ctr", "aes256-ctr"},
+			MACs:         []string{"hmac-sha2-256"},
+		},
+		HostKeyAlgorithms: []string{ssh.KeyAlgoED25519},
+		HostKeyCallback:   ssh.InsecureIgnoreHostKey(),
+	}
+	clientConn, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer clientConn.Close()
+	go ssh.NewClientConn(clientConn, clientConn.RemoteAddr().String(), clientConfig)
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	if _, err := conn.Write([]byte("SSH-2.0-sshesame\r\n")); err != nil {
+		t.Fatalf("Failed to write version: %v", err)
+	}
+	buffer := make([]byte, 256)
+	for clientKexInit(conn.RemoteAddr()) == nil {
+		if _, err := conn.Read(buffer); err != nil {
+			t.Fatalf("Failed to read KEXINIT: %v", err)
+		}
+	}
+
+	kexInit := clientKexInit(conn.RemoteAddr())
+	if !reflect.DeepEqual(kexInit.CiphersClientServer, clientConfig.Ciphers) {
+		t.Errorf("ciphers=%v, want %v", kexInit.CiphersClientServer, clientConfig.Ciphers)
+	}
+	if !reflect.DeepEqual(kexInit.ServerHostKeyAlgos, clientConfig.HostKeyAlgorithms) {
+		t.Errorf("hostKeyAlgorithms=%v, want %v", kexInit.ServerHostKeyAlgos, clientConfig.HostKeyAlgorithms)
+	}
+	// x/crypto appends the extension negotiation and strict key exchange pseudo-algorithms.
+	expectedAlgorithms := "curve25519-sha256,diffie-hellman-group14-sha256,ext-info-c,kex-strict-c-v00@openssh.com;aes128-ctr,aes256-ctr;hmac-sha2-256;none"
+	if algorithms := kexInit.hasshAlgorithms(); algorithms != expectedAlgorithms {
+		t.Errorf("algorithms=%v, want %v", algorithms, expectedAlgorithms)
+	}
+	sum := md5.Sum([]byte(expectedAlgorithms))
+	if hassh := kexInit.hassh(); hassh != hex.EncodeToString(sum[:]) {
+		t.Errorf("hassh=%v, want %v", hassh, hex.EncodeToString(sum[:]))
+	}
+
+	conn.Close()
+	if kexInit := clientKexInit(conn.RemoteAddr()); kexInit != nil {
+		t.Errorf("kexInit=%v, want nil after closing", kexInit)
+	}
+}
+
+type addrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (conn addrConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+type pipeListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (listener pipeListener) Accept() (net.Conn, error) {
+	return <-listener.conns, nil
+}
+
+func TestClientKexInitSameAddress(t *testing.T) {
+	listener := kexInitListener{pipeListener{conns: make(chan net.Conn, 2)}}
+	var conns []net.Conn
+	for range 2 {
+		server, client := net.Pipe()
+		defer client.Close()
+		listener.Listener.(pipeListener).conns <- addrConn{server, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Failed to accept: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	conns[0].(*kexInitConn).kexInit = &kexInitMsg{KexAlgos: []string{"first"}}
+	if kexInit := clientKexInit(conns[0].RemoteAddr()); kexInit == nil || kexInit.KexAlgos[0] != "first" {
+		t.Errorf("kexInit=%v, want the KEXINIT of the first connection", kexInit)
+	}
+	if kexInit := clientKexInit(conns[1].RemoteAddr()); kexInit != nil {
+		t.Errorf("kexInit=%v, want nil for the second connection", kexInit)
+	}
+
+	conns[1].Close()
+	if kexInit := clientKexInit(conns[0].RemoteAddr()); kexInit == nil {
+		t.Errorf("kexInit=nil after closing the second connection, want the KEXINIT of the first connection")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+type idGenerator interface {
+	generate() string
+}
+
+// idGenerators holds the generators in use by format and node, so that reloading the config keeps using the same
+// generator and IDs generated around the reload can't collide.
+var (
+	idGeneratorsLock sync.Mutex
+	idGenerators     = map[string]idGenerator{}
+)
+
+func getIDGenerator(format string, nodeID int64) (idGenerator, error) {
+	idGeneratorsLock.Lock()
+	defer idGeneratorsLock.Unlock()
+	key := fmt.Sprintf("%v-%v", format, nodeID)
+	if generator, ok := idGenerators[key]; ok {
+		return generator, nil
+	}
+	var generator idGenerator
+	switch format {
+	case "snowflake":
+		node, err := snowflake.NewNode(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		generator = snowflakeGenerator{node}
+	case "ulid":
+		generator = &ulidGenerator{}
+	case "uuidv7":
+		generator = uuidv7Generator{}
+	default:
+		return nil, fmt.Errorf("unknown ID format %q, known formats are snowflake, ulid and uuidv7", format)
+	}
+	idGenerators[key] = generator
+	return generator, nil
+}
+
+// setupSensor sets up the name and the ID generator of this sensor.
+func (cfg *config) setupSensor() error {
+	if cfg.Sensor.Name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			warningLogger.Printf("Failed to get hostname to use as sensor name: %v", err)
+		}
+		cfg.Sensor.Name = hostname
+	}
+	generator, err := getIDGenerator(cfg.Sensor.IDFormat, cfg.Sensor.NodeID)
+	if err != nil {
+		return err
+	}
+	cfg.idGenerator = generator
+	return nil
+}
+
+// newID returns a new process-wide unique ID, a snowflake of node 0 if no generator is set up.
+func (cfg *config) newID() string {
+	generator := cfg.idGenerator
+	if generator == nil {
+		var err error
+		if generator, err = getIDGenerator("snowflake", 0); err != nil {
+			panic(err)
+		}
+	}
+	return generator.generate()
+}
+
+type snowflakeGenerator struct {
+	node *snowflake.Node
+}
+
+func (generator snowflakeGenerator) generate() string {
+	return strconv.FormatInt(generator.node.Generate().Int64(), 10)
+}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator generates monotonic ULIDs: within the same millisecond, the random part of the previous one is
+// incremented.
+type ulidGenerator struct {
+	lock       sync.Mutex
+	lastMillis uint64
+	random     [10]byte
+}
+
+func (generator *ulidGenerator) generate() string {
+	generator.lock.Lock()
+	defer generator.lock.Unlock()
+	millis := uint64(time.Now().UnixMilli())
+	if millis <= generator.lastMillis {
+		millis = generator.lastMillis
+		for i := len(generator.random) - 1; i >= 0; i-- {
+			generator.random[i]++
+			if generator.random[i] != 0 {
+				break
+			}
+		}
+	} else {
+		if _, err := rand.Read(generator.random[:]); err != nil {
+			panic(err)
+		}
+		generator.lastMillis = millis
+	}
+	var id [16]byte
+	binary.BigEndian.PutUint16(id[0:2], uint16(millis>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(millis))
+	copy(id[6:], generator.random[:])
+	return encodeULID(id)
+}
+
+// encodeULID encodes the 128 bits of a ULID as 26 Crockford base32 characters, 5 bits each, the first one only
+// holding the top 3 bits.
+func encodeULID(id [16]byte) string {
+	encoded := make([]byte, 26)
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	for i := 25; i >= 0; i-- {
+		encoded[i] = crockfordBase32[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(encoded)
+}
+
+// uuidv7Generator generates UUIDv7s as described in RFC 9562: a millisecond timestamp followed by random bits.
+type uuidv7Generator struct{}
+
+func (uuidv7Generator) generate() string {
+	var id [16]byte
+	if _, err := rand.Read(id[6:]); err != nil {
+		panic(err)
+	}
+	millis := uint64(time.Now().UnixMilli())
+	binary.BigEndian.PutUint16(id[0:2], uint16(millis>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(millis))
+	id[6] = 0x70 | id[6]&0x0f
+	id[8] = 0x80 | id[8]&0x3f
+	encoded := hex.EncodeToString(id[:])
+	return fmt.Sprintf("%v-%v-%v-%v-%v", encoded[0:8], encoded[8:12], encoded[12:16], encoded[16:20], encoded[20:32])
+}
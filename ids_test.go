@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+func TestIDGenerators(t *testing.T) {
+	tests := []struct {
+		format         string
+		expectedFormat *regexp.Regexp
+	}{
+		{"snowflake", regexp.MustCompile(`^[0-9]+$`)},
+		{"ulid", regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)},
+		{"uuidv7", regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+	}
+	for _, test := range tests {
+		cfg := &config{Sensor: sensorConfig{Name: "sensor", IDFormat: test.format, NodeID: 5}}
+		if err := cfg.setupSensor(); err != nil {
+			t.Fatalf("format=%v: Failed to setup sensor: %v", test.format, err)
+		}
+		ids := make([]string, 1000)
+		seen := map[string]bool{}
+		for i := range ids {
+			ids[i] = cfg.newID()
+			if !test.expectedFormat.MatchString(ids[i]) {
+				t.Errorf("format=%v: id=%v, want a match for %v", test.format, ids[i], test.expectedFormat)
+			}
+			if seen[ids[i]] {
+				t.Errorf("format=%v: id=%v generated twice", test.format, ids[i])
+			}
+			seen[ids[i]] = true
+		}
+		if test.format == "ulid" && !sort.StringsAreSorted(ids) {
+			t.Errorf("format=%v: ids aren't sorted", test.format)
+		}
+
+		// Reloading keeps the same generator.
+		reloadedCfg := &config{Sensor: cfg.Sensor}
+		if err := reloadedCfg.setupSensor(); err != nil {
+			t.Fatalf("format=%v: Failed to setup sensor: %v", test.format, err)
+		}
+		if reloadedCfg.idGenerator != cfg.idGenerator {
+			t.Errorf("format=%v: generator=%v, want the same one", test.format, reloadedCfg.idGenerator)
+		}
+	}
+}
+
+func TestEncodeULID(t *testing.T) {
+	id := [16]byte{0x01, 0x8f, 0x3c, 0x5a, 0x1b, 0x2c, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	if encoded, expected := encodeULID(id), "01HWY5M6SCZZZZZZZZZZZZZZZZ"; encoded != expected {
+		t.Errorf("encoded=%v, want %v", encoded, expected)
+	}
+	if encoded, expected := encodeULID([16]byte{}), "00000000000000000000000000"; encoded != expected {
+		t.Errorf("encoded=%v, want %v", encoded, expected)
+	}
+}
+
+func TestSensorConfig(t *testing.T) {
+	cfg := &config{Sensor: sensorConfig{IDFormat: "snowflake"}}
+	if err := cfg.setupSensor(); err != nil {
+		t.Fatalf("Failed to setup sensor: %v", err)
+	}
+	if hostname, _ := os.Hostname(); cfg.Sensor.Name != hostname {
+		t.Errorf("name=%v, want %v", cfg.Sensor.Name, hostname)
+	}
+	for _, sensor := range []sensorConfig{{IDFormat: "uuidv4"}, {IDFormat: "snowflake", NodeID: 1024}} {
+		cfg := &config{Sensor: sensor}
+		if err := cfg.setupSensor(); err == nil {
+			t.Errorf("sensor=%+v: err=nil, want an error", sensor)
+		}
+	}
+}
+
+func TestLogIDs(t *testing.T) {
+	cfg := &config{Sensor: sensorConfig{Name: "sensor-1"}}
+	cfg.Logging.JSON = true
+	logBuffer := setupLogBuffer(t, cfg)
+	context := connContext{ConnMetadata: mockConnContext{}, cfg: cfg, connectionID: "1234"}
+	context.newChannelContext(2).logEvent(sessionLog{channelLog: channelLog{ChannelID: 2}})
+	var logEntry struct {
+		Sensor       string `json:"sensor"`
+		ConnectionID string `json:"session_id"`
+		ChannelUID   string `json:"channel_uid"`
+	}
+	if err := json.Unmarshal(logBuffer.Bytes(), &logEntry); err != nil {
+		t.Fatalf("Failed to parse log: %v", err)
+	}
+	if logEntry.Sensor != "sensor-1" || logEntry.ConnectionID != "1234" || logEntry.ChannelUID != "1234-2" {
+		t.Errorf("entry=%+v, want sensor-1, 1234 and 1234-2", logEntry)
+	}
+}
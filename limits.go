@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	connectionLimitMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sshesame_connection_limit",
+		Help: "Configured connection limits, 0 meaning unlimited",
+	}, []string{"listener", "limit", "action"})
+	limitedConnectionsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sshesame_limited_connections_total",
+		Help: "Total number of connections refused because of a limit",
+	}, []string{"listener", "limit", "action"})
+)
+
+var limitActions = map[string]bool{"drop": true, "close_after_banner": true, "tarpit": true}
+
+// setupLimits validates the connection limits and publishes them as metrics.
+func (cfg *config) setupLimits() error {
+	for name, limit := range cfg.Limits.byName() {
+		if !limitActions[limit.Action] {
+			return fmt.Errorf("unknown action %q for limit %v, known actions are drop, close_after_banner and tarpit", limit.Action, name)
+		}
+		connectionLimitMetric.DeletePartialMatch(prometheus.Labels{"listener": cfg.listenerName, "limit": name})
+		connectionLimitMetric.WithLabelValues(cfg.listenerName, name, limit.Action).Set(float64(limit.Max))
+	}
+	return nil
+}
+
+func (limits limitsConfig) byName() map[string]connectionLimitConfig {
+	return map[string]connectionLimitConfig{
+		"global":            limits.Global,
+		"per_ip":            limits.PerIP,
+		"per_network":       limits.PerNetwork,
+		"per_ip_per_minute": limits.PerIPPerMinute,
+	}
+}
+
+// sourceNetwork returns the /24 of an IPv4 address or the /64 of an IPv6 one.
+func sourceNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// connectionLimiter keeps the state of the limits. It outlives config reloads, which only change the limits.
+type connectionLimiter struct {
+	lock       sync.Mutex
+	total      int
+	tarpitted  int
+	ips        map[string]int
+	networks   map[string]int
+	recent     map[string][]time.Time
+	lastPruned time.Time
+}
+
+func newConnectionLimiter() *connectionLimiter {
+	return &connectionLimiter{
+		ips:        map[string]int{},
+		networks:   map[string]int{},
+		recent:     map[string][]time.Time{},
+		lastPruned: time.Now(),
+	}
+}
+
+// recentConnections drops the connections admitted over a minute ago and returns how many are left.
+func (limiter *connectionLimiter) recentConnections(ip string, now time.Time) int {
+	times := limiter.recent[ip]
+	for len(times) > 0 && now.Sub(times[0]) >= time.Minute {
+		times = times[1:]
+	}
+	if len(times) == 0 {
+		delete(limiter.recent, ip)
+	} else {
+		limiter.recent[ip] = times
+	}
+	return len(times)
+}
+
+// admit counts a new connection from ip. It returns the name of the first limit it exceeds, or an empty string and a
+// function releasing the connection if none.
+func (limiter *connectionLimiter) admit(limits limitsConfig, ip net.IP) (string, func()) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := time.Now()
+	if now.Sub(limiter.lastPruned) >= time.Minute {
+		for ip := range limiter.recent {
+			limiter.recentConnections(ip, now)
+		}
+		limiter.lastPruned = now
+	}
+	ipKey, networkKey := ip.String(), sourceNetwork(ip)
+	recent := limiter.recentConnections(ipKey, now)
+	switch {
+	case limits.Global.Max > 0 && limiter.total >= limits.Global.Max:
+		return "global", nil
+	case limits.PerIP.Max > 0 && limiter.ips[ipKey] >= limits.PerIP.Max:
+		return "per_ip", nil
+	case limits.PerNetwork.Max > 0 && limiter.networks[networkKey] >= limits.PerNetwork.Max:
+		return "per_network", nil
+	case limits.PerIPPerMinute.Max > 0 && recent >= limits.PerIPPerMinute.Max:
+		return "per_ip_per_minute", nil
+	}
+	limiter.total++
+	limiter.ips[ipKey]++
+	limiter.networks[networkKey]++
+	if limits.PerIPPerMinute.Max > 0 {
+		limiter.recent[ipKey] = append(limiter.recent[ipKey], now)
+	}
+	var once sync.Once
+	return "", func() {
+		once.Do(func() {
+			limiter.lock.Lock()
+			defer limiter.lock.Unlock()
+			limiter.total--
+			if limiter.ips[ipKey]--; limiter.ips[ipKey] == 0 {
+				delete(limiter.ips, ipKey)
+			}
+			if limiter.networks[networkKey]--; limiter.networks[networkKey] == 0 {
+				delete(limiter.networks, networkKey)
+			}
+		})
+	}
+}
+
+// admitTarpit counts a refused connection kept in the tarpit. It returns a function releasing it, or nil if max
+// connections (0 meaning unlimited) are in the tarpit already.
+func (limiter *connectionLimiter) admitTarpit(max int) func() {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if max > 0 && limiter.tarpitted >= max {
+		return nil
+	}
+	limiter.tarpitted++
+	return func() {
+		limiter.lock.Lock()
+		defer limiter.lock.Unlock()
+		limiter.tarpitted--
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (conn limitedConn) Close() error {
+	conn.release()
+	return conn.Conn.Close()
+}
+
+// limitListener enforces the connection limits on the connections it accepts.
+type limitListener struct {
+	net.Listener
+	cfg     *config
+	limiter *connectionLimiter
+}
+
+func (listener limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := remoteIP(conn.RemoteAddr())
+		if ip == nil {
+			return conn, nil
+		}
+		cfg := listener.cfg.latest()
+		limit, release := listener.limiter.admit(cfg.Limits, ip)
+		if limit == "" {
+			return limitedConn{conn, release}, nil
+		}
+		action := cfg.Limits.byName()[limit].Action
+		releaseTarpit := func() {}
+		if action == "tarpit" {
+			// Tarpitted connections are held for a while, so only so many of them are, the rest are dropped.
+			if release := listener.limiter.admitTarpit(cfg.Limits.MaxTarpitted); release != nil {
+				releaseTarpit = release
+			} else {
+				action = "drop"
+			}
+		}
+		limitedConnectionsMetric.WithLabelValues(cfg.listenerName, limit, action).Inc()
+		go func() {
+			defer releaseTarpit()
+			refuse(conn, cfg, action)
+		}()
+	}
+}
+
+// refusedWriteTimeout is how long a write to a refused connection can take, so that clients not reading don't hold
+// it open.
+const refusedWriteTimeout = 10 * time.Second
+
+// refuse gets rid of a connection over a limit the way its action says.
+func refuse(conn net.Conn, cfg *config, action string) {
+	defer conn.Close()
+	switch action {
+	case "close_after_banner":
+		conn.SetWriteDeadline(time.Now().Add(refusedWriteTimeout))
+		conn.Write([]byte(cfg.SSHProto.Version + "\r\n"))
+	case "tarpit":
+		// Drip lines until the client gives up or the tarpit duration is up, never getting to the version.
+		end := time.Now().Add(cfg.Limits.TarpitDuration)
+		for {
+			interval := cfg.Tarpit.DripInterval
+			if interval <= 0 {
+				interval = 10 * time.Second
+			}
+			if cfg.Limits.TarpitDuration > 0 && time.Now().Add(interval).After(end) {
+				return
+			}
+			cfg.tarpit("limit", interval)
+			conn.SetWriteDeadline(time.Now().Add(refusedWriteTimeout))
+			if err := writeDripLine(conn); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimiter(t *testing.T) {
+	limits := limitsConfig{
+		Global:         connectionLimitConfig{Max: 4},
+		PerIP:          connectionLimitConfig{Max: 2},
+		PerNetwork:     connectionLimitConfig{Max: 3},
+		PerIPPerMinute: connectionLimitConfig{Max: 3},
+	}
+	limiter := newConnectionLimiter()
+	admit := func(ip string, expectedLimit string) func() {
+		limit, release := limiter.admit(limits, net.ParseIP(ip))
+		if limit != expectedLimit {
+			t.Errorf("ip=%v: limit=%q, want %q", ip, limit, expectedLimit)
+		}
+		if (release == nil) != (expectedLimit != "") {
+			t.Errorf("ip=%v: release=%p, want a function only if admitted", ip, release)
+		}
+		return release
+	}
+	first := admit("192.0.2.1", "")
+	second := admit("192.0.2.1", "")
+	admit("192.0.2.1", "per_ip")
+	admit("192.0.2.2", "")
+	admit("192.0.2.3", "per_network")
+	admit("2001:db8::1", "")
+	admit("2001:db8::2", "global")
+
+	// Closed connections make room again, but still count as recent.
+	first()
+	first()
+	second()
+	admit("192.0.2.1", "")
+	admit("192.0.2.1", "per_ip_per_minute")
+	limiter.recent["192.0.2.1"][0] = time.Now().Add(-time.Hour)
+	admit("192.0.2.1", "")
+	if limiter.total != 4 || limiter.ips["192.0.2.1"] != 2 || limiter.networks["192.0.2.0"] != 3 {
+		t.Errorf("total=%v, ips=%v, networks=%v, want 4 connections", limiter.total, limiter.ips, limiter.networks)
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	tests := []struct {
+		action       string
+		tarpitFull   bool
+		expectedLine string
+	}{
+		{"drop", false, ""},
+		{"close_after_banner", false, "SSH-2.0-sshesame\r\n"},
+		{"tarpit", false, "drip"},
+		{"tarpit", true, ""},
+	}
+	for _, test := range tests {
+		// Each action gets a listener of its own, so that the config isn't changed under the accept loop.
+		cfg := &config{}
+		cfg.SSHProto.Version = "SSH-2.0-sshesame"
+		cfg.Tarpit.DripInterval = time.Millisecond
+		cfg.Limits.PerIP = connectionLimitConfig{Max: 1, Action: test.action}
+		cfg.Limits.MaxTarpitted = 1
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		listener := limitListener{tcpListener, cfg, newConnectionLimiter()}
+		defer listener.Close()
+		if test.tarpitFull {
+			// Connections over the tarpit limit are dropped.
+			listener.limiter.admitTarpit(cfg.Limits.MaxTarpitted)
+		}
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				// Admitted connections stay open.
+				defer conn.Close()
+			}
+		}()
+		admitted, err := net.Dial("tcp", tcpListener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer admitted.Close()
+		conn, err := net.Dial("tcp", tcpListener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		switch test.expectedLine {
+		case "":
+			if err != io.EOF || line != "" {
+				t.Errorf("action=%v: line=%q, err=%v, want EOF", test.action, line, err)
+			}
+		case "drip":
+			if err != nil || len(line) != 34 {
+				t.Errorf("action=%v: line=%q, err=%v, want a dripped line", test.action, line, err)
+			}
+		default:
+			if err != nil || line != test.expectedLine {
+				t.Errorf("action=%v: line=%q, err=%v, want %q", test.action, line, err, test.expectedLine)
+			}
+		}
+	}
+}
+
+func TestTarpitDuration(t *testing.T) {
+	cfg := &config{}
+	cfg.Tarpit.DripInterval = time.Millisecond
+	cfg.Limits.TarpitDuration = 20 * time.Millisecond
+	server, client := net.Pipe()
+	defer client.Close()
+	go refuse(server, cfg, "tarpit")
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(client)
+	if err != nil || len(data) == 0 {
+		t.Errorf("data=%q, err=%v, want dripped lines and then EOF", data, err)
+	}
+}
+
+func TestLimitsConfig(t *testing.T) {
+	cfg := &config{}
+	if err := cfg.load("limits:\n  per_ip:\n    max: 1\n    action: block\n", t.TempDir()); err == nil {
+		t.Errorf("err=nil, want an unknown action error")
+	}
+}
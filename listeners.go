@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// listenerConfig is an address to listen on with settings of its own. Sections set here replace the matching settings
+// of the top level config, which the listener otherwise shares.
+type listenerConfig struct {
+	Name          string        `yaml:"name"`
+	ListenAddress string        `yaml:"listen_address"`
+	HostKeys      []string      `yaml:"host_keys"`
+	ProxyProtocol yaml.MapSlice `yaml:"proxy_protocol"`
+	SSHProto      yaml.MapSlice `yaml:"ssh_proto"`
+	Auth          yaml.MapSlice `yaml:"auth"`
+	Commands      yaml.MapSlice `yaml:"commands"`
+	Filesystem    yaml.MapSlice `yaml:"filesystem"`
+}
+
+func (listener listenerConfig) overrides() yaml.MapSlice {
+	var overrides yaml.MapSlice
+	for _, section := range []yaml.MapItem{
+		{Key: "proxy_protocol", Value: listener.ProxyProtocol},
+		{Key: "ssh_proto", Value: listener.SSHProto},
+		{Key: "auth", Value: listener.Auth},
+		{Key: "commands", Value: listener.Commands},
+		{Key: "filesystem", Value: listener.Filesystem},
+	} {
+		if section.Value.(yaml.MapSlice) != nil {
+			overrides = append(overrides, section)
+		}
+	}
+	return overrides
+}
+
+// loadedListener is what reloading needs to know about a listener of the previous config.
+type loadedListener struct {
+	address string
+	current *atomic.Pointer[config]
+}
+
+// setupListeners creates the config of each listener. Listeners that were already running before a reload share their
+// current config with the new one, which load publishes once the whole config is set up. Listeners are only started
+// and stopped on restart, so changes to the set of listeners are warned about.
+func (cfg *config) setupListeners(configString, dataDir string, previous map[string]loadedListener) error {
+	names := map[string]bool{}
+	if len(cfg.Listeners) == 0 {
+		cfg.listeners = []*config{cfg}
+		names[cfg.listenerName] = true
+	}
+	for i, listener := range cfg.Listeners {
+		listenerCfg, err := cfg.newListenerConfig(listener, configString, dataDir)
+		if err != nil {
+			return fmt.Errorf("invalid listener %v: %w", i+1, err)
+		}
+		if names[listenerCfg.listenerName] {
+			return fmt.Errorf("duplicate listener %q", listenerCfg.listenerName)
+		}
+		names[listenerCfg.listenerName] = true
+		cfg.listeners = append(cfg.listeners, listenerCfg)
+	}
+	for _, listenerCfg := range cfg.listeners {
+		previousListener, ok := previous[listenerCfg.listenerName]
+		if !ok {
+			if len(previous) > 0 {
+				warningLogger.Printf("Listener %q added, restart to start listening on %v", listenerCfg.listenerName, listenerCfg.Server.ListenAddress)
+			}
+			listenerCfg.current = &atomic.Pointer[config]{}
+			continue
+		}
+		if previousListener.address != listenerCfg.Server.ListenAddress {
+			warningLogger.Printf("Listener %q moved, restart to listen on %v instead of %v", listenerCfg.listenerName, listenerCfg.Server.ListenAddress, previousListener.address)
+		}
+		listenerCfg.current = previousListener.current
+	}
+	for name := range previous {
+		if !names[name] {
+			warningLogger.Printf("Listener %q removed, restart to stop listening", name)
+		}
+	}
+	return nil
+}
+
+// latest returns the config last loaded for the listener cfg was loaded for. Connections use the latest config when
+// they're accepted, so that reloads apply to them.
+func (cfg *config) latest() *config {
+	if cfg.current == nil {
+		return cfg
+	}
+	if latest := cfg.current.Load(); latest != nil {
+		return latest
+	}
+	return cfg
+}
+
+// listenerSSHConfig returns the SSH config to listen with. The algorithms, host keys and authentication methods are
+// fixed once the listener is started, but authentication follows the latest config.
+func (cfg *config) listenerSSHConfig() *ssh.ServerConfig {
+	sshConfig := *cfg.sshConfig
+	if sshConfig.PasswordCallback != nil {
+		sshConfig.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if callback := cfg.latest().sshConfig.PasswordCallback; callback != nil {
+				return callback(conn, password)
+			}
+			return nil, errors.New("")
+		}
+	}
+	if sshConfig.PublicKeyCallback != nil {
+		sshConfig.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if callback := cfg.latest().sshConfig.PublicKeyCallback; callback != nil {
+				return callback(conn, key)
+			}
+			return nil, errors.New("")
+		}
+	}
+	if sshConfig.KeyboardInteractiveCallback != nil {
+		sshConfig.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			if callback := cfg.latest().sshConfig.KeyboardInteractiveCallback; callback != nil {
+				return callback(conn, client)
+			}
+			return nil, errors.New("")
+		}
+	}
+	if sshConfig.AuthLogCallback != nil {
+		sshConfig.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+			if callback := cfg.latest().sshConfig.AuthLogCallback; callback != nil {
+				callback(conn, method, err)
+			}
+		}
+	}
+	if sshConfig.BannerCallback != nil {
+		sshConfig.BannerCallback = func(conn ssh.ConnMetadata) string {
+			if callback := cfg.latest().sshConfig.BannerCallback; callback != nil {
+				return callback(conn)
+			}
+			return ""
+		}
+	}
+	return &sshConfig
+}
+
+func (cfg *config) newListenerConfig(listener listenerConfig, configString, dataDir string) (*config, error) {
+	if listener.ListenAddress == "" {
+		return nil, errors.New("no listen address")
+	}
+	listenerCfg := &config{}
+	listenerCfg.setDefaults()
+	if err := yaml.UnmarshalStrict([]byte(configString), listenerCfg); err != nil {
+		return nil, err
+	}
+	overrides, err := yaml.Marshal(listener.overrides())
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(overrides, listenerCfg); err != nil {
+		return nil, err
+	}
+	listenerCfg.Listeners = nil
+	listenerCfg.Server.ListenAddress = listener.ListenAddress
+	if listener.HostKeys != nil {
+		listenerCfg.Server.HostKeys = listener.HostKeys
+	}
+	listenerCfg.Server.TCPIPServices = cfg.Server.TCPIPServices
+	listenerCfg.listenerName = listener.Name
+	if listenerCfg.listenerName == "" {
+		listenerCfg.listenerName = listener.ListenAddress
+	}
+	// The sensor, sinks and state kept across connections are shared by all listeners.
+	listenerCfg.Sensor = cfg.Sensor
+	listenerCfg.idGenerator = cfg.idGenerator
+	listenerCfg.authTracker = cfg.authTracker
+	listenerCfg.credentialMemory = cfg.credentialMemory
+	listenerCfg.mongoRecorder = cfg.mongoRecorder
+	listenerCfg.sinks = cfg.sinks
+	listenerCfg.fetcher = cfg.fetcher
+	if err := listenerCfg.setupListener(dataDir); err != nil {
+		return nil, err
+	}
+	return listenerCfg, nil
+}
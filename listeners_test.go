@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestListeners(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	templateDir := t.TempDir()
+	if err := os.WriteFile(path.Join(templateDir, "router.txt"), []byte("router\n"), 0644); err != nil {
+		t.Fatalf("Failed to write template file: %v", err)
+	}
+	keyFile, err := generateKey(t.TempDir(), ed25519_key)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	cfgString := `
+ssh_proto:
+  version: SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.6
+  banner: Ubuntu
+auth:
+  no_auth: true
+limits:
+  per_ip:
+    max: 3
+listeners:
+  - name: ubuntu
+    listen_address: 0.0.0.0:22
+  - listen_address: 0.0.0.0:2222
+    host_keys: [` + keyFile + `]
+    ssh_proto:
+      version: SSH-2.0-dropbear_2020.81
+      banner: ""
+    auth:
+      no_auth: false
+    commands:
+      disabled: [curl]
+    filesystem:
+      template: ` + templateDir + `
+`
+	cfg := &config{}
+	if err := cfg.load(cfgString, dataDir); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if len(cfg.listeners) != 2 {
+		t.Fatalf("listeners=%v, want 2", len(cfg.listeners))
+	}
+	ubuntu, router := cfg.listeners[0], cfg.listeners[1]
+	if ubuntu.listenerName != "ubuntu" || router.listenerName != "0.0.0.0:2222" {
+		t.Errorf("names=%q and %q, want ubuntu and 0.0.0.0:2222", ubuntu.listenerName, router.listenerName)
+	}
+	if ubuntu.Server.ListenAddress != "0.0.0.0:22" || router.Server.ListenAddress != "0.0.0.0:2222" {
+		t.Errorf("addresses=%v and %v, want 0.0.0.0:22 and 0.0.0.0:2222", ubuntu.Server.ListenAddress, router.Server.ListenAddress)
+	}
+	if ubuntu.sshConfig.ServerVersion != "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.6" || ubuntu.SSHProto.Banner != "Ubuntu" {
+		t.Errorf("version=%q, banner=%q, want the top level ones", ubuntu.sshConfig.ServerVersion, ubuntu.SSHProto.Banner)
+	}
+	if router.sshConfig.ServerVersion != "SSH-2.0-dropbear_2020.81" || router.sshConfig.BannerCallback != nil {
+		t.Errorf("version=%q, banner=%v, want the listener's", router.sshConfig.ServerVersion, router.sshConfig.BannerCallback != nil)
+	}
+	if !ubuntu.sshConfig.NoClientAuth || router.sshConfig.NoClientAuth {
+		t.Errorf("noClientAuth=%v and %v, want true and false", ubuntu.sshConfig.NoClientAuth, router.sshConfig.NoClientAuth)
+	}
+	if len(ubuntu.parsedHostKeys) != 3 || len(router.parsedHostKeys) != 1 {
+		t.Errorf("hostKeys=%v and %v, want 3 and 1", len(ubuntu.parsedHostKeys), len(router.parsedHostKeys))
+	}
+	if ubuntu.command("curl") == nil || router.command("curl") != nil || router.command("wget") == nil {
+		t.Errorf("curl=%v and %v, wget=%v, want curl disabled on the second listener only", ubuntu.command("curl") != nil, router.command("curl") != nil, router.command("wget") != nil)
+	}
+	if _, node, _ := newVirtualFS(ubuntu.filesystemTemplate, "root").walk("/router.txt", true); node != nil {
+		t.Errorf("router.txt exists on the first listener")
+	}
+	if _, node, _ := newVirtualFS(router.filesystemTemplate, "root").walk("/router.txt", true); node == nil {
+		t.Errorf("router.txt doesn't exist on the second listener")
+	}
+	if ubuntu.Limits.PerIP.Max != 3 || router.Limits.PerIP.Max != 3 {
+		t.Errorf("limits=%v and %v, want the top level ones", ubuntu.Limits.PerIP.Max, router.Limits.PerIP.Max)
+	}
+	if ubuntu.authTracker != cfg.authTracker || router.credentialMemory != cfg.credentialMemory {
+		t.Errorf("auth state isn't shared between listeners")
+	}
+
+	if ubuntu.latest() != ubuntu || router.latest() != router {
+		t.Errorf("latest=%p and %p, want the loaded listeners", ubuntu.latest(), router.latest())
+	}
+
+	// Reloading publishes new configs to the running listeners, leaving the old ones untouched.
+	if err := cfg.load(strings.Replace(cfgString, "banner: Ubuntu", "banner: Debian", 1), dataDir); err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if ubuntu.latest() != cfg.listeners[0] || router.latest() != cfg.listeners[1] {
+		t.Errorf("latest=%p and %p, want the reloaded listeners", ubuntu.latest(), router.latest())
+	}
+	if ubuntu.SSHProto.Banner != "Ubuntu" || ubuntu.latest().SSHProto.Banner != "Debian" {
+		t.Errorf("banners=%q and %q, want Ubuntu and Debian", ubuntu.SSHProto.Banner, ubuntu.latest().SSHProto.Banner)
+	}
+
+	// Authentication follows the reloaded config, even though the listener keeps its SSH config.
+	sshConfig := router.listenerSSHConfig()
+	if _, err := sshConfig.PasswordCallback(mockConnContext{}, []byte("hunter2")); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+	if err := cfg.load(strings.Replace(cfgString, "no_auth: false", "no_auth: false\n      password_auth:\n        accepted: false", 1), dataDir); err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if _, err := sshConfig.PasswordCallback(mockConnContext{}, []byte("hunter2")); err == nil {
+		t.Errorf("err=nil, want an error")
+	}
+}
+
+func TestListenerErrors(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTestKeys(t, dataDir)
+	tests := []string{
+		"listeners:\n  - name: a\n",
+		"listeners:\n  - listen_address: 0.0.0.0:22\n  - listen_address: 0.0.0.0:22\n",
+		"listeners:\n  - listen_address: 0.0.0.0:22\n    ssh_proto:\n      unknown: true\n",
+		"listeners:\n  - listen_address: 0.0.0.0:22\n    commands:\n      enabled: [systemctl]\n",
+	}
+	for _, test := range tests {
+		cfg := &config{}
+		if err := cfg.load(test, dataDir); err == nil {
+			t.Errorf("config=%q: err=nil, want an error", test)
+		}
+	}
+}
+
+func TestListenerLogs(t *testing.T) {
+	cfg := &config{listenerName: "router"}
+	logBuffer := setupLogBuffer(t, cfg)
+	context := connContext{ConnMetadata: mockConnContext{}, cfg: cfg}
+	context.logEvent(connectionCloseLog{})
+	if logs, expected := logBuffer.String(), "[router] [127.0.0.1:1234] connection closed\n"; logs != expected {
+		t.Errorf("logs=%q, want %q", logs, expected)
+	}
+
+	cfg.Logging.JSON = true
+	logBuffer = setupLogBuffer(t, cfg)
+	context.logEvent(connectionCloseLog{})
+	var logEntry struct {
+		Listener string `json:"listener"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(logBuffer.Bytes())).Decode(&logEntry); err != nil {
+		t.Fatalf("Failed to parse log: %v", err)
+	}
+	if logEntry.Listener != "router" {
+		t.Errorf("listener=%q, want router", logEntry.Listener)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"go.mongodb.org/mongo-driver/v2/bson"
-	"log"
 	"net"
 	"path/filepath"
 	"strings"
@@ -12,32 +11,38 @@ import (
 )
 
 var eventTypeIdMap = map[string]int{
-	"no_auth":                   1,
-	"password_auth":             2,
-	"public_key_auth":           3,
-	"keyboard_interactive_auth": 4,
-	"connection":                5,
-	"connection_close":          6,
-	"tcpip_forward":             7,
-	"cancel_tcpip_forward":      8,
-	"no_more_sessions":          9,
-	"host_keys_prove":           10,
-	"session":                   11,
-	"session_close":             12,
-	"session_input":             13,
-	"direct_tcpip":              14,
-	"direct_tcpip_close":        15,
-	"direct_tcpip_input":        16,
-	"pty":                       17,
-	"shell":                     18,
-	"exec":                      19,
-	"subsystem":                 20,
-	"x11":                       21,
-	"env":                       22,
-	"window_change":             23,
-	"debug_global_request":      24,
-	"debug_channel":             25,
-	"debug_channel_request":     26,
+	"no_auth":                         1,
+	"password_auth":                   2,
+	"public_key_auth":                 3,
+	"keyboard_interactive_auth":       4,
+	"connection":                      5,
+	"connection_close":                6,
+	"tcpip_forward":                   7,
+	"cancel_tcpip_forward":            8,
+	"no_more_sessions":                9,
+	"host_keys_prove":                 10,
+	"session":                         11,
+	"session_close":                   12,
+	"session_input":                   13,
+	"direct_tcpip":                    14,
+	"direct_tcpip_close":              15,
+	"direct_tcpip_input":              16,
+	"pty":                             17,
+	"shell":                           18,
+	"exec":                            19,
+	"subsystem":                       20,
+	"x11":                             21,
+	"env":                             22,
+	"window_change":                   23,
+	"debug_global_request":            24,
+	"debug_channel":                   25,
+	"debug_channel_request":           26,
+	"file_upload":                     27,
+	"download_attempt":                28,
+	"sftp":                            29,
+	"file_download":                   30,
+	"raw_capture":                     31,
+	"keyboard_interactive_auth_abort": 32,
 }
 
 type logEntry interface {
@@ -104,19 +109,37 @@ func (entry passwordAuthLog) eventType() string {
 
 type publicKeyAuthLog struct {
 	authLog
-	PublicKeyFingerprint string `json:"public_key" bson:"public_key"`
+	PublicKeyFingerprint    string          `json:"public_key" bson:"public_key"`
+	PublicKeyMD5Fingerprint string          `json:"public_key_md5,omitempty" bson:"public_key_md5,omitempty"`
+	PublicKeyType           string          `json:"public_key_type,omitempty" bson:"public_key_type,omitempty"`
+	PublicKeyBits           int             `json:"public_key_bits,omitempty" bson:"public_key_bits,omitempty"`
+	AuthorizedKey           string          `json:"authorized_key,omitempty" bson:"authorized_key,omitempty"`
+	Signed                  bool            `json:"signed" bson:"signed"`
+	Certificate             *certificateLog `json:"certificate,omitempty" bson:"certificate,omitempty"`
 }
 
 func (entry publicKeyAuthLog) String() string {
+	if entry.Signed {
+		return fmt.Sprintf("authentication for user %q with public key %q signed and %v", entry.User, entry.PublicKeyFingerprint, entry.Accepted)
+	}
 	return fmt.Sprintf("authentication for user %q with public key %q %v", entry.User, entry.PublicKeyFingerprint, entry.Accepted)
 }
 func (entry publicKeyAuthLog) eventType() string {
 	return "public_key_auth"
 }
 
+// labeledAnswer is a keyboard interactive answer to a question with a label. The round is kept so that a label asked
+// in several rounds doesn't hide the earlier answers.
+type labeledAnswer struct {
+	Round  int    `json:"round" bson:"round"`
+	Label  string `json:"label" bson:"label"`
+	Answer string `json:"answer" bson:"answer"`
+}
+
 type keyboardInteractiveAuthLog struct {
 	authLog
-	Answers []string `json:"answers" bson:"answers"`
+	Answers []string        `json:"answers" bson:"answers"`
+	Labels  []labeledAnswer `json:"labels,omitempty" bson:"labels,omitempty"`
 }
 
 func (entry keyboardInteractiveAuthLog) String() string {
@@ -126,11 +149,37 @@ func (entry keyboardInteractiveAuthLog) eventType() string {
 	return "keyboard_interactive_auth"
 }
 
+type keyboardInteractiveAuthAbortLog struct {
+	authLog
+	Round   int             `json:"round" bson:"round"`
+	Answers []string        `json:"answers" bson:"answers"`
+	Labels  []labeledAnswer `json:"labels,omitempty" bson:"labels,omitempty"`
+	Error   string          `json:"error" bson:"error"`
+}
+
+func (entry keyboardInteractiveAuthAbortLog) String() string {
+	return fmt.Sprintf("authentication for user %q with keyboard interactive answers %q aborted in round %v: %v", entry.User, entry.Answers, entry.Round, entry.Error)
+}
+func (entry keyboardInteractiveAuthAbortLog) eventType() string {
+	return "keyboard_interactive_auth_abort"
+}
+
 type connectionLog struct {
-	ClientVersion string `json:"client_version" bson:"client_version"`
+	ClientVersion     string   `json:"client_version" bson:"client_version"`
+	KexAlgorithms     []string `json:"kex_algorithms,omitempty" bson:"kex_algorithms,omitempty"`
+	HostKeyAlgorithms []string `json:"host_key_algorithms,omitempty" bson:"host_key_algorithms,omitempty"`
+	Ciphers           []string `json:"ciphers,omitempty" bson:"ciphers,omitempty"`
+	MACs              []string `json:"macs,omitempty" bson:"macs,omitempty"`
+	Compression       []string `json:"compression,omitempty" bson:"compression,omitempty"`
+	HASSH             string   `json:"hassh,omitempty" bson:"hassh,omitempty"`
+	HASSHAlgorithms   string   `json:"hassh_algorithms,omitempty" bson:"hassh_algorithms,omitempty"`
+	ServerHASSH       string   `json:"server_hassh,omitempty" bson:"server_hassh,omitempty"`
 }
 
 func (entry connectionLog) String() string {
+	if entry.HASSH != "" {
+		return fmt.Sprintf("connection with client version %q and HASSH %v established", entry.ClientVersion, entry.HASSH)
+	}
 	return fmt.Sprintf("connection with client version %q established", entry.ClientVersion)
 }
 func (entry connectionLog) eventType() string {
@@ -138,9 +187,13 @@ func (entry connectionLog) eventType() string {
 }
 
 type connectionCloseLog struct {
+	Reason string `json:"reason,omitempty" bson:"reason,omitempty"`
 }
 
 func (entry connectionCloseLog) String() string {
+	if entry.Reason != "" {
+		return fmt.Sprintf("connection closed (%v)", entry.Reason)
+	}
 	return "connection closed"
 }
 func (entry connectionCloseLog) eventType() string {
@@ -211,10 +264,19 @@ func (entry sessionLog) eventType() string {
 
 type sessionCloseLog struct {
 	channelLog
+	Recording string `json:"recording,omitempty" bson:"recording,omitempty"`
+	Reason    string `json:"reason,omitempty" bson:"reason,omitempty"`
 }
 
 func (entry sessionCloseLog) String() string {
-	return fmt.Sprintf("[channel %v] closed", entry.ChannelID)
+	closed := fmt.Sprintf("[channel %v] closed", entry.ChannelID)
+	if entry.Reason != "" {
+		closed = fmt.Sprintf("%v (%v)", closed, entry.Reason)
+	}
+	if entry.Recording != "" {
+		return fmt.Sprintf("%v, recorded to %q", closed, entry.Recording)
+	}
+	return closed
 }
 func (entry sessionCloseLog) eventType() string {
 	return "session_close"
@@ -355,6 +417,88 @@ func (entry windowChangeLog) eventType() string {
 	return "window_change"
 }
 
+type fileUploadLog struct {
+	channelLog
+	Path   string `json:"path" bson:"path"`
+	Size   int    `json:"size" bson:"size"`
+	SHA256 string `json:"sha256" bson:"sha256"`
+}
+
+func (entry fileUploadLog) String() string {
+	return fmt.Sprintf("[channel %v] file %q with size %v and SHA-256 %v uploaded", entry.ChannelID, entry.Path, entry.Size, entry.SHA256)
+}
+func (entry fileUploadLog) eventType() string {
+	return "file_upload"
+}
+
+type downloadAttemptLog struct {
+	channelLog
+	Tool      string `json:"tool" bson:"tool"`
+	URL       string `json:"url" bson:"url"`
+	Output    string `json:"output" bson:"output"`
+	UserAgent string `json:"user_agent" bson:"user_agent"`
+}
+
+func (entry downloadAttemptLog) String() string {
+	return fmt.Sprintf("[channel %v] download of %q to %q with %v using user agent %q attempted", entry.ChannelID, entry.URL, entry.Output, entry.Tool, entry.UserAgent)
+}
+func (entry downloadAttemptLog) eventType() string {
+	return "download_attempt"
+}
+
+type sftpLog struct {
+	channelLog
+	Operation string `json:"operation" bson:"operation"`
+	Path      string `json:"path" bson:"path"`
+	Target    string `json:"target" bson:"target"`
+	Size      int    `json:"size" bson:"size"`
+}
+
+func (entry sftpLog) String() string {
+	switch {
+	case entry.Target != "":
+		return fmt.Sprintf("[channel %v] SFTP %v of %q to %q requested", entry.ChannelID, entry.Operation, entry.Path, entry.Target)
+	case entry.Operation == "read" || entry.Operation == "write":
+		return fmt.Sprintf("[channel %v] SFTP %v of %v bytes of %q completed", entry.ChannelID, entry.Operation, entry.Size, entry.Path)
+	}
+	return fmt.Sprintf("[channel %v] SFTP %v of %q requested", entry.ChannelID, entry.Operation, entry.Path)
+}
+func (entry sftpLog) eventType() string {
+	return "sftp"
+}
+
+type fileDownloadLog struct {
+	channelLog
+	Path   string `json:"path" bson:"path"`
+	Size   int    `json:"size" bson:"size"`
+	SHA256 string `json:"sha256" bson:"sha256"`
+}
+
+func (entry fileDownloadLog) String() string {
+	return fmt.Sprintf("[channel %v] file %q with size %v and SHA-256 %v downloaded", entry.ChannelID, entry.Path, entry.Size, entry.SHA256)
+}
+func (entry fileDownloadLog) eventType() string {
+	return "file_download"
+}
+
+type rawCaptureLog struct {
+	channelLog
+	StdinSize    int64  `json:"stdin_size" bson:"stdin_size"`
+	StdinSHA256  string `json:"stdin_sha256" bson:"stdin_sha256"`
+	StdoutSize   int64  `json:"stdout_size" bson:"stdout_size"`
+	StdoutSHA256 string `json:"stdout_sha256" bson:"stdout_sha256"`
+	StderrSize   int64  `json:"stderr_size" bson:"stderr_size"`
+	StderrSHA256 string `json:"stderr_sha256" bson:"stderr_sha256"`
+}
+
+func (entry rawCaptureLog) String() string {
+	return fmt.Sprintf("[channel %v] raw I/O captured: %v bytes of stdin with SHA-256 %v, %v bytes of stdout with SHA-256 %v, %v bytes of stderr with SHA-256 %v",
+		entry.ChannelID, entry.StdinSize, entry.StdinSHA256, entry.StdoutSize, entry.StdoutSHA256, entry.StderrSize, entry.StderrSHA256)
+}
+func (entry rawCaptureLog) eventType() string {
+	return "raw_capture"
+}
+
 type debugGlobalRequestLog struct {
 	RequestType string `json:"request_type" bson:"request_type"`
 	WantReply   bool   `json:"want_reply" bson:"want_reply"`
@@ -411,51 +555,17 @@ func (entry debugChannelRequestLog) eventType() string {
 }
 
 func (context connContext) logEvent(entry logEntry) {
-	if strings.HasPrefix(entry.eventType(), "debug_") && !context.cfg.Logging.Debug {
-		return
-	}
-	if context.cfg.MongoDBConfig.Enable && context.cfg.mongoRecorder.isConnected {
-		context.logEventToMongo(entry)
+	event := sinkEvent{
+		Time:         time.Now(),
+		Sensor:       context.cfg.Sensor.Name,
+		Listener:     context.cfg.listenerName,
+		ConnectionID: context.connectionID,
+		ChannelUID:   context.channelUID,
+		Source:       context.RemoteAddr(),
+		Entry:        entry,
 	}
-	if context.cfg.Logging.JSON {
-		var jsonEntry interface{}
-		tcpSource := context.RemoteAddr().(*net.TCPAddr)
-		source := getAddressLog(tcpSource.IP.String(), tcpSource.Port, context.cfg)
-		if context.cfg.Logging.Timestamps {
-			jsonEntry = struct {
-				SessionId int64       `json:"session_id"`
-				Time      int64       `json:"time"`
-				Source    interface{} `json:"source"`
-				EventType string      `json:"event_type"`
-				Event     logEntry    `json:"event"`
-			}{
-				context.sessionId,
-				time.Now().Unix(),
-				source,
-				entry.eventType(),
-				entry,
-			}
-		} else {
-			jsonEntry = struct {
-				SessionId int64       `json:"session_id"`
-				Source    interface{} `json:"source"`
-				EventType string      `json:"event_type"`
-				Event     logEntry    `json:"event"`
-			}{
-				context.sessionId,
-				source,
-				entry.eventType(),
-				entry,
-			}
-		}
-		logBytes, err := json.Marshal(jsonEntry)
-		if err != nil {
-			warningLogger.Printf("Failed to log event: %v", err)
-			return
-		}
-		log.Print(string(logBytes))
-	} else {
-		log.Printf("[%v] %v", context.RemoteAddr().String(), entry)
+	for _, sink := range context.cfg.sinks {
+		sink.send(event)
 	}
 }
 
@@ -465,20 +575,3 @@ func mergeBSONM(bson1, bson2 bson.M) *bson.M {
 	}
 	return &bson1
 }
-
-func (context connContext) logEventToMongo(entry logEntry) {
-	eventType := entry.eventType()
-	eventTypeId, ok := eventTypeIdMap[eventType]
-	tcpSource := context.RemoteAddr().(*net.TCPAddr)
-	if !ok {
-		eventTypeId = 0
-	}
-	logRecord := &bson.M{
-		"time":        time.Now(),
-		"session_id":  context.sessionId,
-		"event_type":  eventTypeId,
-		"source_ip":   tcpSource.IP.String(),
-		"source_port": tcpSource.Port,
-	}
-	LogEventToMongo(context.cfg.mongoRecorder, eventType, logRecord, entry)
-}
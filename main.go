@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -76,6 +78,9 @@ func main() {
 	if cfg.MongoDBConfig.Enable {
 		mr := NewMongoRecorder(cfg)
 		cfg.mongoRecorder = mr
+		for _, listenerCfg := range cfg.listeners {
+			listenerCfg.mongoRecorder = mr
+		}
 	}
 
 	if *oldLog != "" {
@@ -83,13 +88,21 @@ func main() {
 		return
 	}
 
-	listener, err := sshutils.Listen(cfg.Server.ListenAddress, cfg.sshConfig)
-	if err != nil {
-		errorLogger.Fatalf("Failed to listen for connections: %v", err)
+	// Limits apply to connections from a source to any listener.
+	limiter := newConnectionLimiter()
+	for _, listenerCfg := range cfg.listeners {
+		listener, err := sshutils.Listen(listenerCfg.Server.ListenAddress, listenerCfg.listenerSSHConfig())
+		if err != nil {
+			errorLogger.Fatalf("Failed to listen for connections: %v", err)
+		}
+		defer listener.Close()
+		if listenerCfg.listenerName != "" {
+			infoLogger.Printf("Listener %q listening on %v", listenerCfg.listenerName, listener.Addr())
+		} else {
+			infoLogger.Printf("Listening on %v", listener.Addr())
+		}
+		go serve(listener, listenerCfg, limiter)
 	}
-	defer listener.Close()
-
-	infoLogger.Printf("Listening on %v", listener.Addr())
 
 	if cfg.Logging.MetricsAddress != "" {
 		http.Handle("/metrics", promhttp.Handler())
@@ -101,12 +114,30 @@ func main() {
 		}()
 	}
 
+	select {}
+}
+
+func serve(listener *sshutils.Listener, cfg *config, limiter *connectionLimiter) {
+	acceptListener := handshakeTimeoutListener{kexInitListener{tarpitListener{limitListener{newProxyProtocolListener(listener.Listener, cfg), cfg, limiter}, cfg}}, cfg}
+	conns := make(chan net.Conn)
+	listener.Listener = handshakeListener{acceptListener, conns}
 	for {
-		conn, err := listener.Accept()
+		conn, err := acceptListener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			warningLogger.Printf("Failed to accept connection: %v", err)
 			continue
 		}
-		go handleConnection(conn, cfg)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				warningLogger.Printf("Failed to accept connection: %v", err)
+				return
+			}
+			handleConnection(conn, cfg.latest())
+		}()
+		conns <- conn
 	}
 }
@@ -86,6 +86,19 @@ func LogEventToMongo(mongoRecorder *MongoRecorder, eventType string, logRecord *
 	var err error
 	collect := mongoRecorder.sshLogCollect
 	switch eventType {
+	case "connection":
+		mergeBSONM(*logRecord, bson.M{
+			"client_version":      entry.(connectionLog).ClientVersion,
+			"kex_algorithms":      entry.(connectionLog).KexAlgorithms,
+			"host_key_algorithms": entry.(connectionLog).HostKeyAlgorithms,
+			"ciphers":             entry.(connectionLog).Ciphers,
+			"macs":                entry.(connectionLog).MACs,
+			"compression":         entry.(connectionLog).Compression,
+			"hassh":               entry.(connectionLog).HASSH,
+			"hassh_algorithms":    entry.(connectionLog).HASSHAlgorithms,
+			"server_hassh":        entry.(connectionLog).ServerHASSH,
+		})
+		break
 	case "no_auth":
 		if entry.(noAuthLog).User != "" {
 			mergeBSONM(*logRecord, bson.M{
@@ -107,19 +120,37 @@ func LogEventToMongo(mongoRecorder *MongoRecorder, eventType string, logRecord *
 		break
 	case "public_key_auth":
 		mergeBSONM(*logRecord, bson.M{
-			"public_key": entry.(publicKeyAuthLog).PublicKeyFingerprint,
-			"user":       entry.(publicKeyAuthLog).User,
-			"accepted":   entry.(publicKeyAuthLog).Accepted,
+			"public_key":      entry.(publicKeyAuthLog).PublicKeyFingerprint,
+			"public_key_md5":  entry.(publicKeyAuthLog).PublicKeyMD5Fingerprint,
+			"public_key_type": entry.(publicKeyAuthLog).PublicKeyType,
+			"public_key_bits": entry.(publicKeyAuthLog).PublicKeyBits,
+			"authorized_key":  entry.(publicKeyAuthLog).AuthorizedKey,
+			"signed":          entry.(publicKeyAuthLog).Signed,
+			"certificate":     entry.(publicKeyAuthLog).Certificate,
+			"user":            entry.(publicKeyAuthLog).User,
+			"accepted":        entry.(publicKeyAuthLog).Accepted,
 		})
 		collect = mongoRecorder.authLogCollect
 		break
 	case "keyboard_interactive_auth":
 		logRecord = mergeBSONM(*logRecord, bson.M{
 			"answers":  entry.(keyboardInteractiveAuthLog).Answers,
+			"labels":   entry.(keyboardInteractiveAuthLog).Labels,
 			"user":     entry.(keyboardInteractiveAuthLog).User,
 			"accepted": entry.(keyboardInteractiveAuthLog).Accepted,
 		})
 
+		collect = mongoRecorder.authLogCollect
+		break
+	case "keyboard_interactive_auth_abort":
+		logRecord = mergeBSONM(*logRecord, bson.M{
+			"round":    entry.(keyboardInteractiveAuthAbortLog).Round,
+			"answers":  entry.(keyboardInteractiveAuthAbortLog).Answers,
+			"labels":   entry.(keyboardInteractiveAuthAbortLog).Labels,
+			"error":    entry.(keyboardInteractiveAuthAbortLog).Error,
+			"user":     entry.(keyboardInteractiveAuthAbortLog).User,
+			"accepted": entry.(keyboardInteractiveAuthAbortLog).Accepted,
+		})
 		collect = mongoRecorder.authLogCollect
 		break
 	case "session_input":
@@ -129,6 +160,56 @@ func LogEventToMongo(mongoRecorder *MongoRecorder, eventType string, logRecord *
 		})
 		collect = mongoRecorder.shellLogCollect
 		break
+	case "file_upload":
+		logRecord = mergeBSONM(*logRecord, bson.M{
+			"path":       entry.(fileUploadLog).Path,
+			"size":       entry.(fileUploadLog).Size,
+			"sha256":     entry.(fileUploadLog).SHA256,
+			"channel_id": entry.(fileUploadLog).ChannelID,
+		})
+		collect = mongoRecorder.shellLogCollect
+		break
+	case "download_attempt":
+		logRecord = mergeBSONM(*logRecord, bson.M{
+			"tool":       entry.(downloadAttemptLog).Tool,
+			"url":        entry.(downloadAttemptLog).URL,
+			"output":     entry.(downloadAttemptLog).Output,
+			"user_agent": entry.(downloadAttemptLog).UserAgent,
+			"channel_id": entry.(downloadAttemptLog).ChannelID,
+		})
+		collect = mongoRecorder.shellLogCollect
+		break
+	case "sftp":
+		logRecord = mergeBSONM(*logRecord, bson.M{
+			"operation":  entry.(sftpLog).Operation,
+			"path":       entry.(sftpLog).Path,
+			"target":     entry.(sftpLog).Target,
+			"size":       entry.(sftpLog).Size,
+			"channel_id": entry.(sftpLog).ChannelID,
+		})
+		collect = mongoRecorder.shellLogCollect
+		break
+	case "file_download":
+		logRecord = mergeBSONM(*logRecord, bson.M{
+			"path":       entry.(fileDownloadLog).Path,
+			"size":       entry.(fileDownloadLog).Size,
+			"sha256":     entry.(fileDownloadLog).SHA256,
+			"channel_id": entry.(fileDownloadLog).ChannelID,
+		})
+		collect = mongoRecorder.shellLogCollect
+		break
+	case "raw_capture":
+		logRecord = mergeBSONM(*logRecord, bson.M{
+			"stdin_size":    entry.(rawCaptureLog).StdinSize,
+			"stdin_sha256":  entry.(rawCaptureLog).StdinSHA256,
+			"stdout_size":   entry.(rawCaptureLog).StdoutSize,
+			"stdout_sha256": entry.(rawCaptureLog).StdoutSHA256,
+			"stderr_size":   entry.(rawCaptureLog).StderrSize,
+			"stderr_sha256": entry.(rawCaptureLog).StderrSHA256,
+			"channel_id":    entry.(rawCaptureLog).ChannelID,
+		})
+		collect = mongoRecorder.shellLogCollect
+		break
 	default:
 		logRecord = mergeBSONM(*logRecord, bson.M{
 			"payload": entry,
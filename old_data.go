@@ -13,32 +13,38 @@ import (
 )
 
 var eventTypeCounter = map[string]int{
-	"no_auth":                   0,
-	"password_auth":             0,
-	"public_key_auth":           0,
-	"keyboard_interactive_auth": 0,
-	"connection":                0,
-	"connection_close":          0,
-	"tcpip_forward":             0,
-	"cancel_tcpip_forward":      0,
-	"no_more_sessions":          0,
-	"host_keys_prove":           0,
-	"session":                   0,
-	"session_close":             0,
-	"session_input":             0,
-	"direct_tcpip":              0,
-	"direct_tcpip_close":        0,
-	"direct_tcpip_input":        0,
-	"pty":                       0,
-	"shell":                     0,
-	"exec":                      0,
-	"subsystem":                 0,
-	"x11":                       0,
-	"env":                       0,
-	"window_change":             0,
-	"debug_global_request":      0,
-	"debug_channel":             0,
-	"debug_channel_request":     0,
+	"no_auth":                         0,
+	"password_auth":                   0,
+	"public_key_auth":                 0,
+	"keyboard_interactive_auth":       0,
+	"connection":                      0,
+	"connection_close":                0,
+	"tcpip_forward":                   0,
+	"cancel_tcpip_forward":            0,
+	"no_more_sessions":                0,
+	"host_keys_prove":                 0,
+	"session":                         0,
+	"session_close":                   0,
+	"session_input":                   0,
+	"direct_tcpip":                    0,
+	"direct_tcpip_close":              0,
+	"direct_tcpip_input":              0,
+	"pty":                             0,
+	"shell":                           0,
+	"exec":                            0,
+	"subsystem":                       0,
+	"x11":                             0,
+	"env":                             0,
+	"window_change":                   0,
+	"debug_global_request":            0,
+	"debug_channel":                   0,
+	"debug_channel_request":           0,
+	"file_upload":                     0,
+	"download_attempt":                0,
+	"sftp":                            0,
+	"file_download":                   0,
+	"raw_capture":                     0,
+	"keyboard_interactive_auth_abort": 0,
 }
 
 func TrimAndRemoveQuote(str string) string {
@@ -116,7 +122,7 @@ func parseOldLogToMongo(cfg *config, filePath string, isJSON bool, dryRun bool)
 					}
 					logRecord := &bson.M{
 						"time":        logObj.Time,
-						"session_id":  0,
+						"session_id":  "",
 						"event_type":  eventTypeId,
 						"source_ip":   ipAddr,
 						"source_port": ipPort,
@@ -192,7 +198,7 @@ func parseOldLogToMongo(cfg *config, filePath string, isJSON bool, dryRun bool)
 				eventTypeId := eventTypeIdMap[eventType]
 				logRecord := &bson.M{
 					"time":        timeStr,
-					"session_id":  0,
+					"session_id":  "",
 					"event_type":  eventTypeId,
 					"source_ip":   ipAddr,
 					"source_port": ipPort,
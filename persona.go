@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serverPersona describes how a real SSH server presents itself, so that the version string, algorithm lists, host
+// key types and banner don't contradict each other. Algorithms x/crypto doesn't implement are left out, as it would
+// silently drop them anyway.
+type serverPersona struct {
+	Version      string
+	Banner       string
+	KeyExchanges []string
+	Ciphers      []string
+	MACs         []string
+	HostKeys     []keySignature
+}
+
+var serverPersonas = map[string]serverPersona{
+	"openssh-8.9-ubuntu": {
+		Version: "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.10",
+		KeyExchanges: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group14-sha256",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com",
+			"aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		},
+		MACs: []string{
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+			"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
+		},
+		HostKeys: []keySignature{rsa_key, ecdsa_key, ed25519_key},
+	},
+	"openssh-7.4-centos": {
+		Version: "SSH-2.0-OpenSSH_7.4",
+		KeyExchanges: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512",
+			"diffie-hellman-group-exchange-sha1", "diffie-hellman-group14-sha256",
+			"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+		},
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com",
+			"aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		},
+		MACs: []string{
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+			"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
+		},
+		HostKeys: []keySignature{rsa_key, ecdsa_key, ed25519_key},
+	},
+	"dropbear-2020": {
+		Version: "SSH-2.0-dropbear_2020.81",
+		KeyExchanges: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp521", "ecdh-sha2-nistp384", "ecdh-sha2-nistp256",
+			"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+		},
+		Ciphers:  []string{"chacha20-poly1305@openssh.com", "aes128-ctr", "aes256-ctr"},
+		MACs:     []string{"hmac-sha1", "hmac-sha2-256"},
+		HostKeys: []keySignature{ed25519_key, ecdsa_key, rsa_key},
+	},
+}
+
+func personaNames() string {
+	names := make([]string, 0, len(serverPersonas))
+	for name := range serverPersonas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// applyPersona fills the SSH protocol settings left unset, or at their defaults, with those of the configured persona, if
+// any. Settings configured explicitly are kept.
+func (cfg *config) applyPersona() error {
+	if cfg.SSHProto.Persona == "" {
+		return nil
+	}
+	persona, ok := serverPersonas[cfg.SSHProto.Persona]
+	if !ok {
+		return fmt.Errorf("unknown persona %q, known personas are %v", cfg.SSHProto.Persona, personaNames())
+	}
+	if cfg.SSHProto.Version == defaultServerVersion {
+		cfg.SSHProto.Version = persona.Version
+	}
+	if cfg.SSHProto.Banner == defaultBanner {
+		cfg.SSHProto.Banner = persona.Banner
+	}
+	if cfg.SSHProto.KeyExchanges == nil {
+		cfg.SSHProto.KeyExchanges = persona.KeyExchanges
+	}
+	if cfg.SSHProto.Ciphers == nil {
+		cfg.SSHProto.Ciphers = persona.Ciphers
+	}
+	if cfg.SSHProto.MACs == nil {
+		cfg.SSHProto.MACs = persona.MACs
+	}
+	return nil
+}
+
+// hostKeySignatures returns the types of host keys to generate if none are configured, in the order they're offered.
+func (cfg *config) hostKeySignatures() []keySignature {
+	if persona, ok := serverPersonas[cfg.SSHProto.Persona]; ok {
+		return persona.HostKeys
+	}
+	return []keySignature{rsa_key, ecdsa_key, ed25519_key}
+}
+
+func (signature keySignature) matches(key ssh.PublicKey) bool {
+	switch signature {
+	case rsa_key:
+		return key.Type() == ssh.KeyAlgoRSA
+	case ecdsa_key:
+		return strings.HasPrefix(key.Type(), "ecdsa-sha2-")
+	case ed25519_key:
+		return key.Type() == ssh.KeyAlgoED25519
+	}
+	return false
+}
+
+// personaHostKeys orders the host keys the way the configured persona offers them, leaving out types it doesn't have.
+func (cfg *config) personaHostKeys(keys []ssh.Signer) ([]ssh.Signer, error) {
+	persona, ok := serverPersonas[cfg.SSHProto.Persona]
+	if !ok {
+		return keys, nil
+	}
+	var result []ssh.Signer
+	for _, signature := range persona.HostKeys {
+		for _, key := range keys {
+			if signature.matches(key.PublicKey()) {
+				result = append(result, key)
+			}
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("none of the host keys has a type offered by persona %q", cfg.SSHProto.Persona)
+	}
+	return result, nil
+}
+
+// serverHASSHAlgorithms returns the algorithms the HASSHServer fingerprint of the server covers.
+func (cfg *config) serverHASSHAlgorithms() string {
+	sshConfig := cfg.sshConfig.Config
+	sshConfig.SetDefaults()
+	// x/crypto offers strict key exchange and no compression.
+	kexAlgorithms := append(append([]string{}, sshConfig.KeyExchanges...), "kex-strict-s-v00@openssh.com")
+	return strings.Join([]string{
+		strings.Join(kexAlgorithms, ","),
+		strings.Join(sshConfig.Ciphers, ","),
+		strings.Join(sshConfig.MACs, ","),
+		"none",
+	}, ";")
+}
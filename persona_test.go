@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"path"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPersona(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &config{}
+	if err := cfg.load("ssh_proto:\n  persona: dropbear-2020\n", dataDir); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	persona := serverPersonas["dropbear-2020"]
+	if cfg.SSHProto.Version != persona.Version || cfg.SSHProto.Banner != "" {
+		t.Errorf("version=%q, banner=%q, want %q and no banner", cfg.SSHProto.Version, cfg.SSHProto.Banner, persona.Version)
+	}
+	expectedHostKeys := []string{
+		path.Join(dataDir, "host_ed25519_key"),
+		path.Join(dataDir, "host_ecdsa_key"),
+		path.Join(dataDir, "host_rsa_key"),
+	}
+	if !reflect.DeepEqual(cfg.Server.HostKeys, expectedHostKeys) {
+		t.Errorf("hostKeys=%v, want %v", cfg.Server.HostKeys, expectedHostKeys)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer serverConn.Close()
+		ssh.NewServerConn(serverConn, cfg.sshConfig)
+	}()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	// The KEXINIT of the server is sniffed the same way as the one of clients.
+	sniffer := &kexInitConn{Conn: clientConn}
+	defer sniffer.Close()
+	ssh.NewClientConn(sniffer, "", &ssh.ClientConfig{
+		HostKeyCallback: func(string, net.Addr, ssh.PublicKey) error {
+			return nil
+		},
+	})
+	if sniffer.kexInit == nil {
+		t.Fatalf("No server KEXINIT seen")
+	}
+	if algorithms := sniffer.kexInit.hasshAlgorithms(); algorithms != cfg.serverHASSHAlgorithms() {
+		t.Errorf("algorithms=%v, want %v", algorithms, cfg.serverHASSHAlgorithms())
+	}
+	if hassh := sniffer.kexInit.hassh(); hassh != cfg.serverHASSH {
+		t.Errorf("hassh=%v, want %v", hassh, cfg.serverHASSH)
+	}
+	expectedHostKeyAlgorithms := []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA}
+	if !reflect.DeepEqual(sniffer.kexInit.ServerHostKeyAlgos, expectedHostKeyAlgorithms) {
+		t.Errorf("hostKeyAlgorithms=%v, want %v", sniffer.kexInit.ServerHostKeyAlgos, expectedHostKeyAlgorithms)
+	}
+}
+
+func TestPersonaKeepsExplicitSettings(t *testing.T) {
+	cfg := &config{}
+	if err := cfg.load("ssh_proto:\n  persona: dropbear-2020\n  version: SSH-2.0-custom\n  banner: Authorized use only\n  ciphers: [aes256-ctr]\n", t.TempDir()); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	persona := serverPersonas["dropbear-2020"]
+	expectedSSHProto := sshProtoConfig{
+		Persona:      "dropbear-2020",
+		Version:      "SSH-2.0-custom",
+		Banner:       "Authorized use only",
+		KeyExchanges: persona.KeyExchanges,
+		Ciphers:      []string{"aes256-ctr"},
+		MACs:         persona.MACs,
+	}
+	if !reflect.DeepEqual(cfg.SSHProto, expectedSSHProto) {
+		t.Errorf("sshProto=%+v, want %+v", cfg.SSHProto, expectedSSHProto)
+	}
+}
+
+func TestPersonaErrors(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := &config{}
+	if err := cfg.load("ssh_proto:\n  persona: openssh-1.0\n", dataDir); err == nil {
+		t.Errorf("err=nil, want an unknown persona error")
+	}
+	keyFile, err := generateKey(dataDir, ed25519_key)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	// Every persona offers ed25519 keys.
+	if err := cfg.load("server:\n  host_keys: ["+keyFile+"]\nssh_proto:\n  persona: openssh-8.9-ubuntu\n", dataDir); err != nil {
+		t.Errorf("err=%v, want nil", err)
+	}
+	if len(cfg.parsedHostKeys) != 1 {
+		t.Errorf("parsedHostKeys=%v, want one key", cfg.parsedHostKeys)
+	}
+}
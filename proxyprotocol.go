@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// setupProxyProtocol parses the networks of the proxies trusted to send PROXY protocol headers.
+func (cfg *config) setupProxyProtocol() error {
+	cfg.trustedProxies = nil
+	for _, source := range cfg.ProxyProtocol.TrustedSources {
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", source)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			source = fmt.Sprintf("%v/%v", source, bits)
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", source, err)
+		}
+		cfg.trustedProxies = append(cfg.trustedProxies, network)
+	}
+	return nil
+}
+
+func (cfg *config) trustedProxy(addr net.Addr) bool {
+	ip := remoteIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range cfg.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol version 1 or 2 header. It returns the address of the client, or nil if the
+// proxy connected on its own behalf, such as for a health check.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyHeaderV1(reader)
+	case proxyProtocolV2Signature[0]:
+		return readProxyHeaderV2(reader)
+	default:
+		return nil, errors.New("no PROXY protocol header")
+	}
+}
+
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	// The longest header is 107 bytes long.
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == 107 {
+			return nil, errors.New("PROXY protocol header too long")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol family %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid PROXY protocol source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) {
+		return nil, errors.New("invalid PROXY protocol signature")
+	}
+	if version := header[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %v", version)
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, err
+	}
+	switch command := header[12] & 0xf; command {
+	case 0:
+		// LOCAL
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command %v", command)
+	}
+	// Only TCP over IPv4 and IPv6 carry addresses we use, anything else is treated like UNKNOWN in version 1.
+	var ipLength int
+	switch header[13] {
+	case 0x11:
+		ipLength = net.IPv4len
+	case 0x21:
+		ipLength = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(addresses) < 2*ipLength+4 {
+		return nil, errors.New("PROXY protocol addresses too short")
+	}
+	ip := net.IP(addresses[:ipLength])
+	port := binary.BigEndian.Uint16(addresses[2*ipLength:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// proxiedConn is a connection relayed by a proxy, coming from the client address in its PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (conn proxiedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func (conn proxiedConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+type proxyAcceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// proxyProtocolListener reads the PROXY protocol headers of connections from trusted proxies. Headers are read
+// concurrently, so that a slow proxy doesn't hold up the next connection. Once the listener is closed, connections
+// nobody accepts anymore are closed instead of waiting for Accept.
+type proxyProtocolListener struct {
+	net.Listener
+	cfg       *config
+	accepted  chan proxyAcceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyProtocolListener(listener net.Listener, cfg *config) *proxyProtocolListener {
+	proxyListener := &proxyProtocolListener{
+		Listener: listener,
+		cfg:      cfg,
+		accepted: make(chan proxyAcceptResult),
+		closed:   make(chan struct{}),
+	}
+	go proxyListener.acceptLoop()
+	return proxyListener
+}
+
+func (listener *proxyProtocolListener) acceptLoop() {
+	defer listener.markClosed()
+	for {
+		conn, err := listener.Listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			if !listener.deliver(proxyAcceptResult{nil, err}) {
+				return
+			}
+			continue
+		}
+		cfg := listener.cfg.latest()
+		if !cfg.ProxyProtocol.Enabled || !cfg.trustedProxy(conn.RemoteAddr()) {
+			if !listener.deliver(proxyAcceptResult{conn, nil}) {
+				return
+			}
+			continue
+		}
+		go func() {
+			conn, err := readProxiedConn(conn, cfg.ProxyProtocol.HeaderTimeout)
+			if err != nil {
+				warningLogger.Printf("Failed to read PROXY protocol header from %v: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			listener.deliver(proxyAcceptResult{conn, nil})
+		}()
+	}
+}
+
+// deliver hands a result to Accept. It reports false, closing the connection, if the listener is closed first.
+func (listener *proxyProtocolListener) deliver(result proxyAcceptResult) bool {
+	select {
+	case listener.accepted <- result:
+		return true
+	case <-listener.closed:
+		if result.conn != nil {
+			result.conn.Close()
+		}
+		return false
+	}
+}
+
+func (listener *proxyProtocolListener) markClosed() {
+	listener.closeOnce.Do(func() { close(listener.closed) })
+}
+
+func (listener *proxyProtocolListener) Close() error {
+	listener.markClosed()
+	return listener.Listener.Close()
+}
+
+func readProxiedConn(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return conn, err
+		}
+	}
+	reader := bufio.NewReader(conn)
+	addr, err := readProxyHeader(reader)
+	if err != nil {
+		return conn, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return conn, err
+	}
+	if addr == nil {
+		addr = conn.RemoteAddr()
+	}
+	return proxiedConn{conn, reader, addr}, nil
+}
+
+func (listener *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-listener.accepted:
+		return result.conn, result.err
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
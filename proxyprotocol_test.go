@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, addresses string) string {
+		return string(proxyProtocolV2Signature) + string([]byte{0x20 | command, family, 0, byte(len(addresses))}) + addresses
+	}
+	tests := []struct {
+		header       string
+		expectedAddr string
+		expectError  bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n", "192.0.2.1:56324", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\n", "[2001:db8::1]:56324", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 22\r\n", "", false},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 22\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 port 22\r\n", "", true},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 22\r\n", "", true},
+		{"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "", true},
+		{"SSH-2.0-OpenSSH_9.2\r\n", "", true},
+		{v2(1, 0x11, "\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x16"), "192.0.2.1:56324", false},
+		{v2(1, 0x21, "\x20\x01\x0d\xb8"+strings.Repeat("\x00", 11)+"\x01\x20\x01\x0d\xb8"+strings.Repeat("\x00", 11)+"\x02\xdc\x04\x00\x16"), "[2001:db8::1]:56324", false},
+		{v2(1, 0x11, "\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x16\x04\x00\x01\x00"), "192.0.2.1:56324", false},
+		{v2(0, 0x00, ""), "", false},
+		{v2(1, 0x31, strings.Repeat("\x00", 216)), "", false},
+		{v2(1, 0x11, "\xc0\x00\x02\x01"), "", true},
+		{v2(2, 0x11, "\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x16"), "", true},
+	}
+	for _, test := range tests {
+		reader := bufio.NewReader(strings.NewReader(test.header + "SSH-2.0-OpenSSH_9.2\r\n"))
+		addr, err := readProxyHeader(reader)
+		if (err != nil) != test.expectError {
+			t.Errorf("header=%q: err=%v, want error=%v", test.header, err, test.expectError)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if addrString := ""; addr != nil {
+			addrString = addr.String()
+			if addrString != test.expectedAddr {
+				t.Errorf("header=%q: addr=%v, want %v", test.header, addrString, test.expectedAddr)
+			}
+		} else if test.expectedAddr != "" {
+			t.Errorf("header=%q: addr=nil, want %v", test.header, test.expectedAddr)
+		}
+		if rest, _ := reader.ReadString('\n'); rest != "SSH-2.0-OpenSSH_9.2\r\n" {
+			t.Errorf("header=%q: rest=%q, want the client version", test.header, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	// Each case gets a config and listener of its own, so that the config isn't changed under the accept loop.
+	listen := func(trustedSources []string) (*proxyProtocolListener, string) {
+		cfg := &config{}
+		cfg.ProxyProtocol = proxyProtocolConfig{Enabled: true, TrustedSources: trustedSources, HeaderTimeout: time.Second}
+		if err := cfg.setupProxyProtocol(); err != nil {
+			t.Fatalf("Failed to setup PROXY protocol: %v", err)
+		}
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		listener := newProxyProtocolListener(tcpListener, cfg)
+		t.Cleanup(func() { listener.Close() })
+		return listener, tcpListener.Addr().String()
+	}
+	tests := []struct {
+		trustedSources []string
+		data           string
+		expectedAddr   string
+		expectedData   string
+	}{
+		{[]string{"127.0.0.0/8"}, "PROXY TCP4 192.0.2.1 127.0.0.1 56324 22\r\nSSH-2.0-client\r\n", "192.0.2.1:56324", "SSH-2.0-client\r\n"},
+		{[]string{"::1", "127.0.0.1"}, "PROXY UNKNOWN\r\nSSH-2.0-client\r\n", "127.0.0.1", "SSH-2.0-client\r\n"},
+		{[]string{"192.0.2.0/24"}, "PROXY TCP4 192.0.2.1 127.0.0.1 56324 22\r\n", "127.0.0.1", "PROXY TCP4 192.0.2.1 127.0.0.1 56324 22\r\n"},
+		{nil, "SSH-2.0-client\r\n", "127.0.0.1", "SSH-2.0-client\r\n"},
+	}
+	for _, test := range tests {
+		listener, address := listen(test.trustedSources)
+		client, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer client.Close()
+		if _, err := client.Write([]byte(test.data)); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Failed to accept: %v", err)
+		}
+		defer conn.Close()
+		if addr := conn.RemoteAddr().String(); addr != test.expectedAddr && !strings.HasPrefix(addr, test.expectedAddr+":") {
+			t.Errorf("trustedSources=%v: addr=%v, want %v", test.trustedSources, addr, test.expectedAddr)
+		}
+		if _, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
+			t.Errorf("trustedSources=%v: addr=%T, want a TCP address", test.trustedSources, conn.RemoteAddr())
+		}
+		data := make([]byte, len(test.expectedData))
+		if _, err := io.ReadFull(conn, data); err != nil || string(data) != test.expectedData {
+			t.Errorf("trustedSources=%v: data=%q, err=%v, want %q", test.trustedSources, data, err, test.expectedData)
+		}
+	}
+
+	// Trusted proxies that don't send a header are dropped.
+	_, address := listen([]string{"127.0.0.1"})
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("SSH-2.0-client\r\n"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("err=nil, want the connection closed")
+	}
+}
+
+func TestProxyProtocolListenerClose(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := newProxyProtocolListener(tcpListener, &config{})
+	client, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	if err := listener.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("err=%v, want %v", err, net.ErrClosed)
+	}
+	// The connection nobody accepted is closed rather than left waiting.
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("err=%v, want the connection closed", err)
+	}
+}
+
+func TestProxyProtocolConfig(t *testing.T) {
+	for _, source := range []string{"proxy.example.com", "192.0.2.0/33"} {
+		cfg := &config{}
+		cfg.ProxyProtocol.TrustedSources = []string{source}
+		if err := cfg.setupProxyProtocol(); err == nil {
+			t.Errorf("source=%v: err=nil, want an error", source)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// publicKeyExtension is the permission extension carrying the authorized_keys line of an accepted public key, so that
+// the key the client signed with can be logged once the handshake is done.
+const publicKeyExtension = "public-key"
+
+type certificateLog struct {
+	Type          string    `json:"type" bson:"type"`
+	KeyID         string    `json:"key_id" bson:"key_id"`
+	Serial        uint64    `json:"serial" bson:"serial"`
+	Principals    []string  `json:"principals" bson:"principals"`
+	ValidAfter    time.Time `json:"valid_after,omitempty" bson:"valid_after,omitempty"`
+	ValidBefore   time.Time `json:"valid_before,omitempty" bson:"valid_before,omitempty"`
+	CAFingerprint string    `json:"ca_fingerprint" bson:"ca_fingerprint"`
+	CAType        string    `json:"ca_type" bson:"ca_type"`
+}
+
+func certificateTime(timestamp uint64) time.Time {
+	if timestamp == 0 || timestamp > uint64(1<<63-1) {
+		return time.Time{}
+	}
+	return time.Unix(int64(timestamp), 0).UTC()
+}
+
+func newCertificateLog(cert *ssh.Certificate) *certificateLog {
+	certType := "user"
+	if cert.CertType == ssh.HostCert {
+		certType = "host"
+	}
+	return &certificateLog{
+		Type:          certType,
+		KeyID:         cert.KeyId,
+		Serial:        cert.Serial,
+		Principals:    cert.ValidPrincipals,
+		ValidAfter:    certificateTime(cert.ValidAfter),
+		ValidBefore:   certificateTime(cert.ValidBefore),
+		CAFingerprint: ssh.FingerprintSHA256(cert.SignatureKey),
+		CAType:        cert.SignatureKey.Type(),
+	}
+}
+
+// publicKeyBits returns the size of a key in bits, or 0 if it's unknown.
+func publicKeyBits(key ssh.PublicKey) int {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		// Security key types don't expose their crypto keys.
+		switch key.Type() {
+		case ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoSKED25519:
+			return 256
+		}
+		return 0
+	}
+	switch cryptoKey := cryptoKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return cryptoKey.N.BitLen()
+	case *ecdsa.PublicKey:
+		return cryptoKey.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return len(cryptoKey) * 8
+	case *dsa.PublicKey:
+		return cryptoKey.P.BitLen()
+	}
+	return 0
+}
+
+func newPublicKeyAuthLog(user string, key ssh.PublicKey, accepted bool, signed bool) publicKeyAuthLog {
+	entry := publicKeyAuthLog{
+		authLog: authLog{
+			User:     user,
+			Accepted: authAccepted(accepted),
+		},
+		PublicKeyFingerprint:    ssh.FingerprintSHA256(key),
+		PublicKeyMD5Fingerprint: "MD5:" + ssh.FingerprintLegacyMD5(key),
+		PublicKeyType:           key.Type(),
+		PublicKeyBits:           publicKeyBits(key),
+		AuthorizedKey:           strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key)), "\n"),
+		Signed:                  signed,
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		entry.Certificate = newCertificateLog(cert)
+	}
+	return entry
+}
+
+// logSignedPublicKey logs the public key the client authenticated with, if it did with one. Public key callbacks run
+// when a key is offered, before the client proves it has the private key, so only here is the signature known to be
+// verified.
+func (context connContext) logSignedPublicKey(user string, permissions *ssh.Permissions) {
+	if permissions == nil || permissions.Extensions[publicKeyExtension] == "" {
+		return
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(permissions.Extensions[publicKeyExtension]))
+	if err != nil {
+		warningLogger.Printf("Failed to parse accepted public key: %v", err)
+		return
+	}
+	context.logEvent(newPublicKeyAuthLog(user, key, true, true))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestPublicKey(t *testing.T, key crypto.PublicKey) ssh.PublicKey {
+	publicKey, err := ssh.NewPublicKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create public key: %v", err)
+	}
+	return publicKey
+}
+
+func TestPublicKeyBits(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	ed25519Key, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tests := []struct {
+		key          ssh.PublicKey
+		expectedBits int
+	}{
+		{newTestPublicKey(t, &rsaKey.PublicKey), 1024},
+		{newTestPublicKey(t, &ecdsaKey.PublicKey), 384},
+		{newTestPublicKey(t, ed25519Key), 256},
+		{mockPublicKey{}, 0},
+	}
+	for _, test := range tests {
+		if bits := publicKeyBits(test.key); bits != test.expectedBits {
+			t.Errorf("key=%v: bits=%v, want %v", test.key.Type(), bits, test.expectedBits)
+		}
+	}
+}
+
+func TestPublicKeyCertificate(t *testing.T) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	userKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	validAfter := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &ssh.Certificate{
+		Key:             newTestPublicKey(t, userKey),
+		Serial:          42,
+		CertType:        ssh.UserCert,
+		KeyId:           "deploy@ci",
+		ValidPrincipals: []string{"root", "deploy"},
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+
+	entry := newPublicKeyAuthLog("root", cert, true, false)
+	if entry.PublicKeyType != ssh.CertAlgoED25519v01 || entry.PublicKeyBits != 256 {
+		t.Errorf("type=%v, bits=%v, want %v and 256", entry.PublicKeyType, entry.PublicKeyBits, ssh.CertAlgoED25519v01)
+	}
+	parsedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(entry.AuthorizedKey))
+	if err != nil {
+		t.Fatalf("Failed to parse authorized key: %v", err)
+	}
+	if !reflect.DeepEqual(parsedKey.Marshal(), cert.Marshal()) {
+		t.Errorf("authorizedKey=%v, want the certificate", entry.AuthorizedKey)
+	}
+	expectedCertificate := &certificateLog{
+		Type:          "user",
+		KeyID:         "deploy@ci",
+		Serial:        42,
+		Principals:    []string{"root", "deploy"},
+		ValidAfter:    validAfter,
+		CAFingerprint: ssh.FingerprintSHA256(caSigner.PublicKey()),
+		CAType:        ssh.KeyAlgoED25519,
+	}
+	if !reflect.DeepEqual(entry.Certificate, expectedCertificate) {
+		t.Errorf("certificate=%+v, want %+v", entry.Certificate, expectedCertificate)
+	}
+}
+
+func TestLogSignedPublicKey(t *testing.T) {
+	cfg := &config{}
+	cfg.Logging.JSON = true
+	logBuffer := setupLogBuffer(t, cfg)
+	context := connContext{ConnMetadata: mockConnContext{}, cfg: cfg}
+	context.logSignedPublicKey("root", nil)
+	context.logSignedPublicKey("root", &ssh.Permissions{Extensions: map[string]string{fakeUserExtension: "admin"}})
+	if logs := logBuffer.String(); logs != "" {
+		t.Errorf("logs=%v, want none", logs)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	context.logSignedPublicKey("root", &ssh.Permissions{Extensions: map[string]string{
+		publicKeyExtension: string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+	}})
+	var logEntry struct {
+		EventType string           `json:"event_type"`
+		Event     publicKeyAuthLog `json:"event"`
+	}
+	if err := json.Unmarshal(logBuffer.Bytes(), &logEntry); err != nil {
+		t.Fatalf("Failed to parse log: %v", err)
+	}
+	expectedEntry := newPublicKeyAuthLog("root", signer.PublicKey(), true, true)
+	if logEntry.EventType != "public_key_auth" || !reflect.DeepEqual(logEntry.Event, expectedEntry) {
+		t.Errorf("eventType=%v, event=%+v, want public_key_auth and %+v", logEntry.EventType, logEntry.Event, expectedEntry)
+	}
+	if expected := `authentication for user "root" with public key "` + ssh.FingerprintSHA256(signer.PublicKey()) + `" signed and accepted`; expectedEntry.String() != expected {
+		t.Errorf("string=%v, want %v", expectedEntry.String(), expected)
+	}
+}
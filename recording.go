@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func (cfg *config) recordingPath(connectionID string, channelID int) string {
+	directory := cfg.Recordings.Directory
+	if directory == "" {
+		directory = filepath.Join(cfg.WorkDir, "recordings")
+	}
+	return filepath.Join(directory, fmt.Sprintf("%v-%v.cast", connectionID, channelID))
+}
+
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env"`
+}
+
+// asciicastRecorder records a terminal session in the asciicast v2 format, which asciinema and similar tools play back.
+// Recording stops once the file would grow beyond maxSize.
+type asciicastRecorder struct {
+	lock    sync.Mutex
+	file    *os.File
+	path    string
+	start   time.Time
+	maxSize int64
+	size    int64
+}
+
+func newAsciicastRecorder(path string, width, height uint32, terminal string, maxSize int64) (*asciicastRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	recorder := &asciicastRecorder{file: file, path: path, start: time.Now(), maxSize: maxSize}
+	headerBytes, err := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: recorder.start.Unix(),
+		Env:       map[string]string{"SHELL": "/bin/bash", "TERM": terminal},
+	})
+	if err == nil {
+		_, err = file.Write(append(headerBytes, '\n'))
+		recorder.size = int64(len(headerBytes) + 1)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recorder, nil
+}
+
+// record appends an event of the given code ("o" for output, "i" for input, "r" for resize) to the recording.
+func (recorder *asciicastRecorder) record(code, data string) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if recorder.file == nil {
+		return
+	}
+	elapsed := math.Round(time.Since(recorder.start).Seconds()*1e6) / 1e6
+	eventBytes, err := json.Marshal([]interface{}{elapsed, code, data})
+	if err != nil {
+		warningLogger.Printf("Failed to record event: %v", err)
+		return
+	}
+	if recorder.maxSize > 0 && recorder.size+int64(len(eventBytes)+1) > recorder.maxSize {
+		warningLogger.Printf("Recording %v reached its maximum size, stopping it", recorder.path)
+		if err := recorder.file.Close(); err != nil {
+			warningLogger.Printf("Failed to finish recording: %v", err)
+		}
+		recorder.file = nil
+		return
+	}
+	if _, err := recorder.file.Write(append(eventBytes, '\n')); err != nil {
+		warningLogger.Printf("Failed to record event: %v", err)
+	}
+	recorder.size += int64(len(eventBytes) + 1)
+}
+
+func (recorder *asciicastRecorder) resize(width, height uint32) {
+	recorder.record("r", fmt.Sprintf("%vx%v", width, height))
+}
+
+func (recorder *asciicastRecorder) Close() error {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if recorder.file == nil {
+		return nil
+	}
+	err := recorder.file.Close()
+	recorder.file = nil
+	return err
+}
+
+// recordingChannel records the data going through a session channel.
+type recordingChannel struct {
+	ssh.Channel
+	recorder *asciicastRecorder
+}
+
+func (channel recordingChannel) Read(data []byte) (int, error) {
+	n, err := channel.Channel.Read(data)
+	if n > 0 {
+		channel.recorder.record("i", string(data[:n]))
+	}
+	return n, err
+}
+
+func (channel recordingChannel) Write(data []byte) (int, error) {
+	n, err := channel.Channel.Write(data)
+	if n > 0 {
+		channel.recorder.record("o", string(data[:n]))
+	}
+	return n, err
+}
+
+// startRecording records the rest of the session, once a pty is requested.
+func (context *sessionContext) startRecording(request *ptyRequestPayload) {
+	if !context.cfg.Recordings.Enabled || context.recorder != nil {
+		return
+	}
+	recorder, err := newAsciicastRecorder(context.cfg.recordingPath(context.connectionID, context.channelID), request.Width, request.Height, request.Term, context.cfg.Recordings.MaxSize)
+	if err != nil {
+		warningLogger.Printf("Failed to start recording: %v", err)
+		return
+	}
+	context.recorder = recorder
+	context.Channel = recordingChannel{context.Channel, recorder}
+}
+
+// stopRecording finishes the recording of the session, if any, and returns its path.
+func (context *sessionContext) stopRecording() string {
+	if context.recorder == nil {
+		return ""
+	}
+	if err := context.recorder.Close(); err != nil {
+		warningLogger.Printf("Failed to finish recording: %v", err)
+	}
+	return context.recorder.path
+}
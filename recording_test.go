@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type mockChannel struct {
+	ssh.Channel
+	input  *bytes.Buffer
+	output *bytes.Buffer
+	stderr *bytes.Buffer
+}
+
+func (channel mockChannel) Read(data []byte) (int, error) {
+	return channel.input.Read(data)
+}
+
+func (channel mockChannel) Write(data []byte) (int, error) {
+	return channel.output.Write(data)
+}
+
+func (channel mockChannel) Stderr() io.ReadWriter {
+	return channel.stderr
+}
+
+func TestRecording(t *testing.T) {
+	cfg := &config{Recordings: recordingsConfig{Enabled: true, Directory: t.TempDir()}}
+	ctx := newTestSessionContext(cfg)
+	ctx.connectionID = "42"
+	ctx.channelID = 3
+	ctx.Channel = mockChannel{input: bytes.NewBufferString("whoami\r"), output: &bytes.Buffer{}}
+
+	ctx.startRecording(&ptyRequestPayload{Term: "xterm", Width: 80, Height: 24})
+	buffer := make([]byte, 64)
+	n, err := ctx.Read(buffer)
+	if err != nil || string(buffer[:n]) != "whoami\r" {
+		t.Fatalf("input=%q, err=%v, want %q", buffer[:n], err, "whoami\r")
+	}
+	if _, err := ctx.Write([]byte("root\r\n\xff")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	ctx.recorder.resize(120, 40)
+	recording := ctx.stopRecording()
+	ctx.Write([]byte("after close"))
+
+	expectedPath := filepath.Join(cfg.Recordings.Directory, "42-3.cast")
+	if recording != expectedPath {
+		t.Errorf("recording=%v, want %v", recording, expectedPath)
+	}
+	file, err := os.Open(recording)
+	if err != nil {
+		t.Fatalf("Failed to open recording: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		t.Fatalf("Recording is empty")
+	}
+	header := asciicastHeader{}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatalf("Failed to parse header: %v", err)
+	}
+	header.Timestamp = 0
+	expectedHeader := asciicastHeader{Version: 2, Width: 80, Height: 24, Env: map[string]string{"SHELL": "/bin/bash", "TERM": "xterm"}}
+	if !reflect.DeepEqual(header, expectedHeader) {
+		t.Errorf("header=%+v, want %+v", header, expectedHeader)
+	}
+	var events [][]string
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Failed to parse event: %v", err)
+		}
+		if _, ok := event[0].(float64); !ok || len(event) != 3 {
+			t.Errorf("event=%v, want a time, a code and data", event)
+			continue
+		}
+		events = append(events, []string{event[1].(string), event[2].(string)})
+	}
+	expectedEvents := [][]string{{"i", "whoami\r"}, {"o", "root\r\n�"}, {"r", "120x40"}}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("events=%q, want %q", events, expectedEvents)
+	}
+}
+
+func TestRecordingDisabled(t *testing.T) {
+	cfg := &config{Recordings: recordingsConfig{Directory: t.TempDir()}}
+	ctx := newTestSessionContext(cfg)
+	ctx.startRecording(&ptyRequestPayload{Term: "xterm", Width: 80, Height: 24})
+	if recording := ctx.stopRecording(); recording != "" {
+		t.Errorf("recording=%v, want none", recording)
+	}
+	if entries, err := os.ReadDir(cfg.Recordings.Directory); err != nil || len(entries) != 0 {
+		t.Errorf("entries=%v, err=%v, want none", entries, err)
+	}
+}
+
+func TestRecordingMaxSize(t *testing.T) {
+	cfg := &config{Recordings: recordingsConfig{Enabled: true, Directory: t.TempDir(), MaxSize: 200}}
+	ctx := newTestSessionContext(cfg)
+	ctx.Channel = mockChannel{input: &bytes.Buffer{}, output: &bytes.Buffer{}}
+	ctx.startRecording(&ptyRequestPayload{Term: "xterm", Width: 80, Height: 24})
+	ctx.Write([]byte("first"))
+	ctx.Write(bytes.Repeat([]byte("x"), 100))
+	// Nothing is recorded after the recording is full, even if it would fit.
+	ctx.Write([]byte("last"))
+	recording := ctx.stopRecording()
+
+	data, err := os.ReadFile(recording)
+	if err != nil {
+		t.Fatalf("Failed to read recording: %v", err)
+	}
+	if len(data) > 200 || !bytes.Contains(data, []byte(`"first"`)) || bytes.Contains(data, []byte("xxx")) || bytes.Contains(data, []byte("last")) {
+		t.Errorf("recording=%q, want at most 200 bytes with only the first event", data)
+	}
+}
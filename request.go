@@ -140,13 +140,13 @@ var (
 	globalRequestsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "sshesame_global_requests_total",
 		Help: "Total number of global requests",
-	}, []string{"type"})
+	}, []string{"listener", "type"})
 )
 
 func handleGlobalRequest(request *ssh.Request, context *connContext) error {
 	parser := globalRequestPayloads[request.Type]
 	if parser == nil {
-		globalRequestsMetric.WithLabelValues("unknown").Inc()
+		globalRequestsMetric.WithLabelValues(context.cfg.listenerName, "unknown").Inc()
 		warningLogger.Printf("Unsupported global request type %v", request.Type)
 		if request.WantReply {
 			if err := request.Reply(false, nil); err != nil {
@@ -155,7 +155,7 @@ func handleGlobalRequest(request *ssh.Request, context *connContext) error {
 		}
 		return nil
 	}
-	globalRequestsMetric.WithLabelValues(request.Type).Inc()
+	globalRequestsMetric.WithLabelValues(context.cfg.listenerName, request.Type).Inc()
 	payload, err := parser(request.Payload, context)
 	if err != nil {
 		return err
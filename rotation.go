@@ -0,0 +1,233 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type rotationConfig struct {
+	MaxSize    int64         `yaml:"max_size"`
+	Interval   time.Duration `yaml:"interval"`
+	MaxBackups int           `yaml:"max_backups"`
+	Compress   bool          `yaml:"compress"`
+	Daily      bool          `yaml:"daily"`
+}
+
+// rotatingFile is a log file that's rotated once it grows too large or too old. Rotated files are renamed with the time
+// of rotation, like ssh-2024-05-01T12-30-00.000.log, optionally compressed, and the oldest are removed. Daily files are
+// named with their date, like ssh-2024-05-01.log, and a new one is started every day.
+// Writes are serialized, so that concurrent writers never lose or interleave lines across a rotation.
+type rotatingFile struct {
+	path   string
+	config rotationConfig
+	now    func() time.Time
+
+	lock     sync.Mutex
+	file     *os.File
+	name     string
+	size     int64
+	openedAt time.Time
+
+	cleanupLock sync.Mutex
+	cleanups    sync.WaitGroup
+}
+
+func newRotatingFile(path string, config rotationConfig) (*rotatingFile, error) {
+	file := &rotatingFile{path: path, config: config, now: time.Now}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (file *rotatingFile) split() (string, string) {
+	ext := filepath.Ext(file.path)
+	return strings.TrimSuffix(file.path, ext), ext
+}
+
+func (file *rotatingFile) currentName(now time.Time) string {
+	if !file.config.Daily {
+		return file.path
+	}
+	prefix, ext := file.split()
+	return fmt.Sprintf("%v-%v%v", prefix, now.Format("2006-01-02"), ext)
+}
+
+func (file *rotatingFile) open() error {
+	now := file.now()
+	name := file.currentName(now)
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	file.file = f
+	file.name = name
+	file.size = info.Size()
+	file.openedAt = now
+	return nil
+}
+
+func (file *rotatingFile) needsRotation(now time.Time, size int) bool {
+	if file.config.MaxSize > 0 && file.size > 0 && file.size+int64(size) > file.config.MaxSize {
+		return true
+	}
+	if file.config.Interval > 0 && now.Sub(file.openedAt) >= file.config.Interval {
+		return true
+	}
+	return file.config.Daily && file.currentName(now) != file.name
+}
+
+func (file *rotatingFile) Write(p []byte) (int, error) {
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	if file.file == nil {
+		return 0, os.ErrClosed
+	}
+	if now := file.now(); file.needsRotation(now, len(p)) {
+		if err := file.rotate(now); err != nil {
+			warningLogger.Printf("Failed to rotate log file %q: %v", file.name, err)
+		}
+	}
+	n, err := file.file.Write(p)
+	file.size += int64(n)
+	return n, err
+}
+
+// rotatedName names a rotated file after the time of rotation, numbered if several are rotated at once.
+func (file *rotatingFile) rotatedName(now time.Time) string {
+	prefix, ext := file.split()
+	name := fmt.Sprintf("%v-%v", prefix, now.Format("2006-01-02T15-04-05.000"))
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name + ext); os.IsNotExist(err) {
+			if _, err := os.Stat(name + ext + ".gz"); os.IsNotExist(err) {
+				return name + ext
+			}
+		}
+		name = fmt.Sprintf("%v-%v.%v", prefix, now.Format("2006-01-02T15-04-05.000"), i)
+	}
+}
+
+// rotate renames the current file unless it's a daily file of another day, and replaces it with a new one. The current
+// file is only closed once the new one is open, so that nothing is lost if that fails. Rotated files are compressed and
+// pruned in the background.
+func (file *rotatingFile) rotate(now time.Time) error {
+	rotated := file.name
+	if file.name == file.currentName(now) {
+		rotated = file.rotatedName(now)
+		if err := os.Rename(file.name, rotated); err != nil {
+			return err
+		}
+	}
+	previous := file.file
+	if err := file.open(); err != nil {
+		return err
+	}
+	if err := previous.Close(); err != nil {
+		warningLogger.Printf("Failed to close log file %q: %v", rotated, err)
+	}
+	file.cleanups.Add(1)
+	go func() {
+		defer file.cleanups.Done()
+		file.cleanupLock.Lock()
+		defer file.cleanupLock.Unlock()
+		if file.config.Compress {
+			if err := compressFile(rotated); err != nil {
+				warningLogger.Printf("Failed to compress log file %q: %v", rotated, err)
+			}
+		}
+		if file.config.MaxBackups > 0 {
+			file.prune()
+		}
+	}()
+	return nil
+}
+
+func compressFile(name string) error {
+	source, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(destination)
+	if _, err := io.Copy(writer, source); err != nil {
+		destination.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		destination.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := destination.Close(); err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// prune removes the oldest rotated files beyond the maximum number of backups.
+func (file *rotatingFile) prune() {
+	prefix, ext := file.split()
+	matches, err := filepath.Glob(prefix + "-*" + ext + "*")
+	if err != nil {
+		warningLogger.Printf("Failed to list log files: %v", err)
+		return
+	}
+	file.lock.Lock()
+	current := file.name
+	file.lock.Unlock()
+	type backup struct {
+		name    string
+		modTime time.Time
+	}
+	var backups []backup
+	for _, match := range matches {
+		if match == current || !(strings.HasSuffix(match, ext) || strings.HasSuffix(match, ext+".gz")) {
+			continue
+		}
+		info, err := os.Stat(match)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{match, info.ModTime()})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].modTime.After(backups[j].modTime)
+	})
+	for i := file.config.MaxBackups; i < len(backups); i++ {
+		if err := os.Remove(backups[i].name); err != nil {
+			warningLogger.Printf("Failed to remove log file: %v", err)
+		}
+	}
+}
+
+// Close closes the file once rotated files are compressed and pruned.
+func (file *rotatingFile) Close() error {
+	file.lock.Lock()
+	if file.file == nil {
+		file.lock.Unlock()
+		return nil
+	}
+	err := file.file.Close()
+	file.file = nil
+	file.lock.Unlock()
+	file.cleanups.Wait()
+	return err
+}
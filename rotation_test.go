@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readLogLines reads the lines of all log files in a directory, decompressing them if needed.
+func readLogLines(t *testing.T, dir string) map[string][]string {
+	t.Helper()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	lines := map[string][]string{}
+	for _, entry := range files {
+		file, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		var reader io.Reader = file
+		if strings.HasSuffix(entry.Name(), ".gz") {
+			if reader, err = gzip.NewReader(file); err != nil {
+				t.Fatalf("Failed to decompress %v: %v", entry.Name(), err)
+			}
+		}
+		scanner := bufio.NewScanner(reader)
+		lines[entry.Name()] = []string{}
+		for scanner.Scan() {
+			lines[entry.Name()] = append(lines[entry.Name()], scanner.Text())
+		}
+		file.Close()
+	}
+	return lines
+}
+
+func TestRotationBySize(t *testing.T) {
+	dir := t.TempDir()
+	file, err := newRotatingFile(filepath.Join(dir, "ssh.log"), rotationConfig{MaxSize: 100, Compress: true})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	// Concurrent writers don't lose any line.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				fmt.Fprintf(file, "writer %v line %v %v\n", i, j, strings.Repeat("x", 10))
+			}
+		}(i)
+	}
+	wg.Wait()
+	file.Close()
+
+	seen := map[string]bool{}
+	for name, lines := range readLogLines(t, dir) {
+		if name != "ssh.log" && (!strings.HasPrefix(name, "ssh-") || !strings.HasSuffix(name, ".log.gz")) {
+			t.Errorf("name=%v, want ssh.log or a compressed backup", name)
+		}
+		if size := len(strings.Join(lines, "\n")) + 1; size > 100 {
+			t.Errorf("name=%v: size=%v, want at most 100", name, size)
+		}
+		for _, line := range lines {
+			seen[line] = true
+		}
+	}
+	if len(seen) != 100 {
+		t.Errorf("lines=%v, want 100", len(seen))
+	}
+}
+
+func TestRotationMaxBackups(t *testing.T) {
+	dir := t.TempDir()
+	file, err := newRotatingFile(filepath.Join(dir, "ssh.log"), rotationConfig{MaxSize: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(file, "line %v\n", i)
+		// Backups are pruned by age.
+		time.Sleep(10 * time.Millisecond)
+	}
+	file.Close()
+	lines := readLogLines(t, dir)
+	if len(lines) != 3 {
+		t.Errorf("files=%v, want ssh.log and 2 backups", lines)
+	}
+	if current := lines["ssh.log"]; len(current) != 1 || current[0] != "line 4" {
+		t.Errorf("ssh.log=%v, want the last line", current)
+	}
+	for name, backup := range lines {
+		if name != "ssh.log" && backup[0] != "line 2" && backup[0] != "line 3" {
+			t.Errorf("%v=%v, want one of the last backups", name, backup)
+		}
+	}
+}
+
+func TestRotationByTime(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.Local)
+	file := &rotatingFile{path: filepath.Join(dir, "ssh.log"), config: rotationConfig{Interval: time.Hour, Daily: true}, now: func() time.Time { return now }}
+	if err := file.open(); err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	fmt.Fprintln(file, "first")
+	// A day ends before the interval.
+	now = now.Add(30 * time.Minute)
+	fmt.Fprintln(file, "second")
+	now = now.Add(31 * time.Minute)
+	fmt.Fprintln(file, "third")
+	now = now.Add(time.Hour)
+	fmt.Fprintln(file, "fourth")
+	file.Close()
+
+	lines := readLogLines(t, dir)
+	expectedLines := map[string][]string{
+		"ssh-2024-05-01.log":              {"first", "second"},
+		"ssh-2024-05-02T01-01-00.000.log": {"third"},
+		"ssh-2024-05-02.log":              {"fourth"},
+	}
+	if fmt.Sprint(lines) != fmt.Sprint(expectedLines) {
+		t.Errorf("lines=%v, want %v", lines, expectedLines)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// lineReader reads the input of a command that can only be read line by line, such as a terminal.
+type lineReader struct {
+	stdin  readLiner
+	buffer []byte
+}
+
+func (reader *lineReader) Read(p []byte) (int, error) {
+	for len(reader.buffer) == 0 {
+		line, err := reader.stdin.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		reader.buffer = []byte(line + "\n")
+	}
+	n := copy(p, reader.buffer)
+	reader.buffer = reader.buffer[n:]
+	return n, nil
+}
+
+// stdinReader returns the input of a command as a byte stream.
+func stdinReader(stdin readLiner) io.Reader {
+	if reader, ok := stdin.(io.Reader); ok {
+		return reader
+	}
+	return &lineReader{stdin: stdin}
+}
+
+var errSCPProtocol = errors.New("protocol error")
+
+// scpTransfer speaks the remote side of the legacy SCP protocol, which clients start with "scp -t" to upload files
+// and "scp -f" to download them.
+type scpTransfer struct {
+	context     commandContext
+	ctx         *sessionContext
+	reader      *bufio.Reader
+	recursive   bool
+	preserve    bool
+	errorsCount int
+}
+
+func (transfer *scpTransfer) ack() error {
+	_, err := transfer.context.stdout.Write([]byte{0})
+	return err
+}
+
+// reportError sends an error to the client, which prints it and carries on unless it's fatal.
+func (transfer *scpTransfer) reportError(fatal bool, format string, args ...interface{}) error {
+	transfer.errorsCount++
+	code := byte(1)
+	if fatal {
+		code = 2
+	}
+	_, err := fmt.Fprintf(transfer.context.stdout, "%cscp: %v\n", code, fmt.Sprintf(format, args...))
+	return err
+}
+
+// response waits for the client to acknowledge a record, returning io.EOF if it went away and errSCPProtocol if it
+// reported an error.
+func (transfer *scpTransfer) response() error {
+	code, err := transfer.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 0:
+		return nil
+	case 1, 2:
+		if _, err := transfer.reader.ReadString('\n'); err != nil {
+			return err
+		}
+		return errSCPProtocol
+	}
+	return errSCPProtocol
+}
+
+func (transfer *scpTransfer) status() uint32 {
+	if transfer.errorsCount > 0 {
+		return 1
+	}
+	return 0
+}
+
+// parseSCPRecord parses the mode, size and name of a "C" or "D" record.
+func parseSCPRecord(record string) (os.FileMode, int64, string, error) {
+	fields := strings.SplitN(record, " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", errors.New("protocol error: bad mode")
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil || len(fields[0]) != 4 {
+		return 0, 0, "", errors.New("protocol error: bad mode")
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", errors.New("protocol error: size not delimited")
+	}
+	return os.FileMode(mode), size, fields[2], nil
+}
+
+// sink receives files into target, in the same order and with the same checks as OpenSSH.
+func (transfer *scpTransfer) sink(target string, targetDir bool) error {
+	filesystem := transfer.ctx.filesystem
+	if info, err := filesystem.Stat(target); targetDir && (err != nil || !info.mode.IsDir()) {
+		return transfer.reportError(true, "%v: %v", target, errNotDir)
+	}
+	if err := transfer.ack(); err != nil {
+		return err
+	}
+	dirs := []string{target}
+	for {
+		code, err := transfer.reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, err := transfer.reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return transfer.reportError(true, "lost connection")
+			}
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch code {
+		case 1:
+			transfer.errorsCount++
+			continue
+		case 2:
+			transfer.errorsCount++
+			return nil
+		case 'E':
+			if len(dirs) == 1 {
+				return transfer.reportError(true, "protocol error: unexpected <newline>")
+			}
+			dirs = dirs[:len(dirs)-1]
+			if err := transfer.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'T':
+			if err := transfer.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			return transfer.reportError(true, "protocol error: expected control record")
+		}
+		mode, size, name, err := parseSCPRecord(line)
+		if err != nil {
+			return transfer.reportError(true, "%v", err)
+		}
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return transfer.reportError(true, "error: unexpected filename: %v", name)
+		}
+		destination := dirs[len(dirs)-1]
+		if info, err := filesystem.Stat(destination); err == nil && info.mode.IsDir() {
+			destination = path.Join(destination, name)
+		}
+		if code == 'D' {
+			if !transfer.recursive {
+				return transfer.reportError(true, "received directory without -r")
+			}
+			if info, err := filesystem.Stat(destination); err == nil && !info.mode.IsDir() {
+				return transfer.reportError(true, "%v: %v", destination, errNotDir)
+			} else if err != nil {
+				if err := filesystem.Mkdir(destination, false); err != nil {
+					return transfer.reportError(true, "%v: %v", destination, err)
+				}
+				filesystem.Chmod(destination, mode|0700)
+			}
+			dirs = append(dirs, destination)
+			if err := transfer.ack(); err != nil {
+				return err
+			}
+			continue
+		}
+		// Files are received in memory, so ones that wouldn't fit in the filesystem are refused before reading them.
+		if free := filesystem.FreeSpace(); size > maxUploadSize || (free >= 0 && size > free) {
+			return transfer.reportError(true, "%v: %v", destination, errNoSpace)
+		}
+		if err := transfer.ack(); err != nil {
+			return err
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(transfer.reader, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return transfer.reportError(true, "lost connection")
+			}
+			return err
+		}
+		if err := transfer.response(); err != nil && err != errSCPProtocol {
+			return err
+		}
+		if err := filesystem.WriteFile(destination, data, false); err != nil {
+			if err := transfer.reportError(false, "%v: %v", destination, err); err != nil {
+				return err
+			}
+			continue
+		}
+		filesystem.Chmod(destination, mode)
+		transfer.ctx.captureFile(destination)
+		if err := transfer.ack(); err != nil {
+			return err
+		}
+	}
+}
+
+// source sends a file, or a directory tree if recursive, to the client.
+func (transfer *scpTransfer) source(name string) error {
+	filesystem := transfer.ctx.filesystem
+	canonical := transfer.ctx.resolvePath(name)
+	info, err := filesystem.Stat(canonical)
+	if err != nil {
+		return transfer.reportError(false, "%v: %v", name, err)
+	}
+	if transfer.preserve {
+		modTime := info.modTime.Unix()
+		if _, err := fmt.Fprintf(transfer.context.stdout, "T%v 0 %v 0\n", modTime, modTime); err != nil {
+			return err
+		}
+		if err := transfer.response(); err != nil {
+			return err
+		}
+	}
+	baseName := path.Base(canonical)
+	if info.mode.IsDir() {
+		if !transfer.recursive {
+			return transfer.reportError(false, "%v: not a regular file", name)
+		}
+		entries, err := filesystem.ReadDir(canonical)
+		if err != nil {
+			return transfer.reportError(false, "%v: %v", name, err)
+		}
+		if _, err := fmt.Fprintf(transfer.context.stdout, "D%04o 0 %v\n", info.mode.Perm(), baseName); err != nil {
+			return err
+		}
+		if err := transfer.response(); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := transfer.source(path.Join(name, entry.name)); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprint(transfer.context.stdout, "E\n"); err != nil {
+			return err
+		}
+		return transfer.response()
+	}
+	if !info.mode.IsRegular() {
+		return transfer.reportError(false, "%v: not a regular file", name)
+	}
+	data, err := filesystem.ReadFile(canonical)
+	if err != nil {
+		return transfer.reportError(false, "%v: %v", name, err)
+	}
+	if _, err := fmt.Fprintf(transfer.context.stdout, "C%04o %v %v\n", info.mode.Perm(), len(data), baseName); err != nil {
+		return err
+	}
+	if err := transfer.response(); err != nil {
+		return err
+	}
+	if _, err := transfer.context.stdout.Write(append(data, 0)); err != nil {
+		return err
+	}
+	if err := transfer.response(); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	transfer.ctx.logEvent(fileDownloadLog{
+		channelLog: channelLog{
+			ChannelID: transfer.ctx.channelID,
+		},
+		Path:   canonical,
+		Size:   len(data),
+		SHA256: hex.EncodeToString(sum[:]),
+	})
+	return nil
+}
+
+type cmdScp struct{}
+
+func (cmdScp) execute(context commandContext, ctx *sessionContext) (uint32, error) {
+	flags, args := parseFlags(context.args[1:])
+	transfer := &scpTransfer{
+		context:   context,
+		ctx:       ctx,
+		reader:    bufio.NewReader(stdinReader(context.stdin)),
+		recursive: flags['r'],
+		preserve:  flags['p'],
+	}
+	switch {
+	case flags['t'] && len(args) == 1:
+		err := transfer.sink(ctx.resolvePath(args[0]), flags['d'])
+		if err == io.EOF {
+			err = nil
+		}
+		return transfer.status(), err
+	case flags['f'] && len(args) > 0:
+		if err := transfer.response(); err != nil {
+			if err == io.EOF || err == errSCPProtocol {
+				err = nil
+			}
+			return 1, err
+		}
+		for _, name := range args {
+			if err := transfer.source(name); err != nil {
+				if err == io.EOF || err == errSCPProtocol {
+					return 1, nil
+				}
+				return 1, err
+			}
+		}
+		return transfer.status(), nil
+	}
+	_, err := fmt.Fprint(context.stderr, "usage: scp [-346BCpqrTv] [-c cipher] [-F ssh_config] [-i identity_file]\n"+
+		"            [-J destination] [-l limit] [-o ssh_option] [-P port]\n"+
+		"            [-S program] source ... target\n")
+	return 1, err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+func runSCP(t *testing.T, cfg *config, ctx *sessionContext, command, input string) (string, string, uint32) {
+	t.Helper()
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := executeProgram(commandContext{
+		args:   []string{"sh", "-c", command},
+		stdin:  newBufferReadLiner([]byte(input)),
+		stdout: stdout,
+		stderr: stderr,
+		user:   "root",
+	}, ctx)
+	if err != nil {
+		t.Fatalf("%q: failed to execute: %v", command, err)
+	}
+	return stdout.String(), stderr.String(), status
+}
+
+func TestSCPSink(t *testing.T) {
+	payload := "\x7fELF\x00\x01binary\npayload"
+	sum := sha256.Sum256([]byte(payload))
+	hash := hex.EncodeToString(sum[:])
+
+	for _, test := range []struct {
+		command, input string
+		stdout         string
+		status         uint32
+		files          map[string]string
+		logs           []string
+	}{
+		{
+			command: "scp -t /tmp",
+			input:   "C0755 20 bot\n" + payload + "\x00",
+			stdout:  "\x00\x00\x00",
+			status:  0,
+			files:   map[string]string{"/tmp/bot": payload},
+			logs:    []string{`[127.0.0.1:1234] [channel 0] file "/tmp/bot" with size 20 and SHA-256 ` + hash + " uploaded\n"},
+		},
+		{
+			command: "scp -t /tmp/renamed",
+			input:   "T1700000000 0 1700000000 0\nC0644 5 original\nhello\x00",
+			stdout:  "\x00\x00\x00\x00",
+			status:  0,
+			files:   map[string]string{"/tmp/renamed": "hello"},
+		},
+		{
+			command: "scp -r -t /tmp",
+			input:   "D0755 0 bins\nC0644 1 a\na\x00D0700 0 nested\nC0644 1 b\nb\x00E\nE\n",
+			stdout:  "\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+			status:  0,
+			files:   map[string]string{"/tmp/bins/a": "a", "/tmp/bins/nested/b": "b"},
+		},
+		{
+			command: "scp -t /tmp",
+			input:   "D0755 0 bins\n",
+			stdout:  "\x00\x02scp: received directory without -r\n",
+			status:  1,
+		},
+		{
+			command: "scp -t /nonexistent/file",
+			input:   "C0644 5 file\nhello\x00",
+			stdout:  "\x00\x00\x01scp: /nonexistent/file: No such file or directory\n",
+			status:  1,
+		},
+		{
+			command: "scp -d -t /etc/passwd",
+			stdout:  "\x02scp: /etc/passwd: Not a directory\n",
+			status:  1,
+		},
+		{
+			command: "scp -t /tmp",
+			input:   "C0644 5 ../evil\nhello\x00",
+			stdout:  "\x00\x02scp: error: unexpected filename: ../evil\n",
+			status:  1,
+		},
+		{
+			command: "scp -t /tmp",
+			input:   "C0644 4611686018427387904 huge\n",
+			stdout:  "\x00\x02scp: /tmp/huge: No space left on device\n",
+			status:  1,
+		},
+		{
+			command: "scp -t /tmp",
+			input:   "C0644 1025 big\n",
+			stdout:  "\x00\x02scp: /tmp/big: No space left on device\n",
+			status:  1,
+		},
+	} {
+		cfg := &config{Artifacts: artifactsConfig{Enabled: true, Directory: t.TempDir()}}
+		logBuffer := setupLogBuffer(t, cfg)
+		ctx := newTestSessionContext(cfg)
+		ctx.filesystem.maxSize = 1024
+		stdout, _, status := runSCP(t, cfg, ctx, test.command, test.input)
+		if stdout != test.stdout {
+			t.Errorf("%q: stdout=%q, want %q", test.command, stdout, test.stdout)
+		}
+		if status != test.status {
+			t.Errorf("%q: status=%v, want %v", test.command, status, test.status)
+		}
+		for name, contents := range test.files {
+			data, err := ctx.filesystem.ReadFile(name)
+			if err != nil || string(data) != contents {
+				t.Errorf("%q: %v=%q, err=%v, want %q", test.command, name, data, err, contents)
+			}
+		}
+		logs := logBuffer.String()
+		for _, expectedLog := range test.logs {
+			if !strings.Contains(logs, expectedLog) {
+				t.Errorf("%q: logs=%q, want %q", test.command, logs, expectedLog)
+			}
+		}
+	}
+
+	cfg := &config{Artifacts: artifactsConfig{Enabled: true, Directory: t.TempDir()}}
+	setupLogBuffer(t, cfg)
+	ctx := newTestSessionContext(cfg)
+	runSCP(t, cfg, ctx, "scp -t /tmp", "C0755 20 bot\n"+payload+"\x00")
+	if info, err := ctx.filesystem.Stat("/tmp/bot"); err != nil || info.mode != 0755 {
+		t.Errorf("mode=%v, err=%v, want %v", info.mode, err, os.FileMode(0755))
+	}
+	if _, err := os.Stat(cfg.artifactPath(hash)); err != nil {
+		t.Errorf("Failed to stat artifact: %v", err)
+	}
+}
+
+func TestSCPSource(t *testing.T) {
+	cfg := &config{}
+	logBuffer := setupLogBuffer(t, cfg)
+	ctx := newTestSessionContext(cfg)
+	if err := ctx.filesystem.Mkdir("/tmp/dir", false); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := ctx.filesystem.WriteFile("/tmp/dir/file", []byte("data"), false); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	sum := sha256.Sum256([]byte("data"))
+	hash := hex.EncodeToString(sum[:])
+
+	for _, test := range []struct {
+		command, input string
+		stdout         string
+		status         uint32
+	}{
+		{"scp -f /tmp/dir/file", "\x00\x00\x00", "C0644 4 file\ndata\x00", 0},
+		{"cd /tmp/dir; scp -f file", "\x00\x00\x00", "C0644 4 file\ndata\x00", 0},
+		{"scp -r -f /tmp/dir", "\x00\x00\x00\x00\x00", "D0755 0 dir\nC0644 4 file\ndata\x00E\n", 0},
+		{"scp -f /tmp/dir", "\x00", "\x01scp: /tmp/dir: not a regular file\n", 1},
+		{"scp -f /nonexistent", "\x00", "\x01scp: /nonexistent: No such file or directory\n", 1},
+		{"scp -f /tmp/dir/file", "", "", 1},
+	} {
+		stdout, _, status := runSCP(t, cfg, ctx, test.command, test.input)
+		if stdout != test.stdout {
+			t.Errorf("%q: stdout=%q, want %q", test.command, stdout, test.stdout)
+		}
+		if status != test.status {
+			t.Errorf("%q: status=%v, want %v", test.command, status, test.status)
+		}
+	}
+	expectedLog := `[127.0.0.1:1234] [channel 0] file "/tmp/dir/file" with size 4 and SHA-256 ` + hash + " downloaded\n"
+	if logs := logBuffer.String(); strings.Count(logs, expectedLog) != 3 {
+		t.Errorf("logs=%q, want %q 3 times", logs, expectedLog)
+	}
+
+	_, stderr, status := runSCP(t, cfg, ctx, "scp file user@host:", "")
+	if !strings.HasPrefix(stderr, "usage: scp") || status != 1 {
+		t.Errorf("stderr=%q, status=%v, want usage, 1", stderr, status)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -136,25 +137,46 @@ type sessionContext struct {
 	active      bool
 	pty         bool
 	virtualPath string
+	env         map[string]string
+	vars        map[string]string
+	pid         int
+	shellDepth  int
+	recorder    *asciicastRecorder
+	capture     *rawCapture
 }
 
-type scannerReadLiner struct {
-	scanner   *bufio.Scanner
+// channelReadLiner reads the input of a session without a pty, line by line or, for commands like scp, as raw bytes.
+type channelReadLiner struct {
+	reader    *bufio.Reader
 	inputChan chan<- string
 }
 
-func (r scannerReadLiner) ReadLine() (string, error) {
-	if !r.scanner.Scan() {
-		if err := r.scanner.Err(); err != nil {
+// ReadLine reads a line of at most bufio.MaxScanTokenSize bytes, failing with bufio.ErrTooLong for longer ones.
+func (r channelReadLiner) ReadLine() (string, error) {
+	var data []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		data = append(data, chunk...)
+		if len(data) > bufio.MaxScanTokenSize {
+			return "", bufio.ErrTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(data) == 0) {
 			return "", err
 		}
-		return "", io.EOF
+		break
 	}
-	line := r.scanner.Text()
+	line := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
 	r.inputChan <- line
 	return line, nil
 }
 
+func (r channelReadLiner) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
 type terminalReadLiner struct {
 	terminal  *term.Terminal
 	inputChan chan<- string
@@ -189,7 +211,8 @@ func (context *sessionContext) handleProgram(program []string) {
 		stdout = terminal
 		stderr = terminal
 	} else {
-		stdin = scannerReadLiner{bufio.NewScanner(context), context.inputChan}
+		context.startCapture()
+		stdin = channelReadLiner{bufio.NewReader(context), context.inputChan}
 		stdout = context
 		stderr = context.Stderr()
 	}
@@ -241,7 +264,7 @@ func (context *sessionContext) handleProgram(program []string) {
 func (context *sessionContext) handleRequest(request *ssh.Request) error {
 	switch request.Type {
 	case "pty-req":
-		sessionChannelRequestsMetric.WithLabelValues(request.Type).Inc()
+		sessionChannelRequestsMetric.WithLabelValues(context.cfg.listenerName, request.Type).Inc()
 		if !context.active {
 			if context.pty {
 				return errors.New("a pty is already requested")
@@ -255,10 +278,12 @@ func (context *sessionContext) handleRequest(request *ssh.Request) error {
 				return err
 			}
 			context.pty = true
+			context.env["TERM"] = payload.Term
+			context.startRecording(payload)
 			return nil
 		}
 	case "shell":
-		sessionChannelRequestsMetric.WithLabelValues(request.Type).Inc()
+		sessionChannelRequestsMetric.WithLabelValues(context.cfg.listenerName, request.Type).Inc()
 		if !context.active {
 			if len(request.Payload) != 0 {
 				return errors.New("invalid request payload")
@@ -273,7 +298,7 @@ func (context *sessionContext) handleRequest(request *ssh.Request) error {
 			return nil
 		}
 	case "x11-req":
-		sessionChannelRequestsMetric.WithLabelValues(request.Type).Inc()
+		sessionChannelRequestsMetric.WithLabelValues(context.cfg.listenerName, request.Type).Inc()
 		if !context.active {
 			payload := &x11RequestPayload{}
 			if err := ssh.Unmarshal(request.Payload, payload); err != nil {
@@ -283,17 +308,18 @@ func (context *sessionContext) handleRequest(request *ssh.Request) error {
 			return request.Reply(true, payload.reply())
 		}
 	case "env":
-		sessionChannelRequestsMetric.WithLabelValues(request.Type).Inc()
+		sessionChannelRequestsMetric.WithLabelValues(context.cfg.listenerName, request.Type).Inc()
 		if !context.active {
 			payload := &envRequestPayload{}
 			if err := ssh.Unmarshal(request.Payload, payload); err != nil {
 				return err
 			}
 			context.logEvent(payload.logEntry(context.channelID))
+			context.env[payload.Name] = payload.Value
 			return request.Reply(true, payload.reply())
 		}
 	case "exec":
-		sessionChannelRequestsMetric.WithLabelValues(request.Type).Inc()
+		sessionChannelRequestsMetric.WithLabelValues(context.cfg.listenerName, request.Type).Inc()
 		if !context.active {
 			payload := &execRequestPayload{}
 			if err := ssh.Unmarshal(request.Payload, payload); err != nil {
@@ -304,11 +330,11 @@ func (context *sessionContext) handleRequest(request *ssh.Request) error {
 				return err
 			}
 			context.active = true
-			context.handleProgram(strings.Fields(payload.Command))
+			context.handleProgram([]string{"sh", "-c", payload.Command})
 			return nil
 		}
 	case "subsystem":
-		sessionChannelRequestsMetric.WithLabelValues(request.Type).Inc()
+		sessionChannelRequestsMetric.WithLabelValues(context.cfg.listenerName, request.Type).Inc()
 		if !context.active {
 			payload := &subsystemRequestPayload{}
 			if err := ssh.Unmarshal(request.Payload, payload); err != nil {
@@ -319,37 +345,44 @@ func (context *sessionContext) handleRequest(request *ssh.Request) error {
 				return err
 			}
 			context.active = true
-			context.handleProgram(strings.Fields(payload.Subsystem))
+			if payload.Subsystem == "sftp" {
+				context.handleSFTP()
+			} else {
+				context.handleProgram(strings.Fields(payload.Subsystem))
+			}
 			return nil
 		}
 	case "window-change":
-		sessionChannelRequestsMetric.WithLabelValues(request.Type).Inc()
+		sessionChannelRequestsMetric.WithLabelValues(context.cfg.listenerName, request.Type).Inc()
 		payload := &windowChangeRequestPayload{}
 		if err := ssh.Unmarshal(request.Payload, payload); err != nil {
 			return err
 		}
 		context.logEvent(payload.logEntry(context.channelID))
+		if context.recorder != nil {
+			context.recorder.resize(payload.Width, payload.Height)
+		}
 		return request.Reply(true, payload.reply())
 	default:
-		sessionChannelRequestsMetric.WithLabelValues("unknown").Inc()
+		sessionChannelRequestsMetric.WithLabelValues(context.cfg.listenerName, "unknown").Inc()
 	}
 	warningLogger.Printf("Rejected session request: %s", request.Type)
 	return request.Reply(false, nil)
 }
 
 var (
-	sessionChannelsMetric = promauto.NewCounter(prometheus.CounterOpts{
+	sessionChannelsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "sshesame_session_channels_total",
 		Help: "Total number of session channels",
-	})
-	activeSessionChannelsMetric = promauto.NewGauge(prometheus.GaugeOpts{
+	}, []string{"listener"})
+	activeSessionChannelsMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "sshesame_active_session_channels",
 		Help: "Number of active session channels",
-	})
+	}, []string{"listener"})
 	sessionChannelRequestsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "sshesame_session_channel_requests_total",
 		Help: "Total number of session channel requests",
-	}, []string{"type"})
+	}, []string{"listener", "type"})
 )
 
 func handleSessionChannel(newChannel ssh.NewChannel, context channelContext) error {
@@ -359,9 +392,9 @@ func handleSessionChannel(newChannel ssh.NewChannel, context channelContext) err
 	if len(newChannel.ExtraData()) != 0 {
 		return errors.New("invalid channel data")
 	}
-	sessionChannelsMetric.Inc()
-	activeSessionChannelsMetric.Inc()
-	defer activeSessionChannelsMetric.Dec()
+	sessionChannelsMetric.WithLabelValues(context.cfg.listenerName).Inc()
+	activeSessionChannelsMetric.WithLabelValues(context.cfg.listenerName).Inc()
+	defer activeSessionChannelsMetric.WithLabelValues(context.cfg.listenerName).Dec()
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		return err
@@ -371,24 +404,51 @@ func handleSessionChannel(newChannel ssh.NewChannel, context channelContext) err
 			ChannelID: context.channelID,
 		},
 	})
-	defer context.logEvent(sessionCloseLog{
-		channelLog: channelLog{
-			ChannelID: context.channelID,
-		},
-	})
-
+	idle := newIdleChannel(channel)
 	inputChan := make(chan string)
 	session := sessionContext{
-		context,
-		channel,
-		inputChan,
-		false,
-		false,
-		"/",
+		channelContext: context,
+		Channel:        idle,
+		inputChan:      inputChan,
+		virtualPath:    homeDirectory(context.User()),
+		env:            defaultEnvironment(context.User()),
+		vars:           map[string]string{},
+		pid:            fakePID(),
+	}
+	closeReason := ""
+	defer func() {
+		session.stopCapture()
+		context.logEvent(sessionCloseLog{
+			channelLog: channelLog{
+				ChannelID: context.channelID,
+			},
+			Recording: session.stopRecording(),
+			Reason:    closeReason,
+		})
+	}()
+
+	var idleTimeout <-chan time.Time
+	if context.cfg.Timeouts.Idle > 0 {
+		idleTimeout = time.After(context.cfg.Timeouts.Idle)
 	}
 
 	for inputChan != nil || requests != nil {
 		select {
+		case <-idleTimeout:
+			if idleFor := idle.idleFor(); idleFor < context.cfg.Timeouts.Idle {
+				idleTimeout = time.After(context.cfg.Timeouts.Idle - idleFor)
+				continue
+			}
+			idleTimeout = nil
+			closeReason = "idle timeout"
+			if session.pty && context.cfg.Timeouts.AutoLogoutMessage {
+				if _, err := session.Write([]byte("\r\n" + autoLogoutMessage)); err != nil {
+					warningLogger.Printf("Error sending auto-logout message: %s", err)
+				}
+			}
+			if err := session.Close(); err != nil {
+				warningLogger.Printf("Error closing channel: %s", err)
+			}
 		case input, ok := <-inputChan:
 			if !ok {
 				inputChan = nil
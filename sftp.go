@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpError converts errors of the virtual filesystem to errors the SFTP server reports with the right status code.
+func sftpError(err error) error {
+	switch err {
+	case errNoSuchFile:
+		return os.ErrNotExist
+	case errExists:
+		return os.ErrExist
+	case errNoSpace:
+		return sftp.ErrSSHFxFailure
+	}
+	return err
+}
+
+// sftpFileInfo exposes a file of the virtual filesystem to the SFTP server.
+type sftpFileInfo struct {
+	fsInfo
+}
+
+func (info sftpFileInfo) Name() string       { return info.name }
+func (info sftpFileInfo) Size() int64        { return info.size }
+func (info sftpFileInfo) Mode() os.FileMode  { return info.mode }
+func (info sftpFileInfo) ModTime() time.Time { return info.modTime }
+func (info sftpFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info sftpFileInfo) Sys() interface{}   { return nil }
+func (info sftpFileInfo) Uid() uint32        { return fakeID(info.owner) }
+func (info sftpFileInfo) Gid() uint32        { return fakeID(info.group) }
+
+// fakeID returns the ID of a user or group, root being the only one with a well-known ID.
+func fakeID(name string) uint32 {
+	if name == "root" {
+		return 0
+	}
+	return 1000
+}
+
+type sftpFileList []os.FileInfo
+
+func (list sftpFileList) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(list)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, list[offset:])
+	if offset+int64(n) >= int64(len(list)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpReader serves the contents of a file as they were when it was opened, and logs how much of it was read.
+type sftpReader struct {
+	handler *sftpHandler
+	name    string
+	reader  *bytes.Reader
+	lock    sync.Mutex
+	read    int
+}
+
+func (reader *sftpReader) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := reader.reader.ReadAt(p, offset)
+	reader.lock.Lock()
+	reader.read += n
+	reader.lock.Unlock()
+	return n, err
+}
+
+func (reader *sftpReader) Close() error {
+	reader.handler.logOperation("read", reader.name, "", reader.read)
+	return nil
+}
+
+// sftpWriter buffers the contents of a file being written,
+// which is saved to the virtual filesystem and captured as an artifact when closed.
+// Data it buffers beyond the original file counts towards the size limit of the filesystem until then.
+type sftpWriter struct {
+	handler   *sftpHandler
+	name      string
+	lock      sync.Mutex
+	data      []byte
+	written   int
+	allocated int64
+}
+
+func (writer *sftpWriter) WriteAt(p []byte, offset int64) (int, error) {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if offset < 0 || offset > maxUploadSize-int64(len(p)) {
+		return 0, sftp.ErrSSHFxFailure
+	}
+	if end := int(offset) + len(p); end > len(writer.data) {
+		if err := writer.handler.context.filesystem.Allocate(int64(end - len(writer.data))); err != nil {
+			return 0, sftp.ErrSSHFxFailure
+		}
+		writer.allocated += int64(end - len(writer.data))
+		writer.data = append(writer.data, make([]byte, end-len(writer.data))...)
+	}
+	copy(writer.data[offset:], p)
+	writer.written += len(p)
+	return len(p), nil
+}
+
+func (writer *sftpWriter) Close() error {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	writer.handler.logOperation("write", writer.name, "", writer.written)
+	writer.handler.context.filesystem.Allocate(-writer.allocated)
+	writer.allocated = 0
+	if err := writer.handler.context.filesystem.WriteFile(writer.name, writer.data, false); err != nil {
+		return sftpError(err)
+	}
+	if writer.written > 0 {
+		writer.handler.context.captureFile(writer.name)
+	}
+	return nil
+}
+
+// sftpHandler handles SFTP requests using the virtual filesystem of a session.
+type sftpHandler struct {
+	context *sessionContext
+}
+
+func (handler *sftpHandler) logOperation(operation, path, target string, size int) {
+	handler.context.logEvent(sftpLog{
+		channelLog: channelLog{
+			ChannelID: handler.context.channelID,
+		},
+		Operation: operation,
+		Path:      path,
+		Target:    target,
+		Size:      size,
+	})
+}
+
+func (handler *sftpHandler) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+	handler.logOperation("open", request.Filepath, "", 0)
+	data, err := handler.context.filesystem.ReadFile(request.Filepath)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	return &sftpReader{handler: handler, name: request.Filepath, reader: bytes.NewReader(data)}, nil
+}
+
+func (handler *sftpHandler) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+	handler.logOperation("open", request.Filepath, "", 0)
+	flags := request.Pflags()
+	filesystem := handler.context.filesystem
+	var data []byte
+	if !flags.Trunc {
+		existing, err := filesystem.ReadFile(request.Filepath)
+		if err != nil && err != errNoSuchFile {
+			return nil, sftpError(err)
+		}
+		data = append(data, existing...)
+	}
+	if _, err := filesystem.Stat(request.Filepath); err == nil && flags.Excl {
+		return nil, os.ErrExist
+	}
+	// Create the file right away, so that it shows up in listings while it's being uploaded.
+	if err := filesystem.WriteFile(request.Filepath, data, false); err != nil {
+		return nil, sftpError(err)
+	}
+	return &sftpWriter{handler: handler, name: request.Filepath, data: data}, nil
+}
+
+func (handler *sftpHandler) Filecmd(request *sftp.Request) error {
+	filesystem := handler.context.filesystem
+	switch request.Method {
+	case "Setstat":
+		handler.logOperation("setstat", request.Filepath, "", 0)
+		attributes, flags := request.Attributes(), request.AttrFlags()
+		if flags.Size {
+			data, err := filesystem.ReadFile(request.Filepath)
+			if err != nil {
+				return sftpError(err)
+			}
+			if free := filesystem.FreeSpace(); attributes.Size > maxUploadSize ||
+				(free >= 0 && int64(attributes.Size) > int64(len(data))+free) {
+				return sftp.ErrSSHFxFailure
+			}
+			if int(attributes.Size) < len(data) {
+				data = data[:attributes.Size]
+			} else {
+				data = append(data, make([]byte, int(attributes.Size)-len(data))...)
+			}
+			if err := filesystem.WriteFile(request.Filepath, data, false); err != nil {
+				return sftpError(err)
+			}
+		}
+		if flags.Permissions {
+			info, err := filesystem.Stat(request.Filepath)
+			if err != nil {
+				return sftpError(err)
+			}
+			return sftpError(filesystem.Chmod(request.Filepath, info.mode&^os.ModePerm|attributes.FileMode()&os.ModePerm))
+		}
+		_, err := filesystem.Stat(request.Filepath)
+		return sftpError(err)
+	case "Rename":
+		handler.logOperation("rename", request.Filepath, request.Target, 0)
+		return sftpError(filesystem.Rename(request.Filepath, request.Target))
+	case "Rmdir":
+		handler.logOperation("rmdir", request.Filepath, "", 0)
+		return sftpError(filesystem.Remove(request.Filepath, false, true))
+	case "Remove":
+		handler.logOperation("remove", request.Filepath, "", 0)
+		return sftpError(filesystem.Remove(request.Filepath, false, false))
+	case "Mkdir":
+		handler.logOperation("mkdir", request.Filepath, "", 0)
+		return sftpError(filesystem.Mkdir(request.Filepath, false))
+	case "Symlink", "Link":
+		handler.logOperation(strings.ToLower(request.Method), request.Filepath, request.Target, 0)
+		return os.ErrPermission
+	}
+	return errors.New("unsupported operation")
+}
+
+func (handler *sftpHandler) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+	filesystem := handler.context.filesystem
+	switch request.Method {
+	case "List":
+		handler.logOperation("list", request.Filepath, "", 0)
+		entries, err := filesystem.ReadDir(request.Filepath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		list := make(sftpFileList, len(entries))
+		for i, entry := range entries {
+			list[i] = sftpFileInfo{entry}
+		}
+		return list, nil
+	case "Stat":
+		handler.logOperation("stat", request.Filepath, "", 0)
+		info, err := filesystem.Stat(request.Filepath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return sftpFileList{sftpFileInfo{info}}, nil
+	}
+	return nil, errors.New("unsupported operation")
+}
+
+func (handler *sftpHandler) Lstat(request *sftp.Request) (sftp.ListerAt, error) {
+	handler.logOperation("lstat", request.Filepath, "", 0)
+	info, err := handler.context.filesystem.Lstat(request.Filepath)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	return sftpFileList{sftpFileInfo{info}}, nil
+}
+
+func (handler *sftpHandler) Readlink(name string) (string, error) {
+	handler.logOperation("readlink", name, "", 0)
+	info, err := handler.context.filesystem.Lstat(name)
+	if err != nil {
+		return "", sftpError(err)
+	}
+	if info.mode&os.ModeSymlink == 0 {
+		return "", errors.New("not a symbolic link")
+	}
+	return info.target, nil
+}
+
+func (handler *sftpHandler) LookupUserName(uid string) string {
+	if uid == "0" {
+		return "root"
+	}
+	return handler.context.User()
+}
+
+func (handler *sftpHandler) LookupGroupName(gid string) string {
+	return handler.LookupUserName(gid)
+}
+
+// handleSFTP serves the SFTP subsystem on the session channel.
+func (context *sessionContext) handleSFTP() {
+	context.active = true
+	handler := &sftpHandler{context}
+	server := sftp.NewRequestServer(context.Channel, sftp.Handlers{
+		FileGet:  handler,
+		FilePut:  handler,
+		FileCmd:  handler,
+		FileList: handler,
+	}, sftp.WithStartDirectory(context.virtualPath))
+	go func() {
+		defer close(context.inputChan)
+
+		if err := server.Serve(); err != nil && err != io.EOF {
+			warningLogger.Printf("Error serving SFTP: %s", err)
+		}
+
+		if _, err := context.SendRequest("exit-status", false, ssh.Marshal(struct {
+			ExitStatus uint32
+		}{0})); err != nil {
+			warningLogger.Printf("Error sending exit status: %s", err)
+			return
+		}
+
+		if err := context.Close(); err != nil {
+			warningLogger.Printf("Error closing channel: %s", err)
+			return
+		}
+	}()
+}
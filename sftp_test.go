@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func newTestSFTPClient(t *testing.T, ctx *sessionContext) *sftp.Client {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	handler := &sftpHandler{ctx}
+	server := sftp.NewRequestServer(serverConn, sftp.Handlers{
+		FileGet:  handler,
+		FilePut:  handler,
+		FileCmd:  handler,
+		FileList: handler,
+	}, sftp.WithStartDirectory(ctx.virtualPath))
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatalf("Failed to create SFTP client: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+func TestSFTP(t *testing.T) {
+	cfg := &config{Artifacts: artifactsConfig{Enabled: true, Directory: t.TempDir()}}
+	logBuffer := setupLogBuffer(t, cfg)
+	ctx := newTestSessionContext(cfg)
+	client := newTestSFTPClient(t, ctx)
+
+	workingDirectory, err := client.Getwd()
+	if err != nil || workingDirectory != "/" {
+		t.Errorf("workingDirectory=%q, err=%v, want /", workingDirectory, err)
+	}
+
+	if err := client.Mkdir("/tmp/upload"); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	file, err := client.Create("/tmp/upload/payload")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if _, err := file.Write([]byte("uploaded payload")); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Failed to close file: %v", err)
+	}
+	if err := client.Chmod("/tmp/upload/payload", 0755); err != nil {
+		t.Fatalf("Failed to change mode: %v", err)
+	}
+	if err := client.Rename("/tmp/upload/payload", "/tmp/upload/renamed"); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+
+	info, err := client.Stat("/tmp/upload/renamed")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if info.Size() != 16 || info.Mode() != 0755 {
+		t.Errorf("size=%v, mode=%v, want 16, %v", info.Size(), info.Mode(), os.FileMode(0755))
+	}
+	entries, err := client.ReadDir("/tmp/upload")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "renamed" {
+		t.Errorf("entries=%v, err=%v, want only renamed", entries, err)
+	}
+	if _, err := client.Stat("/nonexistent"); !os.IsNotExist(err) {
+		t.Errorf("err=%v, want a not exist error", err)
+	}
+
+	file, err = client.Open("/etc/hostname")
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil || string(data) != "never-gonna-give-you-up-server\n" {
+		t.Errorf("data=%q, err=%v, want the hostname", data, err)
+	}
+	file.Close()
+
+	if err := client.Remove("/tmp/upload/renamed"); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if err := client.RemoveDirectory("/tmp/upload"); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+	if _, err := ctx.filesystem.Stat("/tmp/upload"); err != errNoSuchFile {
+		t.Errorf("err=%v, want %v", err, errNoSuchFile)
+	}
+
+	sum := sha256.Sum256([]byte("uploaded payload"))
+	hash := hex.EncodeToString(sum[:])
+	if _, err := os.Stat(cfg.artifactPath(hash)); err != nil {
+		t.Errorf("Failed to stat artifact: %v", err)
+	}
+	logs := logBuffer.String()
+	for _, expectedLog := range []string{
+		`SFTP mkdir of "/tmp/upload" requested`,
+		`SFTP open of "/tmp/upload/payload" requested`,
+		`SFTP write of 16 bytes of "/tmp/upload/payload" completed`,
+		`file "/tmp/upload/payload" with size 16 and SHA-256 ` + hash + ` uploaded`,
+		`SFTP setstat of "/tmp/upload/payload" requested`,
+		`SFTP rename of "/tmp/upload/payload" to "/tmp/upload/renamed" requested`,
+		`SFTP stat of "/tmp/upload/renamed" requested`,
+		`SFTP list of "/tmp/upload" requested`,
+		`SFTP read of 31 bytes of "/etc/hostname" completed`,
+		`SFTP remove of "/tmp/upload/renamed" requested`,
+		`SFTP rmdir of "/tmp/upload" requested`,
+	} {
+		if !strings.Contains(logs, expectedLog) {
+			t.Errorf("logs=%v, want %q", logs, expectedLog)
+		}
+	}
+}
+
+func TestSFTPLimits(t *testing.T) {
+	ctx := newTestSessionContext(&config{})
+	ctx.filesystem.maxSize = 1024
+	client := newTestSFTPClient(t, ctx)
+
+	file, err := client.Create("/tmp/payload")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	for _, offset := range []int64{-1, 1 << 40, maxUploadSize} {
+		if _, err := file.WriteAt([]byte("x"), offset); err == nil {
+			t.Errorf("offset=%v: err=nil, want an error", offset)
+		}
+	}
+	if _, err := file.WriteAt(make([]byte, 2000), 0); err == nil {
+		t.Errorf("err=nil, want an error writing beyond the size of the filesystem")
+	}
+	if _, err := file.WriteAt(make([]byte, 1000), 0); err != nil {
+		t.Errorf("Failed to write file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Failed to close file: %v", err)
+	}
+	if free := ctx.filesystem.FreeSpace(); free != 24 {
+		t.Errorf("free=%v, want 24", free)
+	}
+
+	for _, size := range []int64{1025, 1 << 60} {
+		if err := client.Truncate("/tmp/payload", size); err == nil {
+			t.Errorf("size=%v: err=nil, want an error", size)
+		}
+	}
+	if err := client.Truncate("/tmp/payload", 10); err != nil {
+		t.Errorf("Failed to truncate file: %v", err)
+	}
+	if info, err := ctx.filesystem.Stat("/tmp/payload"); err != nil || info.size != 10 {
+		t.Errorf("size=%v, err=%v, want 10", info.size, err)
+	}
+}
@@ -0,0 +1,1341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// shellList is a sequence of and-or lists separated by ";", "&" or newlines.
+type shellList struct {
+	items []shellAndOr
+}
+
+type shellAndOr struct {
+	first shellPipeline
+	rest  []shellAndOrItem
+}
+
+type shellAndOrItem struct {
+	operator string
+	pipeline shellPipeline
+}
+
+type shellPipeline struct {
+	negate   bool
+	commands []shellCommand
+}
+
+type shellCommand struct {
+	assignments []shellAssignment
+	words       []shellWord
+	redirects   []shellRedirect
+	subshell    *shellList
+}
+
+type shellAssignment struct {
+	name  string
+	value shellWord
+}
+
+type shellRedirect struct {
+	fd       int
+	operator string
+	target   shellWord
+	heredoc  *shellHeredoc
+}
+
+// shellHeredoc is the body of a here-document, read from the lines following the command.
+type shellHeredoc struct {
+	delimiter string
+	quoted    bool
+	stripTabs bool
+	body      shellWord
+}
+
+type shellWord []shellWordPart
+
+type shellWordPart struct {
+	text   string
+	quoted bool
+	subst  *shellList
+	param  *shellParam
+}
+
+// shellParam is a parameter expansion such as $NAME, ${NAME:-default} or ${#NAME}.
+type shellParam struct {
+	name     string
+	length   bool
+	operator string
+	word     shellWord
+}
+
+type shellIncompleteError struct {
+	reason string
+}
+
+func (err shellIncompleteError) Error() string {
+	return err.reason
+}
+
+type shellSyntaxError struct {
+	message string
+}
+
+func (err shellSyntaxError) Error() string {
+	return err.message
+}
+
+type shellParser struct {
+	source []rune
+	pos    int
+	// heredocs are the here-documents whose body starts after the next newline.
+	heredocs []*shellHeredoc
+}
+
+func parseShell(source string) (*shellList, error) {
+	parser := &shellParser{source: []rune(source)}
+	list, err := parser.parseList(0)
+	if err != nil {
+		return nil, err
+	}
+	if !parser.eof() {
+		return nil, parser.unexpected()
+	}
+	return list, nil
+}
+
+func (parser *shellParser) eof() bool {
+	return parser.pos >= len(parser.source)
+}
+
+func (parser *shellParser) peek() rune {
+	if parser.eof() {
+		return 0
+	}
+	return parser.source[parser.pos]
+}
+
+func (parser *shellParser) peekAt(offset int) rune {
+	if parser.pos+offset >= len(parser.source) {
+		return 0
+	}
+	return parser.source[parser.pos+offset]
+}
+
+func (parser *shellParser) hasPrefix(prefix string) bool {
+	for i, r := range []rune(prefix) {
+		if parser.peekAt(i) != r {
+			return false
+		}
+	}
+	return true
+}
+
+func (parser *shellParser) unexpected() error {
+	if parser.eof() {
+		return shellIncompleteError{"end of file unexpected"}
+	}
+	token := string(parser.peek())
+	for _, operator := range []string{"&&", "||", ";;"} {
+		if parser.hasPrefix(operator) {
+			token = operator
+			break
+		}
+	}
+	if token == "\n" {
+		token = "newline"
+	}
+	return shellSyntaxError{fmt.Sprintf("%q unexpected", token)}
+}
+
+// skipBlanks skips spaces, tabs and comments, but not newlines.
+func (parser *shellParser) skipBlanks() {
+	for !parser.eof() {
+		switch parser.peek() {
+		case ' ', '\t', '\r':
+			parser.pos++
+		case '\\':
+			if parser.peekAt(1) != '\n' {
+				return
+			}
+			parser.pos += 2
+		case '#':
+			for !parser.eof() && parser.peek() != '\n' {
+				parser.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (parser *shellParser) skipBlanksAndNewlines() {
+	for {
+		parser.skipBlanks()
+		if parser.peek() != '\n' {
+			return
+		}
+		parser.pos++
+	}
+}
+
+func isShellMetachar(r rune) bool {
+	switch r {
+	case ' ', '\t', '\r', '\n', ';', '&', '|', '<', '>', '(', ')':
+		return true
+	}
+	return false
+}
+
+// parseList parses commands until the end of the input or the closing rune.
+func (parser *shellParser) parseList(closing rune) (*shellList, error) {
+	list := &shellList{}
+	for {
+		parser.skipBlanksAndNewlines()
+		if parser.eof() {
+			if closing != 0 {
+				return nil, shellIncompleteError{fmt.Sprintf("missing %q", closing)}
+			}
+			if len(parser.heredocs) > 0 {
+				return nil, shellIncompleteError{fmt.Sprintf("here-document delimited by %q expected", parser.heredocs[0].delimiter)}
+			}
+			return list, nil
+		}
+		if closing != 0 && parser.peek() == closing {
+			return list, nil
+		}
+		andOr, err := parser.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+		list.items = append(list.items, *andOr)
+		parser.skipBlanks()
+		switch {
+		case parser.eof():
+		case parser.hasPrefix(";;"):
+			return nil, parser.unexpected()
+		case parser.peek() == '\n':
+			parser.pos++
+			if err := parser.readHeredocs(); err != nil {
+				return nil, err
+			}
+		case parser.peek() == ';':
+			parser.pos++
+		case parser.peek() == '&' && parser.peekAt(1) != '&':
+			parser.pos++
+		case closing != 0 && parser.peek() == closing:
+		default:
+			return nil, parser.unexpected()
+		}
+	}
+}
+
+func (parser *shellParser) parseAndOr() (*shellAndOr, error) {
+	first, err := parser.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	andOr := &shellAndOr{first: *first}
+	for {
+		parser.skipBlanks()
+		var operator string
+		switch {
+		case parser.hasPrefix("&&"):
+			operator = "&&"
+		case parser.hasPrefix("||"):
+			operator = "||"
+		default:
+			return andOr, nil
+		}
+		parser.pos += 2
+		parser.skipBlanksAndNewlines()
+		if parser.eof() {
+			return nil, shellIncompleteError{fmt.Sprintf("command expected after %q", operator)}
+		}
+		pipeline, err := parser.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		andOr.rest = append(andOr.rest, shellAndOrItem{operator, *pipeline})
+	}
+}
+
+func (parser *shellParser) parsePipeline() (*shellPipeline, error) {
+	pipeline := &shellPipeline{}
+	parser.skipBlanks()
+	if parser.peek() == '!' && (parser.peekAt(1) == ' ' || parser.peekAt(1) == '\t') {
+		pipeline.negate = true
+		parser.pos++
+	}
+	for {
+		command, err := parser.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		pipeline.commands = append(pipeline.commands, *command)
+		parser.skipBlanks()
+		if parser.peek() != '|' || parser.peekAt(1) == '|' {
+			return pipeline, nil
+		}
+		parser.pos++
+		parser.skipBlanksAndNewlines()
+		if parser.eof() {
+			return nil, shellIncompleteError{`command expected after "|"`}
+		}
+	}
+}
+
+func (parser *shellParser) parseCommand() (*shellCommand, error) {
+	command := &shellCommand{}
+	parser.skipBlanks()
+	if parser.peek() == '(' {
+		parser.pos++
+		subshell, err := parser.parseList(')')
+		if err != nil {
+			return nil, err
+		}
+		if len(subshell.items) == 0 {
+			return nil, parser.unexpected()
+		}
+		parser.pos++
+		command.subshell = subshell
+	}
+	for {
+		parser.skipBlanks()
+		if parser.eof() {
+			break
+		}
+		if redirect, err := parser.parseRedirect(); err != nil {
+			return nil, err
+		} else if redirect != nil {
+			command.redirects = append(command.redirects, *redirect)
+			continue
+		}
+		if isShellMetachar(parser.peek()) {
+			break
+		}
+		if command.subshell != nil {
+			return nil, parser.unexpected()
+		}
+		word, err := parser.parseWord()
+		if err != nil {
+			return nil, err
+		}
+		if len(command.words) == 0 {
+			if assignment, ok := word.assignment(); ok {
+				command.assignments = append(command.assignments, assignment)
+				continue
+			}
+		}
+		command.words = append(command.words, word)
+	}
+	if command.subshell == nil && len(command.assignments) == 0 && len(command.words) == 0 && len(command.redirects) == 0 {
+		return nil, parser.unexpected()
+	}
+	return command, nil
+}
+
+// parseRedirect parses a redirection operator with its optional file descriptor and its target.
+// It returns nil if the input at the current position is not a redirection.
+func (parser *shellParser) parseRedirect() (*shellRedirect, error) {
+	start := parser.pos
+	digits := 0
+	for r := parser.peekAt(digits); r >= '0' && r <= '9'; r = parser.peekAt(digits) {
+		digits++
+	}
+	parser.pos += digits
+	redirect := &shellRedirect{fd: -1}
+	if digits > 0 {
+		fd, err := strconv.Atoi(string(parser.source[start:parser.pos]))
+		if err != nil {
+			parser.pos = start
+			return nil, nil
+		}
+		redirect.fd = fd
+	}
+	for _, operator := range []string{"&>>", "&>", ">>", ">&", ">|", "<<<", "<<-", "<<", "<&", "<>", ">", "<"} {
+		if digits > 0 && operator[0] == '&' {
+			continue
+		}
+		if parser.hasPrefix(operator) {
+			redirect.operator = operator
+			break
+		}
+	}
+	if redirect.operator == "" {
+		parser.pos = start
+		return nil, nil
+	}
+	parser.pos += len(redirect.operator)
+	if redirect.fd == -1 {
+		if strings.HasPrefix(redirect.operator, "<") {
+			redirect.fd = 0
+		} else {
+			redirect.fd = 1
+		}
+	}
+	parser.skipBlanks()
+	if parser.eof() || isShellMetachar(parser.peek()) {
+		if parser.eof() {
+			return nil, shellSyntaxError{"redirection unexpected"}
+		}
+		return nil, parser.unexpected()
+	}
+	target, err := parser.parseWord()
+	if err != nil {
+		return nil, err
+	}
+	redirect.target = target
+	if redirect.operator == "<<" || redirect.operator == "<<-" {
+		redirect.heredoc = &shellHeredoc{stripTabs: redirect.operator == "<<-"}
+		for _, part := range target {
+			redirect.heredoc.delimiter += part.text
+			redirect.heredoc.quoted = redirect.heredoc.quoted || part.quoted
+		}
+		parser.heredocs = append(parser.heredocs, redirect.heredoc)
+	}
+	return redirect, nil
+}
+
+// readHeredocs reads the bodies of the pending here-documents, after the newline ending their command.
+func (parser *shellParser) readHeredocs() error {
+	for len(parser.heredocs) > 0 {
+		heredoc := parser.heredocs[0]
+		body := strings.Builder{}
+		for {
+			if parser.eof() {
+				return shellIncompleteError{fmt.Sprintf("here-document delimited by %q expected", heredoc.delimiter)}
+			}
+			start := parser.pos
+			for !parser.eof() && parser.peek() != '\n' {
+				parser.pos++
+			}
+			line := string(parser.source[start:parser.pos])
+			if !parser.eof() {
+				parser.pos++
+			}
+			if heredoc.stripTabs {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if strings.TrimSuffix(line, "\r") == heredoc.delimiter {
+				break
+			}
+			body.WriteString(line)
+			body.WriteRune('\n')
+		}
+		if heredoc.quoted {
+			heredoc.body = shellWord{{text: body.String(), quoted: true}}
+		} else {
+			bodyParser := &shellParser{source: []rune(body.String())}
+			parts, err := bodyParser.parseHeredocBody()
+			if err != nil {
+				return err
+			}
+			heredoc.body = parts
+		}
+		parser.heredocs = parser.heredocs[1:]
+	}
+	return nil
+}
+
+// parseHeredocBody parses the body of an unquoted here-document, which is subject to expansions.
+func (parser *shellParser) parseHeredocBody() (shellWord, error) {
+	parts := shellWord{{text: "", quoted: true}}
+	literal := strings.Builder{}
+	flush := func() {
+		if literal.Len() > 0 {
+			parts = append(parts, shellWordPart{text: literal.String(), quoted: true})
+			literal.Reset()
+		}
+	}
+	for !parser.eof() {
+		switch r := parser.peek(); r {
+		case '\\':
+			switch next := parser.peekAt(1); next {
+			case '$', '`', '\\':
+				literal.WriteRune(next)
+				parser.pos += 2
+			case '\n':
+				parser.pos += 2
+			default:
+				literal.WriteRune(r)
+				parser.pos++
+			}
+		case '$', '`':
+			part, err := parser.parseExpansion(true)
+			if err != nil {
+				return nil, err
+			}
+			if part == nil {
+				literal.WriteRune(r)
+				parser.pos++
+				continue
+			}
+			flush()
+			parts = append(parts, *part)
+		default:
+			literal.WriteRune(r)
+			parser.pos++
+		}
+	}
+	flush()
+	return parts, nil
+}
+
+func (parser *shellParser) parseWord() (shellWord, error) {
+	word := shellWord{}
+	literal := strings.Builder{}
+	flush := func() {
+		if literal.Len() > 0 {
+			word = append(word, shellWordPart{text: literal.String()})
+			literal.Reset()
+		}
+	}
+	for !parser.eof() && !isShellMetachar(parser.peek()) {
+		switch r := parser.peek(); r {
+		case '\\':
+			parser.pos++
+			if parser.eof() {
+				return nil, shellIncompleteError{"line continuation"}
+			}
+			if parser.peek() == '\n' {
+				parser.pos++
+				continue
+			}
+			flush()
+			word = append(word, shellWordPart{text: string(parser.peek()), quoted: true})
+			parser.pos++
+		case '\'':
+			flush()
+			parser.pos++
+			start := parser.pos
+			for !parser.eof() && parser.peek() != '\'' {
+				parser.pos++
+			}
+			if parser.eof() {
+				return nil, shellIncompleteError{"Unterminated quoted string"}
+			}
+			word = append(word, shellWordPart{text: string(parser.source[start:parser.pos]), quoted: true})
+			parser.pos++
+		case '"':
+			flush()
+			parser.pos++
+			parts, err := parser.parseDoubleQuoted()
+			if err != nil {
+				return nil, err
+			}
+			word = append(word, parts...)
+		case '$', '`':
+			part, err := parser.parseExpansion(false)
+			if err != nil {
+				return nil, err
+			}
+			if part == nil {
+				literal.WriteRune(r)
+				parser.pos++
+				continue
+			}
+			flush()
+			word = append(word, *part)
+		default:
+			literal.WriteRune(r)
+			parser.pos++
+		}
+	}
+	flush()
+	return word, nil
+}
+
+// parseDoubleQuoted parses the contents of a double-quoted string, after the opening quote.
+func (parser *shellParser) parseDoubleQuoted() ([]shellWordPart, error) {
+	parts := []shellWordPart{{text: "", quoted: true}}
+	literal := strings.Builder{}
+	flush := func() {
+		if literal.Len() > 0 {
+			parts = append(parts, shellWordPart{text: literal.String(), quoted: true})
+			literal.Reset()
+		}
+	}
+	for {
+		if parser.eof() {
+			return nil, shellIncompleteError{"Unterminated quoted string"}
+		}
+		switch r := parser.peek(); r {
+		case '"':
+			parser.pos++
+			flush()
+			return parts, nil
+		case '\\':
+			switch next := parser.peekAt(1); next {
+			case '$', '`', '"', '\\':
+				literal.WriteRune(next)
+				parser.pos += 2
+			case '\n':
+				parser.pos += 2
+			default:
+				literal.WriteRune(r)
+				parser.pos++
+			}
+		case '$', '`':
+			part, err := parser.parseExpansion(true)
+			if err != nil {
+				return nil, err
+			}
+			if part == nil {
+				literal.WriteRune(r)
+				parser.pos++
+				continue
+			}
+			flush()
+			parts = append(parts, *part)
+		default:
+			literal.WriteRune(r)
+			parser.pos++
+		}
+	}
+}
+
+// assignment splits a word of the form NAME=value into a variable assignment.
+func (word shellWord) assignment() (shellAssignment, bool) {
+	if len(word) == 0 || word[0].quoted || word[0].subst != nil || word[0].param != nil {
+		return shellAssignment{}, false
+	}
+	name, value, found := strings.Cut(word[0].text, "=")
+	if !found || !shellVariableNameRegexp.MatchString(name) {
+		return shellAssignment{}, false
+	}
+	valueWord := shellWord{}
+	if value != "" {
+		valueWord = append(valueWord, shellWordPart{text: value})
+	}
+	return shellAssignment{name, append(valueWord, word[1:]...)}, true
+}
+
+func isShellNameChar(r rune, first bool) bool {
+	return r == '_' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (!first && r >= '0' && r <= '9')
+}
+
+func isShellSpecialParam(r rune) bool {
+	return strings.ContainsRune("?$#!@*-0123456789", r)
+}
+
+// parseBracedParam parses the contents of a ${...} expansion, after the opening brace.
+func (parser *shellParser) parseBracedParam(quoted bool) (*shellParam, error) {
+	param := &shellParam{}
+	if parser.peek() == '#' && parser.peekAt(1) != '}' {
+		param.length = true
+		parser.pos++
+	}
+	start := parser.pos
+	if isShellSpecialParam(parser.peek()) {
+		parser.pos++
+	} else {
+		for isShellNameChar(parser.peek(), parser.pos == start) {
+			parser.pos++
+		}
+	}
+	param.name = string(parser.source[start:parser.pos])
+	if !param.length {
+		for _, operator := range []string{":-", ":=", ":+", "-", "=", "+"} {
+			if parser.hasPrefix(operator) {
+				param.operator = operator
+				parser.pos += len(operator)
+				break
+			}
+		}
+	}
+	word, err := parser.parseParamWord(quoted)
+	if err != nil {
+		return nil, err
+	}
+	param.word = word
+	parser.pos++
+	if param.name == "" || (param.operator == "" && len(param.word) > 0) {
+		return nil, shellSyntaxError{"Bad substitution"}
+	}
+	return param, nil
+}
+
+// parseParamWord parses the word of a ${NAME<operator>word} expansion, up to the closing brace. Like the expansion,
+// the word is quoted if the expansion is.
+func (parser *shellParser) parseParamWord(quoted bool) (shellWord, error) {
+	word := shellWord{}
+	literal := strings.Builder{}
+	flush := func() {
+		if literal.Len() > 0 {
+			word = append(word, shellWordPart{text: literal.String(), quoted: quoted})
+			literal.Reset()
+		}
+	}
+	for {
+		if parser.eof() {
+			return nil, shellIncompleteError{"missing \"}\""}
+		}
+		switch r := parser.peek(); r {
+		case '}':
+			flush()
+			return word, nil
+		case '\\':
+			if parser.peekAt(1) == '\n' {
+				parser.pos += 2
+				continue
+			}
+			flush()
+			parser.pos++
+			if parser.eof() {
+				return nil, shellIncompleteError{"missing \"}\""}
+			}
+			word = append(word, shellWordPart{text: string(parser.peek()), quoted: true})
+			parser.pos++
+		case '\'':
+			if quoted {
+				literal.WriteRune(r)
+				parser.pos++
+				continue
+			}
+			flush()
+			parser.pos++
+			start := parser.pos
+			for !parser.eof() && parser.peek() != '\'' {
+				parser.pos++
+			}
+			if parser.eof() {
+				return nil, shellIncompleteError{"Unterminated quoted string"}
+			}
+			word = append(word, shellWordPart{text: string(parser.source[start:parser.pos]), quoted: true})
+			parser.pos++
+		case '"':
+			flush()
+			parser.pos++
+			parts, err := parser.parseDoubleQuoted()
+			if err != nil {
+				return nil, err
+			}
+			word = append(word, parts...)
+		case '$', '`':
+			part, err := parser.parseExpansion(quoted)
+			if err != nil {
+				return nil, err
+			}
+			if part == nil {
+				literal.WriteRune(r)
+				parser.pos++
+				continue
+			}
+			flush()
+			word = append(word, *part)
+		default:
+			literal.WriteRune(r)
+			parser.pos++
+		}
+	}
+}
+
+// parseExpansion parses a parameter expansion or a command substitution at the current position.
+// It returns nil if the input at the current position is not an expansion.
+func (parser *shellParser) parseExpansion(quoted bool) (*shellWordPart, error) {
+	switch {
+	case parser.hasPrefix("${"):
+		parser.pos += 2
+		param, err := parser.parseBracedParam(quoted)
+		if err != nil {
+			return nil, err
+		}
+		return &shellWordPart{quoted: quoted, param: param}, nil
+	case parser.peek() == '$' && isShellSpecialParam(parser.peekAt(1)):
+		parser.pos += 2
+		return &shellWordPart{quoted: quoted, param: &shellParam{name: string(parser.source[parser.pos-1])}}, nil
+	case parser.peek() == '$' && isShellNameChar(parser.peekAt(1), true):
+		parser.pos++
+		start := parser.pos
+		for isShellNameChar(parser.peek(), false) {
+			parser.pos++
+		}
+		return &shellWordPart{quoted: quoted, param: &shellParam{name: string(parser.source[start:parser.pos])}}, nil
+	case parser.hasPrefix("$("):
+		parser.pos += 2
+		subst, err := parser.parseList(')')
+		if err != nil {
+			return nil, err
+		}
+		parser.pos++
+		return &shellWordPart{quoted: quoted, subst: subst}, nil
+	case parser.peek() == '`':
+		parser.pos++
+		source := strings.Builder{}
+		for {
+			if parser.eof() {
+				return nil, shellIncompleteError{"Unterminated quoted string"}
+			}
+			r := parser.peek()
+			parser.pos++
+			if r == '`' {
+				break
+			}
+			if r == '\\' && (parser.peek() == '`' || parser.peek() == '\\' || parser.peek() == '$') {
+				r = parser.peek()
+				parser.pos++
+			}
+			source.WriteRune(r)
+		}
+		subst, err := parseShell(source.String())
+		if err != nil {
+			return nil, err
+		}
+		return &shellWordPart{quoted: quoted, subst: subst}, nil
+	}
+	return nil, nil
+}
+
+// shellExitError is returned when the exit builtin is executed, terminating the current shell.
+type shellExitError struct {
+	status uint32
+}
+
+func (err shellExitError) Error() string {
+	return fmt.Sprintf("exit %v", err.status)
+}
+
+// shell holds the state of a single shell invocation.
+// Variables and the working directory are part of the session instead.
+type shell struct {
+	ctx        *sessionContext
+	args       []string
+	lastStatus uint32
+	// substitutions counts the command substitutions performed, to tell the status of commands only consisting of them.
+	substitutions int
+}
+
+// bufferReadLiner reads lines from a pipe or a redirected file.
+type bufferReadLiner struct {
+	reader *bufio.Reader
+}
+
+func newBufferReadLiner(data []byte) bufferReadLiner {
+	return bufferReadLiner{bufio.NewReader(bytes.NewReader(data))}
+}
+
+func (r bufferReadLiner) ReadLine() (string, error) {
+	line, err := r.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		return line, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+func (r bufferReadLiner) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
+// maxShellDepth limits how deeply shells and scripts can run each other, like bash limits nested functions.
+const maxShellDepth = 100
+
+func (sh *shell) runSource(source string, context commandContext) (uint32, error) {
+	if sh.ctx.shellDepth >= maxShellDepth {
+		_, err := fmt.Fprintf(context.stderr, "%v: maximum nested function level reached\n", context.args[0])
+		return 2, err
+	}
+	sh.ctx.shellDepth++
+	defer func() { sh.ctx.shellDepth-- }()
+	list, err := parseShell(source)
+	if err != nil {
+		if _, err := fmt.Fprintf(context.stderr, "%v: 1: Syntax error: %v\n", context.args[0], err); err != nil {
+			return 2, err
+		}
+		return 2, nil
+	}
+	return sh.runList(list, context)
+}
+
+func (sh *shell) runList(list *shellList, context commandContext) (uint32, error) {
+	for _, andOr := range list.items {
+		status, err := sh.runAndOr(andOr, context)
+		sh.lastStatus = status
+		if err != nil {
+			return status, err
+		}
+	}
+	return sh.lastStatus, nil
+}
+
+func (sh *shell) runAndOr(andOr shellAndOr, context commandContext) (uint32, error) {
+	status, err := sh.runPipeline(andOr.first, context)
+	if err != nil {
+		return status, err
+	}
+	for _, item := range andOr.rest {
+		if (item.operator == "&&") != (status == 0) {
+			continue
+		}
+		sh.lastStatus = status
+		if status, err = sh.runPipeline(item.pipeline, context); err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+func (sh *shell) runPipeline(pipeline shellPipeline, context commandContext) (uint32, error) {
+	var status uint32
+	var err error
+	stdin := context.stdin
+	for i, command := range pipeline.commands {
+		commandContext := context
+		commandContext.stdin = stdin
+		if i == len(pipeline.commands)-1 {
+			status, err = sh.runCommand(command, commandContext)
+			break
+		}
+		output := &bytes.Buffer{}
+		commandContext.stdout = output
+		status, err = sh.runCommand(command, commandContext)
+		if err != nil && err != io.EOF {
+			return status, err
+		}
+		stdin = newBufferReadLiner(output.Bytes())
+	}
+	if err != nil {
+		return status, err
+	}
+	if pipeline.negate {
+		if status == 0 {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return status, nil
+}
+
+func (sh *shell) runCommand(command shellCommand, context commandContext) (uint32, error) {
+	substitutions := sh.substitutions
+	var args []string
+	for _, word := range command.words {
+		fields, err := sh.expandWord(word, context)
+		if err != nil {
+			return 1, err
+		}
+		args = append(args, fields...)
+	}
+	context, closers, status, err := sh.applyRedirects(command.redirects, context)
+	defer func() {
+		for _, closer := range closers {
+			if err := closer.Close(); err != nil {
+				warningLogger.Printf("Failed to close redirected file: %v", err)
+			}
+		}
+	}()
+	if err != nil || status != 0 {
+		return status, err
+	}
+	if command.subshell != nil {
+		defer sh.ctx.saveShellState()()
+		subshell := *sh
+		status, err := subshell.runList(command.subshell, context)
+		var exitErr shellExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.status, nil
+		}
+		return status, err
+	}
+	if len(args) == 0 {
+		for _, assignment := range command.assignments {
+			value, err := sh.expandAssignment(assignment, context)
+			if err != nil {
+				return 1, err
+			}
+			sh.ctx.setVariable(assignment.name, value)
+		}
+		if sh.substitutions == substitutions {
+			return 0, nil
+		}
+		return sh.lastStatus, nil
+	}
+	restore, err := sh.applyTemporaryAssignments(command.assignments, context)
+	if err != nil {
+		return 1, err
+	}
+	defer restore()
+	if args[0] == "exit" {
+		status := sh.lastStatus
+		if len(args) > 1 {
+			parsedStatus, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil {
+				parsedStatus = 255
+			}
+			status = uint32(parsedStatus)
+		}
+		return status, shellExitError{status}
+	}
+	context.args = args
+	status, err = executeProgram(context, sh.ctx)
+	if _, piped := context.stdin.(bufferReadLiner); piped && err == io.EOF {
+		// The end of a pipe or a redirected file only ends the command reading it.
+		return status, nil
+	}
+	return status, err
+}
+
+func isShellBlank(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n'
+}
+
+// expandWord performs tilde expansion, parameter expansion, command substitution, field splitting and quote removal on a word.
+func (sh *shell) expandWord(word shellWord, context commandContext) ([]string, error) {
+	var fields []string
+	current := strings.Builder{}
+	inField := false
+	for i, part := range word {
+		var value string
+		switch {
+		case part.subst != nil:
+			var err error
+			value, err = sh.substitute(part.subst, context)
+			if err != nil {
+				return nil, err
+			}
+		case part.param != nil:
+			var err error
+			value, err = sh.expandParam(*part.param, context)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			text := part.text
+			if i == 0 && !part.quoted {
+				text = sh.expandTilde(text)
+			}
+			current.WriteString(text)
+			inField = true
+			continue
+		}
+		if part.quoted {
+			current.WriteString(value)
+			inField = true
+			continue
+		}
+		splitFields := strings.Fields(value)
+		if len(splitFields) == 0 {
+			continue
+		}
+		if isShellBlank(value[0]) && inField {
+			fields = append(fields, current.String())
+			current.Reset()
+		}
+		for i, field := range splitFields {
+			if i > 0 {
+				fields = append(fields, current.String())
+				current.Reset()
+			}
+			current.WriteString(field)
+		}
+		inField = true
+		if isShellBlank(value[len(value)-1]) {
+			fields = append(fields, current.String())
+			current.Reset()
+			inField = false
+		}
+	}
+	if inField {
+		fields = append(fields, current.String())
+	}
+	return fields, nil
+}
+
+// substitute runs a command substitution in a subshell and returns its output.
+func (sh *shell) substitute(list *shellList, context commandContext) (string, error) {
+	defer sh.ctx.saveShellState()()
+	output := &bytes.Buffer{}
+	substContext := context
+	substContext.stdout = output
+	substShell := *sh
+	status, err := substShell.runList(list, substContext)
+	var exitErr shellExitError
+	if errors.As(err, &exitErr) {
+		status, err = exitErr.status, nil
+	}
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	sh.lastStatus = status
+	sh.substitutions++
+	return strings.TrimRight(output.String(), "\n"), nil
+}
+
+func (sh *shell) expandTilde(text string) string {
+	if !strings.HasPrefix(text, "~") {
+		return text
+	}
+	user, rest, _ := strings.Cut(text[1:], "/")
+	var home string
+	if user == "" {
+		home, _ = sh.ctx.lookupVariable("HOME")
+	} else if shellVariableNameRegexp.MatchString(user) {
+		home = homeDirectory(user)
+	} else {
+		return text
+	}
+	if rest == "" && !strings.Contains(text, "/") {
+		return home
+	}
+	return fmt.Sprintf("%v/%v", strings.TrimSuffix(home, "/"), rest)
+}
+
+// lookupParam returns the value of a variable or a special parameter.
+func (sh *shell) lookupParam(name string) (string, bool) {
+	switch name {
+	case "?":
+		return fmt.Sprint(sh.lastStatus), true
+	case "$":
+		return fmt.Sprint(sh.ctx.pid), true
+	case "!":
+		return "", false
+	case "-":
+		return "", true
+	case "#":
+		return fmt.Sprint(max(len(sh.args)-1, 0)), true
+	case "@", "*":
+		if len(sh.args) < 2 {
+			return "", true
+		}
+		return strings.Join(sh.args[1:], " "), true
+	}
+	if index, err := strconv.Atoi(name); err == nil {
+		if index >= len(sh.args) {
+			return "", false
+		}
+		return sh.args[index], true
+	}
+	return sh.ctx.lookupVariable(name)
+}
+
+func (sh *shell) expandParam(param shellParam, context commandContext) (string, error) {
+	value, set := sh.lookupParam(param.name)
+	if param.length {
+		return fmt.Sprint(len([]rune(value))), nil
+	}
+	empty := !set || (strings.HasPrefix(param.operator, ":") && value == "")
+	switch strings.TrimPrefix(param.operator, ":") {
+	case "-":
+		if empty {
+			return sh.expandParamWord(param.word, context)
+		}
+	case "=":
+		if empty {
+			word, err := sh.expandParamWord(param.word, context)
+			if err != nil {
+				return "", err
+			}
+			if shellVariableNameRegexp.MatchString(param.name) {
+				sh.ctx.setVariable(param.name, word)
+			}
+			return word, nil
+		}
+	case "+":
+		if empty {
+			return "", nil
+		}
+		return sh.expandParamWord(param.word, context)
+	}
+	return value, nil
+}
+
+// expandParamWord expands the word of a parameter expansion. Its fields are only split once the value of the whole
+// expansion is.
+func (sh *shell) expandParamWord(word shellWord, context commandContext) (string, error) {
+	unsplit := make(shellWord, len(word))
+	for i, part := range word {
+		if part.subst != nil || part.param != nil {
+			part.quoted = true
+		}
+		unsplit[i] = part
+	}
+	fields, err := sh.expandWord(unsplit, context)
+	return strings.Join(fields, " "), err
+}
+
+// expandAssignment expands the value of a variable assignment, without field splitting.
+func (sh *shell) expandAssignment(assignment shellAssignment, context commandContext) (string, error) {
+	word := make(shellWord, len(assignment.value))
+	for i, part := range assignment.value {
+		part.quoted = true
+		word[i] = part
+	}
+	fields, err := sh.expandWord(word, context)
+	if err != nil || len(fields) == 0 {
+		return "", err
+	}
+	return fields[0], nil
+}
+
+// applyTemporaryAssignments exports the variables assigned in front of a command
+// and returns a function restoring their previous values.
+func (sh *shell) applyTemporaryAssignments(assignments []shellAssignment, context commandContext) (func(), error) {
+	type previousValue struct {
+		name               string
+		envValue, varValue string
+		inEnv, inVars      bool
+	}
+	var previousValues []previousValue
+	restore := func() {
+		for i := len(previousValues) - 1; i >= 0; i-- {
+			previous := previousValues[i]
+			sh.ctx.unsetVariable(previous.name)
+			if previous.inEnv {
+				sh.ctx.env[previous.name] = previous.envValue
+			}
+			if previous.inVars {
+				sh.ctx.vars[previous.name] = previous.varValue
+			}
+		}
+	}
+	for _, assignment := range assignments {
+		value, err := sh.expandAssignment(assignment, context)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		previous := previousValue{name: assignment.name}
+		previous.envValue, previous.inEnv = sh.ctx.env[assignment.name]
+		previous.varValue, previous.inVars = sh.ctx.vars[assignment.name]
+		previousValues = append(previousValues, previous)
+		sh.ctx.exportVariable(assignment.name, value)
+	}
+	return restore, nil
+}
+
+func (sh *shell) expandRedirectTarget(redirect shellRedirect, context commandContext) (string, error) {
+	fields, err := sh.expandWord(redirect.target, context)
+	if err != nil {
+		return "", err
+	}
+	if len(fields) != 1 {
+		return "", shellSyntaxError{"ambiguous redirect"}
+	}
+	return fields[0], nil
+}
+
+func (sh *shell) applyRedirects(redirects []shellRedirect, context commandContext) (commandContext, []io.Closer, uint32, error) {
+	var closers []io.Closer
+	for _, redirect := range redirects {
+		if redirect.heredoc != nil {
+			body, err := sh.expandAssignment(shellAssignment{value: redirect.heredoc.body}, context)
+			if err != nil {
+				return context, closers, 1, err
+			}
+			if redirect.fd == 0 {
+				context.stdin = newBufferReadLiner([]byte(body))
+			}
+			continue
+		}
+		target, err := sh.expandRedirectTarget(redirect, context)
+		if err != nil {
+			if _, ok := err.(shellSyntaxError); ok {
+				_, err := fmt.Fprintf(context.stderr, "sh: %v\n", err)
+				return context, closers, 1, err
+			}
+			return context, closers, 1, err
+		}
+		switch redirect.operator {
+		case ">&", "<&":
+			var writer io.Writer
+			switch target {
+			case "1":
+				writer = context.stdout
+			case "2":
+				writer = context.stderr
+			case "-":
+				writer = io.Discard
+			default:
+				if redirect.operator == "<&" && target == "0" {
+					continue
+				}
+				_, err := fmt.Fprintf(context.stderr, "sh: %v: Bad file descriptor\n", target)
+				return context, closers, 2, err
+			}
+			switch redirect.fd {
+			case 1:
+				context.stdout = writer
+			case 2:
+				context.stderr = writer
+			}
+			continue
+		}
+		switch redirect.operator {
+		case "<<<":
+			if redirect.fd == 0 {
+				context.stdin = newBufferReadLiner([]byte(target + "\n"))
+			}
+		case "<", "<>":
+			data, err := sh.ctx.readRedirectFile(target)
+			if err != nil {
+				_, err := fmt.Fprintf(context.stderr, "sh: %v: %v\n", target, err)
+				return context, closers, 1, err
+			}
+			if redirect.fd == 0 {
+				context.stdin = newBufferReadLiner(data)
+			}
+		default:
+			file, err := sh.ctx.openRedirectFile(target, strings.HasSuffix(redirect.operator, ">>"))
+			if err != nil {
+				_, err := fmt.Fprintf(context.stderr, "sh: %v: %v\n", target, err)
+				return context, closers, 1, err
+			}
+			closers = append(closers, file)
+			switch {
+			case strings.HasPrefix(redirect.operator, "&"):
+				context.stdout = file
+				context.stderr = file
+			case redirect.fd == 1:
+				context.stdout = file
+			case redirect.fd == 2:
+				context.stderr = file
+			}
+		}
+	}
+	return context, closers, 0, nil
+}
+
+// readRedirectFile returns the contents of a file used as the source of an input redirection.
+func (context *sessionContext) readRedirectFile(name string) ([]byte, error) {
+	return context.filesystem.ReadFile(context.resolvePath(name))
+}
+
+// virtualFileWriter appends everything written to it to a file of the virtual filesystem.
+// Once closed, the contents of the file are captured as an artifact if anything was written.
+type virtualFileWriter struct {
+	context *sessionContext
+	name    string
+	written bool
+}
+
+func (writer *virtualFileWriter) Write(p []byte) (int, error) {
+	if err := writer.context.filesystem.WriteFile(writer.name, p, true); err != nil {
+		return 0, err
+	}
+	writer.written = writer.written || len(p) > 0
+	return len(p), nil
+}
+
+func (writer *virtualFileWriter) Close() error {
+	if writer.written {
+		writer.context.captureFile(writer.name)
+	}
+	return nil
+}
+
+// openRedirectFile opens a file used as the target of an output redirection, truncating it unless appending.
+func (context *sessionContext) openRedirectFile(name string, appendMode bool) (io.WriteCloser, error) {
+	name = context.resolvePath(name)
+	if err := context.filesystem.WriteFile(name, nil, appendMode); err != nil {
+		return nil, err
+	}
+	return &virtualFileWriter{context: context, name: name}, nil
+}
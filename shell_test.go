@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func newTestSessionContext(cfg *config) *sessionContext {
+	return &sessionContext{
+		channelContext: channelContext{connContext: connContext{ConnMetadata: mockConnContext{}, cfg: cfg, filesystem: newVirtualFS(nil, "root")}},
+		virtualPath:    "/",
+		env:            defaultEnvironment("root"),
+		vars:           map[string]string{},
+		pid:            1234,
+	}
+}
+
+func runTestShell(t *testing.T, args []string, input string) (string, string, uint32) {
+	t.Helper()
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	status, err := executeProgram(commandContext{
+		args:   args,
+		stdin:  newBufferReadLiner([]byte(input)),
+		stdout: stdout,
+		stderr: stderr,
+		user:   "root",
+	}, newTestSessionContext(&config{}))
+	if err != nil {
+		t.Fatalf("Failed to execute %q: %v", args, err)
+	}
+	return stdout.String(), stderr.String(), status
+}
+
+func TestParseShellWords(t *testing.T) {
+	list, err := parseShell(`echo "a b" 'c  d' e\ f g"h"'i' ""`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(list.items) != 1 || len(list.items[0].first.commands) != 1 {
+		t.Fatalf("list=%+v, want a single command", list)
+	}
+	sh := &shell{}
+	var args []string
+	for _, word := range list.items[0].first.commands[0].words {
+		fields, err := sh.expandWord(word, commandContext{})
+		if err != nil {
+			t.Fatalf("Failed to expand word: %v", err)
+		}
+		args = append(args, fields...)
+	}
+	expectedArgs := []string{"echo", "a b", "c  d", "e f", "ghi", ""}
+	if len(args) != len(expectedArgs) {
+		t.Fatalf("args=%q, want %q", args, expectedArgs)
+	}
+	for i := range args {
+		if args[i] != expectedArgs[i] {
+			t.Errorf("args=%q, want %q", args, expectedArgs)
+		}
+	}
+}
+
+func TestParseShellIncomplete(t *testing.T) {
+	for _, source := range []string{`echo "a`, `echo 'a`, `echo a |`, `true &&`, `(echo a`, `echo $(echo a`, `echo a\`} {
+		_, err := parseShell(source)
+		if _, ok := err.(shellIncompleteError); !ok {
+			t.Errorf("parseShell(%q) err=%v, want an incomplete input error", source, err)
+		}
+	}
+}
+
+func TestParseShellSyntaxError(t *testing.T) {
+	for _, source := range []string{`| echo a`, `echo a ;; echo b`, `echo a && && echo b`, `echo )`, `()`} {
+		_, err := parseShell(source)
+		if _, ok := err.(shellSyntaxError); !ok {
+			t.Errorf("parseShell(%q) err=%v, want a syntax error", source, err)
+		}
+	}
+}
+
+func TestShellCommandLists(t *testing.T) {
+	for _, test := range []struct {
+		source, stdout, stderr string
+		status                 uint32
+	}{
+		{`echo a; echo b`, "a\nb\n", "", 0},
+		{`false && echo no || echo yes`, "yes\n", "", 0},
+		{`true || echo no && echo yes`, "yes\n", "", 0},
+		{`echo hello | cat | cat`, "hello\n", "", 0},
+		{`! true`, "", "", 1},
+		{`nonexistent 2>&1 | cat`, "nonexistent: command not found\n", "", 0},
+		{`nonexistent 2>/dev/null`, "", "", 127},
+		{`echo hidden > /dev/null`, "", "", 0},
+		{`cat < /dev/null`, "", "", 0},
+		{`cat < /does/not/exist`, "", "sh: /does/not/exist: No such file or directory\n", 1},
+		{`(echo a; exit 3) || echo failed`, "a\nfailed\n", "", 0},
+		{`echo $(echo 'a   b') "$(echo 'c  d')" x$(echo y)z`, "a b c  d xyz\n", "", 0},
+		{"echo `echo back tick`", "back tick\n", "", 0},
+		{`echo a; exit 4; echo b`, "a\n", "", 4},
+		{`echo a # comment`, "a\n", "", 0},
+		{`echo a |`, "", "sh: 1: Syntax error: command expected after \"|\"\n", 2},
+		{"cat <<EOF\n$HOME `echo x` \\$HOME\nEOF\necho after", "/root x $HOME\nafter\n", "", 0},
+		{"cat <<'EOF' | cat\n$HOME\nEOF", "$HOME\n", "", 0},
+		{"cat <<-EOF\n\tindented\n\tEOF", "indented\n", "", 0},
+		{"cat <<< 'here string'", "here string\n", "", 0},
+		{`echo -n a; echo -e 'b\tc\x41\0101'`, "ab\tcAA\n", "", 0},
+		{`printf '%s-%d|' a 1 b 2; printf '%05.1f %x %b\n' 3.14159 255 'x\ny'`, "a-1|b-2|003.1 ff x\ny\n", "", 0},
+		{`printf '\101\x42\n'`, "AB\n", "", 0},
+		{`echo aGVsbG8K | base64 -d; printf hello | base64`, "hello\naGVsbG8=\n", "", 0},
+		{`printf 0123456789 | dd bs=2 skip=1 count=2 status=none`, "2345", "", 0},
+		{`printf '%e|%E|%f|%F|%g|%G\n'`, "0.000000e+00|0.000000E+00|0.000000|0.000000|0|0\n", "", 0},
+		{`printf 0123456789 | dd bs=8G skip=9999999999 status=none`, "", "", 0},
+		{`printf 0123456789 | dd bs=9223372036854775807 count=2 status=none`, "0123456789", "", 0},
+		{`dd bs=9999999999G`, "", "dd: invalid number: '9999999999G'\n", 1},
+	} {
+		stdout, stderr, status := runTestShell(t, []string{"sh", "-c", test.source}, "")
+		if stdout != test.stdout {
+			t.Errorf("%q: stdout=%q, want %q", test.source, stdout, test.stdout)
+		}
+		if stderr != test.stderr {
+			t.Errorf("%q: stderr=%q, want %q", test.source, stderr, test.stderr)
+		}
+		if status != test.status {
+			t.Errorf("%q: status=%v, want %v", test.source, status, test.status)
+		}
+	}
+}
+
+func TestShellContinuationLines(t *testing.T) {
+	stdout, stderr, status := runTestShell(t, shellProgram, "echo 'a\nb' &&\necho c\nexit 5\n")
+	if stdout != "a\nb\nc\n" {
+		t.Errorf("stdout=%q, want %q", stdout, "a\nb\nc\n")
+	}
+	if stderr != "" {
+		t.Errorf("stderr=%q, want empty", stderr)
+	}
+	if status != 5 {
+		t.Errorf("status=%v, want 5", status)
+	}
+}
+
+func TestInputLimits(t *testing.T) {
+	inputChan := make(chan string, 10)
+	stdin := channelReadLiner{bufio.NewReader(strings.NewReader("short\n" + strings.Repeat("x", 100000) + "\n")), inputChan}
+	if line, err := stdin.ReadLine(); line != "short" || err != nil {
+		t.Errorf("line=%q, err=%v, want %q", line, err, "short")
+	}
+	if _, err := stdin.ReadLine(); err != bufio.ErrTooLong {
+		t.Errorf("err=%v, want %v", err, bufio.ErrTooLong)
+	}
+
+	_, err := readInput(newBufferReadLiner(make([]byte, maxInputSize+1)))
+	if err != errInputTooLarge {
+		t.Errorf("err=%v, want %v", err, errInputTooLarge)
+	}
+
+	// A here-document that never ends.
+	heredoc := "cat <<EOF\n" + strings.Repeat(strings.Repeat("x", 60000)+"\n", maxShellCommandSize/60000+1)
+	_, err = executeProgram(commandContext{args: shellProgram, stdin: newBufferReadLiner([]byte(heredoc)), stdout: io.Discard, stderr: io.Discard}, newTestSessionContext(&config{}))
+	if err != bufio.ErrTooLong {
+		t.Errorf("err=%v, want %v", err, bufio.ErrTooLong)
+	}
+}
+
+func TestShellHeredocContinuation(t *testing.T) {
+	stdout, _, _ := runTestShell(t, shellProgram, "cat <<EOF\nline 1\nline 2\nEOF\nexit\n")
+	if expected := "line 1\nline 2\n"; stdout != expected {
+		t.Errorf("stdout=%q, want %q", stdout, expected)
+	}
+}
+
+func TestShellVariables(t *testing.T) {
+	for _, test := range []struct {
+		source, stdout string
+		status         uint32
+	}{
+		{`echo $HOME ${HOME} "$PATH" '$HOME'`, "/root /root " + defaultPath + " $HOME\n", 0},
+		{`echo ~ ~/x ~jaksi/y "~"`, "/root /root/x /home/jaksi/y ~\n", 0},
+		{`false; echo $?; echo $?`, "1\n0\n", 0},
+		{`echo $$`, "1234\n", 0},
+		{`FOO="a  b"; echo $FOO "$FOO" ${#FOO}`, "a b a  b 4\n", 0},
+		{`echo ${UNSET:-default} ${UNSET-x} ${HOME:+set} [${UNSET}] [$UNSET]`, "default x set [] []\n", 0},
+		{`echo ${U:-$HOME} ${U:-~/x} ${U:-$(printf "a  b")} "${U:-$(printf "a  b")}" ${HOME:+"[$HOME]"} ${U:-${V:-nested}}`, "/root /root/x a b a  b [/root] nested\n", 0},
+		{`echo ${U:=$(echo x)}; echo $U`, "x\nx\n", 0},
+		{`export PATH=/bin:$PATH; echo $PATH`, "/bin:" + defaultPath + "\n", 0},
+		{`FOO=bar; unset FOO; echo "[$FOO]"`, "[]\n", 0},
+		{`(FOO=sub; echo $FOO); echo "[$FOO]"`, "sub\n[]\n", 0},
+		{`FOO=tmp env | cat > /dev/null; echo "[$FOO]"`, "[]\n", 0},
+		{`x=$(false); echo $?`, "1\n", 0},
+		{`export 1A=b`, "", 2},
+		{`echo ${`, "", 2},
+	} {
+		stdout, _, status := runTestShell(t, []string{"sh", "-c", test.source}, "")
+		if stdout != test.stdout {
+			t.Errorf("%q: stdout=%q, want %q", test.source, stdout, test.stdout)
+		}
+		if status != test.status {
+			t.Errorf("%q: status=%v, want %v", test.source, status, test.status)
+		}
+	}
+}
+
+func TestShellPositionalParameters(t *testing.T) {
+	stdout, _, _ := runTestShell(t, []string{"sh", "-c", `echo $0 $1 $# "$@"`, "name", "a", "b"}, "")
+	if expected := "name a 2 a b\n"; stdout != expected {
+		t.Errorf("stdout=%q, want %q", stdout, expected)
+	}
+}
+
+func TestEnvAndSet(t *testing.T) {
+	stdout, _, _ := runTestShell(t, []string{"sh", "-c", `LOCAL=1; export EXPORTED="it's"; env; set`}, "")
+	if !strings.Contains(stdout, "EXPORTED=it's\n") {
+		t.Errorf("stdout=%q, want env output with EXPORTED", stdout)
+	}
+	if !strings.Contains(stdout, "EXPORTED='it'\\''s'\n") || !strings.Contains(stdout, "LOCAL='1'\n") {
+		t.Errorf("stdout=%q, want set output with EXPORTED and LOCAL", stdout)
+	}
+	if strings.Count(stdout, "LOCAL") != 1 {
+		t.Errorf("stdout=%q, want LOCAL only in set output", stdout)
+	}
+}
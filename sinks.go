@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+var sinkDroppedEventsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sshesame_sink_dropped_events_total",
+	Help: "Total number of events dropped because the queue of a sink was full",
+}, []string{"sink"})
+
+// EventSink is a destination logged events are written to. Writes to a sink are never concurrent.
+type EventSink interface {
+	WriteEvent(event sinkEvent) error
+	Close() error
+}
+
+// eventSinkTypes creates the sinks of each type from their config.
+var eventSinkTypes = map[string]func(cfg *config, sinkCfg sinkConfig) (EventSink, error){
+	"file":    newFileSink,
+	"mongodb": newMongoDBSink,
+	"syslog":  newSyslogSink,
+	"webhook": newWebhookSink,
+}
+
+type sinkConfig struct {
+	Name       string         `yaml:"name"`
+	Type       string         `yaml:"type"`
+	Format     string         `yaml:"format"`
+	File       string         `yaml:"file"`
+	Timestamps bool           `yaml:"timestamps"`
+	EventTypes []string       `yaml:"event_types"`
+	Debug      bool           `yaml:"debug"`
+	QueueSize  int            `yaml:"queue_size"`
+	Rotation   rotationConfig `yaml:"rotation"`
+
+	Syslog  syslogSinkConfig  `yaml:"syslog"`
+	Webhook webhookSinkConfig `yaml:"webhook"`
+}
+
+func (sinkCfg *sinkConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawSinkConfig sinkConfig
+	raw := rawSinkConfig{
+		Timestamps: true,
+		QueueSize:  1000,
+		Syslog:     syslogSinkConfig{Network: "unix", Facility: "auth", AppName: "sshesame"},
+		Webhook: webhookSinkConfig{
+			BatchSize:      100,
+			FlushInterval:  5 * time.Second,
+			Timeout:        10 * time.Second,
+			MaxRetries:     3,
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			SpoolMaxSize:   100 * 1024 * 1024,
+		},
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*sinkCfg = sinkConfig(raw)
+	return nil
+}
+
+// sinkEvent is a logged event with where it happened.
+type sinkEvent struct {
+	Time         time.Time
+	Sensor       string
+	Listener     string
+	ConnectionID string
+	ChannelUID   string
+	Source       net.Addr
+	Entry        logEntry
+}
+
+func (event sinkEvent) text() string {
+	if event.Listener != "" {
+		return fmt.Sprintf("[%v] [%v] %v", event.Listener, event.Source, event.Entry)
+	}
+	return fmt.Sprintf("[%v] %v", event.Source, event.Entry)
+}
+
+func (event sinkEvent) json(timestamps, splitHostPort bool) ([]byte, error) {
+	tcpSource := event.Source.(*net.TCPAddr)
+	var source interface{} = addressLog{tcpSource.IP.String(), tcpSource.Port}
+	if !splitHostPort {
+		source = source.(addressLog).String()
+	}
+	var jsonEntry interface{}
+	if timestamps {
+		jsonEntry = struct {
+			Sensor       string      `json:"sensor,omitempty"`
+			ConnectionID string      `json:"session_id,omitempty"`
+			ChannelUID   string      `json:"channel_uid,omitempty"`
+			Time         int64       `json:"time"`
+			Source       interface{} `json:"source"`
+			Listener     string      `json:"listener,omitempty"`
+			EventType    string      `json:"event_type"`
+			Event        logEntry    `json:"event"`
+		}{
+			event.Sensor,
+			event.ConnectionID,
+			event.ChannelUID,
+			event.Time.Unix(),
+			source,
+			event.Listener,
+			event.Entry.eventType(),
+			event.Entry,
+		}
+	} else {
+		jsonEntry = struct {
+			Sensor       string      `json:"sensor,omitempty"`
+			ConnectionID string      `json:"session_id,omitempty"`
+			ChannelUID   string      `json:"channel_uid,omitempty"`
+			Source       interface{} `json:"source"`
+			Listener     string      `json:"listener,omitempty"`
+			EventType    string      `json:"event_type"`
+			Event        logEntry    `json:"event"`
+		}{
+			event.Sensor,
+			event.ConnectionID,
+			event.ChannelUID,
+			source,
+			event.Listener,
+			event.Entry.eventType(),
+			event.Entry,
+		}
+	}
+	return json.Marshal(jsonEntry)
+}
+
+// eventSink filters the events sent to a sink and queues them, so that a slow sink doesn't hold up connections. Events
+// are dropped when the queue is full, or written right away if the queue size is 0.
+type eventSink struct {
+	name       string
+	sink       EventSink
+	eventTypes map[string]bool
+	debug      bool
+
+	lock      sync.RWMutex
+	writeLock sync.Mutex
+	queue     chan sinkEvent
+	done      chan struct{}
+	closed    bool
+}
+
+func newEventSink(name string, sink EventSink, sinkCfg sinkConfig) (*eventSink, error) {
+	result := &eventSink{
+		name:  name,
+		sink:  sink,
+		debug: sinkCfg.Debug,
+	}
+	for _, eventType := range sinkCfg.EventTypes {
+		if _, ok := eventTypeIdMap[eventType]; !ok {
+			return nil, fmt.Errorf("unknown event type %q", eventType)
+		}
+		if result.eventTypes == nil {
+			result.eventTypes = map[string]bool{}
+		}
+		result.eventTypes[eventType] = true
+	}
+	if sinkCfg.QueueSize < 0 {
+		return nil, fmt.Errorf("invalid queue size %v", sinkCfg.QueueSize)
+	}
+	if sinkCfg.QueueSize > 0 {
+		result.queue = make(chan sinkEvent, sinkCfg.QueueSize)
+		result.done = make(chan struct{})
+		go result.run()
+	}
+	return result, nil
+}
+
+func (sink *eventSink) accepts(eventType string) bool {
+	if strings.HasPrefix(eventType, "debug_") && !sink.debug {
+		return false
+	}
+	return sink.eventTypes == nil || sink.eventTypes[eventType]
+}
+
+func (sink *eventSink) send(event sinkEvent) {
+	if !sink.accepts(event.Entry.eventType()) {
+		return
+	}
+	sink.lock.RLock()
+	defer sink.lock.RUnlock()
+	if sink.closed {
+		sinkDroppedEventsMetric.WithLabelValues(sink.name).Inc()
+		return
+	}
+	if sink.queue == nil {
+		sink.write(event)
+		return
+	}
+	select {
+	case sink.queue <- event:
+	default:
+		sinkDroppedEventsMetric.WithLabelValues(sink.name).Inc()
+	}
+}
+
+func (sink *eventSink) write(event sinkEvent) {
+	sink.writeLock.Lock()
+	defer sink.writeLock.Unlock()
+	if err := sink.sink.WriteEvent(event); err != nil {
+		warningLogger.Printf("Failed to write event to sink %q: %v", sink.name, err)
+	}
+}
+
+func (sink *eventSink) run() {
+	defer close(sink.done)
+	for event := range sink.queue {
+		sink.write(event)
+	}
+}
+
+// close writes the events still queued and closes the sink.
+func (sink *eventSink) close() {
+	sink.lock.Lock()
+	if sink.closed {
+		sink.lock.Unlock()
+		return
+	}
+	sink.closed = true
+	if sink.queue != nil {
+		close(sink.queue)
+	}
+	sink.lock.Unlock()
+	if sink.queue != nil {
+		<-sink.done
+	}
+	if err := sink.sink.Close(); err != nil {
+		warningLogger.Printf("Failed to close sink %q: %v", sink.name, err)
+	}
+}
+
+// setupSinks sets up the configured sinks, or the ones of the logging and mongodb sections if there are none.
+func (cfg *config) setupSinks() error {
+	var sinks []*eventSink
+	closeSinks := func() {
+		for _, sink := range sinks {
+			sink.close()
+		}
+	}
+	if cfg.Sinks == nil {
+		format := "text"
+		if cfg.Logging.JSON {
+			format = "json"
+		}
+		sinkCfg := sinkConfig{Format: format, Timestamps: cfg.Logging.Timestamps, Debug: cfg.Logging.Debug, QueueSize: cfg.Logging.QueueSize}
+		// The log package is set up to write to the log file.
+		sink, err := newEventSink("log", &fileSink{log.Default(), nil, format, cfg.Logging.Timestamps, cfg.Logging.SplitHostPort}, sinkCfg)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, sink)
+		if cfg.MongoDBConfig.Enable {
+			sinkCfg := sinkConfig{Debug: cfg.Logging.Debug, QueueSize: cfg.Logging.QueueSize}
+			sink, err := newEventSink("mongodb", mongoDBSink{cfg}, sinkCfg)
+			if err != nil {
+				closeSinks()
+				return err
+			}
+			sinks = append(sinks, sink)
+		}
+	}
+	names := map[string]bool{}
+	for i, sinkCfg := range cfg.Sinks {
+		name := sinkCfg.Name
+		if name == "" {
+			name = sinkCfg.Type
+		}
+		if names[name] {
+			closeSinks()
+			return fmt.Errorf("duplicate sink %q", name)
+		}
+		names[name] = true
+		newSink, ok := eventSinkTypes[sinkCfg.Type]
+		if !ok {
+			closeSinks()
+			return fmt.Errorf("invalid sink %v: unknown type %q", i+1, sinkCfg.Type)
+		}
+		sink, err := newSink(cfg, sinkCfg)
+		if err != nil {
+			closeSinks()
+			return fmt.Errorf("invalid sink %v: %w", i+1, err)
+		}
+		queuedSink, err := newEventSink(name, sink, sinkCfg)
+		if err != nil {
+			sink.Close()
+			closeSinks()
+			return fmt.Errorf("invalid sink %v: %w", i+1, err)
+		}
+		sinks = append(sinks, queuedSink)
+	}
+	for _, sink := range cfg.sinks {
+		sink.close()
+	}
+	cfg.sinks = sinks
+	return nil
+}
+
+// fileSink writes events as text or JSON lines to a rotated file, or to the standard output.
+type fileSink struct {
+	logger        *log.Logger
+	file          io.Closer
+	format        string
+	timestamps    bool
+	splitHostPort bool
+}
+
+func newFileSink(cfg *config, sinkCfg sinkConfig) (EventSink, error) {
+	format := sinkCfg.Format
+	if format == "" {
+		format = "text"
+	}
+	if format != "text" && format != "json" {
+		return nil, fmt.Errorf("unsupported format %q, supported formats are text and json", format)
+	}
+	flags := 0
+	if format == "text" && sinkCfg.Timestamps {
+		flags = log.LstdFlags
+	}
+	sink := &fileSink{log.New(os.Stdout, "", flags), nil, format, sinkCfg.Timestamps, cfg.Logging.SplitHostPort}
+	if sinkCfg.File != "" {
+		file, err := newRotatingFile(sinkCfg.File, sinkCfg.Rotation)
+		if err != nil {
+			return nil, err
+		}
+		sink.logger.SetOutput(file)
+		sink.file = file
+	}
+	return sink, nil
+}
+
+func (sink *fileSink) WriteEvent(event sinkEvent) error {
+	if sink.format == "text" {
+		sink.logger.Print(event.text())
+		return nil
+	}
+	logBytes, err := event.json(sink.timestamps, sink.splitHostPort)
+	if err != nil {
+		return err
+	}
+	sink.logger.Print(string(logBytes))
+	return nil
+}
+
+func (sink *fileSink) Close() error {
+	if sink.file == nil {
+		return nil
+	}
+	return sink.file.Close()
+}
+
+// mongoDBSink writes events to the collections of the mongodb section, skipping them while disconnected.
+type mongoDBSink struct {
+	cfg *config
+}
+
+func newMongoDBSink(cfg *config, sinkCfg sinkConfig) (EventSink, error) {
+	if !cfg.MongoDBConfig.Enable {
+		return nil, errors.New("mongodb not enabled")
+	}
+	return mongoDBSink{cfg}, nil
+}
+
+func (sink mongoDBSink) WriteEvent(event sinkEvent) error {
+	mongoRecorder := sink.cfg.mongoRecorder
+	if mongoRecorder == nil {
+		return errors.New("MongoDB recorder not set up")
+	}
+	if !mongoRecorder.isConnected {
+		return errors.New("not connected to MongoDB")
+	}
+	eventType := event.Entry.eventType()
+	eventTypeId, ok := eventTypeIdMap[eventType]
+	if !ok {
+		eventTypeId = 0
+	}
+	tcpSource := event.Source.(*net.TCPAddr)
+	logRecord := &bson.M{
+		"time":        event.Time,
+		"sensor":      event.Sensor,
+		"session_id":  event.ConnectionID,
+		"event_type":  eventTypeId,
+		"source_ip":   tcpSource.IP.String(),
+		"source_port": tcpSource.Port,
+	}
+	if event.ChannelUID != "" {
+		(*logRecord)["channel_uid"] = event.ChannelUID
+	}
+	if event.Listener != "" {
+		(*logRecord)["listener"] = event.Listener
+	}
+	LogEventToMongo(mongoRecorder, eventType, logRecord, event.Entry)
+	return nil
+}
+
+func (sink mongoDBSink) Close() error {
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type mockSink struct {
+	events  chan sinkEvent
+	blocked chan struct{}
+	closed  bool
+}
+
+func (sink *mockSink) WriteEvent(event sinkEvent) error {
+	<-sink.blocked
+	sink.events <- event
+	return nil
+}
+
+func (sink *mockSink) Close() error {
+	sink.closed = true
+	return nil
+}
+
+func TestSinkFilters(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config{}
+	cfg.Sinks = []sinkConfig{
+		{Name: "all", Type: "file", File: path.Join(dir, "all.log"), Format: "text", Timestamps: true, Debug: true},
+		{Name: "auth", Type: "file", File: path.Join(dir, "auth.log"), Format: "json", Timestamps: true, EventTypes: []string{"password_auth"}},
+	}
+	if err := cfg.setupLogging(); err != nil {
+		t.Fatalf("Failed to setup logging: %v", err)
+	}
+	context := connContext{ConnMetadata: mockConnContext{}, cfg: cfg}
+	context.logEvent(passwordAuthLog{authLog: authLog{User: "root"}, Password: "123456"})
+	context.logEvent(noAuthLog{authLog: authLog{User: "root"}})
+	context.logEvent(debugGlobalRequestLog{RequestType: "test"})
+	for _, sink := range cfg.sinks {
+		sink.close()
+	}
+
+	expectedLogs := map[string]*regexp.Regexp{
+		"all.log":  regexp.MustCompile(`^[^\n]+ \[127\.0\.0\.1:1234\] authentication for user "root" with password "123456" rejected\n[^\n]+ \[127\.0\.0\.1:1234\] authentication for user "root" without credentials rejected\n[^\n]+ DEBUG global request received: [^\n]+\n$`),
+		"auth.log": regexp.MustCompile(`^{"time":\d+,"source":"127\.0\.0\.1:1234","event_type":"password_auth","event":{[^\n]+}}\n$`),
+	}
+	for file, expected := range expectedLogs {
+		logs, err := os.ReadFile(path.Join(dir, file))
+		if err != nil {
+			t.Fatalf("Failed to read logs: %v", err)
+		}
+		if !expected.Match(logs) {
+			t.Errorf("file=%v: logs=%q, want match for %v", file, logs, expected)
+		}
+	}
+}
+
+func TestSinkQueue(t *testing.T) {
+	mock := &mockSink{events: make(chan sinkEvent, 10), blocked: make(chan struct{})}
+	sink, err := newEventSink("mock", mock, sinkConfig{QueueSize: 2})
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	// The first event is being written while the next two are queued, the rest are dropped without blocking.
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			sink.send(sinkEvent{Entry: mockLogEntry{Content: strings.Repeat("x", i)}})
+			if i == 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("send blocked on a slow sink")
+	}
+	close(mock.blocked)
+	sink.close()
+	close(mock.events)
+	var contents []string
+	for event := range mock.events {
+		contents = append(contents, event.Entry.(mockLogEntry).Content)
+	}
+	if expected := []string{"", "x", "xx"}; !reflect.DeepEqual(contents, expected) {
+		t.Errorf("contents=%q, want %q", contents, expected)
+	}
+	if !mock.closed {
+		t.Errorf("closed=false, want true")
+	}
+	sink.send(sinkEvent{Entry: mockLogEntry{}})
+}
+
+func TestSinksConfig(t *testing.T) {
+	cfg := &config{}
+	if err := yaml.UnmarshalStrict([]byte(`
+sinks:
+  - type: file
+  - name: auth
+    type: file
+    format: json
+    timestamps: false
+    event_types: [password_auth]
+    queue_size: 0
+`), cfg); err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	defaultSyslog := syslogSinkConfig{Network: "unix", Facility: "auth", AppName: "sshesame"}
+	defaultWebhook := webhookSinkConfig{
+		BatchSize:      100,
+		FlushInterval:  5 * time.Second,
+		Timeout:        10 * time.Second,
+		MaxRetries:     3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		SpoolMaxSize:   100 * 1024 * 1024,
+	}
+	expectedSinks := []sinkConfig{
+		{Type: "file", Timestamps: true, QueueSize: 1000, Syslog: defaultSyslog, Webhook: defaultWebhook},
+		{Name: "auth", Type: "file", Format: "json", EventTypes: []string{"password_auth"}, Syslog: defaultSyslog, Webhook: defaultWebhook},
+	}
+	if !reflect.DeepEqual(cfg.Sinks, expectedSinks) {
+		t.Errorf("sinks=%+v, want %+v", cfg.Sinks, expectedSinks)
+	}
+
+	for _, sinks := range [][]sinkConfig{
+		{{Type: "carrier_pigeon"}},
+		{{Type: "file", Format: "xml"}},
+		{{Type: "file", Format: "text", EventTypes: []string{"teleport"}}},
+		{{Type: "file", Format: "text"}, {Type: "file", Format: "json"}},
+		{{Type: "file", Format: "text", QueueSize: -1}},
+		{{Type: "mongodb"}},
+	} {
+		cfg := &config{Sinks: sinks}
+		if err := cfg.setupSinks(); err == nil {
+			t.Errorf("sinks=%+v: err=nil, want an error", sinks)
+		}
+	}
+}
+
+func TestMongoDBSinkNotConnected(t *testing.T) {
+	cfg := &config{}
+	cfg.MongoDBConfig.Enable = true
+	sink, err := newMongoDBSink(cfg, sinkConfig{Type: "mongodb"})
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	event := sinkEvent{Source: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, Entry: mockLogEntry{}}
+	if err := sink.WriteEvent(event); err == nil {
+		t.Errorf("err=nil, want an error without a recorder")
+	}
+	cfg.mongoRecorder = &MongoRecorder{cfg: cfg}
+	if err := sink.WriteEvent(event); err == nil {
+		t.Errorf("err=nil, want an error while disconnected")
+	}
+}
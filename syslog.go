@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type syslogSinkConfig struct {
+	Network            string `yaml:"network"`
+	Address            string `yaml:"address"`
+	Facility           string `yaml:"facility"`
+	AppName            string `yaml:"app_name"`
+	CACert             string `yaml:"ca_cert"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7, "uucp": 8, "cron": 9,
+	"authpriv": 10, "ftp": 11, "local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21,
+	"local6": 22, "local7": 23,
+}
+
+const (
+	syslogSeverityInfo  = 6
+	syslogSeverityDebug = 7
+	// syslogSDID is the ID of the structured data element holding the event, using the enterprise number reserved for
+	// documentation by RFC 5612.
+	syslogSDID    = "sshesame@32473"
+	syslogTimeout = 10 * time.Second
+)
+
+// syslogSink sends events as RFC 5424 messages over UDP, TCP or TLS, or to the local syslog socket. Messages over TCP
+// and TLS are framed with their length as described in RFC 6587.
+type syslogSink struct {
+	network       string
+	address       string
+	tlsConfig     *tls.Config
+	facility      int
+	appName       string
+	format        string
+	splitHostPort bool
+	conn          net.Conn
+}
+
+func newSyslogSink(cfg *config, sinkCfg sinkConfig) (EventSink, error) {
+	format := sinkCfg.Format
+	switch format {
+	case "":
+		format = "text"
+	case "text", "json", "cef", "leef":
+	default:
+		return nil, fmt.Errorf("unsupported format %q, supported formats are text, json, cef and leef", format)
+	}
+	facility, ok := syslogFacilities[sinkCfg.Syslog.Facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", sinkCfg.Syslog.Facility)
+	}
+	sink := &syslogSink{
+		network:       sinkCfg.Syslog.Network,
+		address:       sinkCfg.Syslog.Address,
+		facility:      facility,
+		appName:       sinkCfg.Syslog.AppName,
+		format:        format,
+		splitHostPort: cfg.Logging.SplitHostPort,
+	}
+	switch sink.network {
+	case "unix":
+		if sink.address == "" {
+			sink.address = "/dev/log"
+		}
+	case "udp", "tcp":
+	case "tls":
+		sink.tlsConfig = &tls.Config{InsecureSkipVerify: sinkCfg.Syslog.InsecureSkipVerify}
+		if sinkCfg.Syslog.CACert != "" {
+			caCert, err := os.ReadFile(sinkCfg.Syslog.CACert)
+			if err != nil {
+				return nil, err
+			}
+			sink.tlsConfig.RootCAs = x509.NewCertPool()
+			if !sink.tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+				return nil, fmt.Errorf("no certificates found in %q", sinkCfg.Syslog.CACert)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q, supported networks are udp, tcp, tls and unix", sink.network)
+	}
+	if sink.address == "" {
+		return nil, errors.New("no syslog address")
+	}
+	return sink, nil
+}
+
+func (sink *syslogSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+	switch sink.network {
+	case "unix":
+		// Like the log/syslog package, prefer datagrams and fall back to a stream.
+		conn, err := dialer.Dial("unixgram", sink.address)
+		if err == nil {
+			return conn, nil
+		}
+		return dialer.Dial("unix", sink.address)
+	case "tls":
+		return tls.DialWithDialer(dialer, "tcp", sink.address, sink.tlsConfig)
+	default:
+		return dialer.Dial(sink.network, sink.address)
+	}
+}
+
+func (sink *syslogSink) WriteEvent(event sinkEvent) error {
+	message, err := sink.message(event)
+	if err != nil {
+		return err
+	}
+	// Writes to a stream closed by the server only fail once it's noticed, so check for that first, and reconnect once
+	// if the write fails anyway.
+	if sink.conn != nil && sink.closedByServer() {
+		sink.conn.Close()
+		sink.conn = nil
+	}
+	for attempt := 0; ; attempt++ {
+		if sink.conn == nil {
+			if sink.conn, err = sink.dial(); err != nil {
+				return err
+			}
+		}
+		frame := message
+		switch {
+		case sink.network == "tcp" || sink.network == "tls":
+			frame = append([]byte(fmt.Sprintf("%v ", len(message))), message...)
+		case sink.conn.RemoteAddr().Network() == "unix":
+			frame = append(message, '\n')
+		}
+		if err = sink.conn.SetWriteDeadline(time.Now().Add(syslogTimeout)); err == nil {
+			_, err = sink.conn.Write(frame)
+		}
+		if err == nil {
+			return nil
+		}
+		sink.conn.Close()
+		sink.conn = nil
+		if attempt == 1 {
+			return err
+		}
+	}
+}
+
+// closedByServer checks whether a stream was closed by the server, which otherwise never sends anything. Reads past
+// their deadline aren't even attempted, so the deadline is slightly in the future.
+func (sink *syslogSink) closedByServer() bool {
+	if sink.conn.LocalAddr().Network() == "udp" || sink.conn.LocalAddr().Network() == "unixgram" {
+		return false
+	}
+	if err := sink.conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return true
+	}
+	_, err := sink.conn.Read(make([]byte, 1))
+	var netErr net.Error
+	return !errors.As(err, &netErr) || !netErr.Timeout()
+}
+
+func (sink *syslogSink) Close() error {
+	if sink.conn == nil {
+		return nil
+	}
+	return sink.conn.Close()
+}
+
+// message formats an event as an RFC 5424 message, with the event in structured data and its text, JSON, CEF or LEEF
+// representation as the message.
+func (sink *syslogSink) message(event sinkEvent) ([]byte, error) {
+	severity := syslogSeverityInfo
+	if strings.HasPrefix(event.Entry.eventType(), "debug_") {
+		severity = syslogSeverityDebug
+	}
+	structuredData, err := syslogStructuredData(event)
+	if err != nil {
+		return nil, err
+	}
+	var message string
+	switch sink.format {
+	case "text":
+		message = event.text()
+	case "json":
+		jsonBytes, err := event.json(true, sink.splitHostPort)
+		if err != nil {
+			return nil, err
+		}
+		message = string(jsonBytes)
+	case "cef":
+		message = siemEventOf(event).cef()
+	case "leef":
+		message = siemEventOf(event).leef()
+	}
+	return []byte(fmt.Sprintf("<%v>1 %v %v %v %v %v %v %v",
+		sink.facility*8+severity,
+		event.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(event.Sensor, 255),
+		syslogHeaderField(sink.appName, 48),
+		os.Getpid(),
+		syslogHeaderField(event.Entry.eventType(), 32),
+		structuredData,
+		message)), nil
+}
+
+// syslogHeaderField replaces what isn't allowed in a header field and truncates it.
+func syslogHeaderField(value string, maxLength int) string {
+	field := []byte(value)
+	for i, b := range field {
+		if b < 33 || b > 126 {
+			field[i] = '_'
+		}
+	}
+	if len(field) > maxLength {
+		field = field[:maxLength]
+	}
+	if len(field) == 0 {
+		return "-"
+	}
+	return string(field)
+}
+
+// syslogStructuredData holds the sensor, connection, source and the fields of the event, named after their JSON keys.
+// Fields that aren't strings, numbers or booleans are JSON encoded.
+func syslogStructuredData(event sinkEvent) (string, error) {
+	params := map[string]string{
+		"event_type":  event.Entry.eventType(),
+		"sensor":      event.Sensor,
+		"listener":    event.Listener,
+		"session_id":  event.ConnectionID,
+		"channel_uid": event.ChannelUID,
+	}
+	if tcpSource, ok := event.Source.(*net.TCPAddr); ok {
+		params["src"] = tcpSource.IP.String()
+		params["spt"] = strconv.Itoa(tcpSource.Port)
+	}
+	entryBytes, err := json.Marshal(event.Entry)
+	if err != nil {
+		return "", err
+	}
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(entryBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return "", err
+	}
+	for name, value := range fields {
+		switch value := value.(type) {
+		case string:
+			params[name] = value
+		case json.Number, bool:
+			params[name] = fmt.Sprint(value)
+		case nil:
+		default:
+			valueBytes, err := json.Marshal(value)
+			if err != nil {
+				return "", err
+			}
+			params[name] = string(valueBytes)
+		}
+	}
+	names := make([]string, 0, len(params))
+	for name, value := range params {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var structuredData strings.Builder
+	structuredData.WriteString("[" + syslogSDID)
+	for _, name := range names {
+		fmt.Fprintf(&structuredData, ` %v="%v"`, name, syslogParamEscaper.Replace(params[name]))
+	}
+	structuredData.WriteString("]")
+	return structuredData.String(), nil
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "]", `\]`)
+
+// siemField is a field of an event in the CEF and LEEF formats.
+type siemField struct {
+	cefKey, leefKey, value string
+}
+
+type siemEvent struct {
+	time      time.Time
+	eventType string
+	name      string
+	severity  int
+	fields    []siemField
+}
+
+// siemEventOf maps an event to the fields ArcSight and QRadar know about, adding custom ones for the rest.
+func siemEventOf(event sinkEvent) siemEvent {
+	result := siemEvent{time: event.Time, eventType: event.Entry.eventType(), name: event.Entry.String(), severity: 3}
+	add := func(cefKey, leefKey, value string) {
+		if value != "" {
+			result.fields = append(result.fields, siemField{cefKey, leefKey, value})
+		}
+	}
+	// CEF custom strings come with a label.
+	addCustom := func(number int, label, value string) {
+		if value != "" {
+			add(fmt.Sprintf("cs%v", number), label, value)
+			add(fmt.Sprintf("cs%vLabel", number), "", label)
+		}
+	}
+	add("rt", "", strconv.FormatInt(event.Time.UnixMilli(), 10))
+	if tcpSource, ok := event.Source.(*net.TCPAddr); ok {
+		add("src", "src", tcpSource.IP.String())
+		add("spt", "srcPort", strconv.Itoa(tcpSource.Port))
+	}
+	add("dvchost", "sensor", event.Sensor)
+	add("externalId", "sessionId", event.ConnectionID)
+	addCustom(6, "listener", event.Listener)
+	auth := func(entry authLog) {
+		add("suser", "usrName", entry.User)
+		if entry.Accepted {
+			add("outcome", "outcome", "success")
+			result.severity = 7
+		} else {
+			add("outcome", "outcome", "failure")
+			result.severity = 5
+		}
+	}
+	switch entry := event.Entry.(type) {
+	case noAuthLog:
+		auth(entry.authLog)
+	case passwordAuthLog:
+		auth(entry.authLog)
+		addCustom(1, "password", entry.Password)
+	case publicKeyAuthLog:
+		auth(entry.authLog)
+		addCustom(2, "publicKey", entry.PublicKeyFingerprint)
+	case keyboardInteractiveAuthLog:
+		auth(entry.authLog)
+		addCustom(1, "answers", strings.Join(entry.Answers, "\n"))
+	case keyboardInteractiveAuthAbortLog:
+		auth(entry.authLog)
+		addCustom(1, "answers", strings.Join(entry.Answers, "\n"))
+	case connectionLog:
+		add("requestClientApplication", "clientVersion", entry.ClientVersion)
+		addCustom(4, "hassh", entry.HASSH)
+	case sessionInputLog:
+		result.severity = 6
+		addCustom(3, "input", entry.Input)
+		add("cn1", "channel", strconv.Itoa(entry.ChannelID))
+		add("cn1Label", "", "channel")
+	case directTCPIPLog:
+		result.severity = 6
+		if host, port, err := net.SplitHostPort(fmt.Sprint(entry.To)); err == nil {
+			if net.ParseIP(host) != nil {
+				add("dst", "dst", host)
+			} else {
+				add("dhost", "dstHost", host)
+			}
+			add("dpt", "dstPort", port)
+		}
+		add("cn1", "channel", strconv.Itoa(entry.ChannelID))
+		add("cn1Label", "", "channel")
+	}
+	add("msg", "msg", result.name)
+	return result
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, "|", `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, "=", `\=`, "\n", `\n`, "\r", `\r`)
+	leefEscaper         = strings.NewReplacer("\t", `\t`, "\n", `\n`, "\r", `\r`)
+)
+
+func (event siemEvent) cef() string {
+	var message strings.Builder
+	fmt.Fprintf(&message, "CEF:0|sshesame|sshesame|1.0|%v|%v|%v|", cefHeaderEscaper.Replace(event.eventType), cefHeaderEscaper.Replace(event.name), event.severity)
+	for i, field := range event.fields {
+		if i > 0 {
+			message.WriteByte(' ')
+		}
+		fmt.Fprintf(&message, "%v=%v", field.cefKey, cefExtensionEscaper.Replace(field.value))
+	}
+	return message.String()
+}
+
+// leef formats the event as LEEF 1.0, with tab separated attributes.
+func (event siemEvent) leef() string {
+	var message strings.Builder
+	fmt.Fprintf(&message, "LEEF:1.0|sshesame|sshesame|1.0|%v|", event.eventType)
+	fmt.Fprintf(&message, "devTime=%v\tdevTimeFormat=MMM dd yyyy HH:mm:ss.SSS z\tcat=%v\tsev=%v", event.time.UTC().Format("Jan 02 2006 15:04:05.000 MST"), event.eventType, event.severity)
+	for _, field := range event.fields {
+		if field.leefKey == "" {
+			continue
+		}
+		fmt.Fprintf(&message, "\t%v=%v", field.leefKey, leefEscaper.Replace(field.value))
+	}
+	return message.String()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSyslogEvent() sinkEvent {
+	return sinkEvent{
+		Time:         time.Date(2024, 5, 1, 12, 30, 0, 123000000, time.UTC),
+		Sensor:       "sensor-1",
+		ConnectionID: "1234",
+		Source:       &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324},
+		Entry:        passwordAuthLog{authLog: authLog{User: "root", Accepted: true}, Password: `pa"ss]w=rd`},
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	tests := []struct {
+		format          string
+		expectedMessage *regexp.Regexp
+	}{
+		{"text", regexp.MustCompile(`^\[192\.0\.2\.1:56324\] authentication for user "root" with password "pa\\"ss]w=rd" accepted$`)},
+		{"json", regexp.MustCompile(`^{"sensor":"sensor-1","session_id":"1234","time":1714566600,"source":"192\.0\.2\.1:56324","event_type":"password_auth","event":{"user":"root","accepted":true,"password":"pa\\"ss]w=rd"}}$`)},
+		{"cef", regexp.MustCompile(`^CEF:0\|sshesame\|sshesame\|1\.0\|password_auth\|authentication for user "root" with password "pa\\\\"ss]w=rd" accepted\|7\|rt=1714566600123 src=192\.0\.2\.1 spt=56324 dvchost=sensor-1 externalId=1234 suser=root outcome=success cs1=pa"ss]w\\=rd cs1Label=password msg=authentication for user "root" with password "pa\\\\"ss]w\\=rd" accepted$`)},
+		{"leef", regexp.MustCompile(`^LEEF:1\.0\|sshesame\|sshesame\|1\.0\|password_auth\|devTime=May 01 2024 12:30:00\.123 UTC\tdevTimeFormat=MMM dd yyyy HH:mm:ss\.SSS z\tcat=password_auth\tsev=7\tsrc=192\.0\.2\.1\tsrcPort=56324\tsensor=sensor-1\tsessionId=1234\tusrName=root\toutcome=success\tpassword=pa"ss]w=rd\tmsg=authentication for user "root" with password "pa\\"ss]w=rd" accepted$`)},
+	}
+	for _, test := range tests {
+		sink, err := newSyslogSink(&config{}, sinkConfig{Format: test.format, Syslog: syslogSinkConfig{Network: "udp", Address: "127.0.0.1:514", Facility: "local0", AppName: "sshesame"}})
+		if err != nil {
+			t.Fatalf("format=%v: Failed to create sink: %v", test.format, err)
+		}
+		message, err := sink.(*syslogSink).message(testSyslogEvent())
+		if err != nil {
+			t.Fatalf("format=%v: Failed to format message: %v", test.format, err)
+		}
+		expectedHeader := regexp.MustCompile(`^<134>1 2024-05-01T12:30:00\.123000Z sensor-1 sshesame \d+ password_auth \[sshesame@32473 accepted="true" event_type="password_auth" password="pa\\"ss\\]w=rd" sensor="sensor-1" session_id="1234" spt="56324" src="192\.0\.2\.1" user="root"\] `)
+		header := expectedHeader.FindString(string(message))
+		if header == "" {
+			t.Errorf("format=%v: message=%q, want match for %v", test.format, message, expectedHeader)
+			continue
+		}
+		if body := string(message[len(header):]); !test.expectedMessage.MatchString(body) {
+			t.Errorf("format=%v: body=%q, want match for %v", test.format, body, test.expectedMessage)
+		}
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer udpConn.Close()
+	unixConn, err := net.ListenPacket("unixgram", path.Join(t.TempDir(), "log"))
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer unixConn.Close()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer tcpListener.Close()
+
+	readPacket := func(conn net.PacketConn) func() (string, error) {
+		return func() (string, error) {
+			buffer := make([]byte, 65536)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := conn.ReadFrom(buffer)
+			return string(buffer[:n]), err
+		}
+	}
+	// TCP messages are read as sent by two connections, the second one after the server closes the first.
+	tcpMessages := make(chan string, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				conn.Close()
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSuffix(length, " "))
+			message := make([]byte, n)
+			if _, err := io.ReadFull(reader, message); err == nil {
+				tcpMessages <- string(message)
+			}
+			conn.Close()
+		}
+	}()
+	readTCP := func() (string, error) {
+		select {
+		case message := <-tcpMessages:
+			return message, nil
+		case <-time.After(5 * time.Second):
+			return "", net.ErrClosed
+		}
+	}
+
+	tests := []struct {
+		network, address string
+		read             func() (string, error)
+		messages         int
+	}{
+		{"udp", udpConn.LocalAddr().String(), readPacket(udpConn), 1},
+		{"unix", unixConn.LocalAddr().String(), readPacket(unixConn), 1},
+		{"tcp", tcpListener.Addr().String(), readTCP, 2},
+	}
+	for _, test := range tests {
+		sink, err := newSyslogSink(&config{}, sinkConfig{Format: "text", Syslog: syslogSinkConfig{Network: test.network, Address: test.address, Facility: "auth", AppName: "sshesame"}})
+		if err != nil {
+			t.Fatalf("network=%v: Failed to create sink: %v", test.network, err)
+		}
+		for i := 0; i < test.messages; i++ {
+			if i > 0 {
+				// Give the server time to close the connection.
+				time.Sleep(100 * time.Millisecond)
+			}
+			if err := sink.WriteEvent(testSyslogEvent()); err != nil {
+				t.Fatalf("network=%v: Failed to write event: %v", test.network, err)
+			}
+			message, err := test.read()
+			if err != nil {
+				t.Fatalf("network=%v: Failed to read message %v: %v", test.network, i, err)
+			}
+			if !strings.HasPrefix(message, "<38>1 2024-05-01T12:30:00.123000Z sensor-1 sshesame ") || !strings.HasSuffix(message, " accepted") {
+				t.Errorf("network=%v: message=%q, want an RFC 5424 message", test.network, message)
+			}
+		}
+		sink.Close()
+	}
+}
+
+func TestSyslogSinkConfig(t *testing.T) {
+	for _, syslog := range []syslogSinkConfig{
+		{Network: "carrier_pigeon", Address: "127.0.0.1:514", Facility: "auth"},
+		{Network: "udp", Facility: "auth"},
+		{Network: "udp", Address: "127.0.0.1:514", Facility: "local8"},
+		{Network: "tls", Address: "127.0.0.1:6514", Facility: "auth", CACert: "/nonexistent"},
+	} {
+		if _, err := newSyslogSink(&config{}, sinkConfig{Format: "text", Syslog: syslog}); err == nil {
+			t.Errorf("syslog=%+v: err=nil, want an error", syslog)
+		}
+	}
+	if _, err := newSyslogSink(&config{}, sinkConfig{Format: "xml", Syslog: syslogSinkConfig{Network: "unix", Facility: "auth"}}); err == nil {
+		t.Errorf("format=xml: err=nil, want an error")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var tarpitSecondsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sshesame_tarpit_seconds_total",
+	Help: "Total number of seconds clients spent stuck in the tarpit",
+}, []string{"listener", "stage"})
+
+// jitteredDelay returns delay plus a random duration below jitter.
+func jitteredDelay(delay, jitter time.Duration) time.Duration {
+	if jitter > 0 {
+		delay += time.Duration(mathrand.Int63n(int64(jitter)))
+	}
+	return delay
+}
+
+// tarpit sleeps for the delay, counting the time spent in the given stage.
+func (cfg *config) tarpit(stage string, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	time.Sleep(delay)
+	tarpitSecondsMetric.WithLabelValues(cfg.listenerName, stage).Add(delay.Seconds())
+}
+
+func (cfg *config) tarpitAuth() {
+	cfg.tarpit("auth", jitteredDelay(cfg.Tarpit.AuthDelay, cfg.Tarpit.AuthJitter))
+}
+
+// tarpitCommand delays a command the way the configured delays for it, or the default command delay, say.
+func (cfg *config) tarpitCommand(name string) {
+	delay, ok := cfg.Tarpit.CommandDelays[path.Base(name)]
+	if !ok {
+		delay = cfg.Tarpit.CommandDelay
+	}
+	cfg.tarpit("command", jitteredDelay(delay, cfg.Tarpit.CommandJitter))
+}
+
+// tarpitConn drips lines before the version line of the server, which RFC 4253 section 4.2 allows, to keep clients
+// waiting before the key exchange even starts.
+type tarpitConn struct {
+	net.Conn
+	cfg  *config
+	once sync.Once
+}
+
+func (conn *tarpitConn) Write(p []byte) (int, error) {
+	var err error
+	conn.once.Do(func() {
+		err = conn.drip()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return conn.Conn.Write(p)
+}
+
+func (conn *tarpitConn) drip() error {
+	for i := 0; i < conn.cfg.Tarpit.DripLines; i++ {
+		conn.cfg.tarpit("version", conn.cfg.Tarpit.DripInterval)
+		if err := writeDripLine(conn.Conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDripLine writes a random line clients skip while waiting for the version of the server.
+func writeDripLine(w io.Writer) error {
+	line := make([]byte, 16)
+	if _, err := rand.Read(line); err != nil {
+		return err
+	}
+	// Hex lines never start with "SSH-".
+	_, err := w.Write([]byte(hex.EncodeToString(line) + "\r\n"))
+	return err
+}
+
+type tarpitListener struct {
+	net.Listener
+	cfg *config
+}
+
+func (listener tarpitListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tarpitConn{Conn: conn, cfg: listener.cfg.latest()}, nil
+}
+
+// handshakeListener hands out the connections accepted by the main loop, so that SSH handshakes, which the tarpit
+// drags out, run concurrently instead of holding up the next connection.
+type handshakeListener struct {
+	net.Listener
+	conns <-chan net.Conn
+}
+
+func (listener handshakeListener) Accept() (net.Conn, error) {
+	conn, ok := <-listener.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
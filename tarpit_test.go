@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestJitteredDelay(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if delay := jitteredDelay(time.Second, time.Millisecond); delay < time.Second || delay >= time.Second+time.Millisecond {
+			t.Errorf("delay=%v, want between 1s and 1.001s", delay)
+		}
+	}
+	if delay := jitteredDelay(time.Second, 0); delay != time.Second {
+		t.Errorf("delay=%v, want 1s", delay)
+	}
+}
+
+func TestTarpitCommand(t *testing.T) {
+	cfg := &config{}
+	cfg.Tarpit.CommandDelay = 10 * time.Millisecond
+	cfg.Tarpit.CommandDelays = map[string]time.Duration{"uname": 50 * time.Millisecond}
+	tests := []struct {
+		command  string
+		minDelay time.Duration
+		maxDelay time.Duration
+	}{
+		{"ls", 10 * time.Millisecond, 50 * time.Millisecond},
+		{"uname", 50 * time.Millisecond, time.Second},
+		{"/bin/uname", 50 * time.Millisecond, time.Second},
+	}
+	for _, test := range tests {
+		start := time.Now()
+		cfg.tarpitCommand(test.command)
+		if elapsed := time.Since(start); elapsed < test.minDelay || elapsed > test.maxDelay {
+			t.Errorf("command=%v: elapsed=%v, want between %v and %v", test.command, elapsed, test.minDelay, test.maxDelay)
+		}
+	}
+}
+
+func TestTarpitConn(t *testing.T) {
+	cfg := &config{}
+	cfg.Tarpit.DripLines = 3
+	cfg.Tarpit.DripInterval = 10 * time.Millisecond
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	conn := &tarpitConn{Conn: serverConn, cfg: cfg}
+	start := time.Now()
+	go func() {
+		defer conn.Close()
+		for _, line := range []string{"SSH-2.0-sshesame\r\n", "more\r\n"} {
+			if _, err := conn.Write([]byte(line)); err != nil {
+				t.Errorf("Failed to write: %v", err)
+				return
+			}
+		}
+	}()
+	reader := bufio.NewReader(clientConn)
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("elapsed=%v, want at least 30ms", elapsed)
+	}
+	if len(lines) != 5 {
+		t.Fatalf("lines=%q, want 5 lines", lines)
+	}
+	for _, line := range lines[:3] {
+		if len(line) != 34 || line[:4] == "SSH-" {
+			t.Errorf("line=%q, want 32 hex digits", line)
+		}
+	}
+	if lines[3] != "SSH-2.0-sshesame\r\n" || lines[4] != "more\r\n" {
+		t.Errorf("lines=%q, want the version and more after the dripped lines", lines[3:])
+	}
+}
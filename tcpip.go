@@ -35,15 +35,15 @@ var (
 	tcpipChannelsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "sshesame_tcpip_channels_total",
 		Help: "Total number of TCP/IP channels",
-	}, []string{"service"})
+	}, []string{"listener", "service"})
 	activeTCPIPChannelsMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "sshesame_active_tcpip_channels",
 		Help: "Number of active TCP/IP channels",
-	}, []string{"service"})
+	}, []string{"listener", "service"})
 	tcpipChannelRequestsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "sshesame_tcpip_channel_requests_total",
 		Help: "Total number of TCP/IP channel requests",
-	}, []string{"service"})
+	}, []string{"listener", "service"})
 )
 
 func handleDirectTCPIPChannel(newChannel ssh.NewChannel, context channelContext) error {
@@ -57,13 +57,13 @@ func handleDirectTCPIPChannel(newChannel ssh.NewChannel, context channelContext)
 	service := context.cfg.Server.TCPIPServices[channelData.Port]
 	server := servers[service]
 	if server == nil {
-		tcpipChannelsMetric.WithLabelValues("unknown").Inc()
+		tcpipChannelsMetric.WithLabelValues(context.cfg.listenerName, "unknown").Inc()
 		warningLogger.Printf("Unsupported port %v", channelData.Port)
 		return newChannel.Reject(ssh.ConnectionFailed, "Connection refused")
 	}
-	tcpipChannelsMetric.WithLabelValues(service).Inc()
-	activeTCPIPChannelsMetric.WithLabelValues(service).Inc()
-	defer activeTCPIPChannelsMetric.WithLabelValues(service).Dec()
+	tcpipChannelsMetric.WithLabelValues(context.cfg.listenerName, service).Inc()
+	activeTCPIPChannelsMetric.WithLabelValues(context.cfg.listenerName, service).Inc()
+	defer activeTCPIPChannelsMetric.WithLabelValues(context.cfg.listenerName, service).Dec()
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		return err
@@ -113,7 +113,7 @@ func handleDirectTCPIPChannel(newChannel ssh.NewChannel, context channelContext)
 				requests = nil
 				continue
 			}
-			tcpipChannelRequestsMetric.WithLabelValues("unknown").Inc()
+			tcpipChannelRequestsMetric.WithLabelValues(context.cfg.listenerName, "unknown").Inc()
 			context.logEvent(debugChannelRequestLog{
 				channelLog:  channelLog{ChannelID: context.channelID},
 				RequestType: request.Type,
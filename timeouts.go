@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const autoLogoutMessage = "timed out waiting for input: auto-logout\r\n"
+
+// handshakeTimers holds the timers of connections still in the SSH handshake by connKey, so that the auth callbacks
+// can find them.
+var handshakeTimers sync.Map
+
+// handshakeTimer closes a connection that takes too long to get through the handshake. It's in the handshake stage
+// until the client first tries to authenticate, then in the auth stage until it's authenticated.
+// It also holds the ID of the connection, assigned when it's accepted so that auth events can be logged with it.
+type handshakeTimer struct {
+	lock         sync.Mutex
+	conn         net.Conn
+	cfg          *config
+	connectionID string
+	metadata     ssh.ConnMetadata
+	stage        string
+	timer        *time.Timer
+	done         bool
+}
+
+func (handshake *handshakeTimer) start(timeout time.Duration) {
+	if handshake.timer != nil {
+		handshake.timer.Stop()
+		handshake.timer = nil
+	}
+	if timeout > 0 {
+		handshake.timer = time.AfterFunc(timeout, handshake.expire)
+	}
+}
+
+func (handshake *handshakeTimer) expire() {
+	handshake.lock.Lock()
+	defer handshake.lock.Unlock()
+	if handshake.done {
+		return
+	}
+	handshake.done = true
+	connContext{ConnMetadata: handshake.metadata, cfg: handshake.cfg, connectionID: handshake.connectionID}.logEvent(connectionCloseLog{
+		Reason: handshake.stage + " timeout",
+	})
+	handshake.conn.Close()
+}
+
+// stop stops the timer for good, returning false if it already expired.
+func (handshake *handshakeTimer) stop() bool {
+	handshake.lock.Lock()
+	defer handshake.lock.Unlock()
+	if handshake.done {
+		return false
+	}
+	handshake.done = true
+	handshake.start(0)
+	return true
+}
+
+// startAuthTimeout moves the connection of an authentication attempt to the auth stage, if it isn't there yet.
+func startAuthTimeout(conn ssh.ConnMetadata) {
+	value, ok := handshakeTimers.Load(connKey(conn.RemoteAddr()))
+	if !ok {
+		return
+	}
+	handshake := value.(*handshakeTimer)
+	handshake.lock.Lock()
+	defer handshake.lock.Unlock()
+	if handshake.done || handshake.stage == "auth" {
+		return
+	}
+	handshake.stage = "auth"
+	handshake.metadata = conn
+	handshake.start(handshake.cfg.Timeouts.Auth)
+}
+
+// finishHandshake stops the handshake timer of the connection with the remote address addr and returns its ID, if it has one. It returns
+// false if the timer already expired and closed the connection.
+func finishHandshake(addr net.Addr) (string, bool) {
+	value, ok := handshakeTimers.LoadAndDelete(connKey(addr))
+	if !ok {
+		return "", true
+	}
+	handshake := value.(*handshakeTimer)
+	return handshake.connectionID, handshake.stop()
+}
+
+// handshakeContext returns the context of a connection still in the handshake.
+func (cfg *config) handshakeContext(conn ssh.ConnMetadata) connContext {
+	context := connContext{ConnMetadata: conn, cfg: cfg}
+	if value, ok := handshakeTimers.Load(connKey(conn.RemoteAddr())); ok {
+		context.connectionID = value.(*handshakeTimer).connectionID
+	}
+	return context
+}
+
+// handshakeConnMetadata describes a connection that hasn't sent anything about itself yet.
+type handshakeConnMetadata struct {
+	net.Conn
+}
+
+func (metadata handshakeConnMetadata) User() string {
+	return ""
+}
+
+func (metadata handshakeConnMetadata) SessionID() []byte {
+	return nil
+}
+
+func (metadata handshakeConnMetadata) ClientVersion() []byte {
+	return nil
+}
+
+func (metadata handshakeConnMetadata) ServerVersion() []byte {
+	return nil
+}
+
+type handshakeTimeoutConn struct {
+	net.Conn
+	handshake *handshakeTimer
+}
+
+func (conn handshakeTimeoutConn) Close() error {
+	conn.handshake.stop()
+	handshakeTimers.CompareAndDelete(connKey(conn.RemoteAddr()), conn.handshake)
+	return conn.Conn.Close()
+}
+
+type handshakeTimeoutListener struct {
+	net.Listener
+	cfg *config
+}
+
+func (listener handshakeTimeoutListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	cfg := listener.cfg.latest()
+	handshake := &handshakeTimer{
+		conn:         conn,
+		cfg:          cfg,
+		connectionID: cfg.newID(),
+		metadata:     handshakeConnMetadata{conn},
+		stage:        "handshake",
+	}
+	timeout := cfg.Timeouts.Handshake
+	if timeout > 0 {
+		// Lines dripped by the tarpit don't count.
+		timeout += time.Duration(cfg.Tarpit.DripLines) * cfg.Tarpit.DripInterval
+	}
+	handshake.lock.Lock()
+	handshake.start(timeout)
+	handshake.lock.Unlock()
+	handshakeTimers.Store(connKey(conn.RemoteAddr()), handshake)
+	return handshakeTimeoutConn{conn, handshake}, nil
+}
+
+// idleChannel keeps track of when the client last sent anything on a channel.
+type idleChannel struct {
+	ssh.Channel
+	lock         sync.Mutex
+	lastActivity time.Time
+}
+
+func newIdleChannel(channel ssh.Channel) *idleChannel {
+	return &idleChannel{Channel: channel, lastActivity: time.Now()}
+}
+
+func (channel *idleChannel) Read(data []byte) (int, error) {
+	n, err := channel.Channel.Read(data)
+	if n > 0 {
+		channel.lock.Lock()
+		channel.lastActivity = time.Now()
+		channel.lock.Unlock()
+	}
+	return n, err
+}
+
+func (channel *idleChannel) idleFor() time.Duration {
+	channel.lock.Lock()
+	defer channel.lock.Unlock()
+	return time.Since(channel.lastActivity)
+}
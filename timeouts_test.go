@@ -0,0 +1,208 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaksi/sshutils"
+	"golang.org/x/crypto/ssh"
+)
+
+type addrConnContext struct {
+	mockConnContext
+	addr net.Addr
+}
+
+func (context addrConnContext) RemoteAddr() net.Addr {
+	return context.addr
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	loggingCfg := &config{}
+	logBuffer := setupLogBuffer(t, loggingCfg)
+	// Each case gets a config and listener of its own, so that the config isn't changed under running timers.
+	accept := func(timeouts timeoutsConfig) (net.Conn, net.Conn) {
+		cfg := &config{Timeouts: timeouts, sinks: loggingCfg.sinks}
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		listener := handshakeTimeoutListener{tcpListener, cfg}
+		t.Cleanup(func() { listener.Close() })
+		client, err := net.Dial("tcp", tcpListener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		server, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Failed to accept: %v", err)
+		}
+		return client, server
+	}
+	waitForClose := func(client net.Conn) {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("err=%v, want EOF", err)
+		}
+	}
+
+	client, server := accept(timeoutsConfig{Handshake: 10 * time.Millisecond, Auth: time.Hour})
+	defer client.Close()
+	waitForClose(client)
+	if _, ok := finishHandshake(server.RemoteAddr()); ok {
+		t.Errorf("finishHandshake()=true, want false after the timeout")
+	}
+
+	client, server = accept(timeoutsConfig{Handshake: time.Hour, Auth: 10 * time.Millisecond})
+	defer client.Close()
+	startAuthTimeout(addrConnContext{addr: server.RemoteAddr()})
+	waitForClose(client)
+	if _, ok := finishHandshake(server.RemoteAddr()); ok {
+		t.Errorf("finishHandshake()=true, want false after the timeout")
+	}
+
+	client, server = accept(timeoutsConfig{Handshake: time.Hour, Auth: time.Hour})
+	defer client.Close()
+	defer server.Close()
+	startAuthTimeout(addrConnContext{addr: server.RemoteAddr()})
+	if connectionID, ok := finishHandshake(server.RemoteAddr()); !ok || connectionID == "" {
+		t.Errorf("finishHandshake()=%q, %v, want an ID and true before the timeout", connectionID, ok)
+	}
+
+	logs := logBuffer.String()
+	for _, expected := range []string{"connection closed (handshake timeout)", `connection closed (auth timeout)`} {
+		if !strings.Contains(logs, expected) {
+			t.Errorf("logs=%v, want %q", logs, expected)
+		}
+	}
+	if count := strings.Count(logs, "connection closed"); count != 2 {
+		t.Errorf("logs=%v, want 2 closed connections", logs)
+	}
+}
+
+func TestHandshakeTimersSameAddress(t *testing.T) {
+	cfg := &config{Timeouts: timeoutsConfig{Handshake: time.Hour, Auth: time.Hour}}
+	setupLogBuffer(t, cfg)
+	listener := handshakeTimeoutListener{pipeListener{conns: make(chan net.Conn, 2)}, cfg}
+	var conns []net.Conn
+	for range 2 {
+		server, client := net.Pipe()
+		defer client.Close()
+		listener.Listener.(pipeListener).conns <- addrConn{server, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Failed to accept: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	firstID := cfg.handshakeContext(addrConnContext{addr: conns[0].RemoteAddr()}).connectionID
+	secondID := cfg.handshakeContext(addrConnContext{addr: conns[1].RemoteAddr()}).connectionID
+	if firstID == "" || secondID == "" || firstID == secondID {
+		t.Errorf("connectionIDs=%q, %q, want distinct IDs", firstID, secondID)
+	}
+	if connectionID, ok := finishHandshake(conns[1].RemoteAddr()); !ok || connectionID != secondID {
+		t.Errorf("finishHandshake()=%q, %v, want %q, true", connectionID, ok, secondID)
+	}
+	if connectionID, ok := finishHandshake(conns[0].RemoteAddr()); !ok || connectionID != firstID {
+		t.Errorf("finishHandshake()=%q, %v, want %q, true", connectionID, ok, firstID)
+	}
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	keyFile, err := generateKey(t.TempDir(), ecdsa_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{}
+	cfg.Server.HostKeys = []string{keyFile}
+	cfg.Auth.NoAuth = true
+	if err := cfg.setupSSHConfig(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := sshutils.Listen("127.0.0.1:0", cfg.sshConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	tests := []struct {
+		timeouts         timeoutsConfig
+		expectedOutput   string
+		expectedLogLines []string
+	}{
+		{
+			timeoutsConfig{Idle: 50 * time.Millisecond, AutoLogoutMessage: true},
+			"\r\n" + autoLogoutMessage,
+			[]string{"[channel 0] closed (idle timeout)", "connection closed"},
+		},
+		{
+			timeoutsConfig{Idle: 50 * time.Millisecond},
+			"",
+			[]string{"[channel 0] closed (idle timeout)", "connection closed"},
+		},
+		{
+			timeoutsConfig{MaxLifetime: 50 * time.Millisecond},
+			"",
+			[]string{"[channel 0] closed", "connection closed (max lifetime)"},
+		},
+	}
+	for _, test := range tests {
+		cfg.Timeouts = test.timeouts
+		logBuffer := setupLogBuffer(t, cfg)
+		serverResult := make(chan error)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				serverResult <- err
+				return
+			}
+			handleConnection(conn, cfg)
+			serverResult <- nil
+		}()
+		client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User:            "root",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Keep stdin open without sending anything.
+		if _, err := session.StdinPipe(); err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := session.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Shell(); err != nil {
+			t.Fatal(err)
+		}
+		output, _ := io.ReadAll(stdout)
+		session.Close()
+		client.Close()
+		if err := <-serverResult; err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(output), test.expectedOutput) || (test.expectedOutput == "" && strings.Contains(string(output), autoLogoutMessage)) {
+			t.Errorf("timeouts=%+v: output=%q, want %q at the end", test.timeouts, output, test.expectedOutput)
+		}
+		logs := logBuffer.String()
+		for _, expected := range test.expectedLogLines {
+			if !strings.Contains(logs, "] "+expected+"\n") {
+				t.Errorf("timeouts=%+v: logs=%v, want %q", test.timeouts, logs, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type webhookSinkConfig struct {
+	URL            string            `yaml:"url"`
+	Headers        map[string]string `yaml:"headers"`
+	BearerToken    string            `yaml:"bearer_token"`
+	Gzip           bool              `yaml:"gzip"`
+	BatchSize      int               `yaml:"batch_size"`
+	FlushInterval  time.Duration     `yaml:"flush_interval"`
+	Timeout        time.Duration     `yaml:"timeout"`
+	MaxRetries     int               `yaml:"max_retries"`
+	InitialBackoff time.Duration     `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration     `yaml:"max_backoff"`
+	SpoolDirectory string            `yaml:"spool_directory"`
+	SpoolMaxSize   int64             `yaml:"spool_max_size"`
+}
+
+// errWebhookRejected is returned for batches the endpoint won't ever accept, which aren't retried.
+var errWebhookRejected = errors.New("batch rejected")
+
+// webhookSink POSTs batches of events as JSON lines, or in the format of the Elasticsearch bulk API or Splunk HEC.
+// Batches are sent when full or every flush interval, retried with exponential backoff, and spooled to disk if they
+// still can't be sent. Spooled batches are sent in order every flush interval, before any new batch.
+type webhookSink struct {
+	config        webhookSinkConfig
+	format        string
+	splitHostPort bool
+	client        *http.Client
+
+	lock    sync.Mutex
+	batch   [][]byte
+	spooled int
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newWebhookSink(cfg *config, sinkCfg sinkConfig) (EventSink, error) {
+	format := sinkCfg.Format
+	switch format {
+	case "":
+		format = "json"
+	case "json", "elasticsearch", "splunk":
+	default:
+		return nil, fmt.Errorf("unsupported format %q, supported formats are json, elasticsearch and splunk", format)
+	}
+	webhookURL, err := url.Parse(sinkCfg.Webhook.URL)
+	if err != nil {
+		return nil, err
+	}
+	if webhookURL.Scheme != "http" && webhookURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webhook URL %q", sinkCfg.Webhook.URL)
+	}
+	if sinkCfg.Webhook.BatchSize <= 0 || sinkCfg.Webhook.FlushInterval <= 0 || sinkCfg.Webhook.MaxRetries < 0 {
+		return nil, errors.New("batch_size and flush_interval must be positive and max_retries not negative")
+	}
+	sink := &webhookSink{
+		config:        sinkCfg.Webhook,
+		format:        format,
+		splitHostPort: cfg.Logging.SplitHostPort,
+		client:        &http.Client{Timeout: sinkCfg.Webhook.Timeout},
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	if sink.config.SpoolDirectory != "" {
+		if err := os.MkdirAll(sink.config.SpoolDirectory, 0755); err != nil {
+			return nil, err
+		}
+		// Batches spooled before a restart are sent too.
+		spooled, err := sink.spooledBatches()
+		if err != nil {
+			return nil, err
+		}
+		sink.spooled = len(spooled)
+	}
+	go sink.run()
+	return sink, nil
+}
+
+func (sink *webhookSink) run() {
+	defer close(sink.stopped)
+	ticker := time.NewTicker(sink.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sink.lock.Lock()
+			sink.sendSpooled()
+			sink.flush()
+			sink.lock.Unlock()
+		case <-sink.done:
+			return
+		}
+	}
+}
+
+func (sink *webhookSink) WriteEvent(event sinkEvent) error {
+	line, err := sink.encode(event)
+	if err != nil {
+		return err
+	}
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.batch = append(sink.batch, line)
+	if len(sink.batch) >= sink.config.BatchSize {
+		sink.flush()
+	}
+	return nil
+}
+
+func (sink *webhookSink) encode(event sinkEvent) ([]byte, error) {
+	line, err := event.json(true, sink.splitHostPort)
+	if err != nil {
+		return nil, err
+	}
+	switch sink.format {
+	case "elasticsearch":
+		line = append([]byte("{\"index\":{}}\n"), line...)
+	case "splunk":
+		line, err = json.Marshal(struct {
+			Time       float64         `json:"time"`
+			Host       string          `json:"host,omitempty"`
+			Source     string          `json:"source"`
+			SourceType string          `json:"sourcetype"`
+			Event      json.RawMessage `json:"event"`
+		}{
+			float64(event.Time.UnixMilli()) / 1000,
+			event.Sensor,
+			"sshesame",
+			"_json",
+			line,
+		})
+	}
+	return line, err
+}
+
+// flush sends the current batch, spooling it if it can't be sent or if older batches are still spooled.
+func (sink *webhookSink) flush() {
+	if len(sink.batch) == 0 {
+		return
+	}
+	body := append(bytes.Join(sink.batch, []byte("\n")), '\n')
+	events := len(sink.batch)
+	sink.batch = nil
+	if sink.spooled == 0 {
+		err := sink.sendWithRetries(body)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errWebhookRejected) || sink.config.SpoolDirectory == "" {
+			warningLogger.Printf("Failed to send %v events to webhook, dropping them: %v", events, err)
+			return
+		}
+		warningLogger.Printf("Failed to send %v events to webhook, spooling them: %v", events, err)
+	}
+	if err := sink.spool(body); err != nil {
+		warningLogger.Printf("Failed to spool %v events, dropping them: %v", events, err)
+	}
+}
+
+func (sink *webhookSink) sendWithRetries(body []byte) error {
+	backoff := sink.config.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := sink.send(body)
+		if err == nil || errors.Is(err, errWebhookRejected) || attempt == sink.config.MaxRetries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-sink.done:
+			return err
+		}
+		backoff *= 2
+		if sink.config.MaxBackoff > 0 && backoff > sink.config.MaxBackoff {
+			backoff = sink.config.MaxBackoff
+		}
+	}
+}
+
+func (sink *webhookSink) send(body []byte) error {
+	contentType := "application/x-ndjson"
+	if sink.format == "splunk" {
+		contentType = "application/json"
+	}
+	var requestBody bytes.Buffer
+	if sink.config.Gzip {
+		writer := gzip.NewWriter(&requestBody)
+		if _, err := writer.Write(body); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+	} else {
+		requestBody.Write(body)
+	}
+	request, err := http.NewRequest(http.MethodPost, sink.config.URL, &requestBody)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("User-Agent", "sshesame")
+	if sink.config.Gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	if sink.config.BearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+sink.config.BearerToken)
+	}
+	for name, value := range sink.config.Headers {
+		request.Header.Set(name, value)
+	}
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return fmt.Errorf("unexpected status %v", response.Status)
+	default:
+		return fmt.Errorf("%w with status %v", errWebhookRejected, response.Status)
+	}
+}
+
+func (sink *webhookSink) spooledBatches() ([]string, error) {
+	batches, err := filepath.Glob(filepath.Join(sink.config.SpoolDirectory, "*.batch"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(batches)
+	return batches, nil
+}
+
+func (sink *webhookSink) spool(body []byte) error {
+	if sink.config.SpoolDirectory == "" {
+		return errors.New("no spool directory")
+	}
+	if sink.config.SpoolMaxSize > 0 {
+		batches, err := sink.spooledBatches()
+		if err != nil {
+			return err
+		}
+		size := int64(len(body))
+		for _, batch := range batches {
+			if info, err := os.Stat(batch); err == nil {
+				size += info.Size()
+			}
+		}
+		if size > sink.config.SpoolMaxSize {
+			return errors.New("spool full")
+		}
+	}
+	// Names sort in the order batches were spooled in, and are only used once complete.
+	name := filepath.Join(sink.config.SpoolDirectory, fmt.Sprintf("%020d", time.Now().UnixNano()))
+	if err := os.WriteFile(name+".tmp", body, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name+".batch"); err != nil {
+		return err
+	}
+	sink.spooled++
+	return nil
+}
+
+// sendSpooled sends spooled batches once each, oldest first, until one fails.
+func (sink *webhookSink) sendSpooled() {
+	if sink.spooled == 0 {
+		return
+	}
+	batches, err := sink.spooledBatches()
+	if err != nil {
+		warningLogger.Printf("Failed to list spooled events: %v", err)
+		return
+	}
+	sink.spooled = len(batches)
+	for _, batch := range batches {
+		body, err := os.ReadFile(batch)
+		if err != nil {
+			warningLogger.Printf("Failed to read spooled events: %v", err)
+			return
+		}
+		if err := sink.send(body); err != nil && !errors.Is(err, errWebhookRejected) {
+			return
+		} else if err != nil {
+			warningLogger.Printf("Failed to send spooled events to webhook, dropping them: %v", err)
+		}
+		if err := os.Remove(batch); err != nil {
+			warningLogger.Printf("Failed to remove spooled events: %v", err)
+			return
+		}
+		sink.spooled--
+	}
+}
+
+// Close sends the current batch, without retrying, or spools it.
+func (sink *webhookSink) Close() error {
+	close(sink.done)
+	<-sink.stopped
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.flush()
+	return nil
+}
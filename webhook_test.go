@@ -0,0 +1,247 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   string
+}
+
+// mockWebhook records the requests it accepts, and fails the ones it's told to.
+type mockWebhook struct {
+	lock     sync.Mutex
+	requests []webhookRequest
+	failures int
+	status   int
+}
+
+func (webhook *mockWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	webhook.lock.Lock()
+	defer webhook.lock.Unlock()
+	if webhook.failures > 0 {
+		webhook.failures--
+		w.WriteHeader(webhook.status)
+		return
+	}
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		var err error
+		if body, err = gzip.NewReader(r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	bodyBytes, err := io.ReadAll(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	webhook.requests = append(webhook.requests, webhookRequest{r.Header, string(bodyBytes)})
+}
+
+func (webhook *mockWebhook) receivedRequests() []webhookRequest {
+	webhook.lock.Lock()
+	defer webhook.lock.Unlock()
+	return append([]webhookRequest{}, webhook.requests...)
+}
+
+func testWebhookSink(t *testing.T, url string, format string, configure func(*webhookSinkConfig)) *webhookSink {
+	t.Helper()
+	sinkCfg := sinkConfig{Format: format, Webhook: webhookSinkConfig{
+		URL:            url,
+		BatchSize:      2,
+		FlushInterval:  time.Hour,
+		MaxRetries:     0,
+		InitialBackoff: 10 * time.Millisecond,
+	}}
+	if configure != nil {
+		configure(&sinkCfg.Webhook)
+	}
+	sink, err := newWebhookSink(&config{}, sinkCfg)
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	return sink.(*webhookSink)
+}
+
+func testWebhookEvent(input string) sinkEvent {
+	return sinkEvent{
+		Time:   time.Unix(1714566600, 0),
+		Sensor: "sensor-1",
+		Source: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324},
+		Entry:  sessionInputLog{Input: input},
+	}
+}
+
+func TestWebhookBatches(t *testing.T) {
+	webhook := &mockWebhook{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+	sink := testWebhookSink(t, server.URL, "", func(config *webhookSinkConfig) {
+		config.Gzip = true
+		config.BearerToken = "token"
+		config.Headers = map[string]string{"X-Collector": "honeypots"}
+	})
+	for _, input := range []string{"id", "uname", "exit"} {
+		if err := sink.WriteEvent(testWebhookEvent(input)); err != nil {
+			t.Fatalf("Failed to write event: %v", err)
+		}
+	}
+	if requests := webhook.receivedRequests(); len(requests) != 1 {
+		t.Fatalf("requests=%v, want 1 full batch", len(requests))
+	}
+	sink.Close()
+	requests := webhook.receivedRequests()
+	if len(requests) != 2 {
+		t.Fatalf("requests=%v, want 2", len(requests))
+	}
+	expectedBodies := []string{
+		`{"sensor":"sensor-1","time":1714566600,"source":"192.0.2.1:56324","event_type":"session_input","event":{"channel_id":0,"input":"id"}}
+{"sensor":"sensor-1","time":1714566600,"source":"192.0.2.1:56324","event_type":"session_input","event":{"channel_id":0,"input":"uname"}}
+`,
+		`{"sensor":"sensor-1","time":1714566600,"source":"192.0.2.1:56324","event_type":"session_input","event":{"channel_id":0,"input":"exit"}}
+`,
+	}
+	for i, request := range requests {
+		if request.body != expectedBodies[i] {
+			t.Errorf("body=%q, want %q", request.body, expectedBodies[i])
+		}
+		if request.header.Get("Authorization") != "Bearer token" || request.header.Get("X-Collector") != "honeypots" || request.header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("header=%v, want the bearer token, custom header and content type", request.header)
+		}
+	}
+}
+
+func TestWebhookFormats(t *testing.T) {
+	tests := []struct {
+		format       string
+		expectedBody string
+	}{
+		{"elasticsearch", `{"index":{}}
+{"sensor":"sensor-1","time":1714566600,"source":"192.0.2.1:56324","event_type":"session_input","event":{"channel_id":0,"input":"id"}}
+`},
+		{"splunk", `{"time":1714566600,"host":"sensor-1","source":"sshesame","sourcetype":"_json","event":{"sensor":"sensor-1","time":1714566600,"source":"192.0.2.1:56324","event_type":"session_input","event":{"channel_id":0,"input":"id"}}}
+`},
+	}
+	for _, test := range tests {
+		webhook := &mockWebhook{}
+		server := httptest.NewServer(webhook)
+		sink := testWebhookSink(t, server.URL, test.format, nil)
+		sink.WriteEvent(testWebhookEvent("id"))
+		sink.Close()
+		server.Close()
+		requests := webhook.receivedRequests()
+		if len(requests) != 1 || requests[0].body != test.expectedBody {
+			t.Errorf("format=%v: requests=%+v, want one with body %q", test.format, requests, test.expectedBody)
+		}
+	}
+}
+
+func TestWebhookFlushInterval(t *testing.T) {
+	webhook := &mockWebhook{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+	sink := testWebhookSink(t, server.URL, "", func(config *webhookSinkConfig) {
+		config.BatchSize = 100
+		config.FlushInterval = 50 * time.Millisecond
+	})
+	defer sink.Close()
+	sink.WriteEvent(testWebhookEvent("id"))
+	for i := 0; i < 100 && len(webhook.receivedRequests()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if requests := webhook.receivedRequests(); len(requests) != 1 {
+		t.Errorf("requests=%v, want 1", len(requests))
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	webhook := &mockWebhook{failures: 2, status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+	sink := testWebhookSink(t, server.URL, "", func(config *webhookSinkConfig) {
+		config.BatchSize = 1
+		config.MaxRetries = 2
+	})
+	defer sink.Close()
+	start := time.Now()
+	sink.WriteEvent(testWebhookEvent("id"))
+	if requests := webhook.receivedRequests(); len(requests) != 1 {
+		t.Errorf("requests=%v, want 1", len(requests))
+	}
+	// Backing off 10ms, then 20ms.
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("elapsed=%v, want at least 30ms", elapsed)
+	}
+
+	// Rejected batches aren't retried.
+	webhook.lock.Lock()
+	webhook.failures, webhook.status = 1, http.StatusBadRequest
+	webhook.lock.Unlock()
+	sink.WriteEvent(testWebhookEvent("uname"))
+	sink.WriteEvent(testWebhookEvent("exit"))
+	requests := webhook.receivedRequests()
+	if len(requests) != 2 || !strings.Contains(requests[1].body, `"input":"exit"`) {
+		t.Errorf("requests=%+v, want the first and the last event", requests)
+	}
+}
+
+func TestWebhookSpool(t *testing.T) {
+	webhook := &mockWebhook{failures: 2, status: http.StatusBadGateway}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+	spoolDirectory := filepath.Join(t.TempDir(), "spool")
+	sink := testWebhookSink(t, server.URL, "", func(config *webhookSinkConfig) {
+		config.BatchSize = 1
+		config.SpoolDirectory = spoolDirectory
+	})
+	// The first batch fails and is spooled, so the second one is too, to keep them in order.
+	sink.WriteEvent(testWebhookEvent("id"))
+	sink.WriteEvent(testWebhookEvent("uname"))
+	if spooled, _ := filepath.Glob(filepath.Join(spoolDirectory, "*.batch")); len(spooled) != 2 {
+		t.Fatalf("spooled=%v, want 2 batches", spooled)
+	}
+
+	// Spooled batches are sent by a new sink too, once the endpoint is back.
+	sink.Close()
+	sink = testWebhookSink(t, server.URL, "", func(config *webhookSinkConfig) {
+		config.FlushInterval = 10 * time.Millisecond
+		config.SpoolDirectory = spoolDirectory
+	})
+	defer sink.Close()
+	for i := 0; i < 100 && len(webhook.receivedRequests()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	requests := webhook.receivedRequests()
+	if len(requests) != 2 || !strings.Contains(requests[0].body, `"input":"id"`) || !strings.Contains(requests[1].body, `"input":"uname"`) {
+		t.Errorf("requests=%+v, want both batches in order", requests)
+	}
+	if files, _ := os.ReadDir(spoolDirectory); len(files) != 0 {
+		t.Errorf("files=%v, want none", files)
+	}
+}
+
+func TestWebhookSinkConfig(t *testing.T) {
+	for _, sinkCfg := range []sinkConfig{
+		{Format: "text", Webhook: webhookSinkConfig{URL: "http://127.0.0.1", BatchSize: 1, FlushInterval: time.Second}},
+		{Webhook: webhookSinkConfig{URL: "ftp://127.0.0.1", BatchSize: 1, FlushInterval: time.Second}},
+		{Webhook: webhookSinkConfig{URL: "http://127.0.0.1", FlushInterval: time.Second}},
+		{Webhook: webhookSinkConfig{URL: "http://127.0.0.1", BatchSize: 1}},
+	} {
+		if _, err := newWebhookSink(&config{}, sinkCfg); err == nil {
+			t.Errorf("sink=%+v: err=nil, want an error", sinkCfg)
+		}
+	}
+}